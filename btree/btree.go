@@ -24,6 +24,32 @@ type BTree struct {
 	Get func(uint64) BNode // dereference a pointer (takes a pointer, an returns the Node at that location (page))
 	New func(BNode) uint64 // allocates a New page
 	Del func(uint64)       // deallocate a page
+
+	// when nonzero, leaves whose keys all have this many bytes are written
+	// without a length per key (see keyWidth). 0 writes every leaf with lengths
+	KeyWidth int
+
+	// optional allocator that can fail, used by TryInsert and TryDelete instead of New when set.
+	// a failed operation leaves Root unchanged, but the pages it already allocated and deallocated
+	// must be discarded by the caller.
+	Alloc func(BNode) (uint64, error)
+
+	// optional key normalization (e.g. lowercasing) applied when comparing keys, the keys are
+	// stored as given. must map the empty key to itself and must not change for an existing tree.
+	// a lookup normalizes its key once and keeps the result, so it must not be a reused buffer
+	Normalize func([]byte) []byte
+
+	// a non-root node left with fewer keys than this after a delete is merged with a sibling
+	// when they fit in a page, whatever its size. 0 merges on size alone
+	MinKeys uint16
+
+	// optional hooks for instrumentation, may be nil
+	OnSplit func() // a node was split into 2 or 3 nodes
+	OnMerge func() // 2 nodes were merged into 1
+	// a key was inserted or overwritten by Insert or Apply, or deleted by Delete or Apply.
+	// not called by LoadSorted
+	OnInsert func(key []byte, val []byte)
+	OnDelete func(key []byte)
 }
 
 const HEADER = 4
@@ -32,9 +58,34 @@ const BTREE_PAGE_SIZE = 4096
 const BTREE_MAX_KEY_SIZE = 1000
 const BTREE_MAX_VALUE_SIZE = 3000
 
+// The inline budget: the most key + value bytes a single kv can take in a page, after the
+// header, its pointer, its offset and the 2 lengths: 4096 - 4 - 8 - 2 - 4 = 4078 bytes.
+// There are no overflow pages, every kv is stored inline.
+const BTREE_INLINE_BUDGET = BTREE_PAGE_SIZE - HEADER - 8 - 2 - 4
+
+// A node must always be splittable into pages, so a kv of the maximum sizes has to fit within the
+// budget: 1000 + 3000 = 4000 bytes, leaving 78 bytes spare.
+// So any value up to BTREE_MAX_VALUE_SIZE is storable whatever the key length, and a node is
+// kept as is as long as nbytes() <= BTREE_PAGE_SIZE, i.e. a node of exactly one page doesn't split.
+// A key can't use the spare bytes even with a small value: a later update may grow the value.
 func init() {
-	node1max := HEADER + 8 + 2 + 4 + BTREE_MAX_KEY_SIZE + BTREE_MAX_VALUE_SIZE
-	utils.Assert(node1max <= BTREE_PAGE_SIZE, "node1max exceeds page size")
+	utils.Assert(BTREE_MAX_KEY_SIZE+BTREE_MAX_VALUE_SIZE <= BTREE_INLINE_BUDGET, "max kv exceeds the inline budget")
+}
+
+// MaxKeySize is the longest key Insert accepts.
+func MaxKeySize() int {
+	return BTREE_MAX_KEY_SIZE
+}
+
+// MaxValueSize is the longest value Insert accepts next to a key of keyLen bytes,
+// or -1 if such a key can't be stored at all.
+// A kv must fit in the inline budget, but values are also capped on their own so that any
+// storable key still fits next to the largest value (see above).
+func MaxValueSize(keyLen int) int {
+	if keyLen < 1 || keyLen > BTREE_MAX_KEY_SIZE {
+		return -1
+	}
+	return min(BTREE_MAX_VALUE_SIZE, BTREE_INLINE_BUDGET-keyLen)
 }
 
 // Header
@@ -42,17 +93,48 @@ func init() {
 // this two functions accesses the first 4 bytes of the BNode, which is the Header, holding the node type and it's number of keys
 
 // returns the first 2 bytes of the header which holds information on the node type
-func (node BNode) btype() uint16 {
+// and, for leaves, the key width
+func (node BNode) kind() uint16 {
 	return binary.LittleEndian.Uint16(node.Data)
 }
 
+// the node type, the low byte of the type field
+func (node BNode) btype() uint16 {
+	return node.kind() & 0xff
+}
+
+// the width of every key of a fixed-width leaf, stored in the high byte of the type field.
+// a fixed-width leaf stores its kvs as | vlen 2B | key | val |, 0 means the usual | klen | vlen | key | val |
+func (node BNode) keyWidth() uint16 {
+	return node.kind() >> 8
+}
+
+// the type field of a leaf with the key width w
+func leafType(w uint16) uint16 {
+	return BNODE_LEAF | w<<8
+}
+
 // returns the next 2 bytes (2 and 3) of the header which holds the number of keys
 func (node BNode) nkeys() uint16 {
 	return binary.LittleEndian.Uint16(node.Data[2:4])
 }
 
+// every kv takes at least its pointer, offset and the 2 lengths, and a node being built spans
+// at most 2 pages before it's split. so no node can ever hold more keys than this,
+// far below the 65535 a uint16 count allows. a fixed-width leaf saves the key length, but its
+// keys take 2 bytes or more, or there are at most 256 of them.
+const BTREE_MAX_NKEYS = (2*BTREE_PAGE_SIZE - HEADER) / (8 + 2 + 4)
+
+// the key count of a node being built. the count is computed as an int so a bad count
+// panics here instead of silently wrapping around in uint16
+func nkeysOf(n int) uint16 {
+	utils.Assert(0 <= n && n <= BTREE_MAX_NKEYS, "node key count out of range")
+	return uint16(n)
+}
+
 // Sets the header Data (node type and the number of keys)
 func (node BNode) setHeader(btype uint16, nkeys uint16) {
+	utils.Assert(HEADER+(8+2+4)*int(nkeys) <= len(node.Data), "node key count exceeds the node size")
 	binary.LittleEndian.PutUint16(node.Data[0:2], btype)
 	binary.LittleEndian.PutUint16(node.Data[2:4], nkeys)
 }
@@ -95,37 +177,52 @@ func (node BNode) kvPos(idx uint16) uint16 {
 	return HEADER + 8*node.nkeys() + 2*node.nkeys() + node.GetOffset(idx)
 }
 
+// the key and value lengths of the kv at pos, and the size of the lengths before the key
+func (node BNode) kvLens(pos uint16) (klen, vlen, hlen uint16) {
+	if w := node.keyWidth(); w != 0 {
+		return w, binary.LittleEndian.Uint16(node.Data[pos:]), 2
+	}
+	klen = binary.LittleEndian.Uint16(node.Data[pos+0:])
+	vlen = binary.LittleEndian.Uint16(node.Data[pos+2:])
+	return klen, vlen, 4
+}
+
 func (node BNode) GetKey(idx uint16) []byte {
 	utils.Assert(idx < node.nkeys())
 
 	pos := node.kvPos(idx)
-	klen := binary.LittleEndian.Uint16(node.Data[pos:])
-	return node.Data[pos+1:][:klen]
+	klen, _, hlen := node.kvLens(pos)
+	return node.Data[pos+hlen:][:klen]
 }
 
 func (node BNode) GetVal(idx uint16) []byte {
 	utils.Assert(idx < node.nkeys())
 
 	pos := node.kvPos(idx)
-	klen := binary.LittleEndian.Uint16(node.Data[pos+0:])
-	vlen := binary.LittleEndian.Uint16(node.Data[pos+2:])
-
-	return node.Data[pos+4+klen:][:vlen]
+	klen, vlen, hlen := node.kvLens(pos)
+	return node.Data[pos+hlen+klen:][:vlen]
 }
 
-// node size in bytes
+// node size in bytes, exactly the bytes used: the kv area ends where the offset of the last key points.
+// fits in a uint16 as nodes are at most 2 pages before splitting.
 func (node BNode) nbytes() uint16 {
 	return node.kvPos(node.nkeys())
 }
 
 // returns the first kid node whose range intersects the key. (kid[i] <= key)
-func noDelookupLE(node BNode, key []byte) uint16 {
+func noDelookupLE(tree *BTree, node BNode, key []byte) uint16 {
+	return lookupNorm(tree, node, tree.norm(key))
+}
+
+// noDelookupLE for a key already normalized by norm, so a lookup going down
+// the tree normalizes it once instead of at every comparison
+func lookupNorm(tree *BTree, node BNode, normKey []byte) uint16 {
 	nkeys := node.nkeys()
 	found := uint16(0)
 
 	// The first key is a copy from the parent node, thus it's always less than or equal to teh key
 	for i := uint16(1); i < nkeys; i++ {
-		cmp := bytes.Compare(node.GetKey(i), key)
+		cmp := tree.compareNorm(node.GetKey(i), normKey)
 
 		if cmp <= 0 {
 			found = i
@@ -138,14 +235,58 @@ func noDelookupLE(node BNode, key []byte) uint16 {
 	return found
 }
 
+// the key width of a leaf holding the keys of node and key: the tree's width
+// if they all have it, 0 (the variable encoding) otherwise
+func leafWidth(tree *BTree, node BNode, key []byte) uint16 {
+	w := tree.KeyWidth
+	if w == 0 || w > 0xff || len(key) != w {
+		return 0
+	}
+	for i := uint16(0); i < node.nkeys(); i++ {
+		if len(node.GetKey(i)) != w {
+			return 0
+		}
+	}
+	return uint16(w)
+}
+
+// compare keys in tree order, i.e. after normalization
+func (tree *BTree) compare(a, b []byte) int {
+	if tree.Normalize != nil {
+		return bytes.Compare(tree.Normalize(a), tree.Normalize(b))
+	}
+	return bytes.Compare(a, b)
+}
+
+// the key as the tree orders it
+func (tree *BTree) norm(key []byte) []byte {
+	if tree.Normalize != nil {
+		return tree.Normalize(key)
+	}
+	return key
+}
+
+// compare a key with one already normalized by norm
+func (tree *BTree) compareNorm(a, normB []byte) int {
+	return bytes.Compare(tree.norm(a), normB)
+}
+
 // add a New key to the leaf node
-func leafInsert(New BNode, old BNode, idx uint16, key []byte, val []byte) {
-	New.setHeader(BNODE_LEAF, old.nkeys()+1)
+func leafInsert(New BNode, old BNode, idx uint16, key []byte, val []byte, w uint16) {
+	New.setHeader(leafType(w), nkeysOf(int(old.nkeys())+1))
 	nodeAppendRange(New, old, 0, 0, idx)
 	nodeAppendKV(New, idx, 0, key, val)
 	nodeAppendRange(New, old, idx+1, idx, old.nkeys()-idx)
 }
 
+// replace the value of an existing key in the leaf node
+func leafUpdate(New BNode, old BNode, idx uint16, key []byte, val []byte, w uint16) {
+	New.setHeader(leafType(w), old.nkeys())
+	nodeAppendRange(New, old, 0, 0, idx)
+	nodeAppendKV(New, idx, 0, key, val)
+	nodeAppendRange(New, old, idx+1, idx+1, old.nkeys()-(idx+1))
+}
+
 // Copies keys from an old node to a New node
 func nodeAppendRange(New BNode, old BNode, dstNew uint16, srcOld uint16, n uint16) {
 	utils.Assert(srcOld+n <= old.nkeys())
@@ -154,10 +295,18 @@ func nodeAppendRange(New BNode, old BNode, dstNew uint16, srcOld uint16, n uint1
 	if n == 0 {
 		return
 	}
+	if New.keyWidth() != old.keyWidth() {
+		// different kv encodings, copy them one by one
+		for i := uint16(0); i < n; i++ {
+			idx := srcOld + i
+			nodeAppendKV(New, dstNew+i, old.GetPtr(idx), old.GetKey(idx), old.GetVal(idx))
+		}
+		return
+	}
 
 	// copy pointers
 	for i := uint16(0); i < n; i++ {
-		New.setPtr(dstNew+1, old.GetPtr(srcOld+1))
+		New.setPtr(dstNew+i, old.GetPtr(srcOld+i))
 	}
 
 	// copy offsets
@@ -176,69 +325,112 @@ func nodeAppendRange(New BNode, old BNode, dstNew uint16, srcOld uint16, n uint1
 
 // copy a kv pair into the position
 func nodeAppendKV(New BNode, idx uint16, ptr uint64, key []byte, val []byte) {
+	// the lengths and offsets are uint16, check instead of silently truncating them
+	utils.Assert(len(key) <= BTREE_MAX_KEY_SIZE && len(val) <= BTREE_MAX_VALUE_SIZE, "kv too large")
+
 	// ptrs
 	New.setPtr(idx, ptr)
 
 	// kvs
 	pos := New.kvPos(idx)
-	binary.LittleEndian.PutUint16(New.Data[pos+0:], uint16(len(key)))
-	binary.LittleEndian.PutUint16(New.Data[pos+2:], uint16(len(val)))
-	copy(New.Data[pos+4:], key)
-	copy(New.Data[pos+4+uint16(len(key)):], val)
+	hlen := uint16(4)
+	if w := New.keyWidth(); w != 0 {
+		utils.Assert(len(key) == int(w))
+		binary.LittleEndian.PutUint16(New.Data[pos:], uint16(len(val)))
+		hlen = 2
+	} else {
+		binary.LittleEndian.PutUint16(New.Data[pos+0:], uint16(len(key)))
+		binary.LittleEndian.PutUint16(New.Data[pos+2:], uint16(len(val)))
+	}
+	utils.Assert(int(pos)+int(hlen)+len(key)+len(val) <= len(New.Data), "kv past the end of the node")
+	copy(New.Data[pos+hlen:], key)
+	copy(New.Data[pos+hlen+uint16(len(key)):], val)
 
 	// the offset of the next key
-	New.setOffset(idx+1, New.GetOffset(idx)+4+uint16((len(key)+len(val))))
+	New.setOffset(idx+1, New.GetOffset(idx)+hlen+uint16((len(key)+len(val))))
 }
 
 // Insert a KV into a node, the result might be split into 2 nodes.
 // the caller is responsible for deallocating the input node and splitting and allocating result nodes.
-func treeInsert(tree *BTree, node BNode, key []byte, val []byte) BNode {
+func treeInsert(tree *BTree, node BNode, key []byte, val []byte) (BNode, error) {
 	// The result node. Can be bigger than 1 page and if so will be splitted
 	New := BNode{Data: make([]byte, 2*BTREE_PAGE_SIZE)}
 
 	// where to insert the key?
-	idx := noDelookupLE(node, key)
+	idx := noDelookupLE(tree, node, key)
 
 	// act depending on the node type
 	switch node.btype() {
 	case BNODE_LEAF:
-		if bytes.Equal(key, node.GetKey(idx)) {
+		w := leafWidth(tree, node, key)
+		if tree.compare(key, node.GetKey(idx)) == 0 {
 			// found the key update it
-			leafInsert(New, node, idx, key, val)
+			leafUpdate(New, node, idx, key, val, w)
 		} else {
 			// insert if after the position
-			leafInsert(New, node, idx+1, key, val)
+			leafInsert(New, node, idx+1, key, val, w)
 		}
 
 	case BNODE_NODE:
 		// internal node, insert it to a kid node.
-		nodeInsert(tree, New, node, idx, key, val)
+		if err := nodeInsert(tree, New, node, idx, key, val); err != nil {
+			return BNode{}, err
+		}
 
 	default:
 		panic("bad node!")
 	}
 
-	return New
+	return New, nil
 }
 
-func nodeInsert(tree *BTree, New BNode, node BNode, idx uint16, key []byte, val []byte) {
+func nodeInsert(tree *BTree, New BNode, node BNode, idx uint16, key []byte, val []byte) error {
 	// Get and deallocate the kid node
 	kptr := node.GetPtr(idx)
 	knode := tree.Get(kptr)
 	tree.Del(kptr)
 
-	knode = treeInsert(tree, knode, key, val)
+	knode, err := treeInsert(tree, knode, key, val)
+	if err != nil {
+		return err
+	}
 	nsplit, splitted := nodeSplit3(knode)
+	tree.split(nsplit)
 
 	// update the kid links
-	nodeReplaceKidN(tree, New, node, idx, splitted[:nsplit]...)
+	return nodeReplaceKidN(tree, New, node, idx, splitted[:nsplit]...)
 }
 
+// split an oversized node in 2, the right one always fits in a page
 func nodeSplit2(left BNode, right BNode, old BNode) {
+	nkeys := old.nkeys()
+	utils.Assert(nkeys >= 2)
 
+	// the size of a node of the keys [from, to) of old
+	size := func(from, to uint16) int {
+		return HEADER + (8+2)*int(to-from) + int(old.GetOffset(to)-old.GetOffset(from))
+	}
+
+	// the left node as full as possible
+	nleft := uint16(1)
+	for nleft+1 < nkeys && size(0, nleft+1) <= BTREE_PAGE_SIZE {
+		nleft++
+	}
+	// but the right one must fit, the left one is split again by nodeSplit3 if it doesn't
+	for size(nleft, nkeys) > BTREE_PAGE_SIZE {
+		nleft++
+	}
+	utils.Assert(nleft < nkeys)
+	nright := nkeys - nleft
+
+	left.setHeader(old.kind(), nleft)
+	nodeAppendRange(left, old, 0, 0, nleft)
+	right.setHeader(old.kind(), nright)
+	nodeAppendRange(right, old, 0, nleft, nright)
 }
 
 // split a node if it's too big. the results are 1-3 nodes.
+// a node of exactly BTREE_PAGE_SIZE bytes still fits and is not split.
 func nodeSplit3(old BNode) (uint16, [3]BNode) {
 	if old.nbytes() <= BTREE_PAGE_SIZE {
 		old.Data = old.Data[:BTREE_PAGE_SIZE]
@@ -262,41 +454,46 @@ func nodeSplit3(old BNode) (uint16, [3]BNode) {
 	return 3, [3]BNode{leftleft, middle, right}
 }
 
-func nodeReplaceKidN(tree *BTree, New BNode, old BNode, idx uint16, kids ...BNode) {
+func nodeReplaceKidN(tree *BTree, New BNode, old BNode, idx uint16, kids ...BNode) error {
 	inc := uint16(len(kids))
-	New.setHeader(BNODE_NODE, old.nkeys()+inc-1)
+	New.setHeader(BNODE_NODE, nkeysOf(int(old.nkeys())+len(kids)-1))
 	nodeAppendRange(New, old, 0, 0, idx)
 
 	for i, node := range kids {
-		nodeAppendKV(New, idx+uint16(i), tree.New(node), node.GetKey(0), nil)
+		ptr, err := tree.alloc(node)
+		if err != nil {
+			return err
+		}
+		nodeAppendKV(New, idx+uint16(i), ptr, node.GetKey(0), nil)
 	}
 	nodeAppendRange(New, old, idx+inc, idx+1, old.nkeys()-(idx+1))
+	return nil
 }
 
 // Deletion
 
 // remove a key from a leaf node
 func leafDelete(New BNode, old BNode, idx uint16) {
-	New.setHeader(BNODE_LEAF, old.nkeys()-1)
+	New.setHeader(old.kind(), nkeysOf(int(old.nkeys())-1))
 	nodeAppendRange(New, old, 0, 0, idx)
 	nodeAppendRange(New, old, idx, idx+1, old.nkeys()-(idx+1))
 }
 
 // Delete a key from the tree
-func treeDelete(tree *BTree, node BNode, key []byte) BNode {
+func treeDelete(tree *BTree, node BNode, key []byte) (BNode, error) {
 	// find the location of the key
-	idx := noDelookupLE(node, key)
+	idx := noDelookupLE(tree, node, key)
 
 	switch node.btype() {
 	case BNODE_LEAF:
-		if !bytes.Equal(key, node.GetKey(idx)) {
-			return BNode{} // node not found
+		if tree.compare(key, node.GetKey(idx)) != 0 {
+			return BNode{}, nil // node not found
 		}
 
 		// Delete the key in the leaf
 		New := BNode{Data: make([]byte, BTREE_PAGE_SIZE)}
 		leafDelete(New, node, idx)
-		return New
+		return New, nil
 
 	case BNODE_NODE:
 		return nodeDelete(tree, node, idx, key)
@@ -306,16 +503,17 @@ func treeDelete(tree *BTree, node BNode, key []byte) BNode {
 	}
 }
 
-func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
+func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) (BNode, error) {
 	// recurse into the kid
 	kptr := node.GetPtr(idx)
-	updated := treeDelete(tree, tree.Get(kptr), key)
-	if len(updated.Data) == 0 {
-		return BNode{} // not found
+	updated, err := treeDelete(tree, tree.Get(kptr), key)
+	if err != nil || len(updated.Data) == 0 {
+		return BNode{}, err // failed or not found
 	}
 	tree.Del(kptr)
 
-	New := BNode{Data: make([]byte, BTREE_PAGE_SIZE)}
+	// the kid's first key can be longer than the one it replaces, so the node can outgrow a page
+	New := BNode{Data: make([]byte, 2*BTREE_PAGE_SIZE)}
 
 	// Check for merging
 	mergeDir, sibling := shouldMerge(tree, node, idx, updated)
@@ -325,41 +523,108 @@ func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
 		merged := BNode{Data: make([]byte, BTREE_PAGE_SIZE)}
 		nodeMerge(merged, sibling, updated)
 		tree.Del(node.GetPtr(idx - 1))
-		nodeReplace2Kid(New, node, idx-1, tree.New(merged), merged.GetKey(0))
+		tree.merge()
+		ptr, err := tree.alloc(merged)
+		if err != nil {
+			return BNode{}, err
+		}
+		nodeReplace2Kid(New, node, idx-1, ptr, merged.GetKey(0))
 
 	case mergeDir > 0:
 		merged := BNode{Data: make([]byte, BTREE_PAGE_SIZE)}
 		nodeMerge(merged, updated, sibling)
 		tree.Del(node.GetPtr(idx + 1))
-		nodeReplace2Kid(New, node, idx, tree.New(merged), merged.GetKey(0))
+		tree.merge()
+		ptr, err := tree.alloc(merged)
+		if err != nil {
+			return BNode{}, err
+		}
+		nodeReplace2Kid(New, node, idx, ptr, merged.GetKey(0))
+
+	case mergeDir == 0 && updated.nkeys() == 0:
+		// the only kid is empty, the node goes empty too and is merged at the level above
+		utils.Assert(node.nkeys() == 1 && idx == 0)
+		New.setHeader(BNODE_NODE, 0)
 
 	case mergeDir == 0:
-		utils.Assert(updated.nkeys() > 0)
-		nodeReplaceKidN(tree, New, node, idx, updated)
+		nsplit, splitted := nodeSplit3(updated)
+		if err := nodeReplaceKidN(tree, New, node, idx, splitted[:nsplit]...); err != nil {
+			return BNode{}, err
+		}
+	}
+
+	return New, nil
+}
+
+// replace the 2 adjacent kids at idx and idx+1 with the merged one at ptr, whose first key is key
+func nodeReplace2Kid(New, old BNode, idx uint16, ptr uint64, key []byte) {
+	New.setHeader(BNODE_NODE, nkeysOf(int(old.nkeys())-1))
+	nodeAppendRange(New, old, 0, 0, idx)
+	nodeAppendKV(New, idx, ptr, key, nil)
+	nodeAppendRange(New, old, idx+1, idx+2, old.nkeys()-(idx+2))
+}
+
+// the type field of the node nodeMerge makes of left and right.
+// leaves of different key widths make a variable width leaf, unless one is empty
+func mergeKind(left BNode, right BNode) uint16 {
+	switch {
+	case left.nkeys() == 0:
+		return right.kind()
+	case right.nkeys() == 0 || left.kind() == right.kind():
+		return left.kind()
+	default:
+		return left.btype()
+	}
+}
+
+// allocate a page through Alloc if set, New otherwise
+func (tree *BTree) alloc(node BNode) (uint64, error) {
+	if tree.Alloc != nil {
+		return tree.Alloc(node)
+	}
+	return tree.New(node), nil
+}
+
+func (tree *BTree) split(nsplit uint16) {
+	if nsplit > 1 && tree.OnSplit != nil {
+		tree.OnSplit()
+	}
+}
+
+func (tree *BTree) merge() {
+	if tree.OnMerge != nil {
+		tree.OnMerge()
 	}
+}
 
-	return New
+func (tree *BTree) inserted(key []byte, val []byte) {
+	if tree.OnInsert != nil {
+		tree.OnInsert(key, val)
+	}
 }
 
-func nodeReplace2Kid(New, node BNode, u1 uint16, u2 uint64, b []byte) {
+func (tree *BTree) deleted(key []byte) {
+	if tree.OnDelete != nil {
+		tree.OnDelete(key)
+	}
 }
 
 // merge 2 nodes into 1
 func nodeMerge(New BNode, left BNode, right BNode) {
-	New.setHeader(left.btype(), left.nkeys()+right.nkeys())
+	New.setHeader(mergeKind(left, right), nkeysOf(int(left.nkeys())+int(right.nkeys())))
 	nodeAppendRange(New, left, 0, 0, left.nkeys())
 	nodeAppendRange(New, right, left.nkeys(), 0, right.nkeys())
 }
 
 // determine if the updated kid should be merged with the sibling
 func shouldMerge(tree *BTree, node BNode, idx uint16, updated BNode) (int, BNode) {
-	if updated.nbytes() > BTREE_PAGE_SIZE/4 {
+	if updated.nbytes() > BTREE_PAGE_SIZE/4 && updated.nkeys() >= tree.MinKeys {
 		return 0, BNode{}
 	}
 
 	if idx > 0 {
 		sibling := tree.Get(node.GetPtr(idx - 1))
-		merged := sibling.nbytes() + updated.nbytes() - HEADER
+		merged := mergedSize(sibling, updated)
 
 		if merged <= BTREE_PAGE_SIZE {
 			return -1, sibling
@@ -368,7 +633,7 @@ func shouldMerge(tree *BTree, node BNode, idx uint16, updated BNode) (int, BNode
 
 	if idx+1 < node.nkeys() {
 		sibling := tree.Get(node.GetPtr(idx + 1))
-		merged := sibling.nbytes() + updated.nbytes() - HEADER
+		merged := mergedSize(updated, sibling)
 
 		if merged <= BTREE_PAGE_SIZE {
 			return +1, sibling
@@ -378,32 +643,67 @@ func shouldMerge(tree *BTree, node BNode, idx uint16, updated BNode) (int, BNode
 	return 0, BNode{}
 }
 
+// the size of the node nodeMerge makes of left and right
+func mergedSize(left, right BNode) uint16 {
+	size := left.nbytes() + right.nbytes() - HEADER
+	if mergeKind(left, right)>>8 == 0 {
+		// a fixed width side gets a key length per kv
+		if left.keyWidth() != 0 {
+			size += 2 * left.nkeys()
+		}
+		if right.keyWidth() != 0 {
+			size += 2 * right.nkeys()
+		}
+	}
+	return size
+}
+
 // managing the Root node as tree grows and shrinks
 
 func (tree *BTree) Delete(key []byte) bool {
+	deleted, err := tree.TryDelete(key)
+	if err != nil {
+		panic(err) // only a failing Alloc can get here
+	}
+	return deleted
+}
+
+// TryDelete is Delete for a tree with a failing Alloc. On error the tree is left as it was.
+func (tree *BTree) TryDelete(key []byte) (bool, error) {
 	utils.Assert(len(key) != 0)
 	utils.Assert(len(key) <= BTREE_MAX_KEY_SIZE)
 	if tree.Root == 0 {
-		return false
+		return false, nil
 	}
 
-	updated := treeDelete(tree, tree.Get(tree.Root), key)
-	if len(updated.Data) == 0 {
-		return false // not found
+	updated, err := treeDelete(tree, tree.Get(tree.Root), key)
+	if err != nil || len(updated.Data) == 0 {
+		return false, err // failed or not found
 	}
 
-	tree.Del(tree.Root)
+	root := tree.Root
 	if updated.btype() == BNODE_NODE && updated.nkeys() == 1 {
 		// trim a level
-		tree.Root = updated.GetPtr(0)
-	} else {
-		tree.Root = tree.New(updated)
+		root = updated.GetPtr(0)
+	} else if root, err = tree.newRoot(updated); err != nil {
+		return false, err
 	}
+	tree.Del(tree.Root)
+	tree.Root = root
+	tree.deleted(key)
 
-	return true
+	return true, nil
 }
 
 func (tree *BTree) Insert(key []byte, val []byte) {
+	if err := tree.TryInsert(key, val); err != nil {
+		panic(err) // only a failing Alloc can get here
+	}
+}
+
+// TryInsert is Insert for a tree with a failing Alloc. On error the tree is left as it was,
+// including when the allocation fails in the middle of a split.
+func (tree *BTree) TryInsert(key []byte, val []byte) error {
 	utils.Assert(len(key) != 0)
 	utils.Assert(len(key) <= BTREE_MAX_KEY_SIZE)
 	utils.Assert(len(val) <= BTREE_MAX_VALUE_SIZE)
@@ -414,26 +714,45 @@ func (tree *BTree) Insert(key []byte, val []byte) {
 		nodeAppendKV(Root, 0, 0, nil, nil)
 		nodeAppendKV(Root, 1, 0, key, val)
 
-		tree.Root = tree.New(Root)
-		return
+		ptr, err := tree.alloc(Root)
+		if err != nil {
+			return err
+		}
+		tree.Root = ptr
+		tree.inserted(key, val)
+		return nil
 	}
 
-	node := tree.Get(tree.Root)
+	node, err := treeInsert(tree, tree.Get(tree.Root), key, val)
+	if err != nil {
+		return err
+	}
+	root, err := tree.newRoot(node)
+	if err != nil {
+		return err
+	}
 	tree.Del(tree.Root)
+	tree.Root = root
+	tree.inserted(key, val)
+	return nil
+}
 
-	node = treeInsert(tree, node, key, val)
+// allocate the updated root node, adding a level if it has to be split
+func (tree *BTree) newRoot(node BNode) (uint64, error) {
 	nsplit, splitted := nodeSplit3(node)
+	tree.split(nsplit)
+	if nsplit == 1 {
+		return tree.alloc(splitted[0])
+	}
 
-	if nsplit > 1 {
-		Root := BNode{Data: make([]byte, BTREE_PAGE_SIZE)}
-		Root.setHeader(BNODE_NODE, nsplit)
-
-		for i, knode := range splitted[:nsplit] {
-			ptr, key := tree.New(knode), knode.GetKey(0)
-			nodeAppendKV(Root, uint16(i), ptr, key, nil)
+	Root := BNode{Data: make([]byte, BTREE_PAGE_SIZE)}
+	Root.setHeader(BNODE_NODE, nsplit)
+	for i, knode := range splitted[:nsplit] {
+		ptr, err := tree.alloc(knode)
+		if err != nil {
+			return 0, err
 		}
-		tree.Root = tree.New(Root)
-	} else {
-		tree.Root = tree.New((splitted[0]))
+		nodeAppendKV(Root, uint16(i), ptr, knode.GetKey(0), nil)
 	}
+	return tree.alloc(Root)
 }
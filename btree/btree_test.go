@@ -0,0 +1,712 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// a tree over pages kept in memory, checking that only live pages are read and freed
+type memTree struct {
+	tree  BTree
+	pages map[uint64]BNode
+	next  uint64
+}
+
+func newMemTree(t *testing.T) *memTree {
+	m := &memTree{pages: map[uint64]BNode{}, next: 1}
+	m.tree.Get = func(ptr uint64) BNode {
+		node, ok := m.pages[ptr]
+		if !ok {
+			t.Fatalf("read of page %d, which is not allocated", ptr)
+		}
+		return node
+	}
+	m.tree.New = func(node BNode) uint64 {
+		if len(node.Data) > BTREE_PAGE_SIZE {
+			t.Fatalf("new page of %d bytes", len(node.Data))
+		}
+		m.next++
+		m.pages[m.next] = node
+		return m.next
+	}
+	m.tree.Del = func(ptr uint64) {
+		if _, ok := m.pages[ptr]; !ok {
+			t.Fatalf("free of page %d, which is not allocated", ptr)
+		}
+		delete(m.pages, ptr)
+	}
+	return m
+}
+
+// the pages reachable from the root
+func (m *memTree) reachable() int {
+	n := 0
+	m.tree.RangePages(nil, nil, func(ptr uint64) { n++ })
+	return n
+}
+
+// the kvs of the tree in order, checking that the keys are sorted and each node of at most a page
+func (m *memTree) contents(t *testing.T) map[string][]byte {
+	kvs := map[string][]byte{}
+	var prev []byte
+	var walk func(ptr uint64)
+	walk = func(ptr uint64) {
+		node := m.tree.Get(ptr)
+		if node.nbytes() > BTREE_PAGE_SIZE {
+			t.Fatalf("page %d: node of %d bytes", ptr, node.nbytes())
+		}
+		for i := uint16(0); i < node.nkeys(); i++ {
+			if node.btype() == BNODE_NODE {
+				walk(node.GetPtr(i))
+				continue
+			}
+			key := node.GetKey(i)
+			if len(key) == 0 {
+				continue // the sentinel
+			}
+			if prev != nil && bytes.Compare(prev, key) >= 0 {
+				t.Fatalf("page %d: key %q after %q", ptr, key, prev)
+			}
+			prev = key
+			kvs[string(key)] = node.GetVal(i)
+		}
+	}
+	if m.tree.Root != 0 {
+		walk(m.tree.Root)
+	}
+	return kvs
+}
+
+// check the tree holds exactly the kvs of want
+func (m *memTree) check(t *testing.T, want map[string][]byte) {
+	t.Helper()
+	got := m.contents(t)
+	if len(got) != len(want) {
+		t.Fatalf("%d keys in the tree, want %d", len(got), len(want))
+	}
+	for key, val := range want {
+		if v, ok := got[key]; !ok || !bytes.Equal(v, val) {
+			t.Fatalf("key %q: value %q, want %q", key, v, val)
+		}
+	}
+}
+
+func testKey(i int) []byte {
+	return []byte(fmt.Sprintf("key%06d", i))
+}
+
+func TestNodeKVs(t *testing.T) {
+	node := BNode{Data: make([]byte, BTREE_PAGE_SIZE)}
+	node.setHeader(BNODE_LEAF, 3)
+	vals := [][]byte{nil, []byte("a"), bytes.Repeat([]byte{'v'}, 100)}
+	for i, val := range vals {
+		nodeAppendKV(node, uint16(i), 0, testKey(i), val)
+	}
+	for i, val := range vals {
+		if got := node.GetKey(uint16(i)); !bytes.Equal(got, testKey(i)) {
+			t.Errorf("key %d: %q, want %q", i, got, testKey(i))
+		}
+		if got := node.GetVal(uint16(i)); !bytes.Equal(got, val) {
+			t.Errorf("value %d: %q, want %q", i, got, val)
+		}
+	}
+}
+
+func TestNodeAppendRangeCopiesPointers(t *testing.T) {
+	old := BNode{Data: make([]byte, BTREE_PAGE_SIZE)}
+	old.setHeader(BNODE_NODE, 10)
+	for i := uint16(0); i < 10; i++ {
+		nodeAppendKV(old, i, 100+uint64(i), testKey(int(i)), nil)
+	}
+
+	// 6 kids from position 3 of old to position 2 of New
+	New := BNode{Data: make([]byte, BTREE_PAGE_SIZE)}
+	New.setHeader(BNODE_NODE, 8)
+	nodeAppendKV(New, 0, 1, testKey(-1), nil)
+	nodeAppendKV(New, 1, 2, testKey(-2), nil)
+	nodeAppendRange(New, old, 2, 3, 6)
+	for i := uint16(0); i < 6; i++ {
+		if got, want := New.GetPtr(2+i), old.GetPtr(3+i); got != want {
+			t.Errorf("kid %d: pointer %d, want %d", 2+i, got, want)
+		}
+		if got, want := New.GetKey(2+i), old.GetKey(3+i); !bytes.Equal(got, want) {
+			t.Errorf("kid %d: key %q, want %q", 2+i, got, want)
+		}
+	}
+}
+
+func mustPanic(t *testing.T, what string, fn func()) {
+	t.Helper()
+	defer func() {
+		if recover() == nil {
+			t.Errorf("%s didn't panic", what)
+		}
+	}()
+	fn()
+}
+
+func TestNodeKeyCount(t *testing.T) {
+	if n := nkeysOf(BTREE_MAX_NKEYS); n != BTREE_MAX_NKEYS {
+		t.Fatalf("nkeysOf(%d) = %d", BTREE_MAX_NKEYS, n)
+	}
+	mustPanic(t, "a count of -1", func() { nkeysOf(-1) })
+	mustPanic(t, "a count past BTREE_MAX_NKEYS", func() { nkeysOf(BTREE_MAX_NKEYS + 1) })
+	// what a uint16 sum would have wrapped to 0
+	mustPanic(t, "a count of 65536", func() { nkeysOf(0xffff + 1) })
+
+	// deleting from an empty leaf, which an unsigned count would wrap to 65535
+	empty := BNode{Data: make([]byte, BTREE_PAGE_SIZE)}
+	empty.setHeader(BNODE_LEAF, 0)
+	mustPanic(t, "deleting from an empty leaf", func() {
+		leafDelete(BNode{Data: make([]byte, BTREE_PAGE_SIZE)}, empty, 0)
+	})
+
+	// the count must fit the buffer
+	page := BNode{Data: make([]byte, BTREE_PAGE_SIZE)}
+	page.setHeader(BNODE_NODE, (BTREE_PAGE_SIZE-HEADER)/(8+2+4))
+	mustPanic(t, "a count too large for the page", func() {
+		page.setHeader(BNODE_NODE, (BTREE_PAGE_SIZE-HEADER)/(8+2+4)+1)
+	})
+}
+
+func TestSplitKeyCounts(t *testing.T) {
+	for _, width := range []int{0, 2} {
+		t.Run(fmt.Sprint(width), func(t *testing.T) {
+			m := newMemTree(t)
+			m.tree.KeyWidth = width
+			splits := 0
+			m.tree.OnSplit = func() { splits++ }
+
+			// every page holds as many keys as a page can, with the smallest keys there are
+			checkCounts := func() {
+				t.Helper()
+				for ptr, node := range m.pages {
+					if n := int(node.nkeys()); n == 0 || HEADER+10*n > BTREE_PAGE_SIZE || node.nbytes() > BTREE_PAGE_SIZE {
+						t.Fatalf("page %d: %d keys in %d bytes", ptr, n, node.nbytes())
+					}
+				}
+			}
+			r := rand.New(rand.NewSource(1))
+			for i, k := range r.Perm(0xffff) {
+				m.tree.Insert([]byte{byte((k + 1) >> 8), byte(k + 1)}, nil)
+				if i%5000 == 0 {
+					checkCounts()
+				}
+			}
+			checkCounts()
+			if err := m.tree.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			if h := m.tree.Stats().Height; splits == 0 || h < 3 {
+				t.Fatalf("%d splits, height %d", splits, h)
+			}
+		})
+	}
+}
+
+type testKV struct {
+	key []byte
+	val []byte
+}
+
+// an oversized leaf of the kvs, as treeInsert makes before splitting
+func oversizedLeaf(kvs []testKV) BNode {
+	node := BNode{Data: make([]byte, 2*BTREE_PAGE_SIZE)}
+	node.setHeader(BNODE_LEAF, uint16(len(kvs)))
+	for i, kv := range kvs {
+		nodeAppendKV(node, uint16(i), 0, kv.key, kv.val)
+	}
+	return node
+}
+
+func TestMaxValueSize(t *testing.T) {
+	if got := MaxValueSize(0); got != -1 {
+		t.Fatalf("MaxValueSize(0) = %d, want -1", got)
+	}
+	if got := MaxValueSize(MaxKeySize() + 1); got != -1 {
+		t.Fatalf("MaxValueSize of an oversized key = %d, want -1", got)
+	}
+	for _, keyLen := range []int{1, 100, MaxKeySize()} {
+		m := newMemTree(t)
+		key := bytes.Repeat([]byte{'k'}, keyLen)
+		m.tree.Insert(key, make([]byte, MaxValueSize(keyLen)))
+		mustPanic(t, "oversized value", func() { m.tree.Insert(key, make([]byte, MaxValueSize(keyLen)+1)) })
+	}
+}
+
+func TestNodeSplit(t *testing.T) {
+	kvs := func(from int, n int, vlen int) []testKV {
+		out := []testKV{}
+		for i := from; i < from+n; i++ {
+			out = append(out, testKV{testKey(i), bytes.Repeat([]byte{byte(i)}, vlen)})
+		}
+		return out
+	}
+	// the largest kv a page takes
+	huge := func(i int) testKV {
+		key := append(testKey(i), bytes.Repeat([]byte{'k'}, BTREE_MAX_KEY_SIZE-len(testKey(i)))...)
+		return testKV{key, make([]byte, BTREE_MAX_VALUE_SIZE)}
+	}
+
+	cases := []struct {
+		name   string
+		kvs    []testKV
+		nsplit uint16
+	}{
+		{"all large", kvs(0, 4, 2000), 2},
+		{"many small", kvs(0, 90, 60), 2},
+		{"huge first", append([]testKV{huge(0)}, kvs(1, 30, 90)...), 2},
+		{"huge last", append(kvs(0, 30, 90), huge(99)), 2},
+		{"huge between", append(append(kvs(0, 15, 90), huge(50)), kvs(60, 15, 90)...), 3},
+		{"two huge", []testKV{huge(0), huge(1)}, 2},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			old := oversizedLeaf(c.kvs)
+			if old.nbytes() <= BTREE_PAGE_SIZE {
+				t.Fatalf("the node of %d bytes fits in a page", old.nbytes())
+			}
+
+			nsplit, nodes := nodeSplit3(old)
+			if nsplit != c.nsplit {
+				t.Errorf("split in %d, want %d", nsplit, c.nsplit)
+			}
+			i := 0
+			for _, node := range nodes[:nsplit] {
+				if node.nbytes() > BTREE_PAGE_SIZE || len(node.Data) != BTREE_PAGE_SIZE {
+					t.Errorf("node of %d bytes in a buffer of %d", node.nbytes(), len(node.Data))
+				}
+				if node.nkeys() == 0 {
+					t.Error("empty node")
+				}
+				for j := uint16(0); j < node.nkeys(); j++ {
+					if !bytes.Equal(node.GetKey(j), c.kvs[i].key) || !bytes.Equal(node.GetVal(j), c.kvs[i].val) {
+						t.Fatalf("kv %d changed or out of order", i)
+					}
+					i++
+				}
+			}
+			if i != len(c.kvs) {
+				t.Errorf("%d kvs after the split, had %d", i, len(c.kvs))
+			}
+		})
+	}
+}
+
+// a leaf of the sentinel and 2 kvs, the second value sized so the leaf is BTREE_PAGE_SIZE+delta bytes
+func TestLeafPageBoundary(t *testing.T) {
+	for _, delta := range []int{-1, 0, 1} {
+		t.Run(fmt.Sprint(delta), func(t *testing.T) {
+			fixed := HEADER + 3*(8+2+4) + 2*len(testKey(0)) + BTREE_MAX_VALUE_SIZE
+			vals := [][]byte{make([]byte, BTREE_MAX_VALUE_SIZE), make([]byte, BTREE_PAGE_SIZE+delta-fixed)}
+
+			m := newMemTree(t)
+			want := map[string][]byte{}
+			for i, val := range vals {
+				m.tree.Insert(testKey(i), val)
+				want[string(testKey(i))] = val
+			}
+			m.check(t, want)
+			root := m.tree.Get(m.tree.Root)
+			if delta <= 0 {
+				if root.btype() != BNODE_LEAF || int(root.nbytes()) != BTREE_PAGE_SIZE+delta {
+					t.Fatalf("root of type %d and %d bytes, want a leaf of %d", root.btype(), root.nbytes(), BTREE_PAGE_SIZE+delta)
+				}
+			} else if root.btype() != BNODE_NODE || root.nkeys() != 2 {
+				t.Fatalf("root of type %d with %d keys, want the leaf split in 2", root.btype(), root.nkeys())
+			}
+		})
+	}
+}
+
+func TestInsertLargeValues(t *testing.T) {
+	m := newMemTree(t)
+	r := rand.New(rand.NewSource(1))
+	want := map[string][]byte{}
+	for i, k := range r.Perm(3000) {
+		key := testKey(k)
+		val := bytes.Repeat([]byte{byte(i)}, r.Intn(60))
+		if r.Intn(20) == 0 {
+			key = append(key, bytes.Repeat([]byte{'k'}, BTREE_MAX_KEY_SIZE-len(key))...)
+			val = bytes.Repeat([]byte{byte(i)}, BTREE_MAX_VALUE_SIZE)
+		}
+		m.tree.Insert(key, val)
+		want[string(key)] = val
+	}
+	if root := m.tree.Get(m.tree.Root); root.btype() != BNODE_NODE {
+		t.Fatal("no splits")
+	}
+	// the nodes the splits made are well formed and route every key, newMemTree checks their size
+	if err := m.tree.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	m.check(t, want)
+}
+
+func TestInsertReplacesValue(t *testing.T) {
+	m := newMemTree(t)
+	want := map[string][]byte{}
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 500; i++ {
+			val := []byte(fmt.Sprintf("%d-%d", i, round))
+			m.tree.Insert(testKey(i), val)
+			want[string(testKey(i))] = val
+		}
+		m.check(t, want)
+	}
+}
+
+func TestDeleteUntilEmpty(t *testing.T) {
+	for _, order := range []string{"sequential", "reverse", "random"} {
+		t.Run(order, func(t *testing.T) {
+			m := newMemTree(t)
+			const n = 2000
+			want := map[string][]byte{}
+			for i := 0; i < n; i++ {
+				val := bytes.Repeat([]byte{byte(i)}, 100)
+				m.tree.Insert(testKey(i), val)
+				want[string(testKey(i))] = val
+			}
+
+			keys := rand.New(rand.NewSource(1)).Perm(n)
+			for i := range keys {
+				switch order {
+				case "sequential":
+					keys[i] = i
+				case "reverse":
+					keys[i] = n - 1 - i
+				}
+			}
+			for done, i := range keys {
+				if !m.tree.Delete(testKey(i)) {
+					t.Fatalf("delete %d: key %d not found", done, i)
+				}
+				delete(want, string(testKey(i)))
+				if done%50 == 0 {
+					m.check(t, want)
+				}
+				if m.tree.Delete(testKey(i)) {
+					t.Fatalf("delete %d: key %d deleted twice", done, i)
+				}
+			}
+			m.check(t, want)
+
+			// only the root leaf with the sentinel is left, every other page was freed by merges
+			if len(m.pages) != 1 {
+				t.Errorf("%d pages left", len(m.pages))
+			}
+		})
+	}
+}
+
+func TestInsertDeleteRandom(t *testing.T) {
+	m := newMemTree(t)
+	r := rand.New(rand.NewSource(1))
+	want := map[string][]byte{}
+	// keys of many sizes, so internal nodes fill unevenly and some end up with a single kid
+	keys := [][]byte{}
+	for i := 0; i < 3000; i++ {
+		key := []byte(fmt.Sprintf("%016x", uint64(i)*0x9e3779b97f4a7c15))
+		keys = append(keys, append(key, key...)[:1+r.Intn(31)])
+	}
+
+	for round := 0; round < 20000; round++ {
+		key := keys[r.Intn(len(keys))]
+		if r.Intn(3) == 0 {
+			_, ok := want[string(key)]
+			if m.tree.Delete(key) != ok {
+				t.Fatalf("round %d: delete of %q, key present %v", round, key, ok)
+			}
+			delete(want, string(key))
+		} else {
+			val := bytes.Repeat([]byte{byte(round)}, r.Intn(100))
+			m.tree.Insert(key, val)
+			want[string(key)] = val
+		}
+		if round%1000 == 0 {
+			m.check(t, want)
+		}
+	}
+	m.check(t, want)
+}
+
+func TestMinKeysKeepsTreeShallow(t *testing.T) {
+	// keys of the maximum size, so a node with 2 of them is over the size threshold
+	// and is never merged on size alone
+	bigKey := func(i int) []byte {
+		return append(testKey(i), bytes.Repeat([]byte{'k'}, BTREE_MAX_KEY_SIZE-len(testKey(i)))...)
+	}
+	const n = 500
+	heights := map[uint16]int{}
+	for _, minKeys := range []uint16{0, 3} {
+		m := newMemTree(t)
+		m.tree.MinKeys = minKeys
+		want := map[string][]byte{}
+		for i := 0; i < n; i++ {
+			m.tree.Insert(bigKey(i), []byte("v"))
+			want[string(bigKey(i))] = []byte("v")
+		}
+		// keep every third key, so most nodes are left with 1 or 2 keys
+		for i := 0; i < n; i++ {
+			if i%3 != 0 {
+				m.tree.Delete(bigKey(i))
+				delete(want, string(bigKey(i)))
+			}
+		}
+		m.check(t, want)
+		if err := m.tree.Validate(); err != nil {
+			t.Fatalf("MinKeys %d: %v", minKeys, err)
+		}
+		heights[minKeys] = m.tree.Height()
+	}
+	if heights[3] >= heights[0] {
+		t.Errorf("height %d with MinKeys, %d without", heights[3], heights[0])
+	}
+}
+
+// a 16-byte key, like a UUID
+func uuidKey(i int) []byte {
+	return []byte(fmt.Sprintf("%016x", uint64(i)*0x9e3779b97f4a7c15))
+}
+
+// the average number of keys of the leaves without the sentinel
+func keysPerLeaf(m *memTree) float64 {
+	leaves, keys := 0, 0
+	for _, node := range m.pages {
+		if node.btype() == BNODE_LEAF && len(node.GetKey(0)) != 0 {
+			leaves++
+			keys += int(node.nkeys())
+		}
+	}
+	return float64(keys) / float64(leaves)
+}
+
+// the leaves of the tree, and how many of them hold more than the sentinel with variable width keys
+func leafWidths(m *memTree) (leaves int, variable int) {
+	for _, node := range m.pages {
+		if node.btype() != BNODE_LEAF {
+			continue
+		}
+		leaves++
+		if node.keyWidth() == 0 && !(node.nkeys() == 1 && len(node.GetKey(0)) == 0) {
+			variable++
+		}
+	}
+	return leaves, variable
+}
+
+func TestFixedKeysFitMoreKeysPerLeaf(t *testing.T) {
+	const n = 20000
+	fill := func(width int) *memTree {
+		m := newMemTree(t)
+		m.tree.KeyWidth = width
+		want := map[string][]byte{}
+		// in order, so that every leaf but the last is split as full as it gets
+		for i := 0; i < n; i++ {
+			key := []byte(fmt.Sprintf("%016d", i))
+			val := []byte(fmt.Sprintf("%08d", i))
+			m.tree.Insert(key, val)
+			want[string(key)] = val
+		}
+		m.check(t, want)
+		return m
+	}
+
+	variable := keysPerLeaf(fill(0))
+	fixed := fill(16)
+	if leaves, nvar := leafWidths(fixed); nvar > 1 {
+		t.Errorf("%d of %d leaves with variable width keys", nvar, leaves)
+	}
+	// 36 bytes per kv with its pointer and offset instead of 38
+	if got := keysPerLeaf(fixed); got < variable*1.05 {
+		t.Errorf("%.1f keys per leaf with fixed width keys, %.1f without", got, variable)
+	}
+}
+
+func TestFixedKeysMixedWidths(t *testing.T) {
+	m := newMemTree(t)
+	m.tree.KeyWidth = 16
+	r := rand.New(rand.NewSource(1))
+	want := map[string][]byte{}
+	keys := [][]byte{}
+	for i := 0; i < 3000; i++ {
+		key := uuidKey(i)
+		if r.Intn(10) == 0 {
+			// a few keys of other widths turn their leaves back to the variable encoding
+			key = append(key, key...)[:1+r.Intn(31)]
+		}
+		keys = append(keys, key)
+	}
+
+	for round := 0; round < 20000; round++ {
+		key := keys[r.Intn(len(keys))]
+		if r.Intn(3) == 0 {
+			_, ok := want[string(key)]
+			if m.tree.Delete(key) != ok {
+				t.Fatalf("round %d: delete of %q, key present %v", round, key, ok)
+			}
+			delete(want, string(key))
+		} else {
+			val := bytes.Repeat([]byte{byte(round)}, r.Intn(100))
+			m.tree.Insert(key, val)
+			want[string(key)] = val
+		}
+		if round%1000 == 0 {
+			m.check(t, want)
+		}
+	}
+	m.check(t, want)
+
+	_, variable := leafWidths(m)
+	if leaves, _ := leafWidths(m); variable == leaves {
+		t.Error("no fixed width leaves")
+	}
+}
+
+func TestTryInsertDeleteAllocFailure(t *testing.T) {
+	m := newMemTree(t)
+	// frees are held back until the operation succeeds, as KV does until the commit
+	freed := []uint64{}
+	m.tree.Del = func(ptr uint64) { freed = append(freed, ptr) }
+	errAlloc := errors.New("out of pages")
+	budget := -1
+	m.tree.Alloc = func(node BNode) (uint64, error) {
+		if budget == 0 {
+			return 0, errAlloc
+		}
+		budget--
+		return m.tree.New(node), nil
+	}
+
+	r := rand.New(rand.NewSource(1))
+	want := map[string][]byte{}
+	failures := 0
+	for i := 0; i < 5000; i++ {
+		key := testKey(r.Intn(1000))
+		val := bytes.Repeat([]byte{byte(i)}, r.Intn(500))
+		del := r.Intn(3) == 0
+		apply := func() error {
+			if del {
+				_, err := m.tree.TryDelete(key)
+				return err
+			}
+			return m.tree.TryInsert(key, val)
+		}
+
+		// run out of pages partway through, often in the middle of a split or a merge
+		root := m.tree.Root
+		budget = r.Intn(6)
+		if err := apply(); err != nil {
+			if !errors.Is(err, errAlloc) || m.tree.Root != root {
+				t.Fatalf("op %d: error %v, root %d, was %d", i, err, m.tree.Root, root)
+			}
+			failures++
+			freed = freed[:0] // the pages it allocated are simply leaked here
+			budget = -1
+			if err := apply(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, ptr := range freed {
+			delete(m.pages, ptr)
+		}
+		freed = freed[:0]
+		if del {
+			delete(want, string(key))
+		} else {
+			want[string(key)] = val
+		}
+	}
+	if failures == 0 {
+		t.Fatal("no allocation failed")
+	}
+	m.check(t, want)
+	if err := m.tree.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNodeAppendKVTooLarge(t *testing.T) {
+	node := BNode{Data: make([]byte, 2*BTREE_PAGE_SIZE)}
+	node.setHeader(BNODE_LEAF, 1)
+	mustPanic(t, "oversized key", func() {
+		nodeAppendKV(node, 0, 0, make([]byte, BTREE_MAX_KEY_SIZE+1), nil)
+	})
+	mustPanic(t, "oversized value", func() {
+		nodeAppendKV(node, 0, 0, []byte("k"), make([]byte, BTREE_MAX_VALUE_SIZE+1))
+	})
+	// the largest length a uint16 holds, and the first one it would truncate to 0
+	for _, n := range []int{0xffff, 0x10000} {
+		big := BNode{Data: make([]byte, 2*n)}
+		big.setHeader(BNODE_LEAF, 1)
+		mustPanic(t, fmt.Sprintf("a key of %d bytes", n), func() {
+			nodeAppendKV(big, 0, 0, make([]byte, n), nil)
+		})
+		mustPanic(t, fmt.Sprintf("a value of %d bytes", n), func() {
+			nodeAppendKV(big, 0, 0, []byte("k"), make([]byte, n))
+		})
+	}
+	// a kv that fits the limits but not the rest of the node
+	short := BNode{Data: make([]byte, 64)}
+	short.setHeader(BNODE_LEAF, 1)
+	mustPanic(t, "kv past the end of the node", func() {
+		nodeAppendKV(short, 0, 0, []byte("k"), make([]byte, 100))
+	})
+}
+
+// the kid pointers of every internal node
+func kidPointers(m *memTree) map[uint64][]uint64 {
+	kids := map[uint64][]uint64{}
+	m.tree.RangePages(nil, nil, func(ptr uint64) {
+		node := m.tree.Get(ptr)
+		if node.btype() != BNODE_NODE {
+			return
+		}
+		for i := uint16(0); i < node.nkeys(); i++ {
+			kids[ptr] = append(kids[ptr], node.GetPtr(i))
+		}
+	})
+	return kids
+}
+
+func TestSplitKeepsKidPointers(t *testing.T) {
+	m := newMemTree(t)
+	for i := 0; i < 400; i += 2 {
+		m.tree.Insert(testKey(i), make([]byte, 100))
+	}
+	if h := m.tree.Height(); h != 2 {
+		t.Fatalf("height %d, want 2", h)
+	}
+	before := kidPointers(m)[m.tree.Root]
+
+	// fill the middle leaf until it splits, which rewrites the root through nodeReplaceKidN
+	for i := 201; len(kidPointers(m)[m.tree.Root]) == len(before); i += 2 {
+		m.tree.Insert(testKey(i), make([]byte, 100))
+	}
+	after := kidPointers(m)[m.tree.Root]
+	if len(after) != len(before)+1 {
+		t.Fatalf("%d kids after the split, had %d", len(after), len(before))
+	}
+
+	// the kids left and right of the split one are the same pages, in the same order
+	idx := 0
+	for idx < len(before) && before[idx] == after[idx] {
+		idx++
+	}
+	for j := idx + 1; j < len(before); j++ {
+		if before[j] != after[j+1] {
+			t.Errorf("kid %d: pointer %d, was %d", j+1, after[j+1], before[j])
+		}
+	}
+	if err := m.tree.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 400; i += 2 {
+		if _, ok := m.tree.Lookup(testKey(i)); !ok {
+			t.Fatalf("key %d lost", i)
+		}
+	}
+}
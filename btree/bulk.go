@@ -0,0 +1,352 @@
+package btree
+
+import "kurocifer/LeichtKV/utils"
+
+// LoadSorted builds the tree bottom-up from keys in strictly increasing order, which is much
+// cheaper than inserting them one by one. The tree must be empty, a tree emptied by deletes is freed first.
+// Nodes are filled up to fill*BTREE_PAGE_SIZE bytes, leaving the rest as room for later inserts.
+func (tree *BTree) LoadSorted(keys [][]byte, vals [][]byte, fill float64) {
+	utils.Assert(len(keys) == len(vals))
+	utils.Assert(0 < fill && fill <= 1)
+	if len(keys) == 0 {
+		return
+	}
+	freeEmpty(tree)
+
+	limit := int(fill * BTREE_PAGE_SIZE)
+
+	// the leftmost leaf starts with the sentinel, like the first Insert creates
+	level := []bulkKV{{}}
+	for i := range keys {
+		utils.Assert(len(keys[i]) != 0)
+		utils.Assert(len(keys[i]) <= BTREE_MAX_KEY_SIZE)
+		utils.Assert(len(vals[i]) <= BTREE_MAX_VALUE_SIZE)
+		utils.Assert(i == 0 || tree.compare(keys[i-1], keys[i]) < 0)
+		level = append(level, bulkKV{key: keys[i], val: vals[i]})
+	}
+
+	btype := uint16(BNODE_LEAF)
+	for {
+		level = bulkLevel(tree, btype, level, limit)
+		if len(level) == 1 {
+			tree.Root = level[0].ptr
+			return
+		}
+		btype = BNODE_NODE
+	}
+}
+
+// free a tree of no keys. deletes leave a leaf of only the sentinel, maybe under nodes of a single kid
+func freeEmpty(tree *BTree) {
+	for ptr := tree.Root; ptr != 0; {
+		node := tree.Get(ptr)
+		utils.Assert(node.nkeys() == 1)
+		tree.Del(ptr)
+		ptr = 0
+		if node.btype() == BNODE_NODE {
+			ptr = node.GetPtr(0)
+		}
+	}
+	tree.Root = 0
+}
+
+type bulkKV struct {
+	key []byte
+	val []byte
+	ptr uint64
+}
+
+// how many kvs go in the next node: as many as fit in limit bytes, but always at least one.
+// also returns the key width of the node, a leaf is fixed-width if all its keys have the tree's width
+func bulkTake(tree *BTree, btype uint16, kvs []bulkKV, limit int) (int, uint16) {
+	w := 0
+	if btype == BNODE_LEAF && tree.KeyWidth <= 0xff {
+		w = tree.KeyWidth
+	}
+	fixed := w != 0
+	n, size, fixedSize := 0, HEADER, HEADER
+	for n < len(kvs) {
+		kv := kvs[n]
+		nextSize := size + 8 + 2 + 4 + len(kv.key) + len(kv.val)
+		nextFixed := fixed && len(kv.key) == w
+		nextFixedSize := fixedSize + 8 + 2 + 2 + len(kv.key) + len(kv.val)
+		used := nextSize
+		if nextFixed {
+			used = nextFixedSize
+		}
+		if n > 0 && used > limit {
+			break
+		}
+		size, fixedSize, fixed = nextSize, nextFixedSize, nextFixed
+		n++
+	}
+	if !fixed {
+		return n, 0
+	}
+	return n, uint16(w)
+}
+
+// pack the kvs into nodes of at most limit bytes, returns the links to them for the level above
+func bulkLevel(tree *BTree, btype uint16, kvs []bulkKV, limit int) []bulkKV {
+	parents := []bulkKV{}
+	for len(kvs) > 0 {
+		n, w := bulkTake(tree, btype, kvs, limit)
+
+		node := BNode{Data: make([]byte, BTREE_PAGE_SIZE)}
+		if btype == BNODE_LEAF {
+			node.setHeader(leafType(w), nkeysOf(n))
+		} else {
+			node.setHeader(btype, nkeysOf(n))
+		}
+		for i, kv := range kvs[:n] {
+			nodeAppendKV(node, uint16(i), kv.ptr, kv.key, kv.val)
+		}
+		parents = append(parents, bulkKV{key: kvs[0].key, ptr: tree.New(node)})
+		kvs = kvs[n:]
+	}
+	return parents
+}
+
+// Op is one change of a batch for Apply: set Key to Val, or delete Key if Del is set.
+type Op struct {
+	Key []byte
+	Val []byte
+	Del bool
+}
+
+// Apply applies ops, strictly increasing by key, in a single pass down the tree: each node holding
+// keys of the ops is read and rewritten once, however many of them land in it. Deleting a missing
+// key changes nothing. Unlike Delete, nodes left small by deletes are not merged with their siblings.
+func (tree *BTree) Apply(ops []Op) {
+	for i, op := range ops {
+		utils.Assert(len(op.Key) != 0)
+		utils.Assert(len(op.Key) <= BTREE_MAX_KEY_SIZE)
+		utils.Assert(len(op.Val) <= BTREE_MAX_VALUE_SIZE)
+		utils.Assert(i == 0 || tree.compare(ops[i-1].Key, op.Key) < 0)
+	}
+
+	var links []bulkKV
+	changed := false
+	if tree.Root == 0 {
+		// as if it were a leaf of only the sentinel, like the first Insert creates
+		links, changed = leafApply(tree, []bulkKV{{}}, ops)
+	} else {
+		links, changed = treeApply(tree, tree.Root, ops)
+	}
+	if !changed {
+		return
+	}
+
+	for len(links) > 1 {
+		links = bulkLevel(tree, BNODE_NODE, links, BTREE_PAGE_SIZE)
+	}
+	// the leftmost leaf keeps the sentinel, so something is always left
+	tree.Root = links[0].ptr
+	// drop the levels of a single kid that deletes left behind
+	for root := tree.Get(tree.Root); root.btype() == BNODE_NODE && root.nkeys() == 1; root = tree.Get(tree.Root) {
+		tree.Del(tree.Root)
+		tree.Root = root.GetPtr(0)
+	}
+}
+
+// apply the ops to the subtree at ptr. returns the links to the nodes replacing it,
+// or false if nothing changed and it stays as is
+func treeApply(tree *BTree, ptr uint64, ops []Op) ([]bulkKV, bool) {
+	node := tree.Get(ptr)
+	unchanged := []bulkKV{{key: node.GetKey(0), ptr: ptr}}
+	if len(ops) == 0 {
+		return unchanged, false
+	}
+
+	var links []bulkKV
+	changed := false
+	switch node.btype() {
+	case BNODE_LEAF:
+		kvs := make([]bulkKV, node.nkeys())
+		for i := range kvs {
+			kvs[i] = bulkKV{key: node.GetKey(uint16(i)), val: node.GetVal(uint16(i))}
+		}
+		links, changed = leafApply(tree, kvs, ops)
+
+	case BNODE_NODE:
+		// the ops of each kid are those before the key of the next kid
+		for i := uint16(0); i < node.nkeys(); i++ {
+			n := len(ops)
+			if i+1 < node.nkeys() {
+				next := node.GetKey(i + 1)
+				n = 0
+				for n < len(ops) && tree.compare(ops[n].Key, next) < 0 {
+					n++
+				}
+			}
+			kid, kidChanged := treeApply(tree, node.GetPtr(i), ops[:n])
+			links = append(links, kid...)
+			changed = changed || kidChanged
+			ops = ops[n:]
+		}
+		if changed && len(links) > 0 {
+			links = bulkLevel(tree, BNODE_NODE, links, BTREE_PAGE_SIZE)
+		}
+
+	default:
+		panic("bad node!")
+	}
+
+	if !changed {
+		return unchanged, false
+	}
+	tree.Del(ptr)
+	return links, true
+}
+
+// merge the ops into the kvs of a leaf and pack the result into new leaves,
+// none if all its keys were deleted
+func leafApply(tree *BTree, kvs []bulkKV, ops []Op) ([]bulkKV, bool) {
+	merged := []bulkKV{}
+	changed := false
+	for len(kvs) > 0 || len(ops) > 0 {
+		cmp := -1 // the kv goes first
+		if len(kvs) == 0 {
+			cmp = 1
+		} else if len(ops) > 0 {
+			cmp = tree.compare(kvs[0].key, ops[0].Key)
+		}
+
+		switch {
+		case cmp < 0:
+			merged = append(merged, kvs[0])
+			kvs = kvs[1:]
+			continue
+		case cmp == 0:
+			kvs = kvs[1:]
+			changed = true
+			if ops[0].Del {
+				tree.deleted(ops[0].Key)
+			}
+		case !ops[0].Del:
+			changed = true
+		}
+		if !ops[0].Del {
+			merged = append(merged, bulkKV{key: ops[0].Key, val: ops[0].Val})
+			tree.inserted(ops[0].Key, ops[0].Val)
+		}
+		ops = ops[1:]
+	}
+
+	if !changed || len(merged) == 0 {
+		return nil, changed
+	}
+	return bulkLevel(tree, BNODE_LEAF, merged, BTREE_PAGE_SIZE), true
+}
+
+// CompactRange rewrites the smallest subtree holding the keys in [start, end) with densely packed
+// nodes, leaving the rest of the tree alone apart from the path to it. A nil end means no upper bound.
+// If the packed subtree doesn't fit under a single node again (the new separator keys can be longer),
+// its parent's subtree is rewritten instead, up to the whole tree.
+func (tree *BTree) CompactRange(start []byte, end []byte) {
+	if tree.Root == 0 {
+		return
+	}
+
+	// the path to the smallest subtree covering the range, and the kid taken at each step
+	path, idxs := []uint64{tree.Root}, []uint16{}
+	for {
+		node := tree.Get(path[len(path)-1])
+		if node.btype() != BNODE_NODE {
+			break
+		}
+		i := noDelookupLE(tree, node, start)
+		if i+1 < node.nkeys() && (end == nil || tree.compare(end, node.GetKey(i+1)) > 0) {
+			break // the range spans several kids
+		}
+		path, idxs = append(path, node.GetPtr(i)), append(idxs, i)
+	}
+
+	// pack it, moving up while it doesn't fit under one node
+	level := len(path) - 1
+	var packed uint64
+	for ; ; level-- {
+		ptr, ok := compactSubtree(tree, path[level], level == 0)
+		if ok {
+			packed = ptr
+			break
+		}
+	}
+
+	// copy the path above it with the new pointer, the keys don't change
+	for l := level - 1; l >= 0; l-- {
+		node := tree.Get(path[l])
+		New := BNode{Data: append([]byte{}, node.Data[:BTREE_PAGE_SIZE]...)}
+		New.setPtr(idxs[l], packed)
+		tree.Del(path[l])
+		packed = tree.New(New)
+	}
+	tree.Root = packed
+}
+
+// rebuild the subtree at ptr densely. unless root, it must come out with the same height
+// and a single top node, otherwise nothing is changed and false is returned
+func compactSubtree(tree *BTree, ptr uint64, root bool) (uint64, bool) {
+	kvs, pages := []bulkKV{}, []uint64{}
+	height := collectSubtree(tree, ptr, &kvs, &pages)
+
+	// check the node count level by level before allocating anything
+	if !root {
+		counts, btype := kvs, uint16(BNODE_LEAF)
+		for h := 0; h < height; h++ {
+			counts = bulkCount(tree, btype, counts)
+			btype = BNODE_NODE
+		}
+		if len(counts) != 1 {
+			return 0, false
+		}
+	}
+
+	btype := uint16(BNODE_LEAF)
+	for h := 0; ; h++ {
+		kvs = bulkLevel(tree, btype, kvs, BTREE_PAGE_SIZE)
+		btype = BNODE_NODE
+		if (root || h+1 == height) && len(kvs) == 1 {
+			break
+		}
+	}
+	for _, p := range pages {
+		tree.Del(p)
+	}
+	return kvs[0].ptr, true
+}
+
+// gather the leaf kvs and the pages of a subtree, returns its height
+func collectSubtree(tree *BTree, ptr uint64, kvs *[]bulkKV, pages *[]uint64) int {
+	*pages = append(*pages, ptr)
+	node := tree.Get(ptr)
+
+	switch node.btype() {
+	case BNODE_LEAF:
+		for i := uint16(0); i < node.nkeys(); i++ {
+			*kvs = append(*kvs, bulkKV{key: node.GetKey(i), val: node.GetVal(i)})
+		}
+		return 1
+
+	case BNODE_NODE:
+		height := 0
+		for i := uint16(0); i < node.nkeys(); i++ {
+			height = collectSubtree(tree, node.GetPtr(i), kvs, pages) + 1
+		}
+		return height
+
+	default:
+		panic("bad node!")
+	}
+}
+
+// the links bulkLevel would produce, without building the nodes
+func bulkCount(tree *BTree, btype uint16, kvs []bulkKV) []bulkKV {
+	parents := []bulkKV{}
+	for len(kvs) > 0 {
+		n, _ := bulkTake(tree, btype, kvs, BTREE_PAGE_SIZE)
+		parents = append(parents, bulkKV{key: kvs[0].key})
+		kvs = kvs[n:]
+	}
+	return parents
+}
@@ -0,0 +1,341 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// n sorted kvs, with keys spaced out so others can be inserted between them
+func sortedKVs(n int) (keys, vals [][]byte) {
+	for i := 0; i < n; i++ {
+		keys = append(keys, testKey(10*i))
+		vals = append(vals, bytes.Repeat([]byte{byte(i)}, i%50))
+	}
+	return keys, vals
+}
+
+func TestLoadSorted(t *testing.T) {
+	for _, n := range []int{1, 10, 5000} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			m := newMemTree(t)
+			keys, vals := sortedKVs(n)
+			m.tree.LoadSorted(keys, vals, 0.8)
+
+			want := map[string][]byte{}
+			for i := range keys {
+				want[string(keys[i])] = vals[i]
+			}
+			m.check(t, want)
+			if err := m.tree.Validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			// and it takes updates like any other tree
+			m.tree.Insert(testKey(5), []byte("new"))
+			m.tree.Delete(keys[0])
+			want[string(testKey(5))] = []byte("new")
+			delete(want, string(keys[0]))
+			m.check(t, want)
+		})
+	}
+}
+
+func TestLoadSortedFill(t *testing.T) {
+	// the leaves the tree has after inserting a key next to every 20th loaded key
+	leavesAfterInserts := func(fill float64) (before, after int) {
+		m := newMemTree(t)
+		keys, vals := sortedKVs(5000)
+		m.tree.LoadSorted(keys, vals, fill)
+		before, _ = leafWidths(m)
+		for i := 0; i < 5000; i += 20 {
+			m.tree.Insert(testKey(10*i+1), []byte("v"))
+		}
+		after, _ = leafWidths(m)
+		return before, after
+	}
+
+	fullBefore, fullAfter := leavesAfterInserts(1)
+	before, after := leavesAfterInserts(0.7)
+	if before <= fullBefore {
+		t.Errorf("%d leaves at a fill of 0.7, %d when full", before, fullBefore)
+	}
+	// a full tree splits about every leaf, one with headroom hardly any
+	if splits := after - before; splits*5 > fullAfter-fullBefore {
+		t.Errorf("%d leaves split at a fill of 0.7, %d when full", splits, fullAfter-fullBefore)
+	}
+}
+
+func TestLoadSortedAfterDeletes(t *testing.T) {
+	m := newMemTree(t)
+	for i := 0; i < 2000; i++ {
+		m.tree.Insert(testKey(i), []byte("old"))
+	}
+	for i := 0; i < 2000; i++ {
+		m.tree.Delete(testKey(i))
+	}
+
+	// the sentinel leaf left by the deletes is freed
+	keys, vals := sortedKVs(100)
+	m.tree.LoadSorted(keys, vals, 1)
+	want := map[string][]byte{}
+	for i := range keys {
+		want[string(keys[i])] = vals[i]
+	}
+	m.check(t, want)
+	if leaves, _ := leafWidths(m); len(m.pages) != leaves+1 {
+		t.Errorf("%d pages for %d leaves and a root", len(m.pages), leaves)
+	}
+}
+
+// random sorted ops on keys below n: sets, some of a large value, and deletes, some of missing keys
+func randomOps(r *rand.Rand, n int, count int) []Op {
+	byKey := map[string]Op{}
+	for len(byKey) < count {
+		key := testKey(r.Intn(n))
+		switch r.Intn(10) {
+		case 0, 1, 2, 3:
+			byKey[string(key)] = Op{Key: key, Del: true}
+		case 4:
+			byKey[string(key)] = Op{Key: key, Val: bytes.Repeat([]byte{'b'}, BTREE_MAX_VALUE_SIZE)}
+		default:
+			byKey[string(key)] = Op{Key: key, Val: []byte(fmt.Sprint(r.Int()))}
+		}
+	}
+	ops := []Op{}
+	for _, op := range byKey {
+		ops = append(ops, op)
+	}
+	sort.Slice(ops, func(i, j int) bool { return bytes.Compare(ops[i].Key, ops[j].Key) < 0 })
+	return ops
+}
+
+func TestApply(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	applied, oneByOne := newMemTree(t), newMemTree(t)
+	want := map[string][]byte{}
+	for round := 0; round < 200; round++ {
+		// batches of a few keys, and of about all of them
+		count := 1 + r.Intn(20)
+		if round%10 == 0 {
+			count = 1000
+		}
+		ops := randomOps(r, 2000, count)
+
+		applied.tree.Apply(ops)
+		for _, op := range ops {
+			if op.Del {
+				oneByOne.tree.Delete(op.Key)
+				delete(want, string(op.Key))
+			} else {
+				oneByOne.tree.Insert(op.Key, op.Val)
+				want[string(op.Key)] = op.Val
+			}
+		}
+
+		applied.check(t, want)
+		oneByOne.check(t, want)
+		if err := applied.tree.Validate(); err != nil {
+			t.Fatalf("round %d: %v", round, err)
+		}
+		// and the other way round, so each tree sees both
+		applied, oneByOne = oneByOne, applied
+	}
+}
+
+func TestApplyEmpty(t *testing.T) {
+	m := newMemTree(t)
+	// nothing to delete in an empty tree
+	m.tree.Apply([]Op{{Key: testKey(1), Del: true}})
+	if m.tree.Root != 0 || len(m.pages) != 0 {
+		t.Fatalf("root %d and %d pages after deleting from an empty tree", m.tree.Root, len(m.pages))
+	}
+
+	ops := []Op{}
+	for i := 0; i < 500; i++ {
+		ops = append(ops, Op{Key: testKey(i), Val: []byte("v")})
+	}
+	m.tree.Apply(ops)
+	root := m.tree.Root
+	pages := len(m.pages)
+
+	// deleting missing keys rewrites nothing
+	m.tree.Apply([]Op{{Key: testKey(1000), Del: true}, {Key: testKey(1001), Del: true}})
+	if m.tree.Root != root || len(m.pages) != pages {
+		t.Fatal("the tree was rewritten by deletes of missing keys")
+	}
+
+	// deleting everything leaves a leaf of only the sentinel
+	for i := range ops {
+		ops[i].Del = true
+	}
+	m.tree.Apply(ops)
+	m.check(t, map[string][]byte{})
+	if root := m.tree.Get(m.tree.Root); len(m.pages) != 1 || root.btype() != BNODE_LEAF || root.nkeys() != 1 {
+		t.Fatalf("%d pages after deleting every key", len(m.pages))
+	}
+}
+
+func loadTestTree(t *testing.T, n int, fill float64) *memTree {
+	m := newMemTree(t)
+	keys, vals := [][]byte{}, [][]byte{}
+	for i := 0; i < n; i++ {
+		keys = append(keys, testKey(i))
+		vals = append(vals, bytes.Repeat([]byte{byte(i)}, 100))
+	}
+	m.tree.LoadSorted(keys, vals, fill)
+	return m
+}
+
+// the pages of the subtree under the kid idx of the root
+func kidSubtree(m *memTree, idx uint16) map[uint64]bool {
+	root := m.tree.Get(m.tree.Root)
+	sub := &BTree{Get: m.tree.Get, Root: root.GetPtr(idx)}
+	pages := map[uint64]bool{}
+	sub.RangePages(nil, nil, func(ptr uint64) { pages[ptr] = true })
+	return pages
+}
+
+func TestCompactRange(t *testing.T) {
+	m := loadTestTree(t, 20000, 0.5)
+	if h := m.tree.Stats().Height; h != 3 {
+		t.Fatalf("height %d, want 3", h)
+	}
+	root := m.tree.Get(m.tree.Root)
+	const churned = 3
+	start, end := root.GetKey(churned), root.GetKey(churned+1)
+
+	// thin out the range, which leaves it spread over half empty leaves
+	for i := 0; i < 20000; i++ {
+		if key := testKey(i); bytes.Compare(key, start) >= 0 && bytes.Compare(key, end) < 0 && i%2 == 0 {
+			m.tree.Delete(key)
+		}
+	}
+	// the deletes may have merged its subtree into a neighbor, find the one covering it now
+	root = m.tree.Get(m.tree.Root)
+	covering := noDelookupLE(&m.tree, root, start)
+	if covering+1 < root.nkeys() && bytes.Compare(end, root.GetKey(covering+1)) > 0 {
+		t.Fatal("the range spans several kids of the root")
+	}
+	others := map[uint16]map[uint64]bool{}
+	for i := uint16(0); i < root.nkeys(); i++ {
+		if i != covering {
+			others[i] = kidSubtree(m, i)
+		}
+	}
+	before := m.tree.Stats()
+
+	m.tree.CompactRange(start, end)
+
+	if err := m.tree.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	after := m.tree.Stats()
+	if after.Leaves >= before.Leaves || after.Keys != before.Keys {
+		t.Errorf("leaves %d -> %d, keys %d -> %d", before.Leaves, after.Leaves, before.Keys, after.Keys)
+	}
+	// the other subtrees are the same pages
+	for i, pages := range others {
+		got := kidSubtree(m, i)
+		if len(got) != len(pages) {
+			t.Fatalf("kid %d: %d pages, had %d", i, len(got), len(pages))
+		}
+		for ptr := range got {
+			if !pages[ptr] {
+				t.Fatalf("kid %d: page %d was rewritten", i, ptr)
+			}
+		}
+	}
+	for i := 0; i < 20000; i++ {
+		key := testKey(i)
+		deleted := bytes.Compare(key, start) >= 0 && bytes.Compare(key, end) < 0 && i%2 == 0
+		if _, ok := m.tree.Lookup(key); ok == deleted {
+			t.Fatalf("key %d: found %v", i, ok)
+		}
+	}
+	if got := m.reachable(); got != len(m.pages) {
+		t.Errorf("%d pages reachable, %d allocated", got, len(m.pages))
+	}
+}
+
+func TestCompactRangeWholeTree(t *testing.T) {
+	m := loadTestTree(t, 20000, 0.5)
+	before := m.tree.Stats()
+	m.tree.CompactRange(nil, nil)
+	if err := m.tree.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	after := m.tree.Stats()
+	if after.Keys != before.Keys || after.Leaves > before.Leaves/2+1 {
+		t.Errorf("leaves %d -> %d, keys %d -> %d", before.Leaves, after.Leaves, before.Keys, after.Keys)
+	}
+	if got := m.reachable(); got != len(m.pages) {
+		t.Errorf("%d pages reachable, %d allocated", got, len(m.pages))
+	}
+}
+
+func TestBulkFixedKeys(t *testing.T) {
+	// every leaf but the leftmost, which holds the sentinel, comes out fixed-width
+	checkFixed := func(t *testing.T, m *memTree, want map[string][]byte) {
+		t.Helper()
+		m.check(t, want)
+		if err := m.tree.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		if leaves, nvar := leafWidths(m); nvar > 1 {
+			t.Errorf("%d of %d leaves with variable width keys", nvar, leaves)
+		}
+	}
+
+	keys, vals := sortedKVs(5000)
+	want := map[string][]byte{}
+	for i := range keys {
+		want[string(keys[i])] = vals[i]
+	}
+
+	t.Run("LoadSorted", func(t *testing.T) {
+		m := newMemTree(t)
+		m.tree.KeyWidth = len(testKey(0))
+		m.tree.LoadSorted(keys, vals, 1)
+		checkFixed(t, m, want)
+
+		// packed tighter than the same kvs with key lengths
+		variable := newMemTree(t)
+		variable.tree.LoadSorted(keys, vals, 1)
+		if got, was := m.tree.Stats().Leaves, variable.tree.Stats().Leaves; got >= was {
+			t.Errorf("%d leaves with fixed width keys, %d without", got, was)
+		}
+	})
+
+	t.Run("Apply", func(t *testing.T) {
+		m := newMemTree(t)
+		m.tree.KeyWidth = len(testKey(0))
+		ops := []Op{}
+		for i := range keys {
+			ops = append(ops, Op{Key: keys[i], Val: vals[i]})
+		}
+		m.tree.Apply(ops)
+		checkFixed(t, m, want)
+	})
+
+	t.Run("CompactRange", func(t *testing.T) {
+		m := newMemTree(t)
+		m.tree.KeyWidth = len(testKey(0))
+		for i := range keys {
+			m.tree.Insert(keys[i], vals[i])
+		}
+		// thin it out, so compacting has leaves to pack together
+		for i := 0; i < len(keys); i += 2 {
+			m.tree.Delete(keys[i])
+			delete(want, string(keys[i]))
+		}
+		before := m.tree.Stats()
+		m.tree.CompactRange(nil, nil)
+		checkFixed(t, m, want)
+		if after := m.tree.Stats(); after.Leaves >= before.Leaves {
+			t.Errorf("leaves %d -> %d", before.Leaves, after.Leaves)
+		}
+	})
+}
@@ -0,0 +1,122 @@
+package btree
+
+import "bytes"
+
+// an entry of a diff frontier: a subtree not read yet, or a kv of a leaf that was read
+type diffItem struct {
+	ptr    uint64 // 0 for a kv
+	height int    // of the subtree, 1 for a leaf
+	key    []byte // the kv's key, or the first key of the subtree
+	val    []byte
+}
+
+// Diff calls fn for every key whose value differs between trees a and b, in key order, until fn
+// returns false. va or vb is nil where the key is absent from that tree. Both trees must share
+// the page callbacks and the key normalization.
+//
+// The trees are walked in tandem as two frontiers of subtrees in key order, expanding them until
+// both start at the same page: a page shared by the two trees holds the same subtree in both,
+// as pages are copy-on-write, and is skipped without being read. So diffing two versions of
+// a tree costs in proportion to the pages that differ between them, not to the size of the tree.
+func Diff(a, b *BTree, fn func(key, va, vb []byte) bool) {
+	if a.Root == b.Root {
+		return
+	}
+	// the frontiers are stacks with the next item in key order on top
+	fa, fb := diffRoot(a), diffRoot(b)
+	for len(fa) > 0 || len(fb) > 0 {
+		var ta, tb *diffItem
+		if len(fa) > 0 {
+			ta = &fa[len(fa)-1]
+		}
+		if len(fb) > 0 {
+			tb = &fb[len(fb)-1]
+		}
+
+		switch {
+		case ta != nil && tb != nil && ta.ptr != 0 && ta.ptr == tb.ptr:
+			// the same subtree on both sides
+			fa, fb = fa[:len(fa)-1], fb[:len(fb)-1]
+
+		case ta != nil && ta.ptr != 0 && diffExpandFirst(a, ta, tb):
+			fa = diffExpand(a, fa)
+		case tb != nil && tb.ptr != 0 && diffExpandFirst(a, tb, ta):
+			fb = diffExpand(b, fb)
+
+		default:
+			// both tops are kvs, or a kv facing a subtree that starts after it
+			cmp := 0
+			switch {
+			case tb == nil || tb.ptr != 0:
+				cmp = -1
+			case ta == nil || ta.ptr != 0:
+				cmp = 1
+			default:
+				cmp = a.compare(ta.key, tb.key)
+			}
+
+			more := true
+			switch {
+			case cmp < 0:
+				more = fn(ta.key, ta.val, nil)
+				fa = fa[:len(fa)-1]
+			case cmp > 0:
+				more = fn(tb.key, nil, tb.val)
+				fb = fb[:len(fb)-1]
+			default:
+				if !bytes.Equal(ta.val, tb.val) {
+					more = fn(ta.key, ta.val, tb.val)
+				}
+				fa, fb = fa[:len(fa)-1], fb[:len(fb)-1]
+			}
+			if !more {
+				return
+			}
+		}
+	}
+}
+
+func diffRoot(tree *BTree) []diffItem {
+	if tree.Root == 0 {
+		return nil
+	}
+	return []diffItem{{ptr: tree.Root, height: tree.Height()}}
+}
+
+// whether the subtree top must be read before anything on the other side is decided:
+// always when it starts at or before the other top, and otherwise the taller of two subtrees
+// starting at the same key, so the two sides descend to the same level
+func diffExpandFirst(tree *BTree, top *diffItem, other *diffItem) bool {
+	if other == nil {
+		return true
+	}
+	cmp := tree.compare(top.key, other.key)
+	if other.ptr == 0 {
+		return cmp <= 0
+	}
+	return cmp < 0 || (cmp == 0 && top.height >= other.height)
+}
+
+// replace the subtree on top of the frontier with its kids or kvs
+func diffExpand(tree *BTree, stack []diffItem) []diffItem {
+	top := stack[len(stack)-1]
+	stack = stack[:len(stack)-1]
+
+	node := tree.Get(top.ptr)
+	switch node.btype() {
+	case BNODE_LEAF:
+		for i := int(node.nkeys()) - 1; i >= 0; i-- {
+			if key := node.GetKey(uint16(i)); len(key) > 0 { // not the sentinel
+				stack = append(stack, diffItem{key: key, val: node.GetVal(uint16(i))})
+			}
+		}
+	case BNODE_NODE:
+		for i := int(node.nkeys()) - 1; i >= 0; i-- {
+			kid := diffItem{ptr: node.GetPtr(uint16(i)), height: top.height - 1, key: node.GetKey(uint16(i))}
+			stack = append(stack, kid)
+		}
+	default:
+		panic("bad node!")
+	}
+	return stack
+}
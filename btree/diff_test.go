@@ -0,0 +1,94 @@
+package btree
+
+import (
+	"bytes"
+	"testing"
+)
+
+// a second version of m's tree sharing its pages, as a commit leaves it: the pages the new
+// version replaces stay for the old one
+func nextVersion(m *memTree) *BTree {
+	b := m.tree
+	b.Del = func(uint64) {}
+	return &b
+}
+
+func TestDiffReadsOnlyChangedPaths(t *testing.T) {
+	m := loadTestTree(t, 50000, 1)
+	height := m.tree.Height()
+	if height < 3 {
+		t.Fatalf("height %d, want at least 3", height)
+	}
+
+	for _, i := range []int{0, 25000, 49999} {
+		a := m.tree
+		b := nextVersion(m)
+		b.Insert(testKey(i), []byte("changed"))
+
+		reads := 0
+		get := m.tree.Get
+		a.Get = func(ptr uint64) BNode { reads++; return get(ptr) }
+		b.Get = a.Get
+
+		diffs := 0
+		Diff(&a, b, func(key, va, vb []byte) bool {
+			diffs++
+			if !bytes.Equal(key, testKey(i)) || string(vb) != "changed" || len(va) != 100 {
+				t.Errorf("diff of key %q: %q -> %q", key, va, vb)
+			}
+			return true
+		})
+		if diffs != 1 {
+			t.Errorf("key %d: %d diffs, want 1", i, diffs)
+		}
+		// the changed path on both sides, and the neighbors of each node on it
+		if reads > 6*height {
+			t.Errorf("key %d: %d pages read for a tree of height %d", i, reads, height)
+		}
+		t.Logf("key %d: %d pages read", i, reads)
+	}
+}
+
+func TestDiffSameRoot(t *testing.T) {
+	m := loadTestTree(t, 1000, 1)
+	a := m.tree
+	a.Get = func(ptr uint64) BNode {
+		t.Fatalf("read page %d", ptr)
+		return BNode{}
+	}
+	Diff(&a, &a, func(key, va, vb []byte) bool {
+		t.Errorf("diff of key %q", key)
+		return true
+	})
+}
+
+func TestDiffInsertsAndDeletes(t *testing.T) {
+	m := loadTestTree(t, 5000, 0.7)
+	a := m.tree
+	b := nextVersion(m)
+	b.Insert(testKey(10000), []byte("new"))
+	b.Delete(testKey(42))
+	b.Delete(testKey(4000))
+
+	got := []string{}
+	Diff(&a, b, func(key, va, vb []byte) bool {
+		switch {
+		case va == nil:
+			got = append(got, "+"+string(key))
+		case vb == nil:
+			got = append(got, "-"+string(key))
+		default:
+			got = append(got, "~"+string(key))
+		}
+		return true
+	})
+	want := []string{"-" + string(testKey(42)), "-" + string(testKey(4000)), "+" + string(testKey(10000))}
+	if len(got) != len(want) {
+		t.Fatalf("diffs %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("diffs %v, want %v", got, want)
+		}
+	}
+}
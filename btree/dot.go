@@ -0,0 +1,59 @@
+package btree
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// longer keys are cut in the labels
+const DOT_KEY_LEN = 16
+
+// DOT writes the node structure as a GraphViz graph: a box per node, named by its pointer and
+// listing its keys, with an edge to each kid. Reads the whole tree, meant for small ones.
+func (tree *BTree) DOT(w io.Writer) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprintln(out, "digraph btree {")
+	fmt.Fprintln(out, "\tnode [shape=box, fontname=monospace];")
+	if tree.Root != 0 {
+		dotNode(tree, out, tree.Root)
+	}
+	fmt.Fprintln(out, "}")
+	return out.Flush()
+}
+
+func dotNode(tree *BTree, out *bufio.Writer, ptr uint64) {
+	node := tree.Get(ptr)
+	keys := make([]string, node.nkeys())
+	for i := range keys {
+		keys[i] = dotKey(node.GetKey(uint16(i)))
+	}
+
+	kind := "leaf"
+	if node.btype() == BNODE_NODE {
+		kind = "node"
+	}
+	label := fmt.Sprintf("%s %d\n%s", kind, ptr, strings.Join(keys, "\n"))
+	fmt.Fprintf(out, "\tn%d [label=%s];\n", ptr, strconv.Quote(label))
+
+	if node.btype() != BNODE_NODE {
+		return
+	}
+	for i := uint16(0); i < node.nkeys(); i++ {
+		kid := node.GetPtr(i)
+		fmt.Fprintf(out, "\tn%d -> n%d;\n", ptr, kid)
+		dotNode(tree, out, kid)
+	}
+}
+
+func dotKey(key []byte) string {
+	if len(key) == 0 {
+		return "(sentinel)"
+	}
+	if len(key) > DOT_KEY_LEN {
+		return strconv.QuoteToASCII(string(key[:DOT_KEY_LEN])) + "..."
+	}
+	return strconv.QuoteToASCII(string(key))
+}
@@ -0,0 +1,73 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func mustDOT(t *testing.T, tree *BTree) string {
+	t.Helper()
+	var out bytes.Buffer
+	if err := tree.DOT(&out); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestDOT(t *testing.T) {
+	m := loadTestTree(t, 1000, 1)
+	if m.tree.Height() < 2 {
+		t.Fatalf("height %d, want internal nodes", m.tree.Height())
+	}
+	dot := mustDOT(t, &m.tree)
+	if !strings.HasPrefix(dot, "digraph btree {\n") || !strings.HasSuffix(dot, "}\n") {
+		t.Fatalf("not a digraph:\n%s", dot)
+	}
+
+	// a box per page, and an edge to every page but the root
+	for ptr := range m.pages {
+		if !strings.Contains(dot, fmt.Sprintf("\tn%d [label=", ptr)) {
+			t.Fatalf("no box for page %d", ptr)
+		}
+		if ptr != m.tree.Root && !strings.Contains(dot, fmt.Sprintf(" -> n%d;\n", ptr)) {
+			t.Fatalf("no edge to page %d", ptr)
+		}
+	}
+	if boxes := strings.Count(dot, "[label="); boxes != len(m.pages) {
+		t.Fatalf("%d boxes for %d pages", boxes, len(m.pages))
+	}
+	if edges := strings.Count(dot, " -> "); edges != len(m.pages)-1 {
+		t.Fatalf("%d edges for %d pages", edges, len(m.pages))
+	}
+	root := fmt.Sprintf("\tn%d [label=\"node %d\\n(sentinel)", m.tree.Root, m.tree.Root)
+	if !strings.Contains(dot, root) {
+		t.Fatalf("no root box starting with %q", root)
+	}
+	if !strings.Contains(dot, `\"key000999\"`) {
+		t.Fatal("the last key is in no label")
+	}
+}
+
+func TestDOTLongKey(t *testing.T) {
+	m := newMemTree(t)
+	long := strings.Repeat("k", DOT_KEY_LEN) + "tail"
+	m.tree.Insert([]byte(long), []byte("v"))
+	m.tree.Insert([]byte("short"), []byte("v"))
+
+	dot := mustDOT(t, &m.tree)
+	if !strings.Contains(dot, `\"`+long[:DOT_KEY_LEN]+`\"...`) || strings.Contains(dot, "tail") {
+		t.Fatalf("long key not cut:\n%s", dot)
+	}
+	if !strings.Contains(dot, `\"short\"`) {
+		t.Fatalf("short key missing:\n%s", dot)
+	}
+}
+
+func TestDOTEmpty(t *testing.T) {
+	m := newMemTree(t)
+	if dot, want := mustDOT(t, &m.tree), "digraph btree {\n\tnode [shape=box, fontname=monospace];\n}\n"; dot != want {
+		t.Fatalf("DOT of an empty tree:\n%s", dot)
+	}
+}
@@ -0,0 +1,156 @@
+package btree
+
+// Iter walks the keys in order while holding only the current leaf, not the path from the root.
+// When the leaf is used up it descends again from the root with the last key,
+// which costs a lookup per leaf but keeps memory constant regardless of the tree height.
+type Iter struct {
+	tree *BTree
+	leaf BNode
+	idx  uint16
+	last []byte // the last key returned, owned by the iterator
+}
+
+// SeekIter positions a new Iter at the first key >= key.
+func (tree *BTree) SeekIter(key []byte) *Iter {
+	iter := &Iter{tree: tree}
+	iter.seek(key, false)
+	return iter
+}
+
+// Next returns the current key and value and advances. ok is false at the end.
+func (iter *Iter) Next() (key []byte, val []byte, ok bool) {
+	if !iter.valid() {
+		if iter.last == nil {
+			return nil, nil, false // never found anything
+		}
+		iter.seek(iter.last, true)
+		if !iter.valid() {
+			return nil, nil, false
+		}
+	}
+
+	key, val = iter.leaf.GetKey(iter.idx), iter.leaf.GetVal(iter.idx)
+	iter.last = append(iter.last[:0], key...)
+	iter.idx++
+	return key, val, true
+}
+
+func (iter *Iter) valid() bool {
+	return len(iter.leaf.Data) > 0 && iter.idx < iter.leaf.nkeys()
+}
+
+// position at the first key >= key, or > key if strict
+func (iter *Iter) seek(key []byte, strict bool) {
+	iter.leaf, iter.idx = BNode{}, 0
+	if iter.tree.Root == 0 {
+		return
+	}
+	if leaf, idx, ok := seekLeaf(iter.tree, iter.tree.Get(iter.tree.Root), iter.tree.norm(key), strict); ok {
+		iter.leaf, iter.idx = leaf, idx
+	}
+}
+
+// the key is normalized by norm
+func seekLeaf(tree *BTree, node BNode, normKey []byte, strict bool) (BNode, uint16, bool) {
+	idx := lookupNorm(tree, node, normKey)
+
+	switch node.btype() {
+	case BNODE_LEAF:
+		for i := idx; i < node.nkeys(); i++ {
+			k := node.GetKey(i)
+			if len(k) == 0 {
+				continue // the sentinel
+			}
+			if cmp := tree.compareNorm(k, normKey); cmp > 0 || (cmp == 0 && !strict) {
+				return node, i, true
+			}
+		}
+
+	case BNODE_NODE:
+		// the key may be past the end of kid idx, then the answer is in the next one
+		for i := idx; i < node.nkeys(); i++ {
+			if leaf, j, ok := seekLeaf(tree, tree.Get(node.GetPtr(i)), normKey, strict); ok {
+				return leaf, j, true
+			}
+		}
+
+	default:
+		panic("bad node!")
+	}
+
+	return BNode{}, 0, false
+}
+
+// Cursor walks the keys in order holding the path from the root, so moving to the next leaf
+// only reads the pages that change instead of descending again like Iter.
+// The order is the tree's, i.e. bytes.Compare after Normalize.
+type Cursor struct {
+	tree  *BTree
+	stack []cursorFrame // from the root to the current leaf
+}
+
+type cursorFrame struct {
+	node BNode
+	idx  uint16 // the current key in a leaf, the current kid in an internal node
+}
+
+// Seek positions a new Cursor at the first key >= key.
+func (tree *BTree) Seek(key []byte) *Cursor {
+	cur := &Cursor{tree: tree}
+	if tree.Root == 0 {
+		return cur
+	}
+
+	normKey := tree.norm(key)
+	node := tree.Get(tree.Root)
+	for {
+		idx := lookupNorm(tree, node, normKey)
+		if node.btype() == BNODE_LEAF {
+			if tree.compareNorm(node.GetKey(idx), normKey) < 0 {
+				idx++ // the key isn't there, start at the next one
+			}
+			cur.stack = append(cur.stack, cursorFrame{node, idx})
+			return cur
+		}
+		cur.stack = append(cur.stack, cursorFrame{node, idx})
+		node = tree.Get(node.GetPtr(idx))
+	}
+}
+
+// Next returns the current key and value and advances. ok is false at the end.
+// The sentinel is never returned.
+func (cur *Cursor) Next() (key []byte, val []byte, ok bool) {
+	for cur.settle() {
+		top := &cur.stack[len(cur.stack)-1]
+		key, val = top.node.GetKey(top.idx), top.node.GetVal(top.idx)
+		top.idx++
+		if len(key) > 0 {
+			return key, val, true
+		}
+	}
+	return nil, nil, false
+}
+
+// move past a used up leaf to the first key of the next one. false at the end
+func (cur *Cursor) settle() bool {
+	for len(cur.stack) > 0 {
+		top := &cur.stack[len(cur.stack)-1]
+		if top.idx < top.node.nkeys() {
+			break
+		}
+		// go up to the first level that has another kid
+		cur.stack = cur.stack[:len(cur.stack)-1]
+		if len(cur.stack) > 0 {
+			cur.stack[len(cur.stack)-1].idx++
+		}
+	}
+	if len(cur.stack) == 0 {
+		return false
+	}
+
+	// then down its leftmost path
+	for top := cur.stack[len(cur.stack)-1]; top.node.btype() == BNODE_NODE; top = cur.stack[len(cur.stack)-1] {
+		cur.stack = append(cur.stack, cursorFrame{cur.tree.Get(top.node.GetPtr(top.idx)), 0})
+	}
+	return true
+}
@@ -0,0 +1,192 @@
+package btree
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// the kvs from key on, walked with next
+func walkFrom(next func() ([]byte, []byte, bool)) [][2]string {
+	kvs := [][2]string{}
+	for {
+		k, v, ok := next()
+		if !ok {
+			return kvs
+		}
+		kvs = append(kvs, [2]string{string(k), string(v)})
+	}
+}
+
+func checkCursorMatchesIter(t *testing.T, tree *BTree, seeks [][]byte) {
+	t.Helper()
+	for _, key := range seeks {
+		want := walkFrom(tree.SeekIter(key).Next)
+		got := walkFrom(tree.Seek(key).Next)
+		if len(got) != len(want) {
+			t.Fatalf("seek %q: cursor found %d kvs, iter %d", key, len(got), len(want))
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("seek %q: kv %d is %q, iter has %q", key, i, got[i], want[i])
+			}
+		}
+	}
+}
+
+// a tree of the even keys below 2n, over several leaves
+func evenKeyTree(t *testing.T, n int) *memTree {
+	m := newMemTree(t)
+	for _, i := range rand.New(rand.NewSource(1)).Perm(n) {
+		m.tree.Insert(testKey(2*i), testKey(i))
+	}
+	return m
+}
+
+func TestIterSeekMissingKey(t *testing.T) {
+	m := evenKeyTree(t, 2000)
+	for _, c := range []struct {
+		seek  []byte
+		first int // the index of the first key found, -1 for none
+	}{
+		{testKey(0), 0},
+		{testKey(1), 1},      // between two keys
+		{testKey(1001), 501}, // likewise, deeper in the tree
+		{[]byte("key"), 0},   // before every key
+		{testKey(3998), 1999},
+		{testKey(3999), -1}, // past the last key
+		{[]byte("zzz"), -1},
+	} {
+		k, v, ok := m.tree.SeekIter(c.seek).Next()
+		if c.first < 0 {
+			if ok {
+				t.Errorf("seek %q found %q past the last key", c.seek, k)
+			}
+			continue
+		}
+		if !ok || !bytes.Equal(k, testKey(2*c.first)) || !bytes.Equal(v, testKey(c.first)) {
+			t.Errorf("seek %q found %q %q %v, want %q", c.seek, k, v, ok, testKey(2*c.first))
+		}
+	}
+}
+
+func TestIterSkipsSentinel(t *testing.T) {
+	m := evenKeyTree(t, 2000)
+	// the empty key sorts before everything and sits in the leftmost leaf
+	for _, seek := range [][]byte{nil, {}} {
+		k, _, ok := m.tree.SeekIter(seek).Next()
+		if !ok || !bytes.Equal(k, testKey(0)) {
+			t.Errorf("seek %q found %q %v, want the first key", seek, k, ok)
+		}
+	}
+
+	empty := newMemTree(t)
+	if k, _, ok := empty.tree.SeekIter(nil).Next(); ok {
+		t.Fatalf("iter on an empty tree found %q", k)
+	}
+	// only the sentinel is left
+	empty.tree.Insert([]byte("k"), []byte("v"))
+	empty.tree.Delete([]byte("k"))
+	if k, _, ok := empty.tree.SeekIter(nil).Next(); ok {
+		t.Fatalf("iter on an emptied tree found %q", k)
+	}
+}
+
+func TestIterCrossesLeaves(t *testing.T) {
+	m := evenKeyTree(t, 2000)
+	if m.tree.Height() < 2 {
+		t.Fatal("a single leaf")
+	}
+
+	// from the middle of a leaf, through every leaf boundary to the end
+	iter := m.tree.SeekIter(testKey(1001))
+	leaves := 0
+	var leaf *byte
+	for i := 501; ; i++ {
+		k, _, ok := iter.Next()
+		if i == 2000 {
+			if ok {
+				t.Fatalf("found %q past the last key", k)
+			}
+			break
+		}
+		if !ok || !bytes.Equal(k, testKey(2*i)) {
+			t.Fatalf("key %d is %q %v, want %q", i-501, k, ok, testKey(2*i))
+		}
+		if &iter.leaf.Data[0] != leaf {
+			leaf = &iter.leaf.Data[0]
+			leaves++
+		}
+	}
+	if leaves < 2 {
+		t.Fatalf("walked %d leaves", leaves)
+	}
+	// used up iterators stay at the end
+	if k, _, ok := iter.Next(); ok {
+		t.Fatalf("found %q after the end", k)
+	}
+}
+
+func TestCursorMatchesIter(t *testing.T) {
+	m := newMemTree(t)
+	rng := rand.New(rand.NewSource(1))
+	for _, i := range rng.Perm(5000) {
+		m.tree.Insert(testKey(2*i), bytes.Repeat([]byte{byte(i)}, 1+rng.Intn(200)))
+	}
+	// holes, including whole leaves
+	for i := 1000; i < 1400; i++ {
+		m.tree.Delete(testKey(2 * i))
+	}
+	for _, i := range rng.Perm(5000)[:500] {
+		m.tree.Delete(testKey(2 * i))
+	}
+	if m.tree.Height() < 3 {
+		t.Fatalf("height %d, want at least 3", m.tree.Height())
+	}
+
+	seeks := [][]byte{nil, {}, testKey(0), testKey(2000), testKey(2801), testKey(9998), testKey(9999), []byte("zzz")}
+	for i := 0; i < 50; i++ {
+		seeks = append(seeks, testKey(rng.Intn(10000))) // present, deleted or between two keys
+	}
+	checkCursorMatchesIter(t, &m.tree, seeks)
+}
+
+func TestCursorNormalized(t *testing.T) {
+	m := newMemTree(t)
+	m.tree.Normalize = bytes.ToLower
+	for i := 0; i < 2000; i++ {
+		m.tree.Insert(bytes.ToUpper(testKey(i)), []byte("v"))
+	}
+	checkCursorMatchesIter(t, &m.tree, [][]byte{nil, testKey(500), bytes.ToUpper(testKey(500)), []byte("KEY0010")})
+}
+
+func TestCursorEmpty(t *testing.T) {
+	m := newMemTree(t)
+	if k, _, ok := m.tree.Seek(nil).Next(); ok {
+		t.Fatalf("cursor on an empty tree found %q", k)
+	}
+	// only the sentinel is left
+	m.tree.Insert([]byte("k"), []byte("v"))
+	m.tree.Delete([]byte("k"))
+	if k, _, ok := m.tree.Seek(nil).Next(); ok {
+		t.Fatalf("cursor on an emptied tree found %q", k)
+	}
+}
+
+// the cursor reads each page once, the iterator descends again from the root for every leaf
+func TestCursorReads(t *testing.T) {
+	m := loadTestTree(t, 20000, 1)
+	reads := 0
+	get := m.tree.Get
+	m.tree.Get = func(ptr uint64) BNode { reads++; return get(ptr) }
+
+	walkFrom(m.tree.Seek(nil).Next)
+	if reads != len(m.pages) {
+		t.Fatalf("cursor read %d pages of %d", reads, len(m.pages))
+	}
+	reads = 0
+	walkFrom(m.tree.SeekIter(nil).Next)
+	if reads <= len(m.pages) {
+		t.Fatalf("iter read %d pages of %d", reads, len(m.pages))
+	}
+}
@@ -0,0 +1,100 @@
+package btree
+
+import "fmt"
+
+// reads for damaged trees: every page is checked before it's used, and a bad page (a pointer
+// out of the file, a wrong type, bad offsets) is reported and its subtree skipped
+// instead of panicking half way through.
+
+// read a page, a Get that panics (e.g. on a pointer out of the file) is returned as an error
+func (tree *BTree) tryGet(ptr uint64) (node BNode, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return tree.Get(ptr), nil
+}
+
+// read a page and check that it decodes as a node
+func (tree *BTree) safeGet(ptr uint64) (BNode, error) {
+	node, err := tree.tryGet(ptr)
+	if err != nil {
+		return BNode{}, fmt.Errorf("page %d: %w", ptr, err)
+	}
+	if t := node.btype(); t != BNODE_LEAF && t != BNODE_NODE {
+		return BNode{}, fmt.Errorf("page %d: bad node type %d", ptr, t)
+	}
+	if node.nkeys() == 0 {
+		return BNode{}, fmt.Errorf("page %d: empty node", ptr)
+	}
+	if err := node.verifyOffsets(); err != nil {
+		return BNode{}, fmt.Errorf("page %d: %w", ptr, err)
+	}
+	return node, nil
+}
+
+// ScanBestEffort is Scan for a possibly damaged tree: a bad page is passed to onErr and the keys
+// under it are skipped, the scan goes on with the rest.
+func (tree *BTree) ScanBestEffort(start []byte, fn func(key []byte, val []byte) bool, onErr func(ptr uint64, err error)) {
+	if tree.Root == 0 {
+		return
+	}
+	treeScanBestEffort(tree, tree.Root, start, fn, onErr)
+}
+
+func treeScanBestEffort(tree *BTree, ptr uint64, start []byte,
+	fn func(key []byte, val []byte) bool, onErr func(ptr uint64, err error)) bool {
+	node, err := tree.safeGet(ptr)
+	if err != nil {
+		onErr(ptr, err)
+		return true
+	}
+	idx := noDelookupLE(tree, node, start)
+
+	if node.btype() == BNODE_LEAF {
+		for i := idx; i < node.nkeys(); i++ {
+			key := node.GetKey(i)
+			if len(key) == 0 || tree.compare(key, start) < 0 {
+				continue
+			}
+			if !fn(key, node.GetVal(i)) {
+				return false
+			}
+		}
+		return true
+	}
+
+	for i := idx; i < node.nkeys(); i++ {
+		if !treeScanBestEffort(tree, node.GetPtr(i), start, fn, onErr) {
+			return false
+		}
+	}
+	return true
+}
+
+// LookupBestEffort is Lookup for a possibly damaged tree, returns an error when the path to
+// the key goes through a bad page.
+func (tree *BTree) LookupBestEffort(key []byte) ([]byte, bool, error) {
+	if tree.Root == 0 || len(key) == 0 {
+		return nil, false, nil
+	}
+
+	normKey := tree.norm(key)
+	ptr := tree.Root
+	for {
+		node, err := tree.safeGet(ptr)
+		if err != nil {
+			return nil, false, err
+		}
+		idx := lookupNorm(tree, node, normKey)
+
+		if node.btype() == BNODE_LEAF {
+			if tree.compareNorm(node.GetKey(idx), normKey) == 0 {
+				return node.GetVal(idx), true, nil
+			}
+			return nil, false, nil
+		}
+		ptr = node.GetPtr(idx)
+	}
+}
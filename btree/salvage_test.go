@@ -0,0 +1,40 @@
+package btree
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestScanBestEffort(t *testing.T) {
+	m := newMemTree(t)
+	for i := 0; i < 2000; i++ {
+		m.tree.Insert(testKey(i), bytes.Repeat([]byte{'v'}, 50))
+	}
+	// a leaf with bad offsets
+	leaf, _, _ := m.tree.Locate(testKey(1000))
+	bad := BNode{Data: append([]byte(nil), m.pages[leaf].Data...)}
+	bad.setOffset(1, 0xffff)
+	m.pages[leaf] = bad
+
+	nerr := 0
+	n := 0
+	m.tree.ScanBestEffort(nil, func(key, val []byte) bool {
+		n++
+		return true
+	}, func(ptr uint64, err error) {
+		if ptr != leaf {
+			t.Fatalf("error on page %d, the damaged one is %d: %v", ptr, leaf, err)
+		}
+		nerr++
+	})
+	if nerr != 1 || n == 0 || n >= 2000 {
+		t.Fatalf("%d keys scanned, %d errors", n, nerr)
+	}
+
+	if _, _, err := m.tree.LookupBestEffort(testKey(1000)); err == nil {
+		t.Fatal("lookup through the damaged leaf succeeded")
+	}
+	if val, ok, err := m.tree.LookupBestEffort(testKey(0)); err != nil || !ok || len(val) != 50 {
+		t.Fatalf("lookup of an intact key: %q %v %v", val, ok, err)
+	}
+}
@@ -0,0 +1,226 @@
+package btree
+
+import "slices"
+
+// Scan calls fn for every key >= start in sorted order until fn returns false.
+// A nil start scans from the first key.
+func (tree *BTree) Scan(start []byte, fn func(key []byte, val []byte) bool) {
+	tree.ScanLeaves(start, func(leaf uint64, key []byte, val []byte) bool {
+		return fn(key, val)
+	})
+}
+
+// ScanLeaves is Scan that also passes the pointer of the leaf each kv is stored in.
+// consecutive kvs with the same leaf come from the same page, a new pointer means a page boundary.
+func (tree *BTree) ScanLeaves(start []byte, fn func(leaf uint64, key []byte, val []byte) bool) {
+	if tree.Root == 0 {
+		return
+	}
+	treeScan(tree, tree.Root, start, fn)
+}
+
+// in-order walk of the subtree, returns false once fn asked to stop
+func treeScan(tree *BTree, ptr uint64, start []byte, fn func(leaf uint64, key []byte, val []byte) bool) bool {
+	node := tree.Get(ptr)
+	idx := noDelookupLE(tree, node, start)
+
+	switch node.btype() {
+	case BNODE_LEAF:
+		for i := idx; i < node.nkeys(); i++ {
+			key := node.GetKey(i)
+			// skip the empty sentinel key and anything before the start
+			if len(key) == 0 || tree.compare(key, start) < 0 {
+				continue
+			}
+			if !fn(ptr, key, node.GetVal(i)) {
+				return false
+			}
+		}
+
+	case BNODE_NODE:
+		for i := idx; i < node.nkeys(); i++ {
+			if !treeScan(tree, node.GetPtr(i), start, fn) {
+				return false
+			}
+		}
+
+	default:
+		panic("bad node!")
+	}
+
+	return true
+}
+
+// Lookup returns the value stored under key.
+func (tree *BTree) Lookup(key []byte) ([]byte, bool) {
+	if tree.Root == 0 || len(key) == 0 {
+		return nil, false // the empty key would match the sentinel
+	}
+
+	normKey := tree.norm(key)
+	node := tree.Get(tree.Root)
+	for {
+		idx := lookupNorm(tree, node, normKey)
+
+		switch node.btype() {
+		case BNODE_LEAF:
+			if tree.compareNorm(node.GetKey(idx), normKey) == 0 {
+				return node.GetVal(idx), true
+			}
+			return nil, false
+
+		case BNODE_NODE:
+			node = tree.Get(node.GetPtr(idx))
+
+		default:
+			panic("bad node!")
+		}
+	}
+}
+
+// Locate returns the leaf page holding key and its index there.
+// If the key is absent, idx is where an insert would put it.
+func (tree *BTree) Locate(key []byte) (leafPtr uint64, idx uint16, found bool) {
+	if tree.Root == 0 {
+		return 0, 0, false
+	}
+
+	normKey := tree.norm(key)
+	ptr := tree.Root
+	for {
+		node := tree.Get(ptr)
+		idx := lookupNorm(tree, node, normKey)
+
+		switch node.btype() {
+		case BNODE_LEAF:
+			if len(key) > 0 && tree.compareNorm(node.GetKey(idx), normKey) == 0 {
+				return ptr, idx, true
+			}
+			return ptr, idx + 1, false
+
+		case BNODE_NODE:
+			ptr = node.GetPtr(idx)
+
+		default:
+			panic("bad node!")
+		}
+	}
+}
+
+// RangePages calls fn with the pointer of every page (internal nodes and leaves) that
+// holds keys in [start, end). A nil end means no upper bound. The leaves are passed to fn
+// without being read: the height is taken from the path of start, so the only leaf read
+// is the first one of the range.
+func (tree *BTree) RangePages(start []byte, end []byte, fn func(ptr uint64)) {
+	if tree.Root == 0 {
+		return
+	}
+
+	height := 1
+	for node := tree.Get(tree.Root); node.btype() == BNODE_NODE; height++ {
+		node = tree.Get(node.GetPtr(noDelookupLE(tree, node, start)))
+	}
+	treeRangePages(tree, tree.Root, height, start, end, fn)
+}
+
+func treeRangePages(tree *BTree, ptr uint64, height int, start []byte, end []byte, fn func(ptr uint64)) {
+	fn(ptr)
+	if height == 1 {
+		return
+	}
+	node := tree.Get(ptr)
+	if node.btype() != BNODE_NODE {
+		return
+	}
+
+	for i := noDelookupLE(tree, node, start); i < node.nkeys(); i++ {
+		if end != nil && i > 0 && tree.compare(node.GetKey(i), end) >= 0 {
+			break // this kid and the rest start at or after the end
+		}
+		treeRangePages(tree, node.GetPtr(i), height-1, start, end, fn)
+	}
+}
+
+// Separators returns the first keys of the subtrees of the shallowest level with at least n of them,
+// in key order and without the sentinel. Each one starts a subtree of similar size, so they make
+// cheap boundaries for splitting the keyspace. On a small tree the leaf keys themselves are returned.
+func (tree *BTree) Separators(n int) [][]byte {
+	if tree.Root == 0 {
+		return nil
+	}
+
+	level := []BNode{tree.Get(tree.Root)}
+	for {
+		keys := [][]byte{}
+		for _, node := range level {
+			for i := uint16(0); i < node.nkeys(); i++ {
+				if key := node.GetKey(i); len(key) > 0 {
+					keys = append(keys, key)
+				}
+			}
+		}
+		if len(keys) >= n || level[0].btype() == BNODE_LEAF {
+			return keys
+		}
+
+		kids := []BNode{}
+		for _, node := range level {
+			for i := uint16(0); i < node.nkeys(); i++ {
+				kids = append(kids, tree.Get(node.GetPtr(i)))
+			}
+		}
+		level = kids
+	}
+}
+
+// LeafPages returns the pointers of all the leaves, in key order. Only the internal nodes are read:
+// the tree is balanced, so the height is taken from the leftmost path and the level above the
+// leaves is known without touching the leaves themselves.
+func (tree *BTree) LeafPages() []uint64 {
+	if tree.Root == 0 {
+		return nil
+	}
+
+	leaves := []uint64{}
+	treeLeafPages(tree, tree.Root, tree.Height(), &leaves)
+	return leaves
+}
+
+func treeLeafPages(tree *BTree, ptr uint64, height int, leaves *[]uint64) {
+	if height == 1 {
+		*leaves = append(*leaves, ptr)
+		return
+	}
+
+	node := tree.Get(ptr)
+	if node.btype() != BNODE_NODE {
+		panic("bad node!")
+	}
+	for i := uint16(0); i < node.nkeys(); i++ {
+		treeLeafPages(tree, node.GetPtr(i), height-1, leaves)
+	}
+}
+
+// ScanUnordered calls fn for every key until fn returns false, visiting the leaves by page number
+// instead of in key order. The internal nodes are walked first to find the live leaves,
+// as freed pages may still hold old kvs.
+func (tree *BTree) ScanUnordered(fn func(key []byte, val []byte) bool) {
+	leaves := tree.LeafPages()
+	slices.Sort(leaves)
+
+	for _, ptr := range leaves {
+		node := tree.Get(ptr)
+		if node.btype() != BNODE_LEAF {
+			panic("bad node!")
+		}
+		for i := uint16(0); i < node.nkeys(); i++ {
+			key := node.GetKey(i)
+			if len(key) == 0 {
+				continue // the sentinel
+			}
+			if !fn(key, node.GetVal(i)) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package btree
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+)
+
+func TestLocate(t *testing.T) {
+	m := newMemTree(t)
+	if ptr, _, found := m.tree.Locate(testKey(1)); ptr != 0 || found {
+		t.Fatalf("Locate in an empty tree = %d %v", ptr, found)
+	}
+
+	// the even keys only
+	for i := 0; i < 2000; i += 2 {
+		m.tree.Insert(testKey(i), bytes.Repeat([]byte{'v'}, 50))
+	}
+	for i := 0; i < 2000; i++ {
+		key := testKey(i)
+		ptr, idx, found := m.tree.Locate(key)
+		leaf := m.pages[ptr]
+		if leaf.btype() != BNODE_LEAF {
+			t.Fatalf("key %d: page %d is not a leaf", i, ptr)
+		}
+		if found != (i%2 == 0) {
+			t.Fatalf("key %d: found %v", i, found)
+		}
+		if found {
+			if !bytes.Equal(leaf.GetKey(idx), key) {
+				t.Fatalf("key %d: %q at index %d", i, leaf.GetKey(idx), idx)
+			}
+			continue
+		}
+		// an insert goes between the keys around idx
+		if bytes.Compare(leaf.GetKey(idx-1), key) >= 0 || (idx < leaf.nkeys() && bytes.Compare(leaf.GetKey(idx), key) <= 0) {
+			t.Fatalf("key %d: index %d of %d is not its place", i, idx, leaf.nkeys())
+		}
+	}
+}
+
+// a lookup normalizes its key once, not at every comparison on the way down
+func TestLookupNormalizesKeyOnce(t *testing.T) {
+	m := loadTestTree(t, 20000, 1)
+	if h := m.tree.Stats().Height; h < 3 {
+		t.Fatalf("height %d", h)
+	}
+	search := bytes.ToUpper(testKey(12345))
+	calls := 0
+	m.tree.Normalize = func(key []byte) []byte {
+		if bytes.Equal(key, search) {
+			calls++
+		}
+		return bytes.ToLower(key)
+	}
+
+	for name, lookup := range map[string]func() bool{
+		"Lookup": func() bool { _, ok := m.tree.Lookup(search); return ok },
+		"Locate": func() bool { _, _, ok := m.tree.Locate(search); return ok },
+		"LookupBestEffort": func() bool {
+			_, ok, err := m.tree.LookupBestEffort(search)
+			return ok && err == nil
+		},
+		"Seek": func() bool {
+			k, _, ok := m.tree.Seek(search).Next()
+			return ok && bytes.Equal(k, testKey(12345))
+		},
+		"SeekIter": func() bool {
+			k, _, ok := m.tree.SeekIter(search).Next()
+			return ok && bytes.Equal(k, testKey(12345))
+		},
+	} {
+		calls = 0
+		if !lookup() {
+			t.Errorf("%s: %q not found", name, search)
+		}
+		if calls != 1 {
+			t.Errorf("%s normalized the key %d times", name, calls)
+		}
+	}
+}
+
+func TestRangePages(t *testing.T) {
+	m := newMemTree(t)
+	m.tree.RangePages(nil, nil, func(ptr uint64) { t.Fatal("a page of an empty tree") })
+
+	// the even keys only
+	for i := 0; i < 4000; i += 2 {
+		m.tree.Insert(testKey(i), bytes.Repeat([]byte{'v'}, 50))
+	}
+	for _, r := range [][2]int{{0, 4000}, {101, 102}, {1000, 1500}, {3999, 5000}, {500, 500}} {
+		start, end := testKey(r[0]), testKey(r[1])
+		leaves := map[uint64]bool{}
+		nodes := 0
+		// the leaves are not read, except the first one of the range for the height
+		get, leafReads := m.tree.Get, 0
+		m.tree.Get = func(ptr uint64) BNode {
+			node := get(ptr)
+			if node.btype() == BNODE_LEAF {
+				leafReads++
+			}
+			return node
+		}
+		m.tree.RangePages(start, end, func(ptr uint64) {
+			if m.pages[ptr].btype() == BNODE_LEAF {
+				leaves[ptr] = true
+			} else {
+				nodes++
+			}
+		})
+		m.tree.Get = get
+		if leafReads != 1 {
+			t.Fatalf("range %v: %d leaves read", r, leafReads)
+		}
+
+		// the leaf where the scan starts, and those of the keys in the range
+		want := map[uint64]bool{}
+		ptr, _, _ := m.tree.Locate(start)
+		want[ptr] = true
+		for i := r[0]; i < r[1]; i++ {
+			if ptr, _, found := m.tree.Locate(testKey(i)); found {
+				want[ptr] = true
+			}
+		}
+		if len(leaves) != len(want) {
+			t.Fatalf("range %v: %d leaves, want %d", r, len(leaves), len(want))
+		}
+		for ptr := range want {
+			if !leaves[ptr] {
+				t.Fatalf("range %v: leaf %d missing", r, ptr)
+			}
+		}
+		if nodes == 0 {
+			t.Fatalf("range %v: no internal node", r)
+		}
+	}
+}
+
+func TestScanLeaves(t *testing.T) {
+	m := newMemTree(t)
+	for i := 0; i < 2000; i++ {
+		m.tree.Insert(testKey(i), bytes.Repeat([]byte{'v'}, 50))
+	}
+
+	// every kv comes with the leaf Locate finds it in, and a leaf is never revisited
+	seen := map[uint64]bool{}
+	var prev uint64
+	n := 0
+	m.tree.ScanLeaves(testKey(100), func(leaf uint64, key, val []byte) bool {
+		if ptr, _, found := m.tree.Locate(key); !found || ptr != leaf {
+			t.Fatalf("key %q: leaf %d, Locate finds %d %v", key, leaf, ptr, found)
+		}
+		if leaf != prev {
+			if seen[leaf] {
+				t.Fatalf("leaf %d revisited", leaf)
+			}
+			seen[leaf], prev = true, leaf
+		}
+		n++
+		return true
+	})
+	if n != 1900 || len(seen) < 2 {
+		t.Fatalf("%d kvs over %d leaves", n, len(seen))
+	}
+}
+
+func TestScanUnordered(t *testing.T) {
+	m := newMemTree(t)
+	m.tree.ScanUnordered(func(key, val []byte) bool {
+		t.Fatal("a key in an empty tree")
+		return false
+	})
+
+	for i := 0; i < 3000; i++ {
+		m.tree.Insert(testKey(i), bytes.Repeat([]byte{'v'}, 50))
+	}
+	for i := 0; i < 3000; i += 3 {
+		m.tree.Delete(testKey(i))
+	}
+
+	// the leaves in key order, as Scan finds them
+	want := []uint64{}
+	m.tree.ScanLeaves(nil, func(leaf uint64, key, val []byte) bool {
+		if len(want) == 0 || want[len(want)-1] != leaf {
+			want = append(want, leaf)
+		}
+		return true
+	})
+	if got := m.tree.LeafPages(); !slices.Equal(got, want) {
+		t.Fatalf("LeafPages = %v, want %v", got, want)
+	}
+
+	// every live key once, the leaves in page order
+	seen := map[string]bool{}
+	var prev uint64
+	m.tree.ScanUnordered(func(key, val []byte) bool {
+		if seen[string(key)] {
+			t.Fatalf("key %q visited twice", key)
+		}
+		seen[string(key)] = true
+		leaf, _, _ := m.tree.Locate(key)
+		if leaf < prev {
+			t.Fatalf("leaf %d after leaf %d", leaf, prev)
+		}
+		prev = leaf
+		return true
+	})
+	if len(seen) != 2000 {
+		t.Fatalf("%d keys visited, want 2000", len(seen))
+	}
+}
@@ -0,0 +1,87 @@
+package btree
+
+// Stats describes the shape of the tree.
+type Stats struct {
+	Height int // levels, 0 for an empty tree
+	Nodes  int // internal nodes
+	Leaves int
+	Keys   int // real keys, the sentinel is not counted
+	Bytes  int // sum of the node sizes
+}
+
+// LeafFanout is the average number of keys per leaf.
+func (s Stats) LeafFanout() float64 {
+	if s.Leaves == 0 {
+		return 0
+	}
+	return float64(s.Keys) / float64(s.Leaves)
+}
+
+// Height is the number of levels, 0 for an empty tree. The tree is balanced, so only
+// the leftmost path is read.
+func (tree *BTree) Height() int {
+	if tree.Root == 0 {
+		return 0
+	}
+	height := 1
+	for node := tree.Get(tree.Root); node.btype() == BNODE_NODE; node = tree.Get(node.GetPtr(0)) {
+		height++
+	}
+	return height
+}
+
+// Stats walks the whole tree.
+func (tree *BTree) Stats() Stats {
+	stats := Stats{}
+	if tree.Root != 0 {
+		treeStats(tree, tree.Get(tree.Root), 1, &stats)
+	}
+	return stats
+}
+
+func treeStats(tree *BTree, node BNode, depth int, stats *Stats) {
+	stats.Height = max(stats.Height, depth)
+	stats.Bytes += int(node.nbytes())
+
+	switch node.btype() {
+	case BNODE_LEAF:
+		stats.Leaves++
+		for i := uint16(0); i < node.nkeys(); i++ {
+			if len(node.GetKey(i)) > 0 {
+				stats.Keys++
+			}
+		}
+
+	case BNODE_NODE:
+		stats.Nodes++
+		for i := uint16(0); i < node.nkeys(); i++ {
+			treeStats(tree, tree.Get(node.GetPtr(i)), depth+1, stats)
+		}
+
+	default:
+		panic("bad node!")
+	}
+}
+
+// RangeBytes is the leaf space taken by the kvs in [start, end): each kv's pointer, offset,
+// lengths, key and value. A nil end means no upper bound. Only the leaves overlapping the range are read.
+func (tree *BTree) RangeBytes(start []byte, end []byte) int {
+	total := 0
+	tree.RangePages(start, end, func(ptr uint64) {
+		node := tree.Get(ptr)
+		if node.btype() != BNODE_LEAF {
+			return
+		}
+		for i := uint16(0); i < node.nkeys(); i++ {
+			key := node.GetKey(i)
+			if len(key) == 0 || tree.compare(key, start) < 0 {
+				continue
+			}
+			if end != nil && tree.compare(key, end) >= 0 {
+				break
+			}
+			total += 8 + 2 + int(node.GetOffset(i+1)-node.GetOffset(i))
+		}
+	})
+	return total
+}
@@ -0,0 +1,74 @@
+package btree
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	m := newMemTree(t)
+	if stats := m.tree.Stats(); stats != (Stats{}) {
+		t.Fatalf("empty tree: %+v", stats)
+	}
+
+	for i := 0; i < 1000; i++ {
+		m.tree.Insert(testKey(i), bytes.Repeat([]byte{'v'}, 50))
+	}
+	want := Stats{Keys: 1000}
+	for _, node := range m.pages {
+		want.Bytes += int(node.nbytes())
+		if node.btype() == BNODE_LEAF {
+			want.Leaves++
+		} else {
+			want.Nodes++
+		}
+	}
+	// the root and a level of leaves
+	want.Height = 2
+
+	if got := m.tree.Stats(); got != want {
+		t.Fatalf("Stats = %+v, want %+v", got, want)
+	}
+	if got := m.tree.Stats().LeafFanout(); got != 1000/float64(want.Leaves) {
+		t.Errorf("LeafFanout = %v with %d leaves", got, want.Leaves)
+	}
+}
+
+func TestRangeBytes(t *testing.T) {
+	m := newMemTree(t)
+	if got := m.tree.RangeBytes(nil, nil); got != 0 {
+		t.Fatalf("empty tree: %d", got)
+	}
+
+	for i := 0; i < 2000; i++ {
+		m.tree.Insert(testKey(i), bytes.Repeat([]byte{'v'}, 50))
+	}
+	// a pointer, an offset, the key and value lengths, the key and the value
+	kv := 8 + 2 + 4 + len(testKey(0)) + 50
+	for _, r := range [][2]int{{0, 2000}, {0, 1}, {500, 1500}, {1999, 5000}, {700, 700}} {
+		if got := m.tree.RangeBytes(testKey(r[0]), testKey(r[1])); got != (min(r[1], 2000)-r[0])*kv {
+			t.Fatalf("range %v: %d bytes, want %d", r, got, (min(r[1], 2000)-r[0])*kv)
+		}
+	}
+	if got := m.tree.RangeBytes(testKey(1000), nil); got != 1000*kv {
+		t.Fatalf("unbounded range: %d bytes, want %d", got, 1000*kv)
+	}
+}
+
+func TestHeight(t *testing.T) {
+	m := newMemTree(t)
+	if h := m.tree.Height(); h != 0 {
+		t.Fatalf("empty tree: height %d", h)
+	}
+	for i := 0; i < 20000; i++ {
+		m.tree.Insert(testKey(i), bytes.Repeat([]byte{'v'}, 50))
+		if i%1000 == 0 || i == 19999 {
+			if got, want := m.tree.Height(), m.tree.Stats().Height; got != want {
+				t.Fatalf("%d keys: Height %d, Stats.Height %d", i+1, got, want)
+			}
+		}
+	}
+	if h := m.tree.Height(); h < 3 {
+		t.Fatalf("height %d for 20000 keys", h)
+	}
+}
@@ -0,0 +1,263 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+var ErrNotLeaf = errors.New("not a leaf")
+
+// check that the kv at idx can be decoded without reading past the page.
+// returns the key if it's readable, even when the value is not.
+func (node BNode) decodeKV(idx uint16) ([]byte, error) {
+	pos := int(node.kvPos(idx))
+	hlen := 4
+	if node.keyWidth() != 0 {
+		hlen = 2
+	}
+	if pos+hlen > len(node.Data) {
+		return nil, fmt.Errorf("kv %d: lengths past the end of the page", idx)
+	}
+
+	k, v, _ := node.kvLens(uint16(pos))
+	klen, vlen := int(k), int(v)
+	if pos+hlen+klen > len(node.Data) {
+		return nil, fmt.Errorf("kv %d: key of %d bytes past the end of the page", idx, klen)
+	}
+
+	key := node.Data[pos+hlen:][:klen]
+	if pos+hlen+klen+vlen > len(node.Data) {
+		return key, fmt.Errorf("kv %d: value of %d bytes past the end of the page", idx, vlen)
+	}
+	return key, nil
+}
+
+// Scrub decodes every kv in every leaf and calls fn for each one that fails,
+// without stopping the walk. key is nil when the key itself couldn't be read.
+// A page that can't be read at all, like a kid pointer out of the file or a node whose
+// key count doesn't fit in the page, is reported with a nil key and its subtree is skipped.
+func (tree *BTree) Scrub(fn func(ptr uint64, key []byte, err error)) {
+	if tree.Root == 0 {
+		return
+	}
+	treeScrub(tree, tree.Root, fn)
+}
+
+func treeScrub(tree *BTree, ptr uint64, fn func(ptr uint64, key []byte, err error)) {
+	node, err := tree.tryGet(ptr)
+	if err != nil {
+		fn(ptr, nil, err)
+		return
+	}
+	// a corrupt key count would index the pointers and offsets past the page
+	if err := node.checkNKeys(); err != nil {
+		fn(ptr, nil, err)
+		return
+	}
+
+	switch node.btype() {
+	case BNODE_LEAF:
+		for i := uint16(0); i < node.nkeys(); i++ {
+			if key, err := node.decodeKV(i); err != nil {
+				fn(ptr, key, err)
+			}
+		}
+
+	case BNODE_NODE:
+		for i := uint16(0); i < node.nkeys(); i++ {
+			treeScrub(tree, node.GetPtr(i), fn)
+		}
+
+	default:
+		fn(ptr, nil, fmt.Errorf("bad node type %d", node.btype()))
+	}
+}
+
+// check that the pointers and offsets of every key are inside the page
+func (node BNode) checkNKeys() error {
+	if HEADER+10*int(node.nkeys()) > len(node.Data) {
+		return fmt.Errorf("%d keys don't fit in the page", node.nkeys())
+	}
+	return nil
+}
+
+// verify the offset list of a single node: offsets must be increasing,
+// each offset step must match the encoded size of its kv, and nothing may extend past the page.
+func (node BNode) verifyOffsets() error {
+	if err := node.checkNKeys(); err != nil {
+		return err
+	}
+	nkeys := node.nkeys()
+	// the smallest kv: its lengths alone, or the value length and the key of a fixed-width leaf
+	minKV := 4
+	if w := node.keyWidth(); w != 0 {
+		minKV = 2 + int(w)
+	}
+
+	// computed as ints: an offset near 0xffff would wrap around in uint16 and pass
+	start := HEADER + 10*int(nkeys)
+	for i := uint16(1); i <= nkeys; i++ {
+		prev, cur := int(node.GetOffset(i-1)), int(node.GetOffset(i))
+		if cur < prev+minKV {
+			return fmt.Errorf("offset %d (%d) is not after offset %d (%d)", i, cur, i-1, prev)
+		}
+		if start+cur > len(node.Data) {
+			return fmt.Errorf("offset %d (%d) past the end of the page", i, cur)
+		}
+
+		klen, vlen, hlen := node.kvLens(uint16(start + prev))
+		if size := int(hlen) + int(klen) + int(vlen); cur-prev != size {
+			return fmt.Errorf("kv %d: offset step %d doesn't match its size %d", i-1, cur-prev, size)
+		}
+	}
+
+	if node.nbytes() > BTREE_PAGE_SIZE {
+		return fmt.Errorf("node size %d exceeds the page size", node.nbytes())
+	}
+	return nil
+}
+
+// Validate walks the whole tree and checks the structure of every node.
+// returns the first problem found.
+func (tree *BTree) Validate() error {
+	if tree.Root == 0 {
+		return nil
+	}
+	// every key must be routable: the leftmost path starts with the empty sentinel, so keys
+	// before the first real key still land in the leftmost kid (noDelookupLE never returns less than 0)
+	if root := tree.Get(tree.Root); root.nkeys() > 0 && len(root.GetKey(0)) != 0 {
+		return fmt.Errorf("page %d: the root doesn't start with the sentinel key", tree.Root)
+	}
+	return treeValidate(tree, tree.Root, nil, nil)
+}
+
+// first is the key the parent holds for this node, nil for the root.
+// limit is the parent key of the next kid: every key here must be before it, nil for no limit.
+func treeValidate(tree *BTree, ptr uint64, first []byte, limit []byte) error {
+	node := tree.Get(ptr)
+
+	if t := node.btype(); t != BNODE_LEAF && t != BNODE_NODE {
+		return fmt.Errorf("page %d: bad node type %d", ptr, t)
+	}
+	if node.nkeys() == 0 {
+		return fmt.Errorf("page %d: empty node", ptr)
+	}
+	if err := node.verifyOffsets(); err != nil {
+		return fmt.Errorf("page %d: %w", ptr, err)
+	}
+
+	if first != nil && tree.compare(first, node.GetKey(0)) != 0 {
+		return fmt.Errorf("page %d: first key doesn't match the parent", ptr)
+	}
+	for i := uint16(1); i < node.nkeys(); i++ {
+		if tree.compare(node.GetKey(i-1), node.GetKey(i)) >= 0 {
+			return fmt.Errorf("page %d: keys %d and %d out of order", ptr, i-1, i)
+		}
+	}
+	if last := node.GetKey(node.nkeys() - 1); limit != nil && tree.compare(last, limit) >= 0 {
+		return fmt.Errorf("page %d: key %q is not before the next kid's key %q", ptr, last, limit)
+	}
+
+	if node.btype() == BNODE_NODE {
+		for i := uint16(0); i < node.nkeys(); i++ {
+			next := limit
+			if i+1 < node.nkeys() {
+				next = node.GetKey(i + 1)
+			}
+			if err := treeValidate(tree, node.GetPtr(i), node.GetKey(i), next); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SameShape reports whether two trees have identical node structure: the same node types and encodings,
+// the same keys in each node and the same leaf values. Page numbers may differ.
+func SameShape(a *BTree, b *BTree) bool {
+	if a.Root == 0 || b.Root == 0 {
+		return a.Root == b.Root
+	}
+	return sameShape(a, a.Get(a.Root), b, b.Get(b.Root))
+}
+
+func sameShape(a *BTree, na BNode, b *BTree, nb BNode) bool {
+	if na.kind() != nb.kind() || na.nkeys() != nb.nkeys() {
+		return false
+	}
+	for i := uint16(0); i < na.nkeys(); i++ {
+		if !bytes.Equal(na.GetKey(i), nb.GetKey(i)) {
+			return false
+		}
+		switch na.btype() {
+		case BNODE_LEAF:
+			if !bytes.Equal(na.GetVal(i), nb.GetVal(i)) {
+				return false
+			}
+		case BNODE_NODE:
+			if !sameShape(a, a.Get(na.GetPtr(i)), b, b.Get(nb.GetPtr(i))) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// RepairOffsets returns node as is when its offset list is consistent, and otherwise a copy with
+// the offsets rebuilt from the kv lengths, which are stored inline with each kv (the key width
+// of a fixed-width leaf is in its header). That recovers
+// a node whose offset list alone was damaged. Errors if the lengths are damaged too.
+func RepairOffsets(node BNode) (fixed BNode, repaired bool, err error) {
+	if t := node.btype(); t != BNODE_LEAF && t != BNODE_NODE {
+		return node, false, fmt.Errorf("not a tree node: node type %d", t)
+	}
+	if node.verifyOffsets() == nil {
+		return node, false, nil
+	}
+
+	nkeys := int(node.nkeys())
+	start := HEADER + 10*nkeys // the first kv
+	if start > len(node.Data) {
+		return node, false, fmt.Errorf("%d keys don't fit in the page", nkeys)
+	}
+	fixed = BNode{Data: append([]byte{}, node.Data...)}
+	off := 0
+	for i := 1; i <= nkeys; i++ {
+		pos := start + off
+		hlen := 4
+		if fixed.keyWidth() != 0 {
+			hlen = 2
+		}
+		if pos+hlen > len(fixed.Data) {
+			return node, false, fmt.Errorf("kv %d starts past the end of the page", i-1)
+		}
+		klen, vlen, _ := fixed.kvLens(uint16(pos))
+		off += hlen + int(klen) + int(vlen)
+		if start+off > len(fixed.Data) {
+			return node, false, fmt.Errorf("kv %d runs past the end of the page", i-1)
+		}
+		fixed.setOffset(uint16(i), uint16(off))
+	}
+	if err := fixed.verifyOffsets(); err != nil {
+		return node, false, err
+	}
+	return fixed, true, nil
+}
+
+// ReadLeaf calls fn for every kv of a page that isn't necessarily part of the tree,
+// e.g. a freed page. Returns an error without calling fn if the page is not a well-formed leaf.
+func ReadLeaf(node BNode, fn func(key, val []byte)) error {
+	if node.btype() != BNODE_LEAF {
+		return fmt.Errorf("%w: node type %d", ErrNotLeaf, node.btype())
+	}
+	if err := node.verifyOffsets(); err != nil {
+		return err
+	}
+	for i := uint16(0); i < node.nkeys(); i++ {
+		if key := node.GetKey(i); len(key) > 0 {
+			fn(key, node.GetVal(i))
+		}
+	}
+	return nil
+}
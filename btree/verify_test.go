@@ -0,0 +1,360 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// the leaves of the tree with at least 3 keys, in page order
+func fullLeaves(m *memTree) []uint64 {
+	leaves := []uint64{}
+	for ptr, node := range m.pages {
+		if node.btype() == BNODE_LEAF && node.nkeys() >= 3 {
+			leaves = append(leaves, ptr)
+		}
+	}
+	sort.Slice(leaves, func(i, j int) bool { return leaves[i] < leaves[j] })
+	return leaves
+}
+
+func TestScrub(t *testing.T) {
+	m := newMemTree(t)
+	for i := 0; i < 200; i++ {
+		m.tree.Insert(testKey(i), bytes.Repeat([]byte{'v'}, 50))
+	}
+	m.tree.Scrub(func(ptr uint64, key []byte, err error) {
+		t.Errorf("page %d, key %q: %v", ptr, key, err)
+	})
+
+	leaves := fullLeaves(m)
+	if len(leaves) < 2 {
+		t.Fatalf("%d leaves", len(leaves))
+	}
+	// a value running past the page in one leaf, a key in another
+	badVal, badKey := m.pages[leaves[0]], m.pages[leaves[1]]
+	binary.LittleEndian.PutUint16(badVal.Data[badVal.kvPos(1)+2:], 0xffff)
+	binary.LittleEndian.PutUint16(badKey.Data[badKey.kvPos(2):], 0xffff)
+
+	found := map[uint64][]byte{}
+	m.tree.Scrub(func(ptr uint64, key []byte, err error) {
+		if _, ok := found[ptr]; ok {
+			t.Errorf("page %d reported twice", ptr)
+		}
+		found[ptr] = key
+	})
+	if key, ok := found[leaves[0]]; !ok || !bytes.Equal(key, badVal.GetKey(1)) {
+		t.Errorf("bad value reported as %q %v, want key %q", key, ok, badVal.GetKey(1))
+	}
+	if key, ok := found[leaves[1]]; !ok || key != nil {
+		t.Errorf("bad key reported as %q %v, want a nil key", key, ok)
+	}
+	if len(found) != 2 {
+		t.Errorf("%d pages reported, want 2", len(found))
+	}
+}
+
+func TestScrubBadPointer(t *testing.T) {
+	m := newMemTree(t)
+	for i := 0; i < 2000; i++ {
+		m.tree.Insert(testKey(i), bytes.Repeat([]byte{'v'}, 50))
+	}
+	// reading past the end panics, as it does for pages out of the mapping
+	get := m.tree.Get
+	m.tree.Get = func(ptr uint64) BNode {
+		if _, ok := m.pages[ptr]; !ok {
+			panic("bad ptr")
+		}
+		return get(ptr)
+	}
+	root := m.pages[m.tree.Root]
+	if root.btype() != BNODE_NODE || root.nkeys() < 3 {
+		t.Fatalf("root of type %d with %d keys", root.btype(), root.nkeys())
+	}
+	const bad = 1 << 40
+	root.setPtr(1, bad)
+
+	found := map[uint64]error{}
+	m.tree.Scrub(func(ptr uint64, key []byte, err error) {
+		if key != nil {
+			t.Errorf("page %d reported with key %q", ptr, key)
+		}
+		found[ptr] = err
+	})
+	if len(found) != 1 || found[bad] == nil {
+		t.Fatalf("reported %v, want only page %d", found, uint64(bad))
+	}
+}
+
+func TestScrubBadKeyCount(t *testing.T) {
+	m := newMemTree(t)
+	for i := 0; i < 20000; i++ {
+		m.tree.Insert(testKey(i), bytes.Repeat([]byte{'v'}, 50))
+	}
+	root := m.pages[m.tree.Root]
+	if root.btype() != BNODE_NODE {
+		t.Fatalf("root of type %d", root.btype())
+	}
+	// a kid that is an internal node and a leaf under another kid
+	node, leaf := root.GetPtr(0), uint64(0)
+	if m.pages[node].btype() != BNODE_NODE {
+		t.Fatalf("kid of type %d", m.pages[node].btype())
+	}
+	for leaf = root.GetPtr(1); m.pages[leaf].btype() == BNODE_NODE; {
+		leaf = m.pages[leaf].GetPtr(0)
+	}
+	for _, ptr := range []uint64{node, leaf} {
+		binary.LittleEndian.PutUint16(m.pages[ptr].Data[2:4], 0xffff)
+	}
+
+	found := map[uint64]error{}
+	m.tree.Scrub(func(ptr uint64, key []byte, err error) {
+		if key != nil {
+			t.Errorf("page %d reported with key %q", ptr, key)
+		}
+		found[ptr] = err
+	})
+	if len(found) != 2 || found[node] == nil || found[leaf] == nil {
+		t.Fatalf("reported %v, want pages %d and %d", found, node, leaf)
+	}
+}
+
+func TestValidateCorruptOffset(t *testing.T) {
+	for _, width := range []int{0, 9} {
+		for _, c := range []struct {
+			name   string
+			idx    func(node BNode) uint16
+			offset func(node BNode, idx uint16) uint16
+		}{
+			{"off by one up", func(BNode) uint16 { return 2 }, func(node BNode, idx uint16) uint16 { return node.GetOffset(idx) + 1 }},
+			{"off by one down", func(BNode) uint16 { return 2 }, func(node BNode, idx uint16) uint16 { return node.GetOffset(idx) - 1 }},
+			{"not increasing", func(BNode) uint16 { return 2 }, func(node BNode, idx uint16) uint16 { return node.GetOffset(idx - 1) }},
+			{"past the page", func(node BNode) uint16 { return node.nkeys() }, func(BNode, uint16) uint16 { return BTREE_PAGE_SIZE }},
+		} {
+			t.Run(fmt.Sprintf("%s width %d", c.name, width), func(t *testing.T) {
+				m := newMemTree(t)
+				m.tree.KeyWidth = width
+				for i := 0; i < 200; i++ {
+					m.tree.Insert(testKey(i), bytes.Repeat([]byte{'v'}, 50))
+				}
+				if err := m.tree.Validate(); err != nil {
+					t.Fatal(err)
+				}
+
+				// the last leaf written, fixed width when the tree has a width
+				leaves := fullLeaves(m)
+				node := m.pages[leaves[len(leaves)-1]]
+				if int(node.keyWidth()) != width {
+					t.Fatalf("leaf of key width %d", node.keyWidth())
+				}
+				idx := c.idx(node)
+				node.setOffset(idx, c.offset(node, idx))
+
+				err := m.tree.Validate()
+				if err == nil {
+					t.Fatal("Validate missed the corrupt offset")
+				}
+				if !strings.Contains(err.Error(), "page ") {
+					t.Errorf("error %q doesn't name the page", err)
+				}
+			})
+		}
+	}
+}
+
+func TestVerifyOffsetsNearLimit(t *testing.T) {
+	m := newMemTree(t)
+	for i := 0; i < 200; i++ {
+		m.tree.Insert(testKey(i), bytes.Repeat([]byte{'v'}, 50))
+	}
+	leaves := fullLeaves(m)
+	node := m.pages[leaves[0]]
+	// the kv position of an offset this large wraps around in uint16, back inside the page
+	node.setOffset(node.nkeys(), 0xfffe)
+	err := node.verifyOffsets()
+	if err == nil || !strings.Contains(err.Error(), "past the end") {
+		t.Fatalf("got %v, want the offset past the end of the page", err)
+	}
+}
+
+func TestSameShape(t *testing.T) {
+	build := func(n int, order []int) *memTree {
+		m := newMemTree(t)
+		for _, i := range order[:n] {
+			m.tree.Insert(testKey(i), bytes.Repeat([]byte{'v'}, 50))
+		}
+		return m
+	}
+	inOrder := make([]int, 1000)
+	for i := range inOrder {
+		inOrder[i] = i
+	}
+	reversed := make([]int, 1000)
+	for i := range reversed {
+		reversed[i] = 999 - i
+	}
+
+	a, b := build(1000, inOrder), build(1000, inOrder)
+	if !SameShape(&a.tree, &b.tree) {
+		t.Fatal("the same inserts in the same order give another shape")
+	}
+	// the same kvs, split at other places
+	if c := build(1000, reversed); SameShape(&a.tree, &c.tree) {
+		t.Error("trees built in another order have the same shape")
+	}
+	b.tree.Insert(testKey(500), []byte("other"))
+	if SameShape(&a.tree, &b.tree) {
+		t.Error("trees with another value have the same shape")
+	}
+	if empty := newMemTree(t); SameShape(&a.tree, &empty.tree) || !SameShape(&empty.tree, &newMemTree(t).tree) {
+		t.Error("an empty tree compared wrong")
+	}
+}
+
+func TestValidateSentinel(t *testing.T) {
+	m := newMemTree(t)
+	leaf := BNode{Data: make([]byte, BTREE_PAGE_SIZE)}
+	leaf.setHeader(BNODE_LEAF, 2)
+	nodeAppendKV(leaf, 0, 0, testKey(1), []byte("v"))
+	nodeAppendKV(leaf, 1, 0, testKey(2), []byte("v"))
+	m.tree.Root = m.tree.New(leaf)
+
+	err := m.tree.Validate()
+	if err == nil || !strings.Contains(err.Error(), "sentinel") {
+		t.Fatalf("Validate of a root without the sentinel: %v", err)
+	}
+}
+
+func TestValidateReverseInserts(t *testing.T) {
+	// each key is smaller than all the others so far, and goes through the sentinel's kid
+	m := newMemTree(t)
+	for i := 2999; i >= 0; i-- {
+		m.tree.Insert(testKey(i), bytes.Repeat([]byte{'v'}, 50))
+		if i%500 == 0 {
+			if err := m.tree.Validate(); err != nil {
+				t.Fatalf("after inserting key %d: %v", i, err)
+			}
+		}
+	}
+	if m.tree.Height() < 3 {
+		t.Fatalf("height %d, want at least 3", m.tree.Height())
+	}
+	for i := 0; i < 3000; i++ {
+		if _, ok := m.tree.Lookup(testKey(i)); !ok {
+			t.Fatalf("key %d not found", i)
+		}
+	}
+	// the smallest key is in the leftmost leaf, right after the sentinel
+	ptr, idx, ok := m.tree.Locate(testKey(0))
+	if leftmost, _, _ := m.tree.Locate(nil); !ok || ptr != leftmost || idx != 1 {
+		t.Fatalf("the smallest key is at page %d index %d, not after the sentinel in %d", ptr, idx, leftmost)
+	}
+}
+
+func TestValidateKeyPastNextKid(t *testing.T) {
+	m := newMemTree(t)
+	for i := 0; i < 200; i++ {
+		m.tree.Insert(testKey(i), bytes.Repeat([]byte{'v'}, 50))
+	}
+	if err := m.tree.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// still sorted within the first leaf, but past the key of the next one
+	ptr, _, _ := m.tree.Locate(testKey(0))
+	node := m.pages[ptr]
+	last := node.nkeys() - 1
+	copy(node.Data[node.kvPos(last)+4:], testKey(999))
+
+	err := m.tree.Validate()
+	if err == nil || !strings.Contains(err.Error(), "next kid") {
+		t.Fatalf("Validate of a key past the next kid's key: %v", err)
+	}
+}
+
+func TestRepairOffsets(t *testing.T) {
+	for _, width := range []int{0, 9} {
+		t.Run(fmt.Sprint("width ", width), func(t *testing.T) {
+			m := newMemTree(t)
+			m.tree.KeyWidth = width
+			for i := 0; i < 200; i++ {
+				m.tree.Insert(testKey(i), bytes.Repeat([]byte{'v'}, 50))
+			}
+			leaves := fullLeaves(m)
+			node := m.pages[leaves[len(leaves)-1]]
+			good := append([]byte{}, node.Data...)
+
+			if fixed, repaired, err := RepairOffsets(node); err != nil || repaired || &fixed.Data[0] != &node.Data[0] {
+				t.Fatalf("consistent node: repaired %v, %v", repaired, err)
+			}
+
+			// every offset scrambled
+			for i := uint16(1); i <= node.nkeys(); i++ {
+				node.setOffset(i, 7*i)
+			}
+			damaged := append([]byte{}, node.Data...)
+			fixed, repaired, err := RepairOffsets(node)
+			if err != nil || !repaired {
+				t.Fatalf("RepairOffsets = %v %v", repaired, err)
+			}
+			if !bytes.Equal(fixed.Data, good) {
+				t.Fatal("repaired node differs from the original")
+			}
+			if !bytes.Equal(node.Data, damaged) {
+				t.Fatal("the damaged node was modified")
+			}
+
+			// a damaged length can't be repaired from
+			binary.LittleEndian.PutUint16(node.Data[HEADER+10*int(node.nkeys()):], 0xfff0)
+			if _, repaired, err := RepairOffsets(node); err == nil || repaired {
+				t.Fatalf("damaged lengths: repaired %v, %v", repaired, err)
+			}
+		})
+	}
+}
+
+func TestRepairOffsetsNotANode(t *testing.T) {
+	page := BNode{Data: make([]byte, BTREE_PAGE_SIZE)}
+	binary.LittleEndian.PutUint16(page.Data, 3) // a free list node
+	if _, repaired, err := RepairOffsets(page); err == nil || repaired {
+		t.Fatalf("free list page: repaired %v, %v", repaired, err)
+	}
+}
+
+func TestValidateSmallFixedKeys(t *testing.T) {
+	// a 1-byte key with an empty value takes 3 bytes in a fixed-width leaf
+	m := newMemTree(t)
+	m.tree.KeyWidth = 1
+	// large values to spread the keys over several leaves, then emptied in place
+	for i := 1; i < 256; i++ {
+		m.tree.Insert([]byte{byte(i)}, bytes.Repeat([]byte{'v'}, 500))
+	}
+	for i := 1; i < 256; i++ {
+		m.tree.Insert([]byte{byte(i)}, nil)
+	}
+	if leaves, variable := leafWidths(m); leaves == variable {
+		t.Fatal("no fixed-width leaves")
+	}
+	if err := m.tree.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for ptr, node := range m.pages {
+		if _, repaired, err := RepairOffsets(node); err != nil || repaired {
+			t.Errorf("page %d: repaired %v, %v", ptr, repaired, err)
+		}
+	}
+	n := 0
+	m.tree.ScanBestEffort([]byte{1}, func(key, val []byte) bool {
+		n++
+		return true
+	}, func(ptr uint64, err error) {
+		t.Errorf("page %d: %v", ptr, err)
+	})
+	if n != 255 {
+		t.Errorf("best effort scan found %d keys, want 255", n)
+	}
+}
@@ -1,6 +1,7 @@
 package freelist
 
 import (
+	"encoding/binary"
 	"kurocifer/LeichtKV/btree"
 	"kurocifer/LeichtKV/utils"
 )
@@ -11,21 +12,70 @@ type FreeList struct {
 	Get func(uint64) btree.BNode
 	New func(btree.BNode) uint64
 	Use func(uint64, btree.BNode)
+
+	// optional hook for instrumentation, may be nil.
+	// called by every Update that changes the list
+	OnUpdate func()
 }
 
 const BNODE_FREE_LIST = 3
 const FREE_LIST_HEADER = 4 + 8 + 8
 const FREE_LIST_CAP = (btree.BTREE_PAGE_SIZE - FREE_LIST_HEADER) / 8
 
+// a node of the list
+// | type | size | total | next | pointers |
+// |  2B  |  2B  |  8B   |  8B  |  size*8B |
+// the total is only maintained in the head node, so it can be read without traversing the list.
+
 // number of items in teh list
-func (fl *FreeList) Total() int
+func (fl *FreeList) Total() int {
+	if fl.head == 0 {
+		return 0
+	}
+	return int(flnTotal(fl.Get(fl.head)))
+}
+
+// the first node of the list, 0 if empty. persisted by the owner of the list
+func (fl *FreeList) Head() uint64 {
+	return fl.head
+}
+
+func (fl *FreeList) SetHead(head uint64) {
+	fl.head = head
+}
+
+func flnSize(node btree.BNode) int {
+	return int(binary.LittleEndian.Uint16(node.Data[2:]))
+}
 
-func flnSize(node btree.BNode) int
-func flnNext(node btree.BNode) uint64
-func flnPtr(node btree.BNode, idx int) uint64
-func flnSetptr(node btree.BNode, idx int, ptr uint64)
-func flnSetHeader(node btree.BNode, size uint16, next uint64)
-func flnSetTotal(node btree.BNode, total uint64)
+func flnTotal(node btree.BNode) uint64 {
+	return binary.LittleEndian.Uint64(node.Data[4:])
+}
+
+func flnNext(node btree.BNode) uint64 {
+	return binary.LittleEndian.Uint64(node.Data[12:])
+}
+
+func flnPtr(node btree.BNode, idx int) uint64 {
+	utils.Assert(0 <= idx && idx < flnSize(node))
+	return binary.LittleEndian.Uint64(node.Data[FREE_LIST_HEADER+8*idx:])
+}
+
+func flnSetptr(node btree.BNode, idx int, ptr uint64) {
+	utils.Assert(0 <= idx && idx < flnSize(node))
+	binary.LittleEndian.PutUint64(node.Data[FREE_LIST_HEADER+8*idx:], ptr)
+}
+
+func flnSetHeader(node btree.BNode, size uint16, next uint64) {
+	utils.Assert(int(size) <= FREE_LIST_CAP)
+	binary.LittleEndian.PutUint16(node.Data[0:], BNODE_FREE_LIST)
+	binary.LittleEndian.PutUint16(node.Data[2:], size)
+	binary.LittleEndian.PutUint64(node.Data[12:], next)
+}
+
+func flnSetTotal(node btree.BNode, total uint64) {
+	binary.LittleEndian.PutUint64(node.Data[4:], total)
+}
 
 // get the nth pointer
 func (fl *FreeList) Getn(topn int) uint64 {
@@ -33,7 +83,7 @@ func (fl *FreeList) Getn(topn int) uint64 {
 	node := fl.Get(fl.head)
 
 	for flnSize(node) <= topn {
-		topn = flnSize(node)
+		topn -= flnSize(node)
 		next := flnNext(node)
 		utils.Assert(next != 0)
 		node = fl.Get(next)
@@ -49,10 +99,13 @@ func (fl *FreeList) Update(popn int, freed []uint64) {
 		return
 	}
 
+	// the pointers are taken from the top, i.e. the head node and the end of each node.
+	// consumed nodes are discarded: their own pages and remaining pointers are pushed again,
+	// some of the remaining pointers are reused as the pages of the new nodes.
 	total := fl.Total()
 	reuse := []uint64{}
 
-	for fl.head != 0 && len(reuse)*FREE_LIST_CAP < len(freed) {
+	for fl.head != 0 && (popn > 0 || len(reuse)*FREE_LIST_CAP < len(freed)) {
 		node := fl.Get(fl.head)
 		freed = append(freed, fl.head)
 		if popn >= flnSize(node) {
@@ -75,15 +128,23 @@ func (fl *FreeList) Update(popn int, freed []uint64) {
 		fl.head = flnNext(node)
 	}
 
+	utils.Assert(popn == 0)
 	utils.Assert(len(reuse)*FREE_LIST_CAP >= len(freed) || fl.head == 0)
 
 	flpush(fl, freed, reuse)
 
-	flnSetTotal(fl.Get(fl.head), uint64(total+len(freed)))
+	if fl.head != 0 {
+		flnSetTotal(fl.Get(fl.head), uint64(total+len(freed)))
+	}
+	if fl.OnUpdate != nil {
+		fl.OnUpdate()
+	}
 }
 
+// every reused page becomes a node, even if it ends up empty: taking the page a last node
+// needs can leave just enough items for one node less
 func flpush(fl *FreeList, freed []uint64, reuse []uint64) {
-	for len(freed) > 0 {
+	for len(freed) > 0 || len(reuse) > 0 {
 		new := btree.BNode{Data: make([]byte, btree.BTREE_PAGE_SIZE)}
 
 		size := len(freed)
@@ -106,3 +167,58 @@ func flpush(fl *FreeList, freed []uint64, reuse []uint64) {
 	}
 	utils.Assert(len(reuse) == 0)
 }
+
+// Compact repacks the list into as few nodes as can hold it, e.g. after many updates left it
+// spread over half-empty nodes. Like Update, the new nodes are written to pages taken from the
+// list while the old ones are listed as free, so the set of pages it accounts for is unchanged.
+// Reports whether anything was rewritten.
+func (fl *FreeList) Compact() bool {
+	nodes, ptrs := []uint64{}, []uint64{}
+	fl.Walk(func(ptr uint64, node bool) {
+		if node {
+			nodes = append(nodes, ptr)
+		} else {
+			ptrs = append(ptrs, ptr)
+		}
+	})
+
+	// the fewest nodes k that hold the other total-k pages
+	total := len(nodes) + len(ptrs)
+	k := (total + FREE_LIST_CAP) / (FREE_LIST_CAP + 1)
+	if k >= len(nodes) || k > len(ptrs) {
+		return false
+	}
+
+	// the old nodes may still be referenced by the last commit, they can't be overwritten
+	reuse := ptrs[len(ptrs)-k:]
+	items := append(nodes, ptrs[:len(ptrs)-k]...)
+	fl.head = 0
+	for _, ptr := range reuse {
+		size := min(len(items), FREE_LIST_CAP)
+		new := btree.BNode{Data: make([]byte, btree.BTREE_PAGE_SIZE)}
+		flnSetHeader(new, uint16(size), fl.head)
+		for i, item := range items[:size] {
+			flnSetptr(new, i, item)
+		}
+		items = items[size:]
+		fl.Use(ptr, new)
+		fl.head = ptr
+	}
+	utils.Assert(len(items) == 0)
+
+	flnSetTotal(fl.Get(fl.head), uint64(total-k))
+	return true
+}
+
+// Walk calls fn for every page the list accounts for: the pages of its own nodes (node is true)
+// and the free pointers they hold.
+func (fl *FreeList) Walk(fn func(ptr uint64, node bool)) {
+	for ptr := fl.head; ptr != 0; {
+		node := fl.Get(ptr)
+		fn(ptr, true)
+		for i := 0; i < flnSize(node); i++ {
+			fn(flnPtr(node, i), false)
+		}
+		ptr = flnNext(node)
+	}
+}
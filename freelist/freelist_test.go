@@ -0,0 +1,279 @@
+package freelist
+
+import (
+	"math/rand"
+	"testing"
+
+	"kurocifer/LeichtKV/btree"
+)
+
+// a list over pages kept in memory, page numbers are never reused outside of it
+type memList struct {
+	fl       FreeList
+	pages    map[uint64]btree.BNode
+	next     uint64
+	appended []uint64 // pages the list allocated through New
+}
+
+func newMemList(t *testing.T) *memList {
+	m := &memList{pages: map[uint64]btree.BNode{}, next: 1}
+	m.fl.Get = func(ptr uint64) btree.BNode {
+		node, ok := m.pages[ptr]
+		if !ok {
+			t.Fatalf("read of page %d, which is not a list node", ptr)
+		}
+		return node
+	}
+	m.fl.New = func(node btree.BNode) uint64 {
+		m.next++
+		m.pages[m.next] = node
+		m.appended = append(m.appended, m.next)
+		return m.next
+	}
+	m.fl.Use = func(ptr uint64, node btree.BNode) {
+		m.pages[ptr] = node
+	}
+	return m
+}
+
+// new page numbers, as freed by the owner of the list
+func (m *memList) freePages(n int) []uint64 {
+	freed := make([]uint64, n)
+	for i := range freed {
+		m.next++
+		freed[i] = m.next
+	}
+	return freed
+}
+
+// every page the list accounts for, its nodes and the free pointers, checking no page is listed twice
+func (m *memList) pageSet(t *testing.T) map[uint64]bool {
+	seen := map[uint64]bool{}
+	m.fl.Walk(func(ptr uint64, node bool) {
+		if seen[ptr] {
+			t.Fatalf("page %d listed twice", ptr)
+		}
+		seen[ptr] = true
+	})
+	return seen
+}
+
+func TestGetnAcrossNodes(t *testing.T) {
+	m := newMemList(t)
+	freed := m.freePages(3*FREE_LIST_CAP + 5)
+	m.fl.Update(0, freed)
+	if total := m.fl.Total(); total != len(freed) {
+		t.Fatalf("Total %d, want %d", total, len(freed))
+	}
+
+	want := map[uint64]bool{}
+	for _, ptr := range freed {
+		want[ptr] = true
+	}
+	for i := 0; i < len(freed); i++ {
+		ptr := m.fl.Getn(i)
+		if !want[ptr] {
+			t.Fatalf("Getn(%d) = %d, not a free page or returned twice", i, ptr)
+		}
+		delete(want, ptr)
+	}
+}
+
+func TestUpdateKeepsEveryPage(t *testing.T) {
+	m := newMemList(t)
+	rng := rand.New(rand.NewSource(1))
+	all := map[uint64]bool{}
+	for round := 0; round < 1000; round++ {
+		popn := 0
+		if total := m.fl.Total(); total > 0 {
+			popn = rng.Intn(total + 1)
+		}
+		popped := map[uint64]bool{}
+		for i := 0; i < popn; i++ {
+			popped[m.fl.Getn(i)] = true
+		}
+		freed := m.freePages(rng.Intn(3 * FREE_LIST_CAP / (1 + round%7)))
+
+		m.appended = m.appended[:0]
+		m.fl.Update(popn, freed)
+
+		// the popped pages leave the list, the freed ones and any new nodes join it
+		for ptr := range popped {
+			delete(all, ptr)
+		}
+		for _, ptr := range append(freed, m.appended...) {
+			all[ptr] = true
+		}
+		got := m.pageSet(t)
+		for ptr := range popped {
+			if got[ptr] {
+				t.Fatalf("round %d: popped page %d still listed", round, ptr)
+			}
+		}
+		if len(got) != len(all) {
+			t.Fatalf("round %d: %d pages listed, want %d", round, len(got), len(all))
+		}
+		for ptr := range all {
+			if !got[ptr] {
+				t.Fatalf("round %d: page %d lost", round, ptr)
+			}
+		}
+	}
+}
+
+// the free pointers found by walking every node
+func (m *memList) walked() int {
+	n := 0
+	m.fl.Walk(func(ptr uint64, node bool) {
+		if !node {
+			n++
+		}
+	})
+	return n
+}
+
+func TestTotalMatchesTraversal(t *testing.T) {
+	m := newMemList(t)
+	rng := rand.New(rand.NewSource(2))
+	for round := 0; round < 2000; round++ {
+		popn := 0
+		if total := m.fl.Total(); total > 0 {
+			popn = rng.Intn(total + 1)
+		}
+		for i := 0; i < popn; i++ {
+			m.fl.Getn(i) // each popped pointer can be read
+		}
+		// some rounds push enough to fill several nodes
+		m.fl.Update(popn, m.freePages(rng.Intn(3*FREE_LIST_CAP/(1+round%7))))
+		if total, walked := m.fl.Total(), m.walked(); total != walked {
+			t.Fatalf("round %d: Total %d, traversal found %d", round, total, walked)
+		}
+	}
+}
+
+func TestTotalEmpty(t *testing.T) {
+	m := newMemList(t)
+	m.fl.Update(0, m.freePages(3))
+	m.fl.Update(m.fl.Total(), nil)
+	if total, walked := m.fl.Total(), m.walked(); total != walked {
+		t.Fatalf("Total %d, traversal found %d", total, walked)
+	}
+}
+
+func TestOnUpdate(t *testing.T) {
+	m := newMemList(t)
+	updates := 0
+	m.fl.OnUpdate = func() { updates++ }
+
+	m.fl.Update(0, nil)
+	if updates != 0 {
+		t.Fatalf("%d updates for an Update that changed nothing", updates)
+	}
+	m.fl.Update(0, m.freePages(2*FREE_LIST_CAP))
+	m.fl.Update(3, nil)
+	m.fl.Update(FREE_LIST_CAP, m.freePages(5))
+	if updates != 3 {
+		t.Fatalf("%d updates, want 3", updates)
+	}
+}
+
+// push n nodes holding size pointers each, as many small updates can leave them
+func (m *memList) fragmented(n, size int) {
+	total := m.fl.Total()
+	for i := 0; i < n; i++ {
+		node := btree.BNode{Data: make([]byte, btree.BTREE_PAGE_SIZE)}
+		flnSetHeader(node, uint16(size), m.fl.head)
+		for j, ptr := range m.freePages(size) {
+			flnSetptr(node, j, ptr)
+		}
+		m.fl.head = m.fl.New(node)
+		total += size
+	}
+	flnSetTotal(m.fl.Get(m.fl.head), uint64(total))
+}
+
+// the nodes found by walking the list
+func (m *memList) nodes() int {
+	n := 0
+	m.fl.Walk(func(ptr uint64, node bool) {
+		if node {
+			n++
+		}
+	})
+	return n
+}
+
+func TestCompact(t *testing.T) {
+	m := newMemList(t)
+	m.fragmented(10, 5)
+	before := m.pageSet(t)
+
+	m.appended = m.appended[:0]
+	if !m.fl.Compact() {
+		t.Fatal("Compact rewrote nothing")
+	}
+	// the new nodes are taken from the list, the old ones join it
+	if len(m.appended) != 0 {
+		t.Fatalf("Compact allocated pages %v", m.appended)
+	}
+	after := m.pageSet(t)
+	if len(after) != len(before) {
+		t.Fatalf("%d pages listed, was %d", len(after), len(before))
+	}
+	for ptr := range before {
+		if !after[ptr] {
+			t.Fatalf("page %d lost", ptr)
+		}
+	}
+	if nodes := m.nodes(); nodes != 1 {
+		t.Fatalf("%d nodes, want 1", nodes)
+	}
+	if total, walked := m.fl.Total(), m.walked(); total != walked || total != len(before)-1 {
+		t.Fatalf("Total %d, traversal found %d, want %d", total, walked, len(before)-1)
+	}
+
+	// already dense
+	if m.fl.Compact() {
+		t.Fatal("Compact rewrote a dense list")
+	}
+}
+
+func TestCompactAfterUpdates(t *testing.T) {
+	m := newMemList(t)
+	rng := rand.New(rand.NewSource(3))
+	for round := 0; round < 500; round++ {
+		popn := 0
+		if total := m.fl.Total(); total > 0 {
+			popn = rng.Intn(total + 1)
+		}
+		m.fl.Update(popn, m.freePages(rng.Intn(3*FREE_LIST_CAP/(1+round%7))))
+		if round%3 == 0 {
+			m.fragmented(1+rng.Intn(5), 1+rng.Intn(FREE_LIST_CAP/2))
+		}
+
+		before := m.pageSet(t)
+		m.fl.Compact()
+		after := m.pageSet(t)
+		if len(after) != len(before) {
+			t.Fatalf("round %d: %d pages listed, was %d", round, len(after), len(before))
+		}
+		for ptr := range before {
+			if !after[ptr] {
+				t.Fatalf("round %d: page %d lost", round, ptr)
+			}
+		}
+		if total, walked := m.fl.Total(), m.walked(); total != walked {
+			t.Fatalf("round %d: Total %d, traversal found %d", round, total, walked)
+		}
+		if nodes, want := m.nodes(), (len(after)+FREE_LIST_CAP)/(FREE_LIST_CAP+1); nodes > want {
+			t.Fatalf("round %d: %d nodes for %d pages, want %d", round, nodes, len(after), want)
+		}
+	}
+}
+
+func TestCompactEmpty(t *testing.T) {
+	m := newMemList(t)
+	if m.fl.Compact() {
+		t.Fatal("Compact rewrote an empty list")
+	}
+}
@@ -0,0 +1,119 @@
+package kvstore
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+)
+
+const (
+	BLOOM_BITS_PER_KEY = 10 // about 1% false positives at full capacity
+	BLOOM_HASHES       = 7
+	BLOOM_MIN_KEYS     = 1024
+)
+
+// an in-memory bloom filter over all the keys in the tree, see KV.BloomFilter.
+// keys are only ever added, a deleted key stays in until the next rebuild, which can
+// only cause false positives. readers don't take the writer lock: the bits are atomic, and
+// keys are added before the update writing them commits, so a reader never misses a committed key.
+// a rebuild stores a whole new filter once it holds every committed key.
+type bloom struct {
+	bits  []atomic.Uint64
+	keys  int // the number of keys the filter was sized for
+	added int // Insert calls since it was built, only touched by the writer
+}
+
+func newBloom(keys int) *bloom {
+	keys = max(keys, BLOOM_MIN_KEYS)
+	return &bloom{bits: make([]atomic.Uint64, (keys*BLOOM_BITS_PER_KEY+63)/64), keys: keys}
+}
+
+// double hashing: the i-th probe is h1 + i*h2
+func bloomHash(key []byte) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write(key)
+	h1 := h.Sum64()
+	h2 := h1>>33 | h1<<31 | 1 // odd, so the probes don't repeat early
+	return h1, h2
+}
+
+func (b *bloom) add(key []byte) {
+	nbits := uint64(len(b.bits) * 64)
+	h1, h2 := bloomHash(key)
+	for i := uint64(0); i < BLOOM_HASHES; i++ {
+		bit := (h1 + i*h2) % nbits
+		b.bits[bit/64].Or(1 << (bit % 64))
+	}
+	b.added++
+}
+
+func (b *bloom) mayContain(key []byte) bool {
+	nbits := uint64(len(b.bits) * 64)
+	h1, h2 := bloomHash(key)
+	for i := uint64(0); i < BLOOM_HASHES; i++ {
+		bit := (h1 + i*h2) % nbits
+		if b.bits[bit/64].Load()&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// the filter must agree with the tree on which keys are equal
+func (db *KV) bloomKey(key []byte) []byte {
+	if db.NormalizeKey != nil {
+		return db.NormalizeKey(key)
+	}
+	return key
+}
+
+// rebuild the filter from the tree, sized for twice the current keys
+func (db *KV) bloomBuild() {
+	if !db.BloomFilter {
+		return
+	}
+	keys := 0
+	db.tree.ScanUnordered(func(key, val []byte) bool {
+		keys++
+		return true
+	})
+	b := newBloom(2 * keys)
+	db.tree.ScanUnordered(func(key, val []byte) bool {
+		b.add(db.bloomKey(key))
+		return true
+	})
+	b.added = 0
+	db.bloom.Store(b)
+}
+
+// called for every key Insert or Apply writes
+func (db *KV) bloomAdd(key []byte) {
+	if b := db.bloom.Load(); b != nil {
+		b.add(db.bloomKey(key))
+	}
+}
+
+// add every key of the tree to the filter, for an update that changes the tree without Insert.
+// called inside the update, before it commits
+func (db *KV) bloomAddAll() {
+	b := db.bloom.Load()
+	if b == nil {
+		return
+	}
+	db.tree.ScanUnordered(func(key, val []byte) bool {
+		b.add(db.bloomKey(key))
+		return true
+	})
+}
+
+// rebuild a filter that has taken in more keys than it was sized for, after an update
+func (db *KV) bloomGrow() {
+	if b := db.bloom.Load(); b != nil && b.added > b.keys {
+		db.bloomBuild()
+	}
+}
+
+// false means key is certainly absent
+func (db *KV) bloomMayContain(key []byte) bool {
+	b := db.bloom.Load()
+	return b == nil || b.mayContain(db.bloomKey(key))
+}
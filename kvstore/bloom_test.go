@@ -0,0 +1,148 @@
+package kvstore
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestBloomNoFalseNegatives(t *testing.T) {
+	b := newBloom(10000)
+	for i := 0; i < 10000; i++ {
+		b.add([]byte(fmt.Sprintf("key%06d", i)))
+	}
+	for i := 0; i < 10000; i++ {
+		if key := []byte(fmt.Sprintf("key%06d", i)); !b.mayContain(key) {
+			t.Fatalf("added key %q reported absent", key)
+		}
+	}
+	// about 1% at capacity, allow some slack
+	fp := 0
+	for i := 0; i < 10000; i++ {
+		if b.mayContain([]byte(fmt.Sprintf("absent%06d", i))) {
+			fp++
+		}
+	}
+	if fp > 300 {
+		t.Fatalf("%d false positives in 10000", fp)
+	}
+}
+
+func mustFind(t *testing.T, db *KV, key string) {
+	t.Helper()
+	if _, _, ok, err := db.GetWithFlags([]byte(key)); err != nil || !ok {
+		t.Fatalf("GetWithFlags(%q) = %v %v, want found", key, ok, err)
+	}
+}
+
+// every write path must leave its keys in the filter
+func TestBloomWritePaths(t *testing.T) {
+	db := openTestDB(t, func(db *KV) {
+		db.BloomFilter = true
+		db.NormalizeKey = bytes.ToLower
+	})
+	if err := db.LoadSorted(testPairs(3000, "v"), 1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3000; i += 100 {
+		mustFind(t, db, fmt.Sprintf("KEY%06d", i))
+	}
+
+	mustSet(t, db, "set", "v")
+	if err := db.ApplyDiff([]KVPair{{[]byte("diff"), []byte("v")}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Rename([]byte("set"), []byte("renamed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *Tx) error { return tx.Set([]byte("tx"), []byte("v")) }); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"diff", "renamed", "tx"} {
+		mustFind(t, db, key)
+	}
+
+	root, err := db.BuildTree([]KVPair{{[]byte("swapped"), []byte("v")}}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SwapRoot(root); err != nil {
+		t.Fatal(err)
+	}
+	mustFind(t, db, "swapped")
+
+	skips := db.MetricsSnapshot().BloomSkips
+	for i := 0; i < 100; i++ {
+		db.GetWithFlags([]byte(fmt.Sprintf("absent%03d", i)))
+	}
+	if got := db.MetricsSnapshot().BloomSkips - skips; got < 90 {
+		t.Fatalf("%d of 100 absent gets skipped the tree", got)
+	}
+}
+
+// readers don't take the writer lock, a committed key must never be reported absent
+func TestBloomConcurrentReaders(t *testing.T) {
+	db := openTestDB(t, func(db *KV) { db.BloomFilter = true })
+	const n = 3000 // past the size of the first filter, so it is rebuilt on the way
+
+	var mu sync.Mutex
+	committed := 0
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				mu.Lock()
+				last := committed
+				mu.Unlock()
+				for i := max(0, last-50); i < last; i++ {
+					if !db.bloomMayContain([]byte(fmt.Sprintf("key%06d", i))) {
+						t.Errorf("committed key %d reported absent", i)
+						return
+					}
+				}
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		mustSet(t, db, fmt.Sprintf("key%06d", i), "v")
+		mu.Lock()
+		committed = i + 1
+		mu.Unlock()
+	}
+	close(done)
+	wg.Wait()
+}
+
+func BenchmarkGetAbsent(b *testing.B) {
+	for _, filter := range []bool{false, true} {
+		b.Run(fmt.Sprint("bloom=", filter), func(b *testing.B) {
+			db := &KV{Path: filepath.Join(b.TempDir(), "test.db"), BloomFilter: filter}
+			if err := db.Open(); err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			if err := db.LoadSorted(testPairs(100000, "value"), 1); err != nil {
+				b.Fatal(err)
+			}
+			keys := make([][]byte, 1024)
+			for i := range keys {
+				keys[i] = []byte(fmt.Sprintf("absent%06d", i))
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				db.GetWithFlags(keys[i%len(keys)])
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package kvstore
+
+// Change is a committed set or delete of a key recorded when KV.ChangeLog is set.
+type Change struct {
+	Op  string // "set" or "del"
+	Key []byte
+	Val []byte // the value set, nil for a delete
+	Gen uint64 // the update that committed it, changes of one atomic update share it
+}
+
+// the last KV.ChangeLog changes, oldest first once full. the changes of the running update
+// wait in pending until it commits, and are dropped if it fails.
+type changeLog struct {
+	changes []Change
+	next    int
+	pending []Change
+}
+
+// BTree.OnInsert hook. a tombstone is recorded as the delete it stands for
+func (db *KV) onInsert(key []byte, stored []byte) {
+	db.bloomAdd(key)
+	if db.isTombstone(stored) {
+		db.onDelete(key)
+		return
+	}
+	db.counters.pending.writes++
+	if db.ChangeLog > 0 {
+		val, _ := db.decodeVal(stored)
+		db.changes.pending = append(db.changes.pending,
+			Change{Op: "set", Key: append([]byte{}, key...), Val: append([]byte{}, val...)})
+	}
+}
+
+// BTree.OnDelete hook
+func (db *KV) onDelete(key []byte) {
+	db.counters.pending.writes++
+	db.counters.pending.dels++
+	if db.ChangeLog > 0 {
+		db.changes.pending = append(db.changes.pending, Change{Op: "del", Key: append([]byte{}, key...)})
+	}
+}
+
+// move the changes of the update that just committed into the log
+func (db *KV) commitChanges() {
+	log := &db.changes
+	for _, ch := range log.pending {
+		ch.Gen = db.gen
+		if len(log.changes) < db.ChangeLog {
+			log.changes = append(log.changes, ch)
+			continue
+		}
+		log.changes[log.next] = ch
+		log.next = (log.next + 1) % len(log.changes)
+	}
+	log.pending = log.pending[:0]
+}
+
+// RecentChanges returns up to the last n committed changes, oldest first. Empty unless KV.ChangeLog
+// is set. Only sets and deletes of single keys are recorded: bulk loads, SwapRoot and Clear are not.
+func (db *KV) RecentChanges(n int) []Change {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	if n <= 0 {
+		return nil
+	}
+	log := &db.changes
+	all := append(append([]Change{}, log.changes[log.next:]...), log.changes[:log.next]...)
+	return all[max(0, len(all)-n):]
+}
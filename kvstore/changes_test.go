@@ -0,0 +1,85 @@
+package kvstore
+
+import (
+	"fmt"
+	"syscall"
+	"testing"
+)
+
+// the changes as "op key=val@gen" strings
+func changeStrings(changes []Change) []string {
+	out := []string{}
+	for _, ch := range changes {
+		out = append(out, fmt.Sprintf("%s %s=%s@%d", ch.Op, ch.Key, ch.Val, ch.Gen))
+	}
+	return out
+}
+
+func mustChanges(t *testing.T, db *KV, n int, want ...string) {
+	t.Helper()
+	got := changeStrings(db.RecentChanges(n))
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("RecentChanges(%d) = %q, want %q", n, got, want)
+	}
+}
+
+func TestRecentChanges(t *testing.T) {
+	for _, tombstones := range []bool{false, true} {
+		t.Run(fmt.Sprint("tombstones=", tombstones), func(t *testing.T) {
+			db := openTestDB(t, func(db *KV) { db.ChangeLog, db.Tombstones = 3, tombstones })
+			g := db.gen
+			mustSet(t, db, "a", "1")
+			mustChanges(t, db, 10, fmt.Sprintf("set a=1@%d", g+1))
+
+			mustSet(t, db, "b", "2")
+			mustDel(t, db, "a")
+			mustSet(t, db, "c", "3")
+			// the ring keeps the last 3, oldest first
+			mustChanges(t, db, 10,
+				fmt.Sprintf("set b=2@%d", g+2), fmt.Sprintf("del a=@%d", g+3), fmt.Sprintf("set c=3@%d", g+4))
+			mustChanges(t, db, 1, fmt.Sprintf("set c=3@%d", g+4))
+			mustChanges(t, db, 0)
+
+			// the changes of one update share its generation
+			err := db.Update(func(tx *Tx) error {
+				tx.Set([]byte("d"), []byte("4"))
+				return tx.Del([]byte("b"))
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			mustChanges(t, db, 2, fmt.Sprintf("set d=4@%d", g+5), fmt.Sprintf("del b=@%d", g+5))
+
+			// Apply records its upserts and deletes too, in key order
+			if err := db.ApplyDiff([]KVPair{{[]byte("e"), []byte("5")}}, [][]byte{[]byte("c")}); err != nil {
+				t.Fatal(err)
+			}
+			mustChanges(t, db, 2, fmt.Sprintf("del c=@%d", g+6), fmt.Sprintf("set e=5@%d", g+6))
+		})
+	}
+}
+
+func TestRecentChangesFailedUpdate(t *testing.T) {
+	db := openTestDB(t, func(db *KV) { db.ChangeLog, db.MasterRetries = 10, -1 })
+	mustSet(t, db, "a", "1")
+	g := db.gen
+
+	failMasterWrites(t, syscall.EIO)
+	if err := db.Set([]byte("b"), []byte("2")); err == nil {
+		t.Fatal("Set committed with a failing master write")
+	}
+	mustChanges(t, db, 10, fmt.Sprintf("set a=1@%d", g))
+
+	// nor are they recorded by the next update
+	mustSet(t, db, "c", "3")
+	mustChanges(t, db, 10, fmt.Sprintf("set a=1@%d", g), fmt.Sprintf("set c=3@%d", g+1))
+}
+
+func TestRecentChangesOff(t *testing.T) {
+	db := openTestDB(t, nil)
+	mustSet(t, db, "a", "1")
+	mustDel(t, db, "a")
+	if changes := db.RecentChanges(10); len(changes) != 0 {
+		t.Fatalf("%d changes recorded without a ChangeLog", len(changes))
+	}
+}
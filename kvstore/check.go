@@ -0,0 +1,67 @@
+package kvstore
+
+import (
+	"bytes"
+	"fmt"
+	"kurocifer/LeichtKV/btree"
+)
+
+// Scrub reads every value in the DB and reports each key whose value can't be decoded.
+// The scan keeps going after a failure so the whole extent of the damage is reported.
+// key is nil when the key itself is unreadable.
+func (db *KV) Scrub(fn func(key []byte, err error)) {
+	db.tree.Scrub(func(ptr uint64, key []byte, err error) {
+		fn(key, fmt.Errorf("page %d: %w", ptr, err))
+	})
+}
+
+// Validate checks the structure of every node in the tree.
+func (db *KV) Validate() error {
+	if err := db.tree.Validate(); err != nil {
+		return fmt.Errorf("Validate: %w", err)
+	}
+	return nil
+}
+
+// WasCleanlyClosed reports whether the last writer to the file called Close after its last commit,
+// as recorded in the master page when the DB was opened. False means it may have crashed, and
+// a fuller check such as HealthCheck is worth running. Files written before the flag existed
+// report false; an empty new file reports true.
+func (db *KV) WasCleanlyClosed() bool {
+	return db.wasClean
+}
+
+// TreesEqual reports whether two DBs hold the same keys with the same values and flags,
+// however their trees are laid out. Use SameStructure to also compare the layout.
+func TreesEqual(a, b *KV) (bool, error) {
+	ia, ib := a.tree.SeekIter(nil), b.tree.SeekIter(nil)
+	for {
+		ka, va, oka := a.nextLive(ia)
+		kb, vb, okb := b.nextLive(ib)
+		if !oka || !okb {
+			return oka == okb, nil
+		}
+
+		vala, ma := a.decodeVal(va)
+		valb, mb := b.decodeVal(vb)
+		if !bytes.Equal(ka, kb) || !bytes.Equal(vala, valb) || ma.flags != mb.flags {
+			return false, nil
+		}
+	}
+}
+
+// the next kv of it that isn't a tombstone
+func (db *KV) nextLive(it *btree.Iter) ([]byte, []byte, bool) {
+	for {
+		k, v, ok := it.Next()
+		if !ok || !db.isTombstone(v) {
+			return k, v, ok
+		}
+	}
+}
+
+// SameStructure reports whether two DBs have identical trees node by node, e.g. after
+// restoring a backup with the same options. Page numbers are not compared.
+func SameStructure(a, b *KV) bool {
+	return a.features == b.features && btree.SameShape(&a.tree, &b.tree)
+}
@@ -0,0 +1,110 @@
+package kvstore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTreesEqual(t *testing.T) {
+	flags := func(db *KV) { db.ValueFlags = true }
+	a, b, c := openTestDB(t, flags), openTestDB(t, flags), openTestDB(t, flags)
+	for i := 0; i < 1000; i++ {
+		mustSet(t, a, fmt.Sprintf("key%06d", i), fmt.Sprint(i))
+		mustSet(t, b, fmt.Sprintf("key%06d", i), fmt.Sprint(i))
+		mustSet(t, c, fmt.Sprintf("key%06d", 999-i), fmt.Sprint(999-i))
+	}
+
+	equal := func(x, y *KV) bool {
+		t.Helper()
+		eq, err := TreesEqual(x, y)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return eq
+	}
+	if !equal(a, b) || !SameStructure(a, b) {
+		t.Fatal("the same writes in the same order compare different")
+	}
+	// the same data in a tree split elsewhere
+	if !equal(a, c) {
+		t.Error("the same data written in another order is not equal")
+	}
+	if SameStructure(a, c) {
+		t.Error("trees written in another order have the same structure")
+	}
+
+	if err := b.SetWithFlags([]byte("key000500"), []byte("500"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if equal(a, b) {
+		t.Error("equal with another flags byte")
+	}
+	if err := b.SetWithFlags([]byte("key000500"), []byte("500"), 0); err != nil {
+		t.Fatal(err)
+	}
+	mustDel(t, b, "key000999")
+	if equal(a, b) || equal(b, a) {
+		t.Error("equal with a key missing")
+	}
+}
+
+func TestWasCleanlyClosed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if !db.WasCleanlyClosed() {
+		t.Error("a new file is not clean")
+	}
+	mustSet(t, db, "k", "v")
+
+	// every commit clears the flag, so a copy taken now is what a crash leaves
+	if info, err := Inspect(path); err != nil || info.Clean {
+		t.Fatalf("Inspect of an open DB: clean %v %v", info.Clean, err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crashed, readOnly := filepath.Join(t.TempDir(), "crashed.db"), filepath.Join(t.TempDir(), "ro.db")
+	for _, p := range []string{crashed, readOnly} {
+		if err := os.WriteFile(p, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	if info, err := Inspect(path); err != nil || !info.Clean {
+		t.Fatalf("Inspect after Close: clean %v %v", info.Clean, err)
+	}
+	for _, c := range []struct {
+		path string
+		want bool
+	}{{path, true}, {crashed, false}} {
+		db := &KV{Path: c.path}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		if db.WasCleanlyClosed() != c.want {
+			t.Errorf("%s: WasCleanlyClosed = %v, want %v", filepath.Base(c.path), !c.want, c.want)
+		}
+		mustGet(t, db, "k", "v")
+		db.Close()
+	}
+
+	// the writable opens above marked the files clean on Close, a read-only one leaves the flag alone
+	if info, err := Inspect(crashed); err != nil || !info.Clean {
+		t.Fatalf("Inspect after Close of the crashed file: clean %v %v", info.Clean, err)
+	}
+	ro := &KV{Path: readOnly, ReadOnly: true}
+	if err := ro.Open(); err != nil {
+		t.Fatal(err)
+	}
+	ro.Close()
+	if info, err := Inspect(readOnly); err != nil || info.Clean {
+		t.Fatalf("Inspect after a read-only Close: clean %v %v", info.Clean, err)
+	}
+}
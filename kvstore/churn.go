@@ -0,0 +1,66 @@
+package kvstore
+
+// the commits the rolling rate of ChurnStats covers
+const CHURN_WINDOW = 64
+
+// ChurnStats relates the node splits and merges to the key writes that caused them.
+// A high rate means the writes keep landing on full or nearly empty nodes, e.g. inserts at
+// the edge of pages packed full by LoadSorted with a fill of 1, or deletes undoing the inserts
+// around a merge threshold that is too high (see KV.MinKeysPerNode).
+type ChurnStats struct {
+	Writes   uint64  // keys inserted, overwritten or deleted since Open, bulk loads not counted
+	Splits   uint64  // same as Metrics.Splits
+	Merges   uint64  // same as Metrics.Merges
+	PerWrite float64 // (Splits + Merges) / Writes, 0 without writes
+	Recent   float64 // the same over the last CHURN_WINDOW commits
+}
+
+// the per-commit deltas of the counters for the rolling rate
+type churnWindow struct {
+	last    churnSample // the counters at the last commit
+	samples [CHURN_WINDOW]churnSample
+	next    int
+}
+
+type churnSample struct {
+	writes, churn uint64 // churn is splits + merges
+}
+
+// record the commit that just happened
+func (db *KV) churnCommit() {
+	now := db.churnNow()
+	w := &db.churn
+	w.samples[w.next] = churnSample{writes: now.writes - w.last.writes, churn: now.churn - w.last.churn}
+	w.next = (w.next + 1) % CHURN_WINDOW
+	w.last = now
+}
+
+func (db *KV) churnNow() churnSample {
+	c := &db.counters
+	return churnSample{writes: c.writes.Load(), churn: c.splits.Load() + c.merges.Load()}
+}
+
+// ChurnStats returns the split and merge counts per key written.
+func (db *KV) ChurnStats() ChurnStats {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	c := &db.counters
+	stats := ChurnStats{Writes: c.writes.Load(), Splits: c.splits.Load(), Merges: c.merges.Load()}
+	stats.PerWrite = churnRate(stats.Splits+stats.Merges, stats.Writes)
+
+	recent := churnSample{}
+	for _, s := range db.churn.samples {
+		recent.writes += s.writes
+		recent.churn += s.churn
+	}
+	stats.Recent = churnRate(recent.churn, recent.writes)
+	return stats
+}
+
+func churnRate(churn, writes uint64) float64 {
+	if writes == 0 {
+		return 0
+	}
+	return float64(churn) / float64(writes)
+}
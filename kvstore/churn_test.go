@@ -0,0 +1,66 @@
+package kvstore
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// bulk load every other key at fill, then insert some of the keys in between, spread over the tree
+func churnAfterLoad(t *testing.T, fill float64) ChurnStats {
+	db := openTestDB(t, nil)
+	val := strings.Repeat("v", 100)
+	pairs := []KVPair{}
+	for i := 0; i < 4000; i += 2 {
+		pairs = append(pairs, KVPair{[]byte(fmt.Sprintf("key%06d", i)), []byte(val)})
+	}
+	if err := db.LoadSorted(pairs, fill); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < 4000; i += 40 {
+		mustSet(t, db, fmt.Sprintf("key%06d", i), val)
+	}
+	return db.ChurnStats()
+}
+
+func TestChurnStats(t *testing.T) {
+	// packed full, each insert lands on a full leaf and splits it
+	full := churnAfterLoad(t, 1)
+	if full.Writes != 100 {
+		t.Fatalf("%d writes, want 100", full.Writes)
+	}
+	if full.PerWrite < 0.9 || full.Recent < 0.9 {
+		t.Errorf("fill 1: churn %.2f per write (%.2f recent), want about 1", full.PerWrite, full.Recent)
+	}
+
+	// half full, the same inserts fit in the leaves
+	half := churnAfterLoad(t, 0.5)
+	if half.PerWrite > 0.1 || half.Splits != 0 {
+		t.Errorf("fill 0.5: churn %.2f per write with %d splits, want almost none", half.PerWrite, half.Splits)
+	}
+}
+
+func TestChurnWrites(t *testing.T) {
+	for _, tomb := range []bool{false, true} {
+		t.Run(fmt.Sprintf("tombstones=%v", tomb), func(t *testing.T) {
+			// the change log sees a tombstone as a delete too, it still counts once
+			db := openTestDB(t, func(db *KV) { db.Tombstones = tomb; db.ValueFlags = tomb; db.ChangeLog = 10 })
+			mustSet(t, db, "a", "1")
+			mustSet(t, db, "a", "2")
+			mustDel(t, db, "a")
+			if w := db.ChurnStats().Writes; w != 3 {
+				t.Fatalf("%d writes, want 3", w)
+			}
+
+			// a failed commit wrote nothing
+			failMasterWrites(t, syscall.EIO)
+			if err := db.Set([]byte("b"), []byte("1")); err == nil {
+				t.Fatal("Set succeeded with a failing master write")
+			}
+			if w := db.ChurnStats().Writes; w != 3 {
+				t.Fatalf("%d writes after a failed commit, want 3", w)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package kvstore
+
+import "time"
+
+// how long the background free goroutine waits after a commit queued pages before draining them
+const DRAIN_DELAY = 10 * time.Millisecond
+
+// the pages freed by commits that can't go on the free list yet: while KV.BackgroundFree is set
+// they wait for the drain goroutine, and while a Snapshot is open they are held so the snapshot's
+// pages aren't reused. they are in neither the tree nor the free list meanwhile, and a crash
+// leaks them until the next Open finds them again.
+type drainer struct {
+	wake     chan struct{} // nil unless BackgroundFree
+	done     chan struct{}
+	deferred []uint64 // freed by committed updates
+	later    []uint64 // freed by the running update, deferred once it commits
+	draining bool     // the running update is the drain itself
+	snaps    int      // open snapshots, nothing is drained while there are any
+}
+
+// on Open: find the pages leaked by a crash, which costs a walk of the tree and the free list
+// but only after an unclean shutdown, and start the drain goroutine if asked for
+func (db *KV) drainStart() {
+	if db.ReadOnly {
+		return
+	}
+	if !db.wasClean {
+		db.drain.deferred = db.leakedPages()
+	}
+	if !db.BackgroundFree {
+		_ = db.drainFrees() // best effort, the next unclean Open tries again
+		return
+	}
+
+	wake, done := make(chan struct{}, 1), make(chan struct{})
+	db.drain.wake, db.drain.done = wake, done
+	go func() {
+		defer close(done)
+		for range wake {
+			// let the frees of the commits meanwhile pile up, so one update drains them all
+			time.Sleep(DRAIN_DELAY)
+			db.writer.Lock()
+			_ = db.drainFrees() // on error the pages stay queued for the next round
+			db.writer.Unlock()
+		}
+	}()
+	db.drainWake()
+}
+
+// drain now, or get the goroutine to. the caller holds db.writer
+func (db *KV) drainWake() {
+	if len(db.drain.deferred) == 0 || db.drain.snaps > 0 {
+		return
+	}
+	if db.drain.wake == nil {
+		_ = db.drainFrees()
+		return
+	}
+	select {
+	case db.drain.wake <- struct{}{}:
+	default: // already pending, it will pick these up too
+	}
+}
+
+// stop the goroutine and drain what's left, before Close.
+// snapshots still open can't be used after Close, so their pages are freed too
+func (db *KV) drainStop() {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	if db.drain.wake != nil {
+		// the goroutine may be waiting for the lock, let it finish without it
+		close(db.drain.wake)
+		db.drain.wake = nil
+		db.writer.Unlock()
+		<-db.drain.done
+		db.writer.Lock()
+	}
+
+	db.drain.snaps = 0
+	if !db.ReadOnly {
+		_ = db.drainFrees()
+	}
+}
+
+// push all the deferred pages to the free list in one update. the caller holds db.writer
+func (db *KV) drainFrees() error {
+	ptrs := db.drain.deferred
+	if len(ptrs) == 0 || db.drain.snaps > 0 {
+		return nil
+	}
+	err := db.update(func() {
+		db.drain.draining = true
+		for _, ptr := range ptrs {
+			db.page.updates[ptr] = nil
+		}
+	})
+	if err != nil {
+		return err
+	}
+	db.drain.deferred = db.drain.deferred[len(ptrs):]
+	return nil
+}
+
+// called by writePages with the pages the update freed, returns the ones to free now
+func (db *KV) deferFrees(freed []uint64) []uint64 {
+	if db.drain.draining || (db.drain.wake == nil && db.drain.snaps == 0) {
+		return freed
+	}
+	db.drain.later = freed
+	return nil
+}
+
+// the update committed or failed
+func (db *KV) drainCommitted(ok bool) {
+	if ok {
+		db.drain.deferred = append(db.drain.deferred, db.drain.later...)
+	}
+	later := len(db.drain.later)
+	db.drain.later = nil
+	if db.drain.draining {
+		db.drain.draining = false
+		return // a drain never triggers another one
+	}
+	if ok && later > 0 && db.drain.wake != nil {
+		db.drainWake()
+	}
+}
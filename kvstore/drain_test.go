@@ -0,0 +1,176 @@
+package kvstore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wait for the background free goroutine to empty its queue
+func waitDrained(t *testing.T, db *KV) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		db.writer.Lock()
+		n := len(db.drain.deferred)
+		db.writer.Unlock()
+		if n == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d pages still queued", n)
+		}
+	}
+}
+
+func TestBackgroundFree(t *testing.T) {
+	db := openTestDB(t, func(db *KV) { db.BackgroundFree = true })
+	for i := 0; i < 500; i++ {
+		mustSet(t, db, fmt.Sprintf("key%04d", i), strings.Repeat("v", 100))
+	}
+	waitDrained(t, db)
+	before := db.MetricsSnapshot()
+	total := db.free.Total()
+
+	// the deletes leave the free list to the goroutine
+	for i := 0; i < 500; i += 2 {
+		mustDel(t, db, fmt.Sprintf("key%04d", i))
+	}
+	waitDrained(t, db)
+	after := db.MetricsSnapshot()
+	// the frees of many deletes are drained together, by far fewer updates of their own
+	if deletes, drains := uint64(250), after.Flushes-before.Flushes-250; drains == 0 || drains >= deletes/2 {
+		t.Errorf("%d drains for %d deletes", drains, deletes)
+	}
+	if db.free.Total() <= total {
+		t.Fatalf("free list of %d pages, was %d", db.free.Total(), total)
+	}
+	if leaked := db.PageLeakReport(); len(leaked) != 0 {
+		t.Fatalf("leaked pages %v", leaked)
+	}
+	if r := db.HealthCheck(); !r.OK() {
+		t.Fatalf("health check:\n%s", r)
+	}
+
+	// writes go on while the queue waits, as the queued pages can't be reused yet
+	for i := 0; i < 500; i += 2 {
+		mustSet(t, db, fmt.Sprintf("key%04d", i), strings.Repeat("v", 100))
+	}
+	waitDrained(t, db)
+	if leaked := db.PageLeakReport(); len(leaked) != 0 {
+		t.Fatalf("leaked pages %v", leaked)
+	}
+	mustGet(t, db, "key0498", strings.Repeat("v", 100))
+}
+
+func TestBackgroundFreeClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path, BackgroundFree: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		mustSet(t, db, fmt.Sprintf("key%04d", i), "v")
+	}
+	for i := 0; i < 200; i++ {
+		mustDel(t, db, fmt.Sprintf("key%04d", i))
+	}
+	// Close drains whatever is still queued
+	db.Close()
+
+	db = &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if leaked := db.PageLeakReport(); len(leaked) != 0 {
+		t.Fatalf("leaked pages %v after Close", leaked)
+	}
+}
+
+func TestBackgroundFreeAfterCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		mustSet(t, db, fmt.Sprintf("key%04d", i), "v")
+	}
+	// what a crash leaves with pages queued: freed by a commit but not on the free list
+	err := db.update(func() {
+		for i := 0; i < 100; i++ {
+			db.tree.Delete([]byte(fmt.Sprintf("key%04d", i)))
+		}
+		for ptr, page := range db.page.updates {
+			if page == nil {
+				delete(db.page.updates, ptr)
+			}
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaked := len(db.PageLeakReport())
+	if leaked == 0 {
+		t.Fatal("no pages leaked")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	crashed := filepath.Join(t.TempDir(), "crashed.db")
+	if err := os.WriteFile(crashed, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	db = &KV{Path: crashed, BackgroundFree: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	total := db.free.Total()
+	waitDrained(t, db)
+	if got := db.PageLeakReport(); len(got) != 0 {
+		t.Fatalf("leaked pages %v after the drain", got)
+	}
+	if db.free.Total() < total+leaked {
+		t.Fatalf("free list of %d pages, want at least %d", db.free.Total(), total+leaked)
+	}
+	mustGet(t, db, "key0150", "v")
+}
+
+func BenchmarkDelete(b *testing.B) {
+	for _, background := range []bool{false, true} {
+		b.Run(fmt.Sprint("BackgroundFree=", background), func(b *testing.B) {
+			db := &KV{Path: filepath.Join(b.TempDir(), "test.db"), BackgroundFree: background}
+			if err := db.Open(); err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			key := func(i int) []byte { return []byte(fmt.Sprintf("key%08d", i)) }
+			for i := 0; i < 2*b.N; i++ {
+				if err := db.Set(key(i), []byte(strings.Repeat("v", 100))); err != nil {
+					b.Fatal(err)
+				}
+			}
+			// free pages to reuse, so neither mode grows the file while the queue waits
+			for i := b.N; i < 2*b.N; i++ {
+				if _, err := db.Del(key(i)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			time.Sleep(2 * DRAIN_DELAY)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.Del(key(i)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
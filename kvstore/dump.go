@@ -0,0 +1,83 @@
+package kvstore
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+)
+
+// human readable dumps, in key order. keys and values are arbitrary bytes: printable ones are
+// written as they are, the others escaped so the dump still parses back to the same bytes.
+
+// printable text, without tabs or line breaks that would break a line based dump
+func printable(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// a key or value of DumpJSON: a plain string when printable, base64 in the _b64 field otherwise
+func dumpJSONField(b []byte) (text *string, b64 *string) {
+	s := string(b)
+	if printable(b) {
+		return &s, nil
+	}
+	s = base64.StdEncoding.EncodeToString(b)
+	return nil, &s
+}
+
+// DumpJSON writes one object per line. Printable keys and values are plain strings under "key"
+// and "val", the others are base64 encoded under "key_b64" and "val_b64" instead.
+func (db *KV) DumpJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	var err error
+	db.scan(nil, func(k, v []byte) bool {
+		var pair struct {
+			Key    *string `json:"key,omitempty"`
+			KeyB64 *string `json:"key_b64,omitempty"`
+			Val    *string `json:"val,omitempty"`
+			ValB64 *string `json:"val_b64,omitempty"`
+		}
+		pair.Key, pair.KeyB64 = dumpJSONField(k)
+		pair.Val, pair.ValB64 = dumpJSONField(v)
+		err = enc.Encode(pair)
+		return err == nil
+	})
+	if err != nil {
+		return fmt.Errorf("DumpJSON: %w", err)
+	}
+	return nil
+}
+
+// a key or value of DumpTSV: as is when printable, Go quoted (with \x escapes) otherwise.
+// a printable field starting with a quote is quoted too, so strconv.Unquote tells them apart
+func dumpTSVField(b []byte) string {
+	if printable(b) && (len(b) == 0 || b[0] != '"') {
+		return string(b)
+	}
+	return strconv.Quote(string(b))
+}
+
+// DumpTSV writes one "key<TAB>val" line per pair. Printable keys and values are written as they are,
+// the others Go quoted, which escapes tabs, line breaks and non UTF-8 bytes.
+func (db *KV) DumpTSV(w io.Writer) error {
+	var err error
+	db.scan(nil, func(k, v []byte) bool {
+		_, err = fmt.Fprintf(w, "%s\t%s\n", dumpTSVField(k), dumpTSVField(v))
+		return err == nil
+	})
+	if err != nil {
+		return fmt.Errorf("DumpTSV: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package kvstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// in key order, with bytes that would break a naive text dump
+var dumpPairs = [][2]string{{"\x00\xff", ""}, {"a", "1"}, {"b\tc", "line\nbreak"}, {"key 1", "ünïcode"}, {"z", "\"quoted\""}}
+
+func openDumpDB(t *testing.T) *KV {
+	db := openTestDB(t, nil)
+	for _, i := range []int{2, 0, 4, 3, 1} {
+		mustSet(t, db, dumpPairs[i][0], dumpPairs[i][1])
+	}
+	return db
+}
+
+func checkDump(t *testing.T, got [][2]string) {
+	t.Helper()
+	if len(got) != len(dumpPairs) {
+		t.Fatalf("%d pairs dumped, want %d", len(got), len(dumpPairs))
+	}
+	for i, want := range dumpPairs {
+		if got[i] != want {
+			t.Errorf("pair %d: %q, want %q", i, got[i], want)
+		}
+	}
+}
+
+func TestDumpJSON(t *testing.T) {
+	db := openDumpDB(t)
+	var buf bytes.Buffer
+	if err := db.DumpJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	// printable keys and values are plain strings
+	for _, want := range []string{`{"key":"a","val":"1"}`, `{"key":"key 1","val":"ünïcode"}`, `{"key":"z","val":"\"quoted\""}`} {
+		if !strings.Contains(buf.String(), want+"\n") {
+			t.Errorf("no line %s in the dump:\n%s", want, buf.String())
+		}
+	}
+
+	got := [][2]string{}
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var pair struct {
+			Key    *string `json:"key"`
+			KeyB64 *string `json:"key_b64"`
+			Val    *string `json:"val"`
+			ValB64 *string `json:"val_b64"`
+		}
+		if err := dec.Decode(&pair); err != nil {
+			t.Fatal(err)
+		}
+		field := func(text, b64 *string) string {
+			if (text == nil) == (b64 == nil) {
+				t.Fatalf("pair %d: want exactly one of the plain and base64 fields", len(got))
+			}
+			if text != nil {
+				return *text
+			}
+			b, err := base64.StdEncoding.DecodeString(*b64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return string(b)
+		}
+		got = append(got, [2]string{field(pair.Key, pair.KeyB64), field(pair.Val, pair.ValB64)})
+	}
+	checkDump(t, got)
+}
+
+func TestDumpTSV(t *testing.T) {
+	db := openDumpDB(t)
+	var buf bytes.Buffer
+	if err := db.DumpTSV(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"a\t1\n", "key 1\tünïcode\n", `"\x00\xff"` + "\t\n", `"b\tc"` + "\t" + `"line\nbreak"`, "z\t" + `"\"quoted\""`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("no %q in the dump:\n%s", want, buf.String())
+		}
+	}
+
+	got := [][2]string{}
+	lines := bufio.NewScanner(&buf)
+	for lines.Scan() {
+		fields := strings.Split(lines.Text(), "\t")
+		if len(fields) != 2 {
+			t.Fatalf("line %q has %d fields", lines.Text(), len(fields))
+		}
+		pair := [2]string{}
+		for i, field := range fields {
+			pair[i] = field
+			if strings.HasPrefix(field, `"`) {
+				s, err := strconv.Unquote(field)
+				if err != nil {
+					t.Fatalf("field %s: %v", field, err)
+				}
+				pair[i] = s
+			}
+		}
+		got = append(got, pair)
+	}
+	checkDump(t, got)
+}
+
+type failWriter struct{}
+
+func (failWriter) Write([]byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestDumpWriteError(t *testing.T) {
+	db := openDumpDB(t)
+	if err := db.DumpJSON(failWriter{}); err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Errorf("DumpJSON: %v", err)
+	}
+	if err := db.DumpTSV(failWriter{}); err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Errorf("DumpTSV: %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package kvstore
+
+import (
+	"fmt"
+	"kurocifer/LeichtKV/btree"
+	"slices"
+)
+
+// Flusher persists the pages of a commit, see KV.Flusher.
+// A commit calls Write once with every new or updated page, keyed by page number, after the file
+// has been extended to hold them, then Sync. The master page is only written once Sync returns,
+// so a crash in between leaves the previous version intact (see KV.SyncPolicy).
+// Pages must be readable through the file (and thus the mapping) once Write returns.
+type Flusher interface {
+	Write(pages map[uint64][]byte) error
+	Sync() error
+}
+
+// DefaultFlusher returns the synchronous flusher used when KV.Flusher is nil: it copies the pages
+// into the mapping and fsyncs the file. Custom flushers can wrap it.
+func (db *KV) DefaultFlusher() Flusher {
+	return mmapFlusher{db}
+}
+
+type mmapFlusher struct {
+	db *KV
+}
+
+func (f mmapFlusher) Write(pages map[uint64][]byte) error {
+	if f.db.CoalesceWrites {
+		return f.writeRuns(pages)
+	}
+	for ptr, page := range pages {
+		copy(pageGetMapped(f.db, ptr).Data, page)
+	}
+	return nil
+}
+
+// write runs of consecutive pages with one pwrite each, instead of a copy per page.
+// the mapping is shared, so it sees the written data like with the copies.
+func (f mmapFlusher) writeRuns(pages map[uint64][]byte) error {
+	ptrs := make([]uint64, 0, len(pages))
+	for ptr := range pages {
+		ptrs = append(ptrs, ptr)
+	}
+	slices.Sort(ptrs)
+
+	buf := []byte{}
+	for i := 0; i < len(ptrs); {
+		j := i + 1
+		for j < len(ptrs) && ptrs[j] == ptrs[j-1]+1 {
+			j++
+		}
+
+		buf = slices.Grow(buf[:0], (j-i)*btree.BTREE_PAGE_SIZE)[:(j-i)*btree.BTREE_PAGE_SIZE]
+		for k, ptr := range ptrs[i:j] {
+			dst := buf[k*btree.BTREE_PAGE_SIZE:][:btree.BTREE_PAGE_SIZE]
+			// a short page only overwrites its own bytes, keep the rest of the page like a copy does
+			if n := copy(dst, pages[ptr]); n < len(dst) {
+				copy(dst[n:], pageGetMapped(f.db, ptr).Data[n:])
+			}
+		}
+		if _, err := f.db.fp.WriteAt(buf, int64(ptrs[i])*btree.BTREE_PAGE_SIZE); err != nil {
+			return err
+		}
+		i = j
+	}
+	return nil
+}
+
+func (f mmapFlusher) Sync() error {
+	if err := fsync(f.db.fp); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	return nil
+}
+
+func (db *KV) flusher() Flusher {
+	if db.Flusher != nil {
+		return db.Flusher
+	}
+	return mmapFlusher{db}
+}
+
+// the pages a commit writes, without the freed ones
+func (db *KV) dirtyPages() map[uint64][]byte {
+	pages := make(map[uint64][]byte, len(db.page.updates))
+	for ptr, page := range db.page.updates {
+		if page != nil {
+			pages[ptr] = page
+		}
+	}
+	return pages
+}
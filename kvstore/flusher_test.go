@@ -0,0 +1,180 @@
+package kvstore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"kurocifer/LeichtKV/btree"
+	"maps"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// wraps the default flusher, recording the calls and failing them on demand
+type recFlusher struct {
+	next     Flusher
+	calls    []string
+	written  [][]uint64 // the page numbers of each Write, sorted
+	failNext error
+}
+
+func (f *recFlusher) Write(pages map[uint64][]byte) error {
+	f.calls = append(f.calls, "write")
+	f.written = append(f.written, slices.Sorted(maps.Keys(pages)))
+	if err := f.failNext; err != nil {
+		f.failNext = nil
+		return err
+	}
+	return f.next.Write(pages)
+}
+
+func (f *recFlusher) Sync() error {
+	f.calls = append(f.calls, "sync")
+	return f.next.Sync()
+}
+
+func TestFlusher(t *testing.T) {
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db")}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	f := &recFlusher{next: db.DefaultFlusher()}
+	db.Flusher = f
+
+	mustSet(t, db, "a", "1")
+	first := db.tree.Root
+	mustSet(t, db, "b", "2")
+	if len(f.calls) != 4 || f.calls[0] != "write" || f.calls[1] != "sync" || f.calls[2] != "write" || f.calls[3] != "sync" {
+		t.Fatalf("calls %v, want a write then a sync per commit", f.calls)
+	}
+	// the first commit writes the root leaf. the second a new root, and the free list node
+	// holding the old one, which the DB doesn't reuse within the commit that freed it
+	if !freeSet(db)[first] {
+		t.Fatalf("the first root %d is not in the free list", first)
+	}
+	nodes := []uint64{}
+	db.free.Walk(func(ptr uint64, node bool) {
+		if node {
+			nodes = append(nodes, ptr)
+		}
+	})
+	want := [][]uint64{{first}, slices.Sorted(slices.Values(append(nodes, db.tree.Root)))}
+	if !slices.EqualFunc(f.written, want, slices.Equal) {
+		t.Fatalf("pages written %v, want %v", f.written, want)
+	}
+
+	// a failed write fails the commit and leaves the DB as it was
+	f.failNext = errors.New("disk on fire")
+	if err := db.Set([]byte("a"), []byte("3")); err == nil {
+		t.Fatal("Set succeeded with a failing flusher")
+	}
+	mustGet(t, db, "a", "1")
+	mustSet(t, db, "c", "3")
+	mustGet(t, db, "c", "3")
+
+	db.Close()
+	db = &KV{Path: db.Path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	mustGet(t, db, "a", "1")
+	mustGet(t, db, "b", "2")
+	mustGet(t, db, "c", "3")
+}
+
+func TestCoalesceWrites(t *testing.T) {
+	contents := [2]map[string]string{}
+	for i, coalesce := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "test.db")
+		db := &KV{Path: path, CoalesceWrites: coalesce}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.LoadSorted(testPairs(5000, "value"), 1); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 5000; j += 7 {
+			mustDel(t, db, fmt.Sprintf("key%06d", j))
+		}
+		mustSet(t, db, "key000001", "new")
+		// the mapping sees the written pages
+		mustGet(t, db, "key000001", "new")
+		mustMiss(t, db, "key000007")
+		db.Close()
+
+		db = &KV{Path: path}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		contents[i] = map[string]string{}
+		db.scan(nil, func(k, v []byte) bool {
+			contents[i][string(k)] = string(v)
+			return true
+		})
+		db.Close()
+	}
+	if !maps.Equal(contents[0], contents[1]) {
+		t.Fatalf("%d keys with coalesced writes, %d without", len(contents[1]), len(contents[0]))
+	}
+}
+
+// a large commit, like a bulk load: a run of consecutive new pages
+func BenchmarkCoalesceWrites(b *testing.B) {
+	const npages = 2048
+	for _, coalesce := range []bool{false, true} {
+		b.Run(fmt.Sprint("CoalesceWrites=", coalesce), func(b *testing.B) {
+			db := &KV{Path: filepath.Join(b.TempDir(), "test.db"), CoalesceWrites: coalesce}
+			if err := db.Open(); err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			if err := extendFile(db, 1+npages); err != nil {
+				b.Fatal(err)
+			}
+			if err := extendMmap(db, 1+npages); err != nil {
+				b.Fatal(err)
+			}
+			pages := map[uint64][]byte{}
+			for ptr := uint64(1); ptr <= npages; ptr++ {
+				pages[ptr] = bytes.Repeat([]byte{byte(ptr)}, btree.BTREE_PAGE_SIZE)
+			}
+
+			b.SetBytes(npages * btree.BTREE_PAGE_SIZE)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := db.DefaultFlusher().Write(pages); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// changes a marker in every page on the way to the file, like a bad disk would
+type corruptFlusher struct {
+	next Flusher
+}
+
+func (f corruptFlusher) Write(pages map[uint64][]byte) error {
+	bad := make(map[uint64][]byte, len(pages))
+	for ptr, page := range pages {
+		bad[ptr] = bytes.ReplaceAll(page, []byte("marker"), []byte("MARKER"))
+	}
+	return f.next.Write(bad)
+}
+
+func (f corruptFlusher) Sync() error { return f.next.Sync() }
+
+func TestVerifyWrites(t *testing.T) {
+	db := openTestDB(t, func(db *KV) { db.VerifyWrites = true })
+	for i := 0; i < 500; i++ {
+		mustSet(t, db, fmt.Sprintf("key%04d", i), "value")
+	}
+
+	db.Flusher = corruptFlusher{next: db.DefaultFlusher()}
+	if err := db.Set([]byte("key0001"), []byte("marker")); !errors.Is(err, ErrVerifyFailed) {
+		t.Fatalf("Set of a corrupted write: %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"kurocifer/LeichtKV/btree"
+	"time"
+)
+
+// HealthReport is the outcome of HealthCheck, one entry per check in the order they ran.
+type HealthReport struct {
+	Checks []CheckResult
+}
+
+type CheckResult struct {
+	Name string
+	Err  error // nil if the check passed
+	Took time.Duration
+}
+
+// OK reports whether every check passed.
+func (r HealthReport) OK() bool {
+	for _, c := range r.Checks {
+		if c.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (r HealthReport) String() string {
+	s := ""
+	for _, c := range r.Checks {
+		status := "ok"
+		if c.Err != nil {
+			status = c.Err.Error()
+		}
+		s += fmt.Sprintf("%-9s %-10v %s\n", c.Name, c.Took.Round(time.Microsecond), status)
+	}
+	return s
+}
+
+// HealthCheck runs every structural check on the committed state and reports each one:
+//   - master: the master page on disk agrees with the open DB
+//   - tree: Validate
+//   - values: Scrub, every value decodes
+//   - freelist: the free list is acyclic, in range and its total matches its length
+//   - pages: every page is used exactly once, by the tree or the free list
+//
+// It reads the whole file and blocks updates meanwhile. A damaged page fails the check
+// that met it instead of panicking, and the later checks still run.
+func (db *KV) HealthCheck() HealthReport {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	report := HealthReport{}
+	run := func(name string, check func() error) {
+		start := time.Now()
+		err := func() (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("panic: %v", r)
+				}
+			}()
+			return check()
+		}()
+		report.Checks = append(report.Checks, CheckResult{name, err, time.Since(start)})
+	}
+
+	run("master", db.checkMaster)
+	run("tree", db.tree.Validate)
+	run("values", func() error {
+		n, first := 0, error(nil)
+		db.Scrub(func(key []byte, err error) {
+			if n++; first == nil {
+				first = err
+			}
+		})
+		if n > 0 {
+			return fmt.Errorf("%d bad values, first: %w", n, first)
+		}
+		return nil
+	})
+	run("freelist", db.checkFreeList)
+	run("pages", db.checkPages)
+	return report
+}
+
+func (db *KV) checkMaster() error {
+	if db.mmap.file == 0 {
+		return nil // nothing committed yet
+	}
+	m, err := parseMaster(db.mmap.chunks[0], uint64(db.mmap.file/btree.BTREE_PAGE_SIZE))
+	if err != nil {
+		return err
+	}
+	if m.root != db.tree.Root || m.used != db.page.flushed || m.free != db.free.Head() {
+		return fmt.Errorf("on disk root %d, used %d, free list %d; in memory %d, %d, %d",
+			m.root, m.used, m.free, db.tree.Root, db.page.flushed, db.free.Head())
+	}
+	return nil
+}
+
+// stop a walk of a damaged list
+var errBadFreeList = errors.New("bad free list")
+
+func (db *KV) checkFreeList() (err error) {
+	// err is set before the walk is stopped
+	defer func() {
+		if r := recover(); r != nil && r != errBadFreeList {
+			panic(r)
+		}
+	}()
+
+	items, nodes := 0, map[uint64]bool{}
+	db.free.Walk(func(ptr uint64, node bool) {
+		if ptr == 0 || ptr >= db.page.flushed {
+			err = fmt.Errorf("pointer %d out of range", ptr)
+			panic(errBadFreeList)
+		}
+		if !node {
+			items++
+			return
+		}
+		if nodes[ptr] {
+			err = fmt.Errorf("node %d is linked twice", ptr)
+			panic(errBadFreeList)
+		}
+		nodes[ptr] = true
+	})
+	if total := db.free.Total(); total != items {
+		return fmt.Errorf("total is %d, the list holds %d", total, items)
+	}
+	return nil
+}
+
+func (db *KV) checkPages() error {
+	owner := make([]string, db.page.flushed)
+	owner[0] = "master"
+	problems := []error{}
+	claim := func(ptr uint64, by string) {
+		if ptr >= db.page.flushed {
+			problems = append(problems, fmt.Errorf("page %d (%s) out of range", ptr, by))
+		} else if owner[ptr] != "" {
+			problems = append(problems, fmt.Errorf("page %d used by both the %s and the %s", ptr, owner[ptr], by))
+		} else {
+			owner[ptr] = by
+		}
+	}
+
+	db.tree.RangePages(nil, nil, func(ptr uint64) {
+		claim(ptr, "tree")
+	})
+	if db.checkFreeList() == nil {
+		db.free.Walk(func(ptr uint64, node bool) {
+			claim(ptr, "free list")
+		})
+	}
+	for _, ptr := range db.drain.deferred {
+		claim(ptr, "background free queue")
+	}
+	for ptr, by := range owner {
+		if by == "" {
+			problems = append(problems, fmt.Errorf("page %d is leaked", ptr))
+		}
+	}
+	return errors.Join(problems...)
+}
@@ -0,0 +1,63 @@
+package kvstore
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// the report entry of the named check
+func checkResult(t *testing.T, r HealthReport, name string) CheckResult {
+	t.Helper()
+	for _, c := range r.Checks {
+		if c.Name == name {
+			return c
+		}
+	}
+	t.Fatalf("no %s check in the report:\n%s", name, r)
+	return CheckResult{}
+}
+
+func TestHealthCheck(t *testing.T) {
+	db := openTestDB(t, nil)
+	for i := 0; i < 300; i++ {
+		mustSet(t, db, fmt.Sprintf("key%04d", i), strings.Repeat("v", 100))
+	}
+	for i := 0; i < 300; i += 2 {
+		mustDel(t, db, fmt.Sprintf("key%04d", i))
+	}
+	r := db.HealthCheck()
+	if !r.OK() {
+		t.Fatalf("healthy DB failed:\n%s", r)
+	}
+	if len(r.Checks) != 5 {
+		t.Fatalf("%d checks run, want 5", len(r.Checks))
+	}
+}
+
+func TestHealthCheckOverlap(t *testing.T) {
+	db := openTestDB(t, nil)
+	for i := 0; i < 300; i++ {
+		mustSet(t, db, fmt.Sprintf("key%04d", i), strings.Repeat("v", 100))
+	}
+	// free a page the tree still uses
+	kid := db.pageGet(db.tree.Root).GetPtr(0)
+	if err := db.update(func() { db.pageDel(kid) }); err != nil {
+		t.Fatal(err)
+	}
+
+	r := db.HealthCheck()
+	if r.OK() {
+		t.Fatalf("overlap not reported:\n%s", r)
+	}
+	pages := checkResult(t, r, "pages")
+	want := fmt.Sprintf("page %d used by both the tree and the free list", kid)
+	if pages.Err == nil || !strings.Contains(pages.Err.Error(), want) {
+		t.Fatalf("pages check = %v, want %q", pages.Err, want)
+	}
+	for _, name := range []string{"master", "tree", "freelist"} {
+		if c := checkResult(t, r, name); c.Err != nil {
+			t.Errorf("%s check failed: %v", name, c.Err)
+		}
+	}
+}
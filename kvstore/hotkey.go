@@ -0,0 +1,48 @@
+package kvstore
+
+// HotKey remembers the leaf page holding a single frequently read key, so repeated gets
+// read that page directly instead of descending from the root.
+// Pages are copy-on-write, so any update touching the path produces a new root; the cached
+// location is simply dropped whenever the tree changed since it was taken (KV.gen).
+// Like the other reads, it must not race with updates on the same KV.
+type HotKey struct {
+	db    *KV
+	key   []byte
+	gen   uint64
+	leaf  uint64 // 0 when there is no valid cached location
+	idx   uint16
+	found bool
+}
+
+// HotKey returns a handle caching the location of key.
+func (db *KV) HotKey(key []byte) *HotKey {
+	return &HotKey{db: db, key: append([]byte{}, key...)}
+}
+
+// Get returns the current value of the key, like GetWithFlags without the flags.
+func (h *HotKey) Get() ([]byte, bool) {
+	h.db.counters.gets.Add(1)
+	if h.leaf == 0 || h.gen != h.db.gen {
+		h.db.counters.cacheMiss.Add(1)
+		h.locate()
+	} else {
+		h.db.counters.cacheHits.Add(1)
+	}
+	if !h.found {
+		return nil, false
+	}
+	stored := h.db.tree.Get(h.leaf).GetVal(h.idx)
+	if h.db.isTombstone(stored) {
+		return nil, false
+	}
+	val, meta := h.db.decodeVal(stored)
+	if h.db.expired(meta) {
+		return nil, false
+	}
+	return val, true
+}
+
+func (h *HotKey) locate() {
+	h.gen = h.db.gen
+	h.leaf, h.idx, h.found = h.db.tree.Locate(h.key)
+}
@@ -0,0 +1,76 @@
+package kvstore
+
+import (
+	"fmt"
+	"testing"
+)
+
+func mustHot(t *testing.T, h *HotKey, want string, wantOk bool) {
+	t.Helper()
+	val, ok := h.Get()
+	if ok != wantOk || string(val) != want {
+		t.Fatalf("HotKey(%q).Get() = %q %v, want %q %v", h.key, val, ok, want, wantOk)
+	}
+}
+
+func TestHotKey(t *testing.T) {
+	for _, tombstones := range []bool{false, true} {
+		t.Run(fmt.Sprint("tombstones=", tombstones), func(t *testing.T) {
+			db := openTestDB(t, func(db *KV) { db.Tombstones = tombstones })
+			h := db.HotKey([]byte("hot"))
+			mustHot(t, h, "", false)
+
+			mustSet(t, db, "hot", "1")
+			mustHot(t, h, "1", true)
+			// reads without updates in between reuse the location
+			leaf, gen := h.leaf, h.gen
+			mustHot(t, h, "1", true)
+			if h.leaf != leaf || h.gen != gen {
+				t.Fatal("located the key again without an update")
+			}
+
+			// updates of other keys split and move the leaf
+			for i := 0; i < 2000; i++ {
+				mustSet(t, db, fmt.Sprintf("key%05d", i), "v")
+				if i%100 == 0 {
+					mustHot(t, h, "1", true)
+				}
+			}
+			mustSet(t, db, "hot", "2")
+			mustHot(t, h, "2", true)
+			mustDel(t, db, "hot")
+			mustHot(t, h, "", false)
+
+			mustSet(t, db, "hot", "3")
+			mustHot(t, h, "3", true)
+			if err := db.Clear(); err != nil {
+				t.Fatal(err)
+			}
+			mustHot(t, h, "", false)
+		})
+	}
+}
+
+func TestHotKeyReopen(t *testing.T) {
+	db := openTestDB(t, nil)
+	for i := 0; i < 200; i++ {
+		mustSet(t, db, fmt.Sprintf("key%05d", i), "v")
+	}
+	mustSet(t, db, "hot", "1")
+	h := db.HotKey([]byte("hot"))
+	mustHot(t, h, "1", true)
+
+	// another writer changes the file while the handle's DB is closed
+	db.Close()
+	other := &KV{Path: db.Path}
+	if err := other.Open(); err != nil {
+		t.Fatal(err)
+	}
+	mustSet(t, other, "hot", "2")
+	other.Close()
+
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	mustHot(t, h, "2", true)
+}
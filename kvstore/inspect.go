@@ -0,0 +1,111 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"kurocifer/LeichtKV/btree"
+	"os"
+	"syscall"
+)
+
+// FormatInfo describes a DB file, as read by Inspect.
+type FormatInfo struct {
+	Version    uint32
+	Features   uint32 // FEATURE_* bits, may include ones this build doesn't know
+	ValueFlags bool   // values carry a flags byte
+	KeyWidth   int    // the fixed leaf key width, 0 if keys are variable width
+	PageSize   int    // as recorded in the file, or the page size it was read with for older files
+	Root       uint64
+	Used       uint64 // pages
+	Seq        uint64 // the commit seq of the last update
+	Keys       int    // like KV.Len, tombstones and expired values are not counted
+	Clean      bool   // see KV.WasCleanlyClosed
+}
+
+// Inspect reads the master page of a DB file read-only and reports its format, without
+// needing the options the file was created with. The key count comes from walking the tree.
+func Inspect(path string) (info FormatInfo, err error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return info, fmt.Errorf("Inspect: %w", err)
+	}
+	defer fp.Close()
+
+	fi, err := fp.Stat()
+	if err != nil {
+		return info, fmt.Errorf("Inspect: stat: %w", err)
+	}
+	size := int(fi.Size())
+	if err := checkPageSize(fp, fi.Size()); err != nil {
+		return info, fmt.Errorf("Inspect: %w", err)
+	}
+	if size == 0 || size%btree.BTREE_PAGE_SIZE != 0 {
+		return info, errors.New("Inspect: file size is not a multiple of page size")
+	}
+
+	data, err := mmap(int(fp.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return info, fmt.Errorf("Inspect: mmap: %w", err)
+	}
+	defer munmap(data)
+
+	m, err := parseMaster(data, uint64(size/btree.BTREE_PAGE_SIZE))
+	if err != nil {
+		return info, fmt.Errorf("Inspect: %w", err)
+	}
+	info = FormatInfo{
+		Version:    m.version,
+		Features:   m.features,
+		ValueFlags: m.features&FEATURE_VALUE_FLAGS != 0,
+		PageSize:   int(m.pageSize),
+		Root:       m.root,
+		Used:       m.used,
+		Seq:        m.seq,
+		Clean:      m.clean,
+	}
+	if m.features&FEATURE_FIXED_KEYS != 0 {
+		info.KeyWidth = int(m.keyWidth)
+	}
+
+	if info.PageSize == 0 {
+		info.PageSize = btree.BTREE_PAGE_SIZE
+	}
+
+	// the tree of an unknown file may be damaged, the walk panics on a bad page
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Inspect: walking the tree: %v", r)
+		}
+	}()
+	tree := btree.BTree{
+		Root: m.root,
+		Get: func(ptr uint64) btree.BNode {
+			if ptr == 0 || ptr >= m.used {
+				panic(fmt.Sprintf("bad ptr %d", ptr))
+			}
+			offset := ptr * btree.BTREE_PAGE_SIZE
+			return btree.BNode{Data: data[offset : offset+btree.BTREE_PAGE_SIZE]}
+		},
+	}
+	// the values are decoded for the features of the file
+	probe := &KV{features: m.features}
+	tree.Scan(nil, func(key, stored []byte) bool {
+		if !probe.absent(stored) {
+			info.Keys++
+		}
+		return true
+	})
+	return info, nil
+}
+
+// ReadRawPage returns a copy of a committed page, for debugging and visualization tools.
+// The master page (ptr 0) is only returned when RawMaster is set.
+func (db *KV) ReadRawPage(ptr uint64) ([]byte, error) {
+	if ptr == 0 && !db.RawMaster {
+		return nil, errors.New("ReadRawPage: page 0 is the master page")
+	}
+	if ptr >= db.page.flushed || int(ptr)*btree.BTREE_PAGE_SIZE >= db.mmap.file {
+		return nil, fmt.Errorf("ReadRawPage: page %d out of range", ptr)
+	}
+	return append([]byte{}, pageGetMapped(db, ptr).Data...), nil
+}
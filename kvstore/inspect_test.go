@@ -0,0 +1,134 @@
+package kvstore
+
+import (
+	"fmt"
+	"kurocifer/LeichtKV/btree"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db"), KeyWidth: 8, ValueFlags: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		mustSet(t, db, fmt.Sprintf("k%07d", i), "v")
+	}
+	db.Close()
+
+	info, err := Inspect(db.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != FORMAT_VERSION {
+		t.Errorf("Version = %d, want %d", info.Version, FORMAT_VERSION)
+	}
+	if info.Features != FEATURE_FIXED_KEYS|FEATURE_VALUE_FLAGS || !info.ValueFlags || info.KeyWidth != 8 {
+		t.Errorf("Features = %#x, ValueFlags = %v, KeyWidth = %d", info.Features, info.ValueFlags, info.KeyWidth)
+	}
+	if info.PageSize != btree.BTREE_PAGE_SIZE {
+		t.Errorf("PageSize = %d", info.PageSize)
+	}
+	if info.Keys != 500 {
+		t.Errorf("Keys = %d, want 500", info.Keys)
+	}
+}
+
+func TestInspectSkipsTombstones(t *testing.T) {
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db"), Tombstones: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		mustSet(t, db, fmt.Sprint("k", i), "v")
+	}
+	for i := 0; i < 4; i++ {
+		mustDel(t, db, fmt.Sprint("k", i))
+	}
+	db.Close()
+
+	info, err := Inspect(db.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Keys != 6 {
+		t.Errorf("Keys = %d, want the 6 keys not deleted", info.Keys)
+	}
+}
+
+func TestInspectUnknownFeature(t *testing.T) {
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db")}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	mustSet(t, db, "k", "v")
+	db.features |= 1 << 31
+	mustSet(t, db, "k", "v2")
+	db.Close()
+
+	// Open refuses the file, Inspect still reports it
+	info, err := Inspect(db.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Features&(1<<31) == 0 || info.KeyWidth != 0 {
+		t.Errorf("Features = %#x, KeyWidth = %d", info.Features, info.KeyWidth)
+	}
+}
+
+func TestInspectBadFile(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.db")
+	if err := os.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Inspect(empty); err == nil || !strings.Contains(err.Error(), "page size") {
+		t.Errorf("Inspect of an empty file: %v", err)
+	}
+
+	garbage := filepath.Join(dir, "garbage.db")
+	if err := os.WriteFile(garbage, make([]byte, btree.BTREE_PAGE_SIZE), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Inspect(garbage); err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Errorf("Inspect of a file without a signature: %v", err)
+	}
+}
+
+func TestReadRawPage(t *testing.T) {
+	db := openTestDB(t, nil)
+	mustSet(t, db, "k", "v")
+
+	page, err := db.ReadRawPage(db.tree.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := btree.BNode{Data: page}
+	if len(page) != btree.BTREE_PAGE_SIZE || string(root.GetKey(1)) != "k" {
+		t.Fatalf("root page of %d bytes, second key %q", len(page), root.GetKey(1))
+	}
+	// a copy, not the mapping
+	page[0] ^= 0xff
+	mustGet(t, db, "k", "v")
+
+	if _, err := db.ReadRawPage(0); err == nil {
+		t.Error("read the master page without RawMaster")
+	}
+	db.RawMaster = true
+	master, err := db.ReadRawPage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(master), DB_SIG) {
+		t.Errorf("master page starts with %q", master[:16])
+	}
+
+	for _, ptr := range []uint64{db.page.flushed, uint64(db.mmap.file / btree.BTREE_PAGE_SIZE)} {
+		if _, err := db.ReadRawPage(ptr); err == nil {
+			t.Errorf("read page %d, past the used size %d", ptr, db.page.flushed)
+		}
+	}
+}
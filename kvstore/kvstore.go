@@ -5,36 +5,96 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"kurocifer/LeichtKV/btree"
+	"kurocifer/LeichtKV/freelist"
 	"kurocifer/LeichtKV/utils"
 	"os"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
 const DB_SIG = "BANKAI"
 
+// the master page
+// | sig | root | used | free list | version | features | key width | commit seq | page size | schema | clean |
+// | 16B |  8B  |  8B  |    8B     |   4B    |    4B    |    4B     |     8B     |    4B     |   4B   |  4B   |
+// files written before the version field have zeros there, which reads as version 0 with no features.
+// the page size was added in version 2, 0 means unrecorded.
+// the schema version belongs to the application (see Migrate), older files have zeros there.
+// the clean flag is 1 when written by Close, every commit writes 0. older files have zeros there.
+const FORMAT_VERSION = 2
+const MASTER_SIZE = 72
+
+// optional format features recorded in the master page.
+// a file using a feature this build doesn't know can't be opened.
+const (
+	FEATURE_FIXED_KEYS  = 1 << iota // leaves of keys of the recorded key width store no key lengths
+	FEATURE_VALUE_FLAGS             // every value is prefixed with a flags byte
+	FEATURE_TOMBSTONES              // every value is prefixed with a tag, deletes leave tombstones
+	FEATURE_TIMESTAMPS              // every value is prefixed with its created and modified times
+	FEATURE_EXPIRY                  // every value is prefixed with the time it expires
+)
+
+const KNOWN_FEATURES = FEATURE_FIXED_KEYS | FEATURE_VALUE_FLAGS | FEATURE_TOMBSTONES | FEATURE_TIMESTAMPS | FEATURE_EXPIRY
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+var ErrReadOnly = errors.New("DB is opened read-only")
+var ErrLocked = errors.New("DB is locked by another process")
+var ErrVerifyFailed = errors.New("write verification failed")
+var ErrTreeTooTall = errors.New("tree height over MaxHeight")
+
+// the file grows by 1/8 at a time unless KV.GrowthFactor says otherwise
+const GROWTH_FACTOR = 1.125
+
+const MASTER_RETRIES = 3
+const MASTER_BACKOFF = time.Millisecond
+
+// the order a commit makes its data durable in, see KV.SyncPolicy
+const (
+	// write the pages, fsync them (Flusher.Sync), then write the master page and fsync it.
+	// the master page never reaches the disk before the pages it points to
+	SYNC_BARRIER = iota
+	// write the pages and the master page, then fsync once. saves an fsync per commit, but is only
+	// safe on a filesystem that persists writes to a file in order; elsewhere a crash can leave
+	// a master page pointing to pages that never made it. needs the default Flusher
+	SYNC_COMBINED
+)
+
 // create the initial mmap that covers the while file.
-func mmapInt(fp *os.File) (int, []byte, error) {
-	fi, err := fp.Stat()
+func mmapInt(db *KV) (int, []byte, error) {
+	fi, err := db.fp.Stat()
 	if err != nil {
 		return 0, nil, fmt.Errorf("stat: %w", err)
 	}
+	db.hugeMode = HUGEPAGES_NONE
+	if db.HugePages {
+		if db.hugeMode, err = hugePagesMode(db.fp); err != nil {
+			return 0, nil, err
+		}
+	}
 
+	// the file size can only be checked against the page size the file was written with
+	if err := checkPageSize(db.fp, fi.Size()); err != nil {
+		return 0, nil, err
+	}
 	if fi.Size()%btree.BTREE_PAGE_SIZE != 0 {
 		return 0, nil, errors.New("File size is not a multiple of page size")
 	}
 
 	mmapSize := 64 << 20 // 64MB
-	utils.Assert(mmapSize < int(fi.Size()))
-
 	for mmapSize < int(fi.Size()) {
 		mmapSize *= 2
 	}
+	if db.MmapChunkSize > 0 {
+		// just enough whole chunks for the file
+		mmapSize = max(1, (int(fi.Size())+db.MmapChunkSize-1)/db.MmapChunkSize) * db.MmapChunkSize
+	}
 
 	// mmapSize can be larger than the file
-	chunk, err := syscall.Mmap(
-		int(fp.Fd()), 0, mmapSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED,
-	)
+	chunk, err := mmapFile(db, 0, mmapSize)
 	if err != nil {
 		return 0, nil, fmt.Errorf("mmap: %w", err)
 	}
@@ -42,44 +102,292 @@ func mmapInt(fp *os.File) (int, []byte, error) {
 	return int(fi.Size()), chunk, nil
 }
 
+// the f_type of a hugetlbfs mount, see statfs(2)
+const HUGETLBFS_MAGIC = 0x958458f6
+
+// how the mapping uses huge pages, see KV.HugePages and KV.HugePageMode
+const (
+	HUGEPAGES_NONE = iota // normal pages
+	// a file on hugetlbfs, mapped with MAP_HUGETLB
+	HUGEPAGES_HUGETLB
+	// a regular file, mapped with normal pages and advised with MADV_HUGEPAGE so the kernel may
+	// back it with transparent huge pages where the filesystem supports them
+	HUGEPAGES_ADVISED
+)
+
+// huge pages can only back a file on hugetlbfs, a regular file gets the MADV_HUGEPAGE hint instead
+func hugePagesMode(fp *os.File) (int, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Fstatfs(int(fp.Fd()), &fs); err != nil {
+		return 0, fmt.Errorf("statfs: %w", err)
+	}
+	if fs.Type != HUGETLBFS_MAGIC {
+		return HUGEPAGES_ADVISED, nil
+	}
+	return HUGEPAGES_HUGETLB, nil
+}
+
+// map a region of the DB file, with huge pages if the file allows them
+func mmapFile(db *KV, offset int64, length int) ([]byte, error) {
+	fd := int(db.fp.Fd())
+	prot := syscall.PROT_READ | syscall.PROT_WRITE
+	if db.ReadOnly {
+		prot = syscall.PROT_READ
+	}
+
+	flags := syscall.MAP_SHARED
+	if db.hugeMode == HUGEPAGES_HUGETLB {
+		// fails if not enough huge pages are reserved
+		flags |= syscall.MAP_HUGETLB
+	}
+	chunk, err := mmap(fd, offset, length, prot, flags)
+	if err != nil {
+		return nil, err
+	}
+
+	if db.hugeMode == HUGEPAGES_ADVISED {
+		// only a hint: a kernel without transparent huge pages rejects it, which leaves normal pages
+		// and stops hinting the later mappings
+		if err := madvise(chunk, syscall.MADV_HUGEPAGE); err != nil {
+			db.hugeMode = HUGEPAGES_NONE
+		}
+	}
+	if db.RandomAccess {
+		// no readahead around faults, point lookups only touch the pages they need
+		if err := madvise(chunk, syscall.MADV_RANDOM); err != nil {
+			_ = munmap(chunk)
+			return nil, fmt.Errorf("madvise: %w", err)
+		}
+	}
+	return chunk, nil
+}
+
+// HugePageMode reports how the mapping uses huge pages: HUGEPAGES_HUGETLB for a file on hugetlbfs,
+// HUGEPAGES_ADVISED when HugePages fell back to a normal mapping with the MADV_HUGEPAGE hint,
+// and HUGEPAGES_NONE without HugePages or when the kernel rejected the hint.
+func (db *KV) HugePageMode() int {
+	return db.hugeMode
+}
+
 type KV struct {
 	Path string
+	// open with a shared lock and a read-only mapping, all updates fail with ErrReadOnly.
+	// any number of processes can open a file read-only, but not while a writer has it open.
+	ReadOnly bool
+	// fail with an os.ErrExist error if the file already exists instead of opening it,
+	// for initialization that must start from a fresh file. the default opens or creates.
+	CreateOnly bool
+	// for salvaging a damaged file: reads check every page and skip the subtree of a bad one,
+	// returning what is still reachable. the problems are collected by ReadErrors
+	BestEffort bool
+	// read every Set back from the file after it commits and fail with ErrVerifyFailed if it doesn't
+	// match, to catch corruption in tests. costs a lookup per write
+	VerifyWrites bool
+	// keep a bloom filter of the keys in memory, so gets of absent keys mostly skip the tree.
+	// it is built by a full scan on Open and takes about 10 bits per key
+	BloomFilter bool
+	// the size of each mapping added as the file grows, a multiple of the page size.
+	// 0 maps 64MB at first and doubles the mapping each time, adding at most MMAP_MAX_CHUNK.
+	// smaller chunks reserve less address space past the end of the file but make more mappings to walk
+	MmapChunkSize int
+	// keep the last ChangeLog committed sets and deletes in memory, see RecentChanges. 0 keeps none
+	ChangeLog int
+	// the most levels the tree may have, to bound the cost of a lookup. an update that makes it
+	// taller fails with ErrTreeTooTall, unless it only deletes keys; CompactRange(nil, nil)
+	// repacks the tree, which may make room for more keys at the same height. 0 is no limit
+	MaxHeight int
+	// check the offset list of every committed node read and rebuild a damaged one from the kv
+	// lengths, in memory only. costs a pass over the offsets per page read. see btree.RepairOffsets
+	RepairOffsets bool
+	// a sidecar file caching the bloom filter (see BloomFilter), so Open doesn't scan the whole DB
+	// to build it. written by Close, and only used if it matches the master page and the DB was
+	// closed cleanly, otherwise the filter is rebuilt
+	IndexPath string
+	// hand the pages freed by each commit to a background goroutine that puts them on the free
+	// list in batches, taking that work off the writes. queued pages can't be reused, so the file
+	// may grow meanwhile. Close waits for it. pages not yet on the free list at a crash are found
+	// again on the next Open
+	BackgroundFree bool
+	// the file is never grown past this size in bytes. 0 means no limit
+	MaxFileSize int64
+	// for keys that all have the same size, like 8-byte IDs or 16-byte UUIDs: leaves whose keys
+	// all have this many bytes (1 to 255) are stored without a length per key, so more keys fit in a leaf.
+	// only used when creating the file, Open sets it to the width an existing file was created with
+	KeyWidth int
+	// the file is grown by this factor when it runs out of pages, must be > 1. 0 means GROWTH_FACTOR.
+	// larger values mean fewer fallocate calls but more preallocated disk
+	GrowthFactor float64
+	// map the file with huge pages, to cut TLB misses on large DBs. a file on hugetlbfs is mapped
+	// with huge pages, which is backed by memory so the DB doesn't outlive a reboot. any other file
+	// falls back to a normal mapping hinted with MADV_HUGEPAGE. see HugePageMode for the one taken
+	HugePages bool
+	// store a flags byte with every value, see SetWithFlags. only used when creating a new file,
+	// an existing file keeps the features it was created with.
+	ValueFlags bool
+	// make deletes leave a tombstone stamped with the commit seq instead of removing the key,
+	// so changelog consumers can see them, see DeletesSince and GCTombstones.
+	// only used when creating a new file, like ValueFlags.
+	Tombstones bool
+	// store the created and modified times with every value, see GetTimes. only used when creating a new file.
+	Timestamps bool
+	// store an expiry time with every value, see SetWithTTL. only used when creating a new file.
+	Expiry bool
+	// the time to live of the values written without one, e.g. by Set. 0 means they don't expire.
+	// needs a file with Expiry, a new file gets it when this is set
+	DefaultTTL time.Duration
+	// the clock for Timestamps and Expiry, time.Now if nil
+	Clock func() time.Time
+	// compare keys after this normalization (e.g. lowercasing), keys are still stored as given.
+	// a file must always be opened with the same normalizer, see btree.BTree.Normalize
+	NormalizeKey func([]byte) []byte
+	// merge nodes left with fewer keys than this by a delete, see btree.BTree.MinKeys.
+	// keeps a few large kvs from leaving 1-key internal nodes that add height. 0 merges on size alone
+	MinKeysPerNode uint16
+	// advise the kernel that access is random, disabling readahead. for workloads of small point lookups
+	RandomAccess bool
+	// let ReadRawPage return the master page
+	RawMaster bool
+	// record the last PageLog page allocations and frees with their caller, see PageEvents.
+	// for debugging page leaks, 0 disables it
+	PageLog int
+	// write runs of consecutive pages with a single pwrite instead of copying each page into
+	// the mapping, for large commits such as bulk loads. the result is the same
+	CoalesceWrites bool
+	// writes and syncs the pages of each commit, DefaultFlusher if nil. see Flusher
+	Flusher Flusher
+	// attempts to rewrite the master page after a transient error. 0 means MASTER_RETRIES, negative means none
+	MasterRetries int
+	// SYNC_BARRIER (the default) or SYNC_COMBINED. checked with Flusher by Open and again by every
+	// commit, as both can be changed on an open DB: a commit under a bad pair fails before writing
+	SyncPolicy int
 	// internals
-	fp   *os.File
-	tree btree.BTree
+	fp       *os.File
+	writer   sync.Mutex // serializes updates
+	tree     btree.BTree
+	free     freelist.FreeList
+	features uint32 // FEATURE_* of the file
+	seq      uint64 // the commit seq, bumped by every update
+	schema   uint32 // the application schema version, see Migrate
+	wasClean bool   // see WasCleanlyClosed
+	hugeMode int    // HUGEPAGES_*, see HugePageMode
+	gen      uint64 // bumped by every committed change to the tree, and when it is loaded on open
+	counters counters
+	pins     pinCache
+	pageLog  pageLog
+	readErrs readErrors
+	bloom    atomic.Pointer[bloom] // nil unless BloomFilter
+	changes  changeLog
+	drain    drainer
+	churn    churnWindow
+	ranges   rangeLocks // see UpdateRange
+	group    struct {
+		sync.Mutex
+		next *commitGroup // the one range txs join, nil until one is ready
+	}
 
+	// the file is mapped as a list of chunks, each covering the file range after the one before.
+	// growth appends chunks (extendMmap) and leaves the existing ones in place, so a zero-copy
+	// slice into a committed page stays valid across it. only TrimMapping and ConsolidateMapping,
+	// which replace all chunks with one, and Close unmap them, apart from the page being freed and reused.
 	mmap struct {
-		file   int
-		total  int
-		chunks [][]byte
+		file   int      // file size in bytes, can be less than total
+		total  int      // mapped size in bytes, the sum of the chunk sizes
+		chunks [][]byte // in file order
 	}
 
 	page struct {
-		flushed uint64   // database size in number of pages
-		temp    [][]byte // newly allocated pages
-		nfree   int
-		nappend int
+		flushed uint64 // database size in number of pages
+		nfree   int    // number of pages taken from the free list
+		nappend int    // number of pages to be appended
+		// newly allocated or deallocated pages keyed by the pointer.
+		// nil value denotes a deallocated page.
 		updates map[uint64][]byte
 	}
 }
 
-// extend the mmap by adding new mappings
+// the largest mapping extendMmap adds when doubling, so a large file doesn't reserve
+// as much address space again on every growth
+const MMAP_MAX_CHUNK = 1 << 30
+
+// extend the mmap by adding new mappings.
+// the existing chunks must stay where they are, see the KV.mmap comment.
 func extendMmap(db *KV, npages int) error {
 	if db.mmap.total >= npages*btree.BTREE_PAGE_SIZE {
 		return nil
 	}
 
-	chunk, err := syscall.Mmap(
-		int(db.fp.Fd()), int64(db.mmap.total), db.mmap.total,
-		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED,
-	)
+	for db.mmap.total < npages*btree.BTREE_PAGE_SIZE {
+		// double the mapping unless the chunk size is fixed, but by at most MMAP_MAX_CHUNK
+		size := min(db.mmap.total, MMAP_MAX_CHUNK)
+		if db.MmapChunkSize > 0 {
+			size = db.MmapChunkSize
+		}
+		chunk, err := mmapFile(db, int64(db.mmap.total), size)
+		if err != nil {
+			return fmt.Errorf("mmap: %w", err)
+		}
+
+		db.mmap.total += len(chunk)
+		db.mmap.chunks = append(db.mmap.chunks, chunk)
+	}
+	return nil
+}
+
+// TrimMapping replaces the mappings with a single one just large enough for the current file,
+// giving back the address space the initial 64MB mapping reserved for a small DB.
+// Any value slice obtained before the call is invalid afterwards.
+func (db *KV) TrimMapping() error {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	if db.drain.snaps > 0 {
+		return errors.New("TrimMapping: snapshots are open")
+	}
+
+	size := max(db.mmap.file, btree.BTREE_PAGE_SIZE)
+	if size >= db.mmap.total {
+		return nil
+	}
+
+	return remapWhole(db, size)
+}
+
+// ConsolidateMapping replaces the mappings with a single one of the same total size when there are
+// more than maxChunks of them, as every page access walks the list of mappings.
+// A long-lived DB growing with a small MmapChunkSize accumulates many.
+// Like TrimMapping, any value slice obtained before the call is invalid afterwards.
+func (db *KV) ConsolidateMapping(maxChunks int) error {
+	if maxChunks < 1 {
+		return fmt.Errorf("ConsolidateMapping: bad chunk count %d", maxChunks)
+	}
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	if db.drain.snaps > 0 {
+		return errors.New("ConsolidateMapping: snapshots are open")
+	}
+
+	if len(db.mmap.chunks) <= maxChunks {
+		return nil
+	}
+	if err := remapWhole(db, db.mmap.total); err != nil {
+		return fmt.Errorf("ConsolidateMapping: %w", err)
+	}
+	return nil
+}
 
+// map the file again as one region of size bytes and drop the old mappings
+func remapWhole(db *KV, size int) error {
+	chunk, err := mmapFile(db, 0, size)
 	if err != nil {
 		return fmt.Errorf("mmap: %w", err)
 	}
+	for _, old := range db.mmap.chunks {
+		if err := munmap(old); err != nil {
+			return fmt.Errorf("munmap: %w", err)
+		}
+	}
 
-	db.mmap.total += db.mmap.total
-	db.mmap.chunks = append(db.mmap.chunks, chunk)
+	db.mmap.total = len(chunk)
+	db.mmap.chunks = [][]byte{chunk}
 	return nil
 }
 
@@ -87,16 +395,28 @@ func extendMmap(db *KV, npages int) error {
 func (db *KV) pageGet(ptr uint64) btree.BNode {
 	if page, ok := db.page.updates[ptr]; ok {
 		utils.Assert(page != nil)
-		return btree.BNode{page}
+		return btree.BNode{Data: page}
 	}
 
-	return pageGetMapped(db, ptr)
+	node := pageGetMapped(db, ptr)
+	if db.RepairOffsets {
+		if fixed, repaired, err := btree.RepairOffsets(node); err == nil && repaired {
+			db.counters.offsetRepairs.Add(1)
+			return fixed
+		}
+	}
+	return node
 }
 
 func pageGetMapped(db *KV, ptr uint64) btree.BNode {
+	return chunksPage(db.mmap.chunks, ptr)
+}
+
+// the page at ptr in the mappings
+func chunksPage(chunks [][]byte, ptr uint64) btree.BNode {
 	start := uint64(0)
 
-	for _, chunk := range db.mmap.chunks {
+	for _, chunk := range chunks {
 		end := start + uint64(len(chunk))/btree.BTREE_PAGE_SIZE
 		if ptr < end {
 			offset := btree.BTREE_PAGE_SIZE * (ptr - start)
@@ -110,32 +430,152 @@ func pageGetMapped(db *KV, ptr uint64) btree.BNode {
 
 func (db *KV) pageDel(ptr uint64) {
 	db.page.updates[ptr] = nil
+	db.logPage("del", ptr)
 }
 func masterLoad(db *KV) error {
+	// the tree is read anew: the file may have been changed by someone else since a reopened
+	// KV last saw it, so anything cached from the old tree (see HotKey) must be dropped
+	db.gen++
 	if db.mmap.file == 0 {
 		// empty file, the master page will be created on the first write
+		db.wasClean = true
 		db.page.flushed = 1 // reserced for the master page
+		if db.KeyWidth != 0 {
+			db.features |= FEATURE_FIXED_KEYS
+			db.tree.KeyWidth = db.KeyWidth
+		}
+		if db.ValueFlags {
+			db.features |= FEATURE_VALUE_FLAGS
+		}
+		if db.Tombstones {
+			db.features |= FEATURE_TOMBSTONES
+		}
+		if db.Timestamps {
+			db.features |= FEATURE_TIMESTAMPS
+		}
+		if db.Expiry || db.DefaultTTL > 0 {
+			db.features |= FEATURE_EXPIRY
+		}
 		return nil
 	}
 
-	data := db.mmap.chunks[0]
-	root := binary.LittleEndian.Uint64(data[16:])
-	used := binary.LittleEndian.Uint64(data[24:])
+	m, err := parseMaster(db.mmap.chunks[0], uint64(db.mmap.file/btree.BTREE_PAGE_SIZE))
+	if err != nil {
+		return err
+	}
+	if m.version > FORMAT_VERSION || m.features&^KNOWN_FEATURES != 0 {
+		return fmt.Errorf("unsupported format: version %d, features %#x", m.version, m.features)
+	}
+
+	db.tree.Root = m.root
+	db.free.SetHead(m.free)
+	db.schema = m.schema
+	db.page.flushed = m.used
+	db.features = m.features
+	db.seq = m.seq
+	db.KeyWidth = 0
+	if m.features&FEATURE_FIXED_KEYS != 0 {
+		db.KeyWidth = int(m.keyWidth)
+	}
+	db.tree.KeyWidth = db.KeyWidth
+	db.wasClean = m.clean
+	return nil
+}
+
+// the decoded master page
+type master struct {
+	root     uint64
+	used     uint64
+	free     uint64 // the free list head, 0 if empty
+	version  uint32
+	features uint32
+	keyWidth uint32 // only meaningful with FEATURE_FIXED_KEYS
+	seq      uint64 // 0 in files written before the field
+	pageSize uint32 // 0 if not recorded
+	schema   uint32 // 0 in files written before the field
+	clean    bool   // closed by Close after the last commit, false in files written before the field
+}
+
+// error out if the master page records a page size other than BTREE_PAGE_SIZE,
+// before any of the page math is trusted
+func checkPageSize(fp *os.File, fileSize int64) error {
+	var data [MASTER_SIZE]byte
+	if fileSize < int64(len(data)) {
+		return nil // new file, or not a DB at all, left to masterLoad
+	}
+	if _, err := fp.ReadAt(data[:], 0); err != nil {
+		return fmt.Errorf("read master page: %w", err)
+	}
+
+	var sig [16]byte
+	copy(sig[:], DB_SIG)
+	pageSize := binary.LittleEndian.Uint32(data[60:])
+	if bytes.Equal(sig[:], data[:16]) && pageSize != 0 && pageSize != btree.BTREE_PAGE_SIZE {
+		return fmt.Errorf("page size mismatch: the file uses %d, this build uses %d", pageSize, btree.BTREE_PAGE_SIZE)
+	}
+	return nil
+}
+
+// decode and verify the master page of a file of filePages pages
+func parseMaster(data []byte, filePages uint64) (master, error) {
+	m := master{
+		root:     binary.LittleEndian.Uint64(data[16:]),
+		used:     binary.LittleEndian.Uint64(data[24:]),
+		free:     binary.LittleEndian.Uint64(data[32:]),
+		version:  binary.LittleEndian.Uint32(data[40:]),
+		features: binary.LittleEndian.Uint32(data[44:]),
+		keyWidth: binary.LittleEndian.Uint32(data[48:]),
+		seq:      binary.LittleEndian.Uint64(data[52:]),
+		pageSize: binary.LittleEndian.Uint32(data[60:]),
+		schema:   binary.LittleEndian.Uint32(data[64:]),
+		clean:    binary.LittleEndian.Uint32(data[68:]) == 1,
+	}
 
 	// verify the page
-	if !bytes.Equal([]byte(DB_SIG), data[:16]) {
-		return errors.New("Bad signature")
+	var sig [16]byte
+	copy(sig[:], DB_SIG)
+	if !bytes.Equal(sig[:], data[:16]) {
+		return master{}, errors.New("Bad signature")
 	}
 
-	bad := !(1 <= used && used <= uint64(db.mmap.file/btree.BTREE_PAGE_SIZE))
-	bad = bad || !(0 <= root && root < used)
+	bad := !(1 <= m.used && m.used <= filePages)
+	bad = bad || !(0 <= m.root && m.root < m.used)
+	bad = bad || !(m.free < m.used)
 
 	if bad {
-		return errors.New("Bad master page.")
+		return master{}, errors.New("Bad master page.")
+	}
+	return m, nil
+}
+
+// A crash between writePages and syncPages leaves pages past the used size that nothing references,
+// appended in a run right after it. they go to the free list, the file keeps its size.
+// the zeroed space extendFile preallocated after them stays for appends, so an Open with
+// nothing to reclaim writes nothing.
+func reclaimTail(db *KV) error {
+	filePages := uint64(db.mmap.file / btree.BTREE_PAGE_SIZE)
+	used := db.page.flushed
+	// every page written starts with a nonzero node type
+	end := used
+	for end < filePages && binary.LittleEndian.Uint16(pageGetMapped(db, end).Data) != 0 {
+		end++
+	}
+	// the new list nodes are appended to the last pages of the run, enough of them for the rest
+	nodes := (end - used + freelist.FREE_LIST_CAP) / (freelist.FREE_LIST_CAP + 1)
+	if used+nodes >= end {
+		return nil
 	}
 
-	db.tree.Root = root
-	db.page.flushed = used
+	head := db.free.Head()
+	db.page.flushed = end - nodes
+	for ptr := used; ptr < db.page.flushed; ptr++ {
+		db.pageDel(ptr)
+	}
+	if err := flushPages(db); err != nil {
+		rollback(db, db.tree.Root, head)
+		db.page.flushed = used
+		return err
+	}
 	return nil
 }
 
@@ -154,27 +594,85 @@ func (db *KV) pageUse(ptr uint64, node btree.BNode) {
 	db.page.updates[ptr] = node.Data
 }
 
-// update the master page. Must be atomic
+// update the master page after a commit. Must be atomic
 func masterStore(db *KV) error {
-	var data [32]byte
+	return masterStoreClean(db, false)
+}
+
+func masterStoreClean(db *KV, clean bool) error {
+	var data [MASTER_SIZE]byte
 	copy(data[:16], []byte(DB_SIG))
 
 	binary.LittleEndian.PutUint64(data[16:], db.tree.Root)
 	binary.LittleEndian.PutUint64(data[24:], db.page.flushed)
+	binary.LittleEndian.PutUint64(data[32:], db.free.Head())
+	binary.LittleEndian.PutUint32(data[40:], FORMAT_VERSION)
+	binary.LittleEndian.PutUint32(data[44:], db.features)
+	binary.LittleEndian.PutUint32(data[48:], uint32(db.tree.KeyWidth))
+	binary.LittleEndian.PutUint64(data[52:], db.seq)
+	binary.LittleEndian.PutUint32(data[60:], btree.BTREE_PAGE_SIZE)
+	binary.LittleEndian.PutUint32(data[64:], db.schema)
+	if clean {
+		binary.LittleEndian.PutUint32(data[68:], 1)
+	}
+
+	// retry transient failures with an exponential backoff,
+	// so a blip doesn't fail a commit whose pages are already written.
+	retries := db.MasterRetries
+	if retries == 0 {
+		retries = MASTER_RETRIES
+	}
+	backoff := MASTER_BACKOFF
+	for attempt := 0; ; attempt++ {
+		err := masterWrite(db, data[:])
+		if err == nil || !isTransient(err) || attempt >= retries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// the write behind masterWrite, tests swap it to inject failures
+var masterWriteAt = (*os.File).WriteAt
 
+func masterWrite(db *KV, data []byte) error {
+	if db.hugeMode == HUGEPAGES_HUGETLB {
+		// hugetlbfs has no write(2), the mapping is the only way in
+		copy(db.mmap.chunks[0], data)
+		return nil
+	}
 	// NOTE: Updating the page via mmap is not atomic.
-	_, err := db.fp.WriteAt(data[:], 0)
-	if err != nil {
+	if _, err := masterWriteAt(db.fp, data, 0); err != nil {
 		return fmt.Errorf("write master page: %w", err)
 	}
+	if err := fsync(db.fp); err != nil {
+		return fmt.Errorf("fsync master page: %w", err)
+	}
 	return nil
 }
 
-// callback for BTree, allocate a new page
+// errors worth retrying. A failed fsync (EIO) is not one of them,
+// the kernel may have already dropped the dirty pages.
+func isTransient(err error) bool {
+	return errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, io.ErrShortWrite)
+}
+
+// callback for BTree, allocate a new page.
+// reuses a page from the free list if there is one left, appends to the file otherwise
 func (db *KV) pageNew(node btree.BNode) uint64 {
 	utils.Assert(len(node.Data) <= btree.BTREE_PAGE_SIZE)
-	ptr := db.page.flushed + uint64(len(db.page.temp))
-	db.page.temp = append(db.page.temp, node.Data)
+	ptr := uint64(0)
+	if db.page.nfree < db.free.Total() {
+		ptr = db.free.Getn(db.page.nfree)
+		db.page.nfree++
+	} else {
+		ptr = db.page.flushed + uint64(db.page.nappend)
+		db.page.nappend++
+	}
+	db.page.updates[ptr] = node.Data
+	db.logPage("new", ptr)
 	return ptr
 }
 
@@ -185,9 +683,13 @@ func extendFile(db *KV, npages int) error {
 		return nil
 	}
 
+	growth := db.GrowthFactor
+	if growth == 0 {
+		growth = GROWTH_FACTOR
+	}
 	for filePages < npages {
 		// the file size is increased exponentially, so that we don't have to extend the file for every update
-		inc := filePages / 8
+		inc := int(float64(filePages) * (growth - 1))
 		if inc < 1 {
 			inc = 1
 		}
@@ -195,7 +697,15 @@ func extendFile(db *KV, npages int) error {
 	}
 
 	fileSize := filePages * btree.BTREE_PAGE_SIZE
-	err := syscall.Fallocate(int(db.fp.Fd()), 0, 0, int64(fileSize))
+	if db.MaxFileSize > 0 && int64(fileSize) > db.MaxFileSize {
+		// grow up to the cap, but no further
+		if int64(npages*btree.BTREE_PAGE_SIZE) > db.MaxFileSize {
+			return ErrQuotaExceeded
+		}
+		fileSize = int(db.MaxFileSize) / btree.BTREE_PAGE_SIZE * btree.BTREE_PAGE_SIZE
+	}
+
+	err := fallocate(int(db.fp.Fd()), 0, 0, int64(fileSize))
 	if err != nil {
 		return fmt.Errorf("fallocate: %w", err)
 	}
@@ -205,15 +715,73 @@ func extendFile(db *KV, npages int) error {
 }
 
 func (db *KV) Open() error {
+	if db.KeyWidth < 0 || db.KeyWidth > 0xff {
+		return fmt.Errorf("KV.Open: key width %d out of range", db.KeyWidth)
+	}
+	if db.GrowthFactor != 0 && !(db.GrowthFactor > 1) {
+		return fmt.Errorf("KV.Open: growth factor %v is not > 1", db.GrowthFactor)
+	}
+	if err := db.checkSyncPolicy(); err != nil {
+		return fmt.Errorf("KV.Open: %w", err)
+	}
+	if db.MmapChunkSize < 0 || db.MmapChunkSize%btree.BTREE_PAGE_SIZE != 0 {
+		return fmt.Errorf("KV.Open: mmap chunk size %d is not a multiple of the page size", db.MmapChunkSize)
+	}
+
 	// open or create the DB file
-	fp, err := os.OpenFile(db.Path, os.O_RDWR|os.O_CREATE, 0644)
+	flags := os.O_RDWR | os.O_CREATE
+	if db.ReadOnly {
+		if db.CreateOnly {
+			return errors.New("KV.Open: CreateOnly with ReadOnly")
+		}
+		flags = os.O_RDONLY
+	}
+	if db.CreateOnly {
+		flags |= os.O_EXCL
+	}
+	fp, err := os.OpenFile(db.Path, flags, 0644)
 	if err != nil {
 		return fmt.Errorf("OpenFile: %w", err)
 	}
+	return openFile(db, fp)
+}
+
+// OpenFd opens a DB on a descriptor that is already open for reading and writing,
+// e.g. one passed in by a more privileged process. path is only informational.
+// The DB works on its own duplicate of fd, so Close never closes the caller's descriptor.
+func OpenFd(fd int, path string) (*KV, error) {
+	dup, err := syscall.Dup(fd)
+	if err != nil {
+		return nil, fmt.Errorf("dup: %w", err)
+	}
+
+	db := &KV{Path: path}
+	if err := openFile(db, os.NewFile(uintptr(dup), path)); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// set up the DB on an opened file, takes ownership of fp
+func openFile(db *KV, fp *os.File) error {
 	db.fp = fp
 
+	// a single writer or any number of readers per file, across processes.
+	// the lock goes away when the file is closed.
+	how := syscall.LOCK_EX
+	if db.ReadOnly {
+		how = syscall.LOCK_SH
+	}
+	if err := flock(int(fp.Fd()), how|syscall.LOCK_NB); err != nil {
+		db.fp.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			err = ErrLocked
+		}
+		return fmt.Errorf("KV.Open: %w", err)
+	}
+
 	// create the initial mmap
-	sz, chunk, err := mmapInt(db.fp)
+	sz, chunk, err := mmapInt(db)
 	if err != nil {
 		goto fail
 	}
@@ -221,18 +789,43 @@ func (db *KV) Open() error {
 	db.mmap.file = sz
 	db.mmap.total = len(chunk)
 	db.mmap.chunks = [][]byte{chunk}
+	db.page.updates = map[uint64][]byte{}
 
 	// btree callbacks
 	db.tree.Get = db.pageGet
 	db.tree.New = db.pageNew
 	db.tree.Del = db.pageDel
+	db.tree.Normalize = db.NormalizeKey
+	db.tree.MinKeys = db.MinKeysPerNode
+	db.tree.OnSplit = func() { db.counters.pending.splits++ }
+	db.tree.OnMerge = func() { db.counters.pending.merges++ }
+	db.tree.OnInsert = db.onInsert
+	db.tree.OnDelete = db.onDelete
+	// free list callbacks
+	db.free.Get = db.pageGet
+	db.free.New = db.pageAppend
+	db.free.Use = db.pageUse
+	db.free.OnUpdate = func() { db.counters.pending.freeListUpdates++ }
 
 	// read the master page
 	err = masterLoad(db)
 	if err != nil {
 		goto fail
 	}
+	if db.DefaultTTL > 0 && db.features&FEATURE_EXPIRY == 0 {
+		err = fmt.Errorf("DefaultTTL: %w", ErrNoExpiry)
+		goto fail
+	}
+
+	if !db.ReadOnly {
+		err = reclaimTail(db)
+		if err != nil {
+			goto fail
+		}
+	}
 
+	db.bloomOpen()
+	db.drainStart()
 	return nil
 
 fail:
@@ -242,68 +835,227 @@ fail:
 
 // cleanups
 func (db *KV) Close() {
+	db.drainStop()
+	// mark the file as closed cleanly, if it has a master page to mark
+	if !db.ReadOnly && db.mmap.file > 0 {
+		if masterStoreClean(db, true) == nil && db.IndexPath != "" {
+			_ = db.indexStore()
+		}
+	}
 	for _, chunk := range db.mmap.chunks {
-		err := syscall.Munmap(chunk)
+		err := munmap(chunk)
 		utils.Assert(err == nil)
 	}
+	// the lock belongs to the open file, which a descriptor given to OpenFd shares with the caller
+	_ = flock(int(db.fp.Fd()), syscall.LOCK_UN)
 	_ = db.fp.Close()
 }
 
 // Update operatins must persist data before returning
 
-// read the db
-func (db *KV) Get(key uint64) btree.BNode {
-	return db.tree.Get(key)
+// Get returns the value stored under key. A damaged page on the path counts as not found
+// in BestEffort mode, see ReadErrors.
+func (db *KV) Get(key []byte) ([]byte, bool) {
+	val, _, ok, err := db.GetWithFlags(key)
+	if err != nil {
+		return nil, false
+	}
+	return val, ok
+}
+
+// Node returns the tree page at ptr, for looking at the raw layout.
+func (db *KV) Node(ptr uint64) btree.BNode {
+	return db.tree.Get(ptr)
 }
 
 // update the db
 func (db *KV) Set(key []byte, val []byte) error {
-	db.tree.Insert(key, val)
-	return flushPages(db)
+	return db.SetWithFlags(key, val, 0)
+}
+
+// SetWithFlags stores flags next to the value. Needs a file created with ValueFlags,
+// unless flags is 0.
+func (db *KV) SetWithFlags(key []byte, val []byte, flags byte) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	return db.set(key, val, db.metaFor(key, flags))
+}
+
+// store one value with the given metadata. the caller holds db.writer
+func (db *KV) set(key []byte, val []byte, meta valMeta) error {
+	stored, err := db.encodeVal(val, meta)
+	if err != nil {
+		return err
+	}
+	if err := db.update(func() { db.tree.Insert(key, stored) }); err != nil {
+		return err
+	}
+	db.counters.sets.Add(1)
+	if db.VerifyWrites {
+		return db.verifyWrite(key, stored)
+	}
+	return nil
+}
+
+// read a committed key back through the mapping, i.e. from the file, and compare it
+func (db *KV) verifyWrite(key []byte, stored []byte) error {
+	got, ok := db.tree.Lookup(key)
+	if !ok {
+		return fmt.Errorf("%w: key %q not found after the commit", ErrVerifyFailed, key)
+	}
+	if !bytes.Equal(got, stored) {
+		return fmt.Errorf("%w: key %q reads back a different value", ErrVerifyFailed, key)
+	}
+	return nil
 }
 
 func (db *KV) Del(key []byte) (bool, error) {
-	deleted := db.tree.Delete(key)
-	return deleted, flushPages(db)
+	if err := checkKey(key); err != nil {
+		return false, err
+	}
+
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	deleted := false
+	if err := db.update(func() { deleted = db.deleteKey(key) }); err != nil {
+		return false, err
+	}
+	db.counters.dels.Add(1)
+	return deleted, nil
+}
+
+// apply the tree updates in fn and persist them with a single flush,
+// so they either all land or none do. the caller holds db.writer
+func (db *KV) update(fn func()) error {
+	if db.ReadOnly {
+		return ErrReadOnly
+	}
+
+	root, head, seq, flushed := db.tree.Root, db.free.Head(), db.seq, db.page.flushed
+	db.seq++ // the seq of this update, for the tombstones it writes
+	db.counters.pending = pendingCounts{}
+	db.changes.pending = db.changes.pending[:0]
+	fn()
+	if err := db.checkHeight(); err != nil {
+		rollback(db, root, head)
+		db.seq = seq
+		return err
+	}
+	if err := flushPages(db); err != nil {
+		rollback(db, root, head)
+		// the pages appended before a failed master write are past the used size again,
+		// so the master page Close writes doesn't claim them
+		db.seq, db.page.flushed = seq, flushed
+		return err
+	}
+	db.gen++
+	db.counters.splits.Add(db.counters.pending.splits)
+	db.counters.merges.Add(db.counters.pending.merges)
+	db.counters.writes.Add(db.counters.pending.writes)
+	db.counters.freeListUpdates.Add(db.counters.pending.freeListUpdates)
+	db.pinRefresh()
+	db.bloomGrow()
+	db.commitChanges()
+	db.churnCommit()
+	db.drainCommitted(true)
+	return nil
+}
+
+// discard the pending pages of a failed update and go back to the old root and free list.
+// the pages written by the failed update were all free before it, so the old state is intact.
+func rollback(db *KV, root uint64, head uint64) {
+	db.tree.Root = root
+	db.free.SetHead(head)
+	db.page.nfree = 0
+	db.page.nappend = 0
+	clear(db.page.updates)
+	db.changes.pending = db.changes.pending[:0]
+	db.drainCommitted(false)
 }
 
 // persist the newly allocated pages after updates
 func flushPages(db *KV) error {
+	// SyncPolicy and Flusher can be changed after Open, check the pair before writing anything
+	if err := db.checkSyncPolicy(); err != nil {
+		return err
+	}
 	if err := writePages(db); err != nil {
 		return err
 	}
-
-	return syncPages(db)
+	written := 0
+	for _, page := range db.page.updates {
+		if page != nil {
+			written++
+		}
+	}
+	if err := syncPages(db); err != nil {
+		return err
+	}
+	db.counters.flushes.Add(1)
+	db.counters.bytesWritten.Add(uint64(written) * btree.BTREE_PAGE_SIZE)
+	return nil
 }
 
 func writePages(db *KV) error {
-	// Update the free list
+	// update the free list: drop the reused pages and add the freed ones, all of the update's
+	// pages in one go however many nodes it touched.
+	// this may append pages, so it goes before extending the file
 	freed := []uint64{}
-
 	for ptr, page := range db.page.updates {
 		if page == nil {
 			freed = append(freed, ptr)
 		}
 	}
+	freed = db.deferFrees(freed)
+	db.free.Update(db.page.nfree, freed)
+
+	// extend the file & mmap if needed
+	npages := int(db.page.flushed) + db.page.nappend
+	if err := extendFile(db, npages); err != nil {
+		return err
+	}
+	if err := extendMmap(db, npages); err != nil {
+		return err
+	}
 
 	// copy pages to the file
-	for ptr, page := range db.page.updates {
-		if page != nil {
-			copy(pageGetMapped(db, ptr).Data, page)
-		}
+	pages := db.dirtyPages()
+	if err := db.flusher().Write(pages); err != nil {
+		return fmt.Errorf("write pages: %w", err)
 	}
 
 	return nil
 }
 
+// the sync policy must be known, and SYNC_COMBINED can't cover the writes of a custom flusher
+func (db *KV) checkSyncPolicy() error {
+	switch {
+	case db.SyncPolicy != SYNC_BARRIER && db.SyncPolicy != SYNC_COMBINED:
+		return fmt.Errorf("unknown sync policy %d", db.SyncPolicy)
+	case db.SyncPolicy == SYNC_COMBINED && db.Flusher != nil:
+		return errors.New("SYNC_COMBINED needs the default Flusher")
+	}
+	return nil
+}
+
 func syncPages(db *KV) error {
-	// Flush data to the disk. Must be done before updating master
-	if err := db.fp.Sync(); err != nil {
-		return fmt.Errorf("fsync: %w", err)
+	// Flush data to the disk. Must be done before updating master,
+	// unless the master's own fsync is trusted to cover the pages written before it
+	if db.SyncPolicy != SYNC_COMBINED {
+		if err := db.flusher().Sync(); err != nil {
+			return err
+		}
 	}
 
-	db.page.flushed += uint64(len(db.page.temp))
-	db.page.temp = db.page.temp[:0]
+	db.page.flushed += uint64(db.page.nappend)
+	db.page.nfree = 0
+	db.page.nappend = 0
+	clear(db.page.updates)
 
 	// update and flush the master
 	if err := masterStore(db); err != nil {
@@ -0,0 +1,1047 @@
+package kvstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"kurocifer/LeichtKV/btree"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// a new DB in a temp dir, set up by init before Open and closed with the test
+func openTestDB(t *testing.T, init func(db *KV)) *KV {
+	t.Helper()
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db")}
+	if init != nil {
+		init(db)
+	}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	return db
+}
+
+func mustSet(t *testing.T, db *KV, key, val string) {
+	t.Helper()
+	if err := db.Set([]byte(key), []byte(val)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// the value of key, read with a Scan starting at it
+func scanGet(db *KV, key string) (string, bool) {
+	val, ok := "", false
+	db.Scan([]byte(key), 1, 0, func(k, v []byte) bool {
+		val, ok = string(v), string(k) == key
+		return false
+	})
+	return val, ok
+}
+
+func mustGet(t *testing.T, db *KV, key, want string) {
+	t.Helper()
+	val, ok := scanGet(db, key)
+	if !ok {
+		t.Fatalf("Get(%q): not found", key)
+	}
+	if val != want {
+		t.Fatalf("Get(%q) = %q, want %q", key, val, want)
+	}
+}
+
+func mustMiss(t *testing.T, db *KV, key string) {
+	t.Helper()
+	if val, ok := scanGet(db, key); ok {
+		t.Fatalf("Get(%q) = %q, want not found", key, val)
+	}
+}
+
+func mustDel(t *testing.T, db *KV, key string) {
+	t.Helper()
+	if ok, err := db.Del([]byte(key)); err != nil || !ok {
+		t.Fatalf("Del(%q) = %v %v", key, ok, err)
+	}
+}
+
+func TestGet(t *testing.T) {
+	for _, tomb := range []bool{false, true} {
+		t.Run(fmt.Sprintf("tombstones=%v", tomb), func(t *testing.T) {
+			db := openTestDB(t, func(db *KV) { db.Tombstones = tomb; db.ValueFlags = true })
+			if err := db.SetWithFlags([]byte("a"), []byte("1"), 3); err != nil {
+				t.Fatal(err)
+			}
+			mustSet(t, db, "b", "2")
+			mustDel(t, db, "b")
+
+			// the value without its flags
+			if val, ok := db.Get([]byte("a")); !ok || string(val) != "1" {
+				t.Fatalf("Get(a) = %q, %v", val, ok)
+			}
+			for _, key := range []string{"b", "c"} {
+				if val, ok := db.Get([]byte(key)); ok {
+					t.Fatalf("Get(%q) = %q, want not found", key, val)
+				}
+			}
+		})
+	}
+}
+
+func TestGetEmptyTree(t *testing.T) {
+	db := openTestDB(t, nil)
+	mustGetMiss := func(when string) {
+		t.Helper()
+		// the empty key too, which would match the sentinel of the leftmost leaf
+		for _, key := range []string{"a", ""} {
+			if val, ok := db.Get([]byte(key)); ok {
+				t.Fatalf("%s: Get(%q) = %q, want not found", when, key, val)
+			}
+		}
+	}
+
+	if db.tree.Root != 0 {
+		t.Fatalf("root %d in a new DB", db.tree.Root)
+	}
+	mustGetMiss("new DB")
+
+	// deleting every key leaves a root leaf of only the sentinel
+	mustSet(t, db, "a", "1")
+	mustDel(t, db, "a")
+	if db.tree.Root == 0 {
+		t.Fatal("no root after deleting the only key")
+	}
+	mustGetMiss("all keys deleted")
+
+	mustSet(t, db, "a", "1")
+	if err := db.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	mustGetMiss("cleared")
+}
+
+func TestNode(t *testing.T) {
+	db := openTestDB(t, nil)
+	mustSet(t, db, "k", "v")
+	// the root is a leaf of the sentinel and k
+	node := db.Node(db.tree.Root)
+	if typ := binary.LittleEndian.Uint16(node.Data); typ != btree.BNODE_LEAF {
+		t.Fatalf("root of type %d", typ)
+	}
+	if key := node.GetKey(1); string(key) != "k" {
+		t.Fatalf("second key of the root %q", key)
+	}
+}
+
+func TestReuseFreedPages(t *testing.T) {
+	db := openTestDB(t, nil)
+	val := strings.Repeat("v", 500)
+
+	used := uint64(0)
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 200; i++ {
+			mustSet(t, db, fmt.Sprintf("key%04d", i), val)
+		}
+		for i := 0; i < 200; i++ {
+			mustDel(t, db, fmt.Sprintf("key%04d", i))
+		}
+		if round == 0 {
+			used = db.page.flushed
+		}
+	}
+	// every later round runs on the pages the first one freed
+	if db.page.flushed > used+used/4 {
+		t.Fatalf("the file grew from %d to %d pages", used, db.page.flushed)
+	}
+}
+
+// every page the free list accounts for, its nodes and the free pointers
+func freeSet(db *KV) map[uint64]bool {
+	pages := map[uint64]bool{}
+	db.free.Walk(func(ptr uint64, node bool) { pages[ptr] = true })
+	return pages
+}
+
+func TestReopenKeepsFreeList(t *testing.T) {
+	db := openTestDB(t, nil)
+	for i := 0; i < 200; i++ {
+		mustSet(t, db, fmt.Sprintf("key%04d", i), strings.Repeat("v", 500))
+	}
+	for i := 0; i < 100; i++ {
+		mustDel(t, db, fmt.Sprintf("key%04d", i))
+	}
+	root, used, total, seq := db.tree.Root, db.page.flushed, db.free.Total(), db.seq
+	if total == 0 {
+		t.Fatal("no free pages after the deletes")
+	}
+
+	db.Close()
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	// nothing to reclaim, the reopen doesn't commit
+	if db.tree.Root != root || db.page.flushed != used || db.free.Total() != total || db.seq != seq {
+		t.Fatalf("reopened with root %d, %d pages, %d free, seq %d; had %d, %d, %d, %d",
+			db.tree.Root, db.page.flushed, db.free.Total(), db.seq, root, used, total, seq)
+	}
+	mustSet(t, db, "key0000", "v")
+	if db.page.flushed != used {
+		t.Errorf("the file grew from %d to %d pages with free pages left", used, db.page.flushed)
+	}
+}
+
+func TestReclaimTail(t *testing.T) {
+	// nothing freed yet, so the free list will only have the reclaimed pages
+	db := openTestDB(t, nil)
+	mustSet(t, db, "key", "v")
+	used := db.page.flushed
+	if err := extendFile(db, int(used)+20); err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash before the master page: the pages of the update are written past the used size
+	failMasterWrites(t, syscall.EIO)
+	if err := db.Set([]byte("lost"), []byte(strings.Repeat("v", 3000))); err == nil {
+		t.Fatal("Set with a failing master page write")
+	}
+	fileSize := db.mmap.file
+	if uint64(fileSize/btree.BTREE_PAGE_SIZE) <= used {
+		t.Fatal("nothing past the used size")
+	}
+
+	db.Close()
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	mustMiss(t, db, "lost")
+	if db.mmap.file != fileSize {
+		t.Errorf("file of %d bytes after the reopen, was %d", db.mmap.file, fileSize)
+	}
+	free := freeSet(db)
+	for ptr := used; ptr < uint64(fileSize/btree.BTREE_PAGE_SIZE); ptr++ {
+		if !free[ptr] && ptr < db.page.flushed {
+			t.Fatalf("page %d of the tail is used but not in the free list", ptr)
+		}
+	}
+	// only the pages the failed update wrote, the preallocated space after them is left for appends
+	if db.page.flushed == used || db.page.flushed >= uint64(fileSize/btree.BTREE_PAGE_SIZE) {
+		t.Errorf("%d pages used after the reclaim, was %d in a file of %d", db.page.flushed, used, fileSize/btree.BTREE_PAGE_SIZE)
+	}
+
+	// the next update takes its pages from the tail instead of growing the file
+	mustSet(t, db, "new", strings.Repeat("v", 500))
+	if db.mmap.file != fileSize {
+		t.Errorf("the file grew from %d to %d bytes with the tail free", fileSize, db.mmap.file)
+	}
+	reused := 0
+	after := freeSet(db)
+	for ptr := range free {
+		if ptr >= used && !after[ptr] {
+			reused++
+		}
+	}
+	if reused == 0 {
+		t.Error("no tail page reused")
+	}
+}
+
+func TestMaxFileSize(t *testing.T) {
+	const max = 64 * 4096
+	db := openTestDB(t, func(db *KV) { db.MaxFileSize = max })
+	val := strings.Repeat("v", 1000)
+
+	n := 0
+	for ; ; n++ {
+		err := db.Set([]byte(fmt.Sprintf("key%06d", n)), []byte(val))
+		if errors.Is(err, ErrQuotaExceeded) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > 1000 {
+			t.Fatal("no quota error after 1000 writes")
+		}
+	}
+	if n == 0 {
+		t.Fatal("quota error on the first write")
+	}
+	info, err := os.Stat(db.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > max {
+		t.Fatalf("file of %d bytes, over the cap of %d", info.Size(), max)
+	}
+	// the failed write left nothing behind
+	mustMiss(t, db, fmt.Sprintf("key%06d", n))
+	mustGet(t, db, fmt.Sprintf("key%06d", n-1), val)
+
+	for i := 0; i < n/2; i++ {
+		mustDel(t, db, fmt.Sprintf("key%06d", i))
+	}
+	// the freed pages take the new writes
+	for i := 0; i < n/4; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("new%06d", i)), []byte(val)); err != nil {
+			t.Fatalf("write %d after the deletes: %v", i, err)
+		}
+	}
+	mustGet(t, db, fmt.Sprintf("new%06d", n/4-1), val)
+}
+
+func TestGrowthFactor(t *testing.T) {
+	db := openTestDB(t, func(db *KV) { db.GrowthFactor = 2 })
+	mustSet(t, db, "k", "v")
+	filePages := db.mmap.file / 4096
+	if err := extendFile(db, filePages+1); err != nil {
+		t.Fatal(err)
+	}
+	if got := db.mmap.file / 4096; got != 2*filePages {
+		t.Fatalf("grown from %d to %d pages, want %d", filePages, got, 2*filePages)
+	}
+
+	// a larger factor takes fewer fallocate calls for the same writes
+	grows := func(factor float64) int {
+		n := 0
+		fallocate := sysFallocate
+		sysFallocate = func(fd int, mode uint32, offset int64, length int64) error {
+			n++
+			return fallocate(fd, mode, offset, length)
+		}
+		defer func() { sysFallocate = fallocate }()
+
+		db := openTestDB(t, func(db *KV) { db.GrowthFactor = factor })
+		for i := 0; i < 2000; i++ {
+			mustSet(t, db, fmt.Sprintf("key%06d", i), strings.Repeat("v", 100))
+		}
+		return n
+	}
+	if def, four := grows(0), grows(4); four >= def {
+		t.Fatalf("%d fallocate calls with a factor of 4, %d with the default", four, def)
+	}
+}
+
+func TestGrowthFactorOutOfRange(t *testing.T) {
+	for _, factor := range []float64{-1, 0.5, 1} {
+		db := &KV{Path: filepath.Join(t.TempDir(), "test.db"), GrowthFactor: factor}
+		if err := db.Open(); err == nil {
+			db.Close()
+			t.Errorf("GrowthFactor %v: opened", factor)
+		}
+	}
+}
+
+func TestKeyWidth(t *testing.T) {
+	db := openTestDB(t, func(db *KV) { db.KeyWidth = 16 })
+	for i := 0; i < 2000; i++ {
+		mustSet(t, db, fmt.Sprintf("%016d", i), fmt.Sprint(i))
+	}
+
+	// an existing file keeps its width whatever is asked for
+	db.Close()
+	db.KeyWidth = 8
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if db.KeyWidth != 16 || db.tree.KeyWidth != 16 {
+		t.Fatalf("reopened with key width %d, tree %d", db.KeyWidth, db.tree.KeyWidth)
+	}
+	for i := 0; i < 2000; i += 97 {
+		mustGet(t, db, fmt.Sprintf("%016d", i), fmt.Sprint(i))
+	}
+	// keys of other sizes still work, in leaves with key lengths
+	mustSet(t, db, "short", "s")
+	mustGet(t, db, "short", "s")
+}
+
+func TestKeyWidthOutOfRange(t *testing.T) {
+	for _, width := range []int{-1, 256} {
+		db := &KV{Path: filepath.Join(t.TempDir(), "test.db"), KeyWidth: width}
+		if err := db.Open(); err == nil {
+			db.Close()
+			t.Errorf("KeyWidth %d: opened", width)
+		}
+	}
+}
+
+func TestUnknownFeature(t *testing.T) {
+	db := openTestDB(t, nil)
+	mustSet(t, db, "k", "v")
+	db.features |= 1 << 31
+	mustSet(t, db, "k", "v2")
+
+	db.Close()
+	if err := db.Open(); err == nil || !strings.Contains(err.Error(), "unsupported format") {
+		if err == nil {
+			db.Close()
+		}
+		t.Fatalf("Open of a file with an unknown feature: %v", err)
+	}
+}
+
+// fail the master page writes with the errors of errs in turn, then let them through
+func failMasterWrites(t *testing.T, errs ...error) *int {
+	calls := 0
+	writeAt := masterWriteAt
+	masterWriteAt = func(fp *os.File, data []byte, off int64) (int, error) {
+		if calls++; calls <= len(errs) {
+			return 0, errs[calls-1]
+		}
+		return writeAt(fp, data, off)
+	}
+	t.Cleanup(func() { masterWriteAt = writeAt })
+	return &calls
+}
+
+func TestMasterRetries(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		retries int
+		errs    []error
+		calls   int
+		fails   bool
+	}{
+		{"transient", 0, []error{syscall.EINTR, syscall.EAGAIN, io.ErrShortWrite}, 4, false},
+		{"too many", 0, []error{syscall.EINTR, syscall.EINTR, syscall.EINTR, syscall.EINTR}, 4, true},
+		{"more retries", 5, []error{syscall.EINTR, syscall.EINTR, syscall.EINTR, syscall.EINTR}, 5, false},
+		{"no retries", -1, []error{syscall.EINTR}, 1, true},
+		{"not transient", 0, []error{syscall.EIO}, 1, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			db := openTestDB(t, func(db *KV) { db.MasterRetries = c.retries })
+			calls := failMasterWrites(t, c.errs...)
+			err := db.Set([]byte("k"), []byte("v"))
+			if (err != nil) != c.fails {
+				t.Fatalf("Set: %v", err)
+			}
+			if *calls != c.calls {
+				t.Errorf("%d master page writes, want %d", *calls, c.calls)
+			}
+			if !c.fails {
+				mustGet(t, db, "k", "v")
+			}
+		})
+	}
+}
+
+// record the fsyncs and master page writes of the commits, in order
+func recordSyncs(t *testing.T) *[]string {
+	calls := []string{}
+	fsync, writeAt := sysFsync, masterWriteAt
+	sysFsync = func(fp *os.File) error {
+		calls = append(calls, "fsync")
+		return fsync(fp)
+	}
+	masterWriteAt = func(fp *os.File, data []byte, off int64) (int, error) {
+		calls = append(calls, "master")
+		return writeAt(fp, data, off)
+	}
+	t.Cleanup(func() { sysFsync, masterWriteAt = fsync, writeAt })
+	return &calls
+}
+
+func TestSyncPolicy(t *testing.T) {
+	for _, c := range []struct {
+		policy int
+		want   string
+	}{
+		// the pages are synced before the master page is written
+		{SYNC_BARRIER, "[fsync master fsync fsync master fsync]"},
+		// one fsync covers the pages and the master page
+		{SYNC_COMBINED, "[master fsync master fsync]"},
+	} {
+		db := openTestDB(t, func(db *KV) { db.SyncPolicy = c.policy })
+		calls := recordSyncs(t)
+		mustSet(t, db, "a", "1")
+		mustSet(t, db, "b", "2")
+		if got := fmt.Sprint(*calls); got != c.want {
+			t.Errorf("policy %d: calls %s, want %s", c.policy, got, c.want)
+		}
+		mustGet(t, db, "a", "1")
+		mustGet(t, db, "b", "2")
+	}
+}
+
+func TestSyncPolicyInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	for _, db := range []*KV{
+		{Path: path, SyncPolicy: -1},
+		{Path: path, SyncPolicy: SYNC_COMBINED + 1},
+		// a custom flusher's writes may not be covered by an fsync of the file
+		{Path: path, SyncPolicy: SYNC_COMBINED, Flusher: &recFlusher{}},
+	} {
+		if err := db.Open(); err == nil {
+			db.Close()
+			t.Errorf("opened with sync policy %d and flusher %v", db.SyncPolicy, db.Flusher)
+		}
+	}
+
+	// the same pairs set on an open DB fail the next commit, which writes nothing
+	for _, set := range []func(db *KV){
+		func(db *KV) { db.SyncPolicy = SYNC_COMBINED + 1 },
+		func(db *KV) { db.SyncPolicy, db.Flusher = SYNC_COMBINED, &recFlusher{next: db.DefaultFlusher()} },
+	} {
+		db := openTestDB(t, nil)
+		mustSet(t, db, "a", "1")
+		set(db)
+		f, _ := db.Flusher.(*recFlusher)
+		if err := db.Set([]byte("a"), []byte("2")); err == nil {
+			t.Errorf("Set succeeded with sync policy %d and flusher %v", db.SyncPolicy, db.Flusher)
+		}
+		if f != nil && len(f.calls) != 0 {
+			t.Errorf("flusher calls %v of a rejected commit", f.calls)
+		}
+		mustGet(t, db, "a", "1")
+
+		db.SyncPolicy, db.Flusher = SYNC_BARRIER, nil
+		mustSet(t, db, "a", "3")
+		mustGet(t, db, "a", "3")
+	}
+}
+
+func TestHugePagesFallback(t *testing.T) {
+	advice := []int{}
+	madvise := sysMadvise
+	sysMadvise = func(chunk []byte, a int) error {
+		advice = append(advice, a)
+		if a == syscall.MADV_HUGEPAGE {
+			return nil // accepted, whether or not this kernel has transparent huge pages
+		}
+		return madvise(chunk, a)
+	}
+	t.Cleanup(func() { sysMadvise = madvise })
+
+	// a file outside hugetlbfs gets a normal mapping with the hint
+	db := openTestDB(t, func(db *KV) { db.HugePages = true })
+	if mode := db.HugePageMode(); mode != HUGEPAGES_ADVISED {
+		t.Fatalf("HugePageMode = %d, want HUGEPAGES_ADVISED", mode)
+	}
+	if len(advice) != 1 || advice[0] != syscall.MADV_HUGEPAGE {
+		t.Fatalf("madvise %v, want MADV_HUGEPAGE", advice)
+	}
+	for i := 0; i < 100; i++ {
+		mustSet(t, db, fmt.Sprintf("key%04d", i), "v")
+	}
+	mustGet(t, db, "key0042", "v")
+
+	if db := openTestDB(t, nil); db.HugePageMode() != HUGEPAGES_NONE {
+		t.Errorf("HugePageMode = %d without HugePages", db.HugePageMode())
+	}
+}
+
+func TestHugePagesHintRejected(t *testing.T) {
+	madvise := sysMadvise
+	sysMadvise = func(chunk []byte, a int) error {
+		if a == syscall.MADV_HUGEPAGE {
+			return syscall.EINVAL // no transparent huge pages
+		}
+		return madvise(chunk, a)
+	}
+	t.Cleanup(func() { sysMadvise = madvise })
+
+	db := openTestDB(t, func(db *KV) { db.HugePages = true })
+	if mode := db.HugePageMode(); mode != HUGEPAGES_NONE {
+		t.Fatalf("HugePageMode = %d, want HUGEPAGES_NONE", mode)
+	}
+	mustSet(t, db, "k", "v")
+	mustGet(t, db, "k", "v")
+}
+
+// HUGETLBFS_DIR names a hugetlbfs mount with huge pages reserved
+func TestHugePages(t *testing.T) {
+	dir := os.Getenv("HUGETLBFS_DIR")
+	if dir == "" {
+		t.Skip("HUGETLBFS_DIR not set")
+	}
+	db := &KV{Path: filepath.Join(dir, fmt.Sprintf("leichtkv-%d.db", os.Getpid())), HugePages: true}
+	t.Cleanup(func() { os.Remove(db.Path) })
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		mustSet(t, db, fmt.Sprintf("key%04d", i), "v")
+	}
+
+	db.Close()
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if mode := db.HugePageMode(); mode != HUGEPAGES_HUGETLB {
+		t.Errorf("HugePageMode = %d, want HUGEPAGES_HUGETLB", mode)
+	}
+	mustGet(t, db, "key0042", "v")
+}
+
+func TestTrimMapping(t *testing.T) {
+	db := openTestDB(t, nil)
+	for i := 0; i < 50; i++ {
+		mustSet(t, db, fmt.Sprintf("key%04d", i), strings.Repeat("v", 100))
+	}
+	if err := db.TrimMapping(); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.mmap.chunks) != 1 || db.mmap.total != db.mmap.file {
+		t.Fatalf("%d bytes in %d chunks mapped for a file of %d", db.mmap.total, len(db.mmap.chunks), db.mmap.file)
+	}
+	mustGet(t, db, "key0007", strings.Repeat("v", 100))
+
+	// growing past the trimmed mapping extends it again
+	for i := 0; i < 2000; i++ {
+		mustSet(t, db, fmt.Sprintf("key%04d", i), strings.Repeat("v", 100))
+	}
+	if db.mmap.total < db.mmap.file {
+		t.Fatalf("%d bytes mapped for a file of %d", db.mmap.total, db.mmap.file)
+	}
+	for i := 0; i < 2000; i += 99 {
+		mustGet(t, db, fmt.Sprintf("key%04d", i), strings.Repeat("v", 100))
+	}
+}
+
+func TestMmapChunkSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	chunk := 4 * btree.BTREE_PAGE_SIZE
+	db := &KV{Path: path, MmapChunkSize: chunk}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(strings.Repeat("v", 100))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(db.mmap.chunks) < 2 {
+		t.Fatalf("%d chunks after growing", len(db.mmap.chunks))
+	}
+	for i, c := range db.mmap.chunks {
+		if len(c) != chunk {
+			t.Fatalf("chunk %d is %d bytes, want %d", i, len(c), chunk)
+		}
+	}
+	if db.mmap.total < db.mmap.file {
+		t.Fatalf("%d bytes mapped for a file of %d", db.mmap.total, db.mmap.file)
+	}
+	db.Close()
+
+	db = &KV{Path: path, MmapChunkSize: chunk}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.mmap.total%chunk != 0 {
+		t.Fatalf("%d bytes mapped, not a whole number of chunks", db.mmap.total)
+	}
+	for i := 0; i < 500; i += 37 {
+		mustGet(t, db, fmt.Sprintf("key%04d", i), strings.Repeat("v", 100))
+	}
+}
+
+// the default mapping doubles past the first 64MB, and pages in the new chunk read back
+func TestMmapGrowth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	first := len(db.mmap.chunks[0])
+	val := strings.Repeat("v", 3000) // about a leaf per key
+	for n := 0; db.mmap.file < first+first/4; n += 1000 {
+		err := db.Update(func(tx *Tx) error {
+			for i := n; i < n+1000; i++ {
+				if err := tx.Set([]byte(fmt.Sprintf("key%06d", i)), []byte(val)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(db.mmap.chunks) != 2 || len(db.mmap.chunks[1]) != first {
+		t.Fatalf("chunks of %d bytes after growing past %d", chunkSizes(db), first)
+	}
+	if sum := len(db.mmap.chunks[0]) + len(db.mmap.chunks[1]); db.mmap.total != sum {
+		t.Fatalf("%d bytes mapped, the chunks add up to %d", db.mmap.total, sum)
+	}
+
+	// keys whose leaf is in the second chunk
+	keys := []string{}
+	db.ScanLeaves(nil, func(page uint64, k, v []byte) bool {
+		if page >= uint64(first/btree.BTREE_PAGE_SIZE) && len(keys) < 50 {
+			keys = append(keys, string(k))
+		}
+		return true
+	})
+	if len(keys) == 0 {
+		t.Fatal("no leaf in the second chunk")
+	}
+	for _, key := range keys {
+		mustGet(t, db, key, val)
+	}
+	db.Close()
+
+	db = &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range keys {
+		mustGet(t, db, key, val)
+	}
+	if r := db.HealthCheck(); !r.OK() {
+		t.Fatalf("health check:\n%s", r)
+	}
+}
+
+func chunkSizes(db *KV) []int {
+	sizes := []int{}
+	for _, c := range db.mmap.chunks {
+		sizes = append(sizes, len(c))
+	}
+	return sizes
+}
+
+func TestMmapChunkSizeInvalid(t *testing.T) {
+	for _, size := range []int{-btree.BTREE_PAGE_SIZE, btree.BTREE_PAGE_SIZE + 1} {
+		db := &KV{Path: filepath.Join(t.TempDir(), "test.db"), MmapChunkSize: size}
+		if err := db.Open(); err == nil {
+			db.Close()
+			t.Fatalf("chunk size %d accepted", size)
+		}
+	}
+}
+
+func TestConsolidateMapping(t *testing.T) {
+	db := openTestDB(t, func(db *KV) { db.MmapChunkSize = 4 * btree.BTREE_PAGE_SIZE })
+	for i := 0; i < 500; i++ {
+		mustSet(t, db, fmt.Sprintf("key%04d", i), strings.Repeat("v", 100))
+	}
+	n, total := len(db.mmap.chunks), db.mmap.total
+	if n < 3 {
+		t.Fatalf("%d chunks after growing", n)
+	}
+	if err := db.ConsolidateMapping(0); err == nil {
+		t.Fatal("chunk count 0 accepted")
+	}
+
+	// under the limit nothing changes
+	if err := db.ConsolidateMapping(n); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.mmap.chunks) != n {
+		t.Fatalf("%d chunks, want %d", len(db.mmap.chunks), n)
+	}
+
+	if err := db.ConsolidateMapping(n - 1); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.mmap.chunks) != 1 || db.mmap.total != total {
+		t.Fatalf("%d bytes in %d chunks, want %d in one", db.mmap.total, len(db.mmap.chunks), total)
+	}
+	for i := 0; i < 500; i += 37 {
+		mustGet(t, db, fmt.Sprintf("key%04d", i), strings.Repeat("v", 100))
+	}
+
+	// growing afterwards adds chunks again
+	for i := 500; i < 1000; i++ {
+		mustSet(t, db, fmt.Sprintf("key%04d", i), strings.Repeat("v", 100))
+	}
+	if len(db.mmap.chunks) < 2 {
+		t.Fatalf("%d chunks after growing again", len(db.mmap.chunks))
+	}
+	mustGet(t, db, "key0999", strings.Repeat("v", 100))
+}
+
+func TestValueSurvivesMmapGrowth(t *testing.T) {
+	db := openTestDB(t, nil)
+	// a and b don't fit in a leaf together, so the leaf of a is left alone by the later writes
+	big := strings.Repeat("a", 3000)
+	mustSet(t, db, "a", big)
+	mustSet(t, db, "b", strings.Repeat("b", 3000))
+
+	val, _, ok, err := db.GetWithFlags([]byte("a"))
+	if err != nil || !ok {
+		t.Fatalf("GetWithFlags = %v %v", ok, err)
+	}
+	first := &db.mmap.chunks[0][0]
+
+	// each growth doubles the mapping, well past the file
+	for i := 0; i < 3; i++ {
+		if err := extendMmap(db, 2*db.mmap.total/4096); err != nil {
+			t.Fatal(err)
+		}
+		mustSet(t, db, fmt.Sprintf("c%d", i), "v")
+	}
+	if len(db.mmap.chunks) != 4 || &db.mmap.chunks[0][0] != first {
+		t.Fatalf("%d chunks, the first one moved: %v", len(db.mmap.chunks), &db.mmap.chunks[0][0] != first)
+	}
+	if string(val) != big {
+		t.Fatal("the value read before the growth changed")
+	}
+}
+
+func TestOpenFd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	fp, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+
+	db, err := OpenFd(int(fp.Fd()), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustSet(t, db, "k", "v")
+	db.Close()
+
+	// the caller's descriptor outlives the DB
+	if _, err := fp.Stat(); err != nil {
+		t.Fatalf("descriptor closed with the DB: %v", err)
+	}
+	db = &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	mustGet(t, db, "k", "v")
+}
+
+func TestOpenFdBadDescriptor(t *testing.T) {
+	if db, err := OpenFd(-1, "none"); err == nil {
+		db.Close()
+		t.Fatal("opened a bad descriptor")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	w := &KV{Path: path}
+	if err := w.Open(); err != nil {
+		t.Fatal(err)
+	}
+	mustSet(t, w, "k", "v")
+
+	// no reader while the writer has the file
+	r1 := &KV{Path: path, ReadOnly: true}
+	if err := r1.Open(); !errors.Is(err, ErrLocked) {
+		t.Fatalf("read-only open next to a writer: %v", err)
+	}
+	w.Close()
+
+	// any number of readers
+	if err := r1.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer r1.Close()
+	r2 := &KV{Path: path, ReadOnly: true}
+	if err := r2.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer r2.Close()
+	mustGet(t, r1, "k", "v")
+	mustGet(t, r2, "k", "v")
+
+	if err := r1.Set([]byte("k"), []byte("v2")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Set on a read-only DB: %v", err)
+	}
+	if _, err := r1.Del([]byte("k")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Del on a read-only DB: %v", err)
+	}
+	mustGet(t, r1, "k", "v")
+
+	// but no writer while they have it
+	if err := w.Open(); !errors.Is(err, ErrLocked) {
+		t.Fatalf("open next to readers: %v", err)
+	}
+}
+
+// the other process of TestReadOnlyProcesses, run by re-executing the test binary.
+// opens the DB as a writer or a reader, says "ready" once it holds the lock, and keeps
+// the DB open until its stdin is closed
+func TestReadOnlyHelper(t *testing.T) {
+	path := os.Getenv("LEICHTKV_HELPER_PATH")
+	if path == "" {
+		t.Skip("run by TestReadOnlyProcesses")
+	}
+	db := &KV{Path: path, ReadOnly: os.Getenv("LEICHTKV_HELPER") == "reader"}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.ReadOnly {
+		mustGet(t, db, "k", "v")
+		if err := db.Set([]byte("k"), []byte("v2")); !errors.Is(err, ErrReadOnly) {
+			t.Fatalf("Set on a read-only DB: %v", err)
+		}
+	} else {
+		mustSet(t, db, "k", "v")
+	}
+	fmt.Println("ready")
+	_, _ = io.Copy(io.Discard, os.Stdin)
+}
+
+func TestReadOnlyProcesses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	// start TestReadOnlyHelper in another process, returns once it holds the lock
+	start := func(role string) (stop func()) {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestReadOnlyHelper$")
+		cmd.Env = append(os.Environ(), "LEICHTKV_HELPER="+role, "LEICHTKV_HELPER_PATH="+path)
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		out := bufio.NewReader(stdout)
+		if line, _ := out.ReadString('\n'); line != "ready\n" {
+			rest, _ := io.ReadAll(out)
+			stdin.Close()
+			cmd.Wait()
+			t.Fatalf("%s process: %s%s", role, line, rest)
+		}
+		return func() {
+			stdin.Close()
+			rest, _ := io.ReadAll(out)
+			if err := cmd.Wait(); err != nil {
+				t.Fatalf("%s process: %v: %s", role, err, rest)
+			}
+		}
+	}
+
+	// no reader while a writer process has the file
+	stop := start("writer")
+	r := &KV{Path: path, ReadOnly: true}
+	if err := r.Open(); !errors.Is(err, ErrLocked) {
+		t.Fatalf("read-only open next to a writer process: %v", err)
+	}
+	stop()
+
+	// a reader process and this one together, both see the committed data
+	stop = start("reader")
+	defer stop()
+	if err := r.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	mustGet(t, r, "k", "v")
+	if err := r.Set([]byte("k"), []byte("v2")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Set on a read-only DB: %v", err)
+	}
+
+	// but no writer while they have it
+	w := &KV{Path: path}
+	if err := w.Open(); !errors.Is(err, ErrLocked) {
+		t.Fatalf("open next to a reader process: %v", err)
+	}
+}
+
+func TestCreateOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path, CreateOnly: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	mustSet(t, db, "k", "v")
+	db.Close()
+
+	// the file exists now
+	if err := db.Open(); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("CreateOnly open of an existing file: %v", err)
+	}
+	ro := &KV{Path: filepath.Join(t.TempDir(), "other.db"), CreateOnly: true, ReadOnly: true}
+	if err := ro.Open(); err == nil {
+		t.Fatal("CreateOnly with ReadOnly opened")
+	}
+
+	// and opens as usual without the option
+	db.CreateOnly = false
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	mustGet(t, db, "k", "v")
+}
+
+func TestReadOnlyKeepsTail(t *testing.T) {
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db")}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	mustSet(t, db, "k", "v")
+	if err := extendFile(db, int(db.page.flushed)+20); err != nil {
+		t.Fatal(err)
+	}
+	size := db.mmap.file
+	db.Close()
+
+	// the tail is left for the next writer to reclaim
+	ro := &KV{Path: db.Path, ReadOnly: true}
+	if err := ro.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	if ro.free.Head() != 0 || ro.mmap.file != size {
+		t.Fatalf("free list head %d, file of %d bytes, want %d", ro.free.Head(), ro.mmap.file, size)
+	}
+	mustGet(t, ro, "k", "v")
+}
+
+// overwrite the page size recorded in the master page of the file at path
+func setPageSize(t *testing.T, path string, size uint32) {
+	fp, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	var data [4]byte
+	binary.LittleEndian.PutUint32(data[:], size)
+	if _, err := fp.WriteAt(data[:], 60); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPageSize(t *testing.T) {
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db")}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	mustSet(t, db, "k", "v")
+	db.Close()
+
+	setPageSize(t, db.Path, 8192)
+	if err := db.Open(); err == nil || !strings.Contains(err.Error(), "page size mismatch") {
+		if err == nil {
+			db.Close()
+		}
+		t.Fatalf("Open of a file of another page size: %v", err)
+	}
+	if _, err := Inspect(db.Path); err == nil {
+		t.Fatal("Inspect of a file of another page size")
+	}
+
+	// files from before the page size was recorded
+	setPageSize(t, db.Path, 0)
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, db, "k", "v")
+	mustSet(t, db, "k", "v2")
+	db.Close()
+	if info, err := Inspect(db.Path); err != nil || info.PageSize != 4096 {
+		t.Fatalf("Inspect after a commit = %+v %v", info, err)
+	}
+}
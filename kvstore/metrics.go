@@ -0,0 +1,63 @@
+package kvstore
+
+import "sync/atomic"
+
+// Metrics are cumulative counters since the DB was opened, see MetricsSnapshot.
+type Metrics struct {
+	Sets         uint64 // keys written by SetWithFlags
+	Gets         uint64 // point lookups
+	Dels         uint64 // Del calls, whether or not the key existed
+	Splits       uint64 // nodes split by inserts
+	Merges       uint64 // nodes merged by deletes
+	Flushes      uint64 // committed updates
+	BytesWritten uint64 // page bytes copied into the file, not counting the master page
+	CacheHits    uint64 // gets served from a pinned value or the HotKey cached leaf
+	CacheMisses  uint64 // HotKey gets that had to descend from the root
+	BloomSkips   uint64 // gets of absent keys answered by the bloom filter without reading the tree
+	// FreeList.Update calls that changed the free list. a commit makes a single one for all the
+	// pages it freed and reused
+	FreeListUpdates uint64
+	OffsetRepairs   uint64 // committed nodes read with a damaged offset list that RepairOffsets rebuilt
+}
+
+// the live counters behind Metrics, updated atomically so readers and the writer don't race.
+// updates are only counted once they commit
+type counters struct {
+	sets, gets, dels      atomic.Uint64
+	splits, merges        atomic.Uint64
+	flushes, bytesWritten atomic.Uint64
+	cacheHits, cacheMiss  atomic.Uint64
+	bloomSkips            atomic.Uint64
+	freeListUpdates       atomic.Uint64
+	offsetRepairs         atomic.Uint64
+	writes                atomic.Uint64 // keys inserted or deleted through the tree hooks, see ChurnStats
+
+	// counted during an update and added to the above once it commits. guarded by KV.writer
+	pending pendingCounts
+}
+
+type pendingCounts struct {
+	splits, merges, writes uint64
+	dels                   uint64 // the writes that deleted a key, tombstones included
+	freeListUpdates        uint64
+}
+
+// MetricsSnapshot returns the current counters, for polling-based monitoring.
+// Each counter is read atomically, but not all of them at the same instant.
+func (db *KV) MetricsSnapshot() Metrics {
+	c := &db.counters
+	return Metrics{
+		Sets:            c.sets.Load(),
+		Gets:            c.gets.Load(),
+		Dels:            c.dels.Load(),
+		Splits:          c.splits.Load(),
+		Merges:          c.merges.Load(),
+		Flushes:         c.flushes.Load(),
+		BytesWritten:    c.bytesWritten.Load(),
+		CacheHits:       c.cacheHits.Load(),
+		CacheMisses:     c.cacheMiss.Load(),
+		BloomSkips:      c.bloomSkips.Load(),
+		FreeListUpdates: c.freeListUpdates.Load(),
+		OffsetRepairs:   c.offsetRepairs.Load(),
+	}
+}
@@ -0,0 +1,117 @@
+package kvstore
+
+import (
+	"fmt"
+	"kurocifer/LeichtKV/btree"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestMetricsSnapshot(t *testing.T) {
+	db := openTestDB(t, func(db *KV) { db.MasterRetries = -1 })
+	base := db.MetricsSnapshot()
+
+	for i := 0; i < 1000; i++ {
+		mustSet(t, db, fmt.Sprintf("key%04d", i), "value")
+	}
+	for i := 0; i < 10; i++ {
+		db.GetWithFlags([]byte(fmt.Sprintf("key%04d", i)))
+	}
+	db.SnapshotGetMany([][]byte{[]byte("key0000"), []byte("missing")})
+	for i := 0; i < 1000; i += 2 {
+		mustDel(t, db, fmt.Sprintf("key%04d", i))
+	}
+	h := db.HotKey([]byte("key0001"))
+	for i := 0; i < 3; i++ {
+		h.Get()
+	}
+
+	m := db.MetricsSnapshot()
+	if m.Sets-base.Sets != 1000 || m.Dels-base.Dels != 500 || m.Flushes-base.Flushes != 1500 {
+		t.Errorf("%d sets, %d dels, %d flushes, want 1000, 500, 1500",
+			m.Sets-base.Sets, m.Dels-base.Dels, m.Flushes-base.Flushes)
+	}
+	if m.Gets-base.Gets != 15 || m.CacheHits != 2 || m.CacheMisses != 1 {
+		t.Errorf("%d gets, %d cache hits, %d misses, want 15, 2, 1", m.Gets-base.Gets, m.CacheHits, m.CacheMisses)
+	}
+	// every update writes at least a new leaf and root
+	if m.BytesWritten-base.BytesWritten < 2*1500*btree.BTREE_PAGE_SIZE {
+		t.Errorf("%d bytes written by 1500 updates", m.BytesWritten-base.BytesWritten)
+	}
+	if m.Splits == 0 || m.Merges == 0 {
+		t.Errorf("%d splits, %d merges", m.Splits, m.Merges)
+	}
+
+	// failed updates count nothing, not even the split of a large value
+	big := make([]byte, btree.BTREE_MAX_VALUE_SIZE)
+	failMasterWrites(t, syscall.EIO, syscall.EIO)
+	if err := db.Set([]byte("key0501"), big); err == nil {
+		t.Fatal("Set committed with a failing master write")
+	}
+	if _, err := db.Del([]byte("key0001")); err == nil {
+		t.Fatal("Del committed with a failing master write")
+	}
+	if after := db.MetricsSnapshot(); after != m {
+		t.Errorf("failed updates changed the metrics: %+v, was %+v", after, m)
+	}
+	if err := db.Set([]byte("key0501"), big); err != nil {
+		t.Fatal(err)
+	}
+	if after := db.MetricsSnapshot(); after.Sets != m.Sets+1 || after.Splits == m.Splits {
+		t.Errorf("%d sets and %d splits after the retry, was %d and %d", after.Sets, after.Splits, m.Sets, m.Splits)
+	}
+}
+
+func TestFreeListUpdates(t *testing.T) {
+	db := openTestDB(t, nil)
+	mustSet(t, db, "first", "v") // the empty tree had no page to free
+	if n := db.MetricsSnapshot().FreeListUpdates; n != 0 {
+		t.Fatalf("%d free list updates for the first set", n)
+	}
+	base := db.MetricsSnapshot()
+
+	// one update splitting and freeing many nodes still updates the free list once
+	err := db.Update(func(tx *Tx) error {
+		for i := 0; i < 1000; i++ {
+			tx.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("value"))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := db.MetricsSnapshot()
+	if m.Splits == base.Splits {
+		t.Fatal("no splits")
+	}
+	if n := m.FreeListUpdates - base.FreeListUpdates; n != 1 {
+		t.Fatalf("%d free list updates for one flush", n)
+	}
+
+	// a single insert splitting a leaf and its parent
+	for i := 0; i < 40; i++ {
+		mustSet(t, db, fmt.Sprintf("big%04d", i), strings.Repeat("v", 2000))
+	}
+	before := db.MetricsSnapshot()
+	height := db.Height()
+	for i := 40; db.Height() == height; i++ {
+		before = db.MetricsSnapshot()
+		mustSet(t, db, fmt.Sprintf("big%04d", i), strings.Repeat("v", 2000))
+	}
+	split := db.MetricsSnapshot()
+	if split.Splits-before.Splits < 2 {
+		t.Fatalf("%d splits for the insert adding a level", split.Splits-before.Splits)
+	}
+	if n := split.FreeListUpdates - before.FreeListUpdates; n != 1 {
+		t.Fatalf("%d free list updates for a multi-level split", n)
+	}
+
+	for i := 0; i < 100; i++ {
+		mustDel(t, db, fmt.Sprintf("key%04d", i))
+	}
+	after := db.MetricsSnapshot()
+	if n := after.FreeListUpdates - split.FreeListUpdates; n != 100 {
+		t.Fatalf("%d free list updates for 100 deletes", n)
+	}
+}
@@ -0,0 +1,122 @@
+package kvstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// MultiMap stores a sorted set of values under each key, on top of a KV. The set is encoded into
+// the key's single value, so all the values of a key together must fit in KV.MaxValueSize.
+// Keys written by a MultiMap must not be written directly through the KV.
+type MultiMap struct {
+	db *KV
+}
+
+func NewMultiMap(db *KV) *MultiMap {
+	return &MultiMap{db: db}
+}
+
+// the encoded set: | len | val | len | val | ... with 2B lengths, values sorted and unique
+func multiDecode(data []byte) ([][]byte, error) {
+	vals := [][]byte{}
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, errors.New("truncated length")
+		}
+		n := int(binary.LittleEndian.Uint16(data))
+		if len(data) < 2+n {
+			return nil, errors.New("truncated value")
+		}
+		vals = append(vals, data[2:2+n])
+		data = data[2+n:]
+	}
+	return vals, nil
+}
+
+func multiEncode(vals [][]byte) []byte {
+	data := []byte{}
+	for _, val := range vals {
+		data = binary.LittleEndian.AppendUint16(data, uint16(len(val)))
+		data = append(data, val...)
+	}
+	return data
+}
+
+// read and decode the set of key inside a transaction
+func multiGet(tx *Tx, key []byte) ([][]byte, error) {
+	data, ok, err := tx.Get(key)
+	if err != nil || !ok {
+		return nil, err
+	}
+	vals, err := multiDecode(data)
+	if err != nil {
+		return nil, fmt.Errorf("key %q is not a multimap value: %w", key, err)
+	}
+	return vals, nil
+}
+
+// Add puts val in the set of key. Adding a value that is already there does nothing.
+func (m *MultiMap) Add(key []byte, val []byte) error {
+	if len(val) > 0xffff {
+		return fmt.Errorf("MultiMap.Add: %w", ErrValueTooLarge)
+	}
+	err := m.db.Update(func(tx *Tx) error {
+		vals, err := multiGet(tx, key)
+		if err != nil {
+			return err
+		}
+		idx, found := slices.BinarySearchFunc(vals, val, bytes.Compare)
+		if found {
+			return nil
+		}
+		return tx.Set(key, multiEncode(slices.Insert(vals, idx, val)))
+	})
+	if err != nil {
+		return fmt.Errorf("MultiMap.Add: %w", err)
+	}
+	return nil
+}
+
+// Remove takes val out of the set of key and reports whether it was there.
+// The key is deleted with its last value.
+func (m *MultiMap) Remove(key []byte, val []byte) (bool, error) {
+	removed := false
+	err := m.db.Update(func(tx *Tx) error {
+		vals, err := multiGet(tx, key)
+		if err != nil {
+			return err
+		}
+		idx, found := slices.BinarySearchFunc(vals, val, bytes.Compare)
+		if !found {
+			return nil
+		}
+		removed = true
+		if vals = slices.Delete(vals, idx, idx+1); len(vals) == 0 {
+			return tx.Del(key)
+		}
+		return tx.Set(key, multiEncode(vals))
+	})
+	if err != nil {
+		return false, fmt.Errorf("MultiMap.Remove: %w", err)
+	}
+	return removed, nil
+}
+
+// Values returns copies of the values of key in sorted order, none for a missing key.
+func (m *MultiMap) Values(key []byte) ([][]byte, error) {
+	data, _, ok, err := m.db.GetWithFlags(key)
+	if err != nil || !ok {
+		return nil, err
+	}
+	vals, err := multiDecode(data)
+	if err != nil {
+		return nil, fmt.Errorf("MultiMap.Values: key %q is not a multimap value: %w", key, err)
+	}
+	for i, val := range vals {
+		vals[i] = append([]byte{}, val...)
+	}
+	return vals, nil
+}
@@ -0,0 +1,99 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func mustValues(t *testing.T, m *MultiMap, key string, want ...string) {
+	t.Helper()
+	vals, err := m.Values([]byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, val := range vals {
+		got = append(got, string(val))
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("Values(%q) = %q, want %q", key, got, want)
+	}
+}
+
+func TestMultiMap(t *testing.T) {
+	db := openTestDB(t, nil)
+	m := NewMultiMap(db)
+	mustValues(t, m, "k")
+
+	for _, val := range []string{"b", "c", "a", "b", ""} {
+		if err := m.Add([]byte("k"), []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Add([]byte("other"), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	mustValues(t, m, "k", "", "a", "b", "c")
+	mustValues(t, m, "other", "x")
+
+	// the returned values are copies
+	vals, _ := m.Values([]byte("k"))
+	vals[1][0] = 'z'
+	mustValues(t, m, "k", "", "a", "b", "c")
+
+	for _, c := range []struct {
+		val  string
+		want bool
+	}{{"b", true}, {"b", false}, {"missing", false}, {"", true}, {"a", true}} {
+		if removed, err := m.Remove([]byte("k"), []byte(c.val)); err != nil || removed != c.want {
+			t.Fatalf("Remove(%q) = %v %v, want %v", c.val, removed, err, c.want)
+		}
+	}
+	mustValues(t, m, "k", "c")
+
+	// the key goes with its last value
+	if removed, err := m.Remove([]byte("k"), []byte("c")); err != nil || !removed {
+		t.Fatalf("Remove of the last value = %v %v", removed, err)
+	}
+	mustMiss(t, db, "k")
+	mustValues(t, m, "k")
+	mustValues(t, m, "other", "x")
+}
+
+func TestMultiMapTooLarge(t *testing.T) {
+	db := openTestDB(t, nil)
+	m := NewMultiMap(db)
+	if err := m.Add([]byte("k"), make([]byte, 0x10000)); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("Add of a 64KB value: %v", err)
+	}
+
+	// the whole set has to fit in one value
+	val := strings.Repeat("v", 1000)
+	var err error
+	n := 0
+	for ; err == nil; n++ {
+		err = m.Add([]byte("k"), []byte(fmt.Sprint(n, val)))
+	}
+	if !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("Add past MaxValueSize: %v", err)
+	}
+	vals, _ := m.Values([]byte("k"))
+	if len(vals) != n-1 {
+		t.Fatalf("%d values kept after %d adds, the last failing", len(vals), n)
+	}
+}
+
+func TestMultiMapNotAMultiMap(t *testing.T) {
+	db := openTestDB(t, nil)
+	m := NewMultiMap(db)
+	mustSet(t, db, "k", "\x05\x00ab") // a length past the end
+	if _, err := m.Values([]byte("k")); err == nil {
+		t.Error("Values decoded a truncated set")
+	}
+	if err := m.Add([]byte("k"), []byte("v")); err == nil {
+		t.Error("Add to a truncated set")
+	}
+	mustGet(t, db, "k", "\x05\x00ab")
+}
@@ -0,0 +1,108 @@
+package kvstore
+
+import (
+	"bytes"
+	"testing"
+)
+
+func openLowerDB(t *testing.T) *KV {
+	return openTestDB(t, func(db *KV) { db.NormalizeKey = bytes.ToLower })
+}
+
+// mustGet compares the scanned key byte for byte, this looks key up the way the tree compares it
+func mustLookup(t *testing.T, db *KV, key, want string) {
+	t.Helper()
+	val, _, ok, err := db.GetWithFlags([]byte(key))
+	if err != nil || !ok || string(val) != want {
+		t.Fatalf("GetWithFlags(%q) = %q %v %v, want %q", key, val, ok, err, want)
+	}
+}
+
+func TestNormalizeKeyGet(t *testing.T) {
+	db := openLowerDB(t)
+	mustSet(t, db, "Foo", "v")
+	mustLookup(t, db, "foo", "v")
+	mustLookup(t, db, "FOO", "v")
+
+	// the key is stored as first given
+	db.ScanPrefix([]byte("f"), func(k, v []byte) bool {
+		if string(k) != "Foo" {
+			t.Errorf("stored key %q, want Foo", k)
+		}
+		return true
+	})
+}
+
+func TestNormalizeKeyLoadSorted(t *testing.T) {
+	db := openLowerDB(t)
+	// sorted once lowercased, not byte for byte
+	pairs := []KVPair{{[]byte("apple"), []byte("1")}, {[]byte("Banana"), []byte("2")}, {[]byte("cherry"), []byte("3")}}
+	if err := db.LoadSorted(pairs, 1); err != nil {
+		t.Fatal(err)
+	}
+	mustLookup(t, db, "BANANA", "2")
+	mustLookup(t, db, "Cherry", "3")
+
+	dup := openLowerDB(t)
+	pairs = []KVPair{{[]byte("Foo"), []byte("1")}, {[]byte("foo"), []byte("2")}}
+	if err := dup.LoadSorted(pairs, 1); err == nil {
+		t.Fatal("LoadSorted accepted keys equal once normalized")
+	}
+}
+
+func TestNormalizeKeyScanPrefix(t *testing.T) {
+	db := openLowerDB(t)
+	for _, k := range []string{"ab1", "AB2", "aC", "b"} {
+		mustSet(t, db, k, "v")
+	}
+	got := []string{}
+	db.ScanPrefix([]byte("Ab"), func(k, v []byte) bool {
+		got = append(got, string(k))
+		return true
+	})
+	if len(got) != 2 || got[0] != "ab1" || got[1] != "AB2" {
+		t.Fatalf("ScanPrefix = %q, want [ab1 AB2]", got)
+	}
+
+	// the bound comes from the normalized prefix: "Z" ends at "[" byte for byte, before "zoo"
+	mustSet(t, db, "zoo", "v")
+	if got := prefixKeys(db, "Z", 10); len(got) != 1 || got[0] != "zoo" {
+		t.Fatalf("ScanPrefix(Z) = %q, want [zoo]", got)
+	}
+}
+
+func TestNormalizeKeyRename(t *testing.T) {
+	db := openLowerDB(t)
+	mustSet(t, db, "Foo", "v")
+	mustSet(t, db, "bar", "w")
+
+	// the same key once normalized, only the stored bytes change
+	if ok, err := db.Rename([]byte("Foo"), []byte("foo")); !ok || err != nil {
+		t.Fatalf("Rename(Foo, foo) = %v %v", ok, err)
+	}
+	if got := prefixKeys(db, "f", 10); len(got) != 1 || got[0] != "foo" {
+		t.Fatalf("keys after the rename: %q", got)
+	}
+	mustLookup(t, db, "FOO", "v")
+
+	if _, err := db.Rename([]byte("foo"), []byte("BAR")); err != ErrKeyExists {
+		t.Fatalf("Rename onto an existing key: %v", err)
+	}
+}
+
+func TestNormalizeKeyApplyDiff(t *testing.T) {
+	db := openLowerDB(t)
+	mustSet(t, db, "b", "v")
+	upserts := []KVPair{{[]byte("a"), []byte("1")}, {[]byte("C"), []byte("3")}}
+	if err := db.ApplyDiff(upserts, [][]byte{[]byte("B")}); err != nil {
+		t.Fatal(err)
+	}
+	mustLookup(t, db, "c", "3")
+	if _, _, ok, _ := db.GetWithFlags([]byte("B")); ok {
+		t.Fatal("B is still there")
+	}
+
+	if err := db.ApplyDiff([]KVPair{{[]byte("X"), []byte("1")}}, [][]byte{[]byte("x")}); err == nil {
+		t.Fatal("ApplyDiff accepted a key both upserted and deleted")
+	}
+}
@@ -0,0 +1,101 @@
+package kvstore
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// PageEvent is a page allocation or deallocation recorded when KV.PageLog is set.
+type PageEvent struct {
+	Op     string // "new" or "del"
+	Ptr    uint64
+	Caller string // the first caller outside the btree and kvstore page code, as "func file:line"
+}
+
+// the last KV.PageLog page events, oldest first once full
+type pageLog struct {
+	events []PageEvent
+	next   int
+}
+
+func (db *KV) logPage(op string, ptr uint64) {
+	if db.PageLog <= 0 {
+		return
+	}
+	ev := PageEvent{Op: op, Ptr: ptr, Caller: pageCaller()}
+	log := &db.pageLog
+	if len(log.events) < db.PageLog {
+		log.events = append(log.events, ev)
+		return
+	}
+	log.events[log.next] = ev
+	log.next = (log.next + 1) % len(log.events)
+}
+
+// skip the page callbacks and the tree internals, the interesting caller is the KV operation
+func pageCaller() string {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for {
+		f, more := frames.Next()
+		internal := strings.Contains(f.Function, "LeichtKV/btree.") ||
+			strings.Contains(f.Function, "LeichtKV/freelist.") ||
+			strings.Contains(f.Function, "kvstore.(*KV).page") ||
+			strings.Contains(f.Function, "kvstore.(*KV).update") ||
+			strings.HasSuffix(f.Function, "kvstore.(*KV).set") ||
+			strings.Contains(f.Function, "kvstore.(*KV).set.func")
+		if !internal || !more {
+			return fmt.Sprintf("%s %s:%d", f.Function, f.File, f.Line)
+		}
+	}
+}
+
+// PageEvents returns the recorded page events, oldest first. Empty unless KV.PageLog is set.
+func (db *KV) PageEvents() []PageEvent {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	log := &db.pageLog
+	return append(append([]PageEvent{}, log.events[log.next:]...), log.events[:log.next]...)
+}
+
+// PageLeakReport lists the committed pages that are neither reachable from the tree
+// nor accounted for by the free list, i.e. pages that were lost.
+// Pages waiting for the background free goroutine (KV.BackgroundFree) are not lost.
+func (db *KV) PageLeakReport() []uint64 {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	leaked := []uint64{}
+	deferred := map[uint64]bool{}
+	for _, ptr := range db.drain.deferred {
+		deferred[ptr] = true
+	}
+	for _, ptr := range db.leakedPages() {
+		if !deferred[ptr] {
+			leaked = append(leaked, ptr)
+		}
+	}
+	return leaked
+}
+
+// the committed pages in neither the tree nor the free list
+func (db *KV) leakedPages() []uint64 {
+	known := make([]bool, db.page.flushed)
+	known[0] = true // the master page
+	db.tree.RangePages(nil, nil, func(ptr uint64) {
+		known[ptr] = true
+	})
+	db.free.Walk(func(ptr uint64, node bool) {
+		known[ptr] = true
+	})
+
+	leaked := []uint64{}
+	for ptr, ok := range known {
+		if !ok {
+			leaked = append(leaked, uint64(ptr))
+		}
+	}
+	return leaked
+}
@@ -0,0 +1,62 @@
+package kvstore
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPageLeakReport(t *testing.T) {
+	db := openTestDB(t, nil)
+	for i := 0; i < 2000; i++ {
+		mustSet(t, db, fmt.Sprintf("key%05d", i), "value")
+	}
+	for i := 0; i < 2000; i += 3 {
+		mustDel(t, db, fmt.Sprintf("key%05d", i))
+	}
+	if leaked := db.PageLeakReport(); len(leaked) != 0 {
+		t.Fatalf("leaked pages %v", leaked)
+	}
+
+	// a tree that is built and never swapped in is not reachable
+	root, err := db.BuildTree(testPairs(100, "v"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaked := db.PageLeakReport()
+	found := false
+	for _, ptr := range leaked {
+		found = found || ptr == root
+	}
+	if !found {
+		t.Fatalf("unswapped root %d not in the report %v", root, leaked)
+	}
+}
+
+func TestPageEvents(t *testing.T) {
+	db := openTestDB(t, func(db *KV) { db.PageLog = 8 })
+	if events := db.PageEvents(); len(events) != 0 {
+		t.Fatalf("%d events before any update", len(events))
+	}
+	for i := 0; i < 100; i++ {
+		mustSet(t, db, fmt.Sprintf("key%05d", i), "value")
+	}
+
+	events := db.PageEvents()
+	if len(events) != 8 {
+		t.Fatalf("%d events, want the last 8", len(events))
+	}
+	for _, ev := range events {
+		if !strings.Contains(ev.Caller, "SetWithFlags") {
+			t.Fatalf("event caller %q, want the Set", ev.Caller)
+		}
+	}
+	// an update of an existing leaf frees the old page and allocates the new one
+	ops := map[string]bool{}
+	for _, ev := range events {
+		ops[ev.Op] = true
+	}
+	if !ops["new"] || !ops["del"] {
+		t.Fatalf("events %+v, want both new and del", events)
+	}
+}
@@ -0,0 +1,67 @@
+package kvstore
+
+import (
+	"fmt"
+	"sync"
+)
+
+// values of pinned keys by normalized key, kept in memory and served without descending the tree.
+// refreshed after every committed update, so there should only be a handful of them.
+type pinCache struct {
+	sync.RWMutex // readers don't take db.writer
+	vals         map[string]pinned
+}
+
+type pinned struct {
+	stored []byte // a copy of the value as stored in the tree, nil if the key is absent
+	ok     bool
+}
+
+// Pin keeps the value of key in memory until Unpin, so GetWithFlags serves it without
+// descending the tree. Writes to the key are reflected. A missing key can be pinned as well.
+func (db *KV) Pin(key []byte) error {
+	if err := checkKey(key); err != nil {
+		return fmt.Errorf("Pin: %w", err)
+	}
+
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	db.pins.Lock()
+	defer db.pins.Unlock()
+	if db.pins.vals == nil {
+		db.pins.vals = map[string]pinned{}
+	}
+	db.pins.vals[string(db.normalize(key))] = db.pinLoad(key)
+	return nil
+}
+
+// Unpin drops key from the pinned values.
+func (db *KV) Unpin(key []byte) {
+	db.pins.Lock()
+	defer db.pins.Unlock()
+	delete(db.pins.vals, string(db.normalize(key)))
+}
+
+// tombstones load as absent
+func (db *KV) pinLoad(key []byte) pinned {
+	stored, ok := db.lookup(key)
+	return pinned{stored: append([]byte(nil), stored...), ok: ok}
+}
+
+// reload every pinned value after the tree changed. the caller holds db.writer
+func (db *KV) pinRefresh() {
+	db.pins.Lock()
+	defer db.pins.Unlock()
+	for key := range db.pins.vals {
+		db.pins.vals[key] = db.pinLoad([]byte(key))
+	}
+}
+
+// the pinned stored value of key, if key is pinned
+func (db *KV) pinGet(key []byte) (p pinned, hit bool) {
+	db.pins.RLock()
+	defer db.pins.RUnlock()
+	p, hit = db.pins.vals[string(db.normalize(key))]
+	return p, hit
+}
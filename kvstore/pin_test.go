@@ -0,0 +1,108 @@
+package kvstore
+
+import (
+	"fmt"
+	"kurocifer/LeichtKV/btree"
+	"testing"
+)
+
+func mustLookupMiss(t *testing.T, db *KV, key string) {
+	t.Helper()
+	if val, _, ok, err := db.GetWithFlags([]byte(key)); err != nil || ok {
+		t.Fatalf("GetWithFlags(%q) = %q %v %v, want a miss", key, val, ok, err)
+	}
+}
+
+// GetWithFlags must return val with flags
+func mustGetFlags(t *testing.T, db *KV, key, want string, flags byte) {
+	t.Helper()
+	val, got, ok, err := db.GetWithFlags([]byte(key))
+	if err != nil || !ok || string(val) != want || got != flags {
+		t.Fatalf("GetWithFlags(%q) = %q %#x %v %v, want %q %#x", key, val, got, ok, err, want, flags)
+	}
+}
+
+func mustSetFlags(t *testing.T, db *KV, key, val string, flags byte) {
+	t.Helper()
+	if err := db.SetWithFlags([]byte(key), []byte(val), flags); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// the number of tree pages a GetWithFlags of key reads, 0 when it doesn't descend the tree
+func getReads(t *testing.T, db *KV, key string) int {
+	t.Helper()
+	get, reads := db.tree.Get, 0
+	db.tree.Get = func(ptr uint64) btree.BNode {
+		reads++
+		return get(ptr)
+	}
+	defer func() { db.tree.Get = get }()
+	if _, _, _, err := db.GetWithFlags([]byte(key)); err != nil {
+		t.Fatal(err)
+	}
+	return reads
+}
+
+func TestPin(t *testing.T) {
+	for _, tombstones := range []bool{false, true} {
+		t.Run(fmt.Sprint("tombstones=", tombstones), func(t *testing.T) {
+			db := openTestDB(t, func(db *KV) { db.Tombstones = tombstones; db.ValueFlags = true })
+			// a missing key can be pinned and is picked up once written
+			if err := db.Pin([]byte("hot")); err != nil {
+				t.Fatal(err)
+			}
+			mustLookupMiss(t, db, "hot")
+			mustSetFlags(t, db, "hot", "1", 0x01)
+			mustGetFlags(t, db, "hot", "1", 0x01)
+			// pinned gets don't descend the tree, others do
+			mustSetFlags(t, db, "cold", "1", 0x01)
+			if n := getReads(t, db, "hot"); n != 0 {
+				t.Fatalf("pinned get read %d pages", n)
+			}
+			if n := getReads(t, db, "cold"); n == 0 {
+				t.Fatal("unpinned get read no page")
+			}
+			// the flags of every write are picked up, not only the value
+			mustSetFlags(t, db, "hot", "1", 0x02)
+			mustGetFlags(t, db, "hot", "1", 0x02)
+
+			// the value is the caller's, writing to it leaves the pinned one alone
+			val, _, _, _ := db.GetWithFlags([]byte("hot"))
+			val[0] = 'x'
+			mustGetFlags(t, db, "hot", "1", 0x02)
+
+			mustDel(t, db, "hot")
+			mustLookupMiss(t, db, "hot")
+			if n := getReads(t, db, "hot"); n != 0 {
+				t.Fatalf("pinned get of a deleted key read %d pages", n)
+			}
+			mustSetFlags(t, db, "hot", "2", 0x03)
+			if err := db.Clear(); err != nil {
+				t.Fatal(err)
+			}
+			mustLookupMiss(t, db, "hot")
+
+			mustSetFlags(t, db, "hot", "3", 0x04)
+			db.Unpin([]byte("hot"))
+			mustSetFlags(t, db, "hot", "4", 0x05)
+			mustGetFlags(t, db, "hot", "4", 0x05)
+			if n := getReads(t, db, "hot"); n == 0 {
+				t.Fatal("unpinned key still served without a lookup")
+			}
+		})
+	}
+}
+
+func TestPinNormalizedKey(t *testing.T) {
+	db := openLowerDB(t)
+	mustSet(t, db, "Hot", "1")
+	if err := db.Pin([]byte("HOT")); err != nil {
+		t.Fatal(err)
+	}
+	hits := db.MetricsSnapshot().CacheHits
+	mustLookup(t, db, "hot", "1")
+	if got := db.MetricsSnapshot().CacheHits; got != hits+1 {
+		t.Fatal("pinned key not served from the pins under another spelling")
+	}
+}
@@ -0,0 +1,131 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var ErrOutOfRange = errors.New("key outside the locked range")
+
+// a key range [start, end), a nil end is unbounded
+type keyRange struct {
+	start, end []byte
+}
+
+// the ranges held by running UpdateRange calls, which never overlap
+type rangeLocks struct {
+	sync.Mutex
+	cond *sync.Cond // signaled when a range is released
+	held []*keyRange
+}
+
+// the UpdateRange batches waiting for db.writer, committed as one update
+type commitGroup struct {
+	txs  []*Tx
+	done chan struct{}
+	err  error
+}
+
+// UpdateRange is Update restricted to the keys in [start, end), a nil end meaning no upper bound.
+// Calls on disjoint ranges run fn concurrently, a call only waits for the ones whose range
+// overlaps its own. The writes are then committed together with those of the other calls that
+// are ready at the same time, as one update; fn failing leaves the others unaffected.
+// The tx fails with ErrOutOfRange outside the range. Other writes don't take range locks:
+// one made inside a running call's range between its reads and its commit isn't seen by fn.
+func (db *KV) UpdateRange(start, end []byte, fn func(tx *Tx) error) error {
+	if end != nil && db.compareKeys(start, end) >= 0 {
+		return fmt.Errorf("UpdateRange: empty range [%q, %q)", start, end)
+	}
+	if db.ReadOnly {
+		return ErrReadOnly
+	}
+
+	r := &keyRange{start: append([]byte{}, start...)}
+	if end != nil {
+		r.end = append([]byte{}, end...)
+	}
+	db.rangeLock(r)
+	defer db.rangeUnlock(r)
+
+	tx := &Tx{db: db, keys: r}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return db.commitGrouped(tx)
+}
+
+func (db *KV) rangeLock(r *keyRange) {
+	db.ranges.Lock()
+	defer db.ranges.Unlock()
+	if db.ranges.cond == nil {
+		db.ranges.cond = sync.NewCond(&db.ranges.Mutex)
+	}
+	for db.rangeTaken(r) {
+		db.ranges.cond.Wait()
+	}
+	db.ranges.held = append(db.ranges.held, r)
+}
+
+func (db *KV) rangeUnlock(r *keyRange) {
+	db.ranges.Lock()
+	defer db.ranges.Unlock()
+	for i, h := range db.ranges.held {
+		if h == r {
+			db.ranges.held = append(db.ranges.held[:i], db.ranges.held[i+1:]...)
+			break
+		}
+	}
+	db.ranges.cond.Broadcast()
+}
+
+// r overlaps a held range. the caller holds db.ranges
+func (db *KV) rangeTaken(r *keyRange) bool {
+	for _, h := range db.ranges.held {
+		if db.rangeBefore(h.start, r.end) && db.rangeBefore(r.start, h.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// key < end, where a nil end is past every key
+func (db *KV) rangeBefore(key, end []byte) bool {
+	return end == nil || db.compareKeys(key, end) < 0
+}
+
+func (db *KV) inRange(r *keyRange, key []byte) bool {
+	return db.compareKeys(key, r.start) >= 0 && db.rangeBefore(key, r.end)
+}
+
+// commit tx with whatever other range txs join before the writer lock is free. the first one in
+// a group commits it, the others wait for the result
+func (db *KV) commitGrouped(tx *Tx) error {
+	db.group.Lock()
+	g, leader := db.group.next, false
+	if g == nil {
+		g, leader = &commitGroup{done: make(chan struct{})}, true
+		db.group.next = g
+	}
+	g.txs = append(g.txs, tx)
+	db.group.Unlock()
+
+	if leader {
+		db.writer.Lock()
+		db.group.Lock()
+		db.group.next = nil // later txs start a new group
+		db.group.Unlock()
+
+		// the ranges are disjoint, so the order doesn't matter
+		g.err = db.update(func() {
+			for _, tx := range g.txs {
+				tx.apply()
+			}
+		})
+		db.writer.Unlock()
+		close(g.done)
+	}
+
+	<-g.done
+	return g.err
+}
@@ -0,0 +1,181 @@
+package kvstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUpdateRange(t *testing.T) {
+	for _, tomb := range []bool{false, true} {
+		t.Run(fmt.Sprintf("tombstones=%v", tomb), func(t *testing.T) {
+			db := openTestDB(t, func(db *KV) { db.Tombstones = tomb; db.ValueFlags = tomb })
+			mustSet(t, db, "b1", "old")
+			mustSet(t, db, "b2", "old")
+
+			err := db.UpdateRange([]byte("b"), []byte("c"), func(tx *Tx) error {
+				if val, ok, err := tx.Get([]byte("b1")); err != nil || !ok || string(val) != "old" {
+					t.Errorf("Get(b1) = %q, %v, %v", val, ok, err)
+				}
+				if err := tx.Set([]byte("b1"), []byte("new")); err != nil {
+					return err
+				}
+				if err := tx.Del([]byte("b2")); err != nil {
+					return err
+				}
+				// the range is [start, end)
+				for _, key := range []string{"a", "c", "c0"} {
+					if err := tx.Set([]byte(key), []byte("v")); !errors.Is(err, ErrOutOfRange) {
+						t.Errorf("Set(%q) = %v, want ErrOutOfRange", key, err)
+					}
+					if _, _, err := tx.Get([]byte(key)); !errors.Is(err, ErrOutOfRange) {
+						t.Errorf("Get(%q) = %v, want ErrOutOfRange", key, err)
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			mustGet(t, db, "b1", "new")
+			mustMiss(t, db, "b2")
+			mustMiss(t, db, "a")
+
+			// a deleted key is missing for the next call, tombstone or not
+			err = db.UpdateRange([]byte("b"), nil, func(tx *Tx) error {
+				if val, ok, err := tx.Get([]byte("b2")); err != nil || ok {
+					t.Errorf("Get(b2) = %q, %v, %v", val, ok, err)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// a failing fn writes nothing
+			failed := errors.New("failed")
+			err = db.UpdateRange([]byte("b"), nil, func(tx *Tx) error {
+				tx.Set([]byte("b1"), []byte("lost"))
+				return failed
+			})
+			if !errors.Is(err, failed) {
+				t.Fatalf("UpdateRange = %v", err)
+			}
+			mustGet(t, db, "b1", "new")
+
+			if err := db.UpdateRange([]byte("b"), []byte("b"), func(tx *Tx) error { return nil }); err == nil {
+				t.Fatal("UpdateRange on an empty range")
+			}
+		})
+	}
+}
+
+// a call waits for the one before it on an overlapping range, but not on a disjoint one
+func TestUpdateRangeLocking(t *testing.T) {
+	db := openTestDB(t, nil)
+	inside, release := make(chan struct{}), make(chan struct{})
+	go func() {
+		db.UpdateRange([]byte("a"), []byte("m"), func(tx *Tx) error {
+			close(inside)
+			<-release
+			return tx.Set([]byte("a"), []byte("1"))
+		})
+	}()
+	<-inside
+
+	done := make(chan error)
+	go func() {
+		done <- db.UpdateRange([]byte("m"), nil, func(tx *Tx) error {
+			return tx.Set([]byte("z"), []byte("1"))
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a call on a disjoint range waited")
+	}
+
+	go func() {
+		done <- db.UpdateRange([]byte("l"), []byte("n"), func(tx *Tx) error {
+			return tx.Set([]byte("l"), []byte("1"))
+		})
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("a call on an overlapping range ran: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, db, "a", "1")
+	mustGet(t, db, "l", "1")
+	mustGet(t, db, "z", "1")
+}
+
+// run with -race: calls on disjoint ranges read and write concurrently, along with plain writes
+func TestUpdateRangeConcurrent(t *testing.T) {
+	db := openTestDB(t, nil)
+	const writers, rounds = 8, 50
+	counter := func(w int) []byte { return []byte(fmt.Sprintf("r%d/n", w)) }
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			start, end := []byte(fmt.Sprintf("r%d/", w)), []byte(fmt.Sprintf("r%d0", w))
+			for i := 0; i < rounds; i++ {
+				err := db.UpdateRange(start, end, func(tx *Tx) error {
+					n := uint64(0)
+					if val, ok, err := tx.Get(counter(w)); err != nil {
+						return err
+					} else if ok {
+						n = binary.LittleEndian.Uint64(val)
+					}
+					var val [8]byte
+					binary.LittleEndian.PutUint64(val[:], n+1)
+					if err := tx.Set(counter(w), val[:]); err != nil {
+						return err
+					}
+					return tx.Set([]byte(fmt.Sprintf("r%d/%04d", w, i)), []byte("v"))
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			if err := db.Set([]byte(fmt.Sprintf("other%04d", i)), []byte("v")); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	// no increment was lost to another call
+	for w := 0; w < writers; w++ {
+		val, ok := db.Get(counter(w))
+		if !ok || binary.LittleEndian.Uint64(val) != rounds {
+			t.Fatalf("counter %d: %v, %v", w, val, ok)
+		}
+		mustGet(t, db, fmt.Sprintf("r%d/%04d", w, rounds-1), "v")
+	}
+	mustGet(t, db, fmt.Sprintf("other%04d", rounds-1), "v")
+	if r := db.HealthCheck(); !r.OK() {
+		t.Fatalf("health check:\n%s", r)
+	}
+}
@@ -0,0 +1,60 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"kurocifer/LeichtKV/btree"
+	"slices"
+)
+
+// RecoverFreed scans the pages freed by earlier updates, those on the free list or waiting to go
+// on it (see BackgroundFree), and calls fn for every readable pair on them whose key is no longer
+// in the DB. Pages in no committed tree that were never freed, like those of a BuildTree tree that
+// wasn't swapped in, are not scanned.
+// This is best effort forensics after an accidental delete: a freed page survives only until it
+// is reused, and since updates copy pages, a key may be reported several times with older values.
+// Pages are visited in file order, later pages usually hold the more recent values.
+// Stops early if fn returns false. Freed leaves that can't be decoded are skipped and returned
+// as errors, the other freed pages, like internal nodes, hold no pairs.
+func (db *KV) RecoverFreed(fn func(key, val []byte) bool) error {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	freed := slices.Clone(db.drain.deferred)
+	// the free list nodes hold pointers, not pairs
+	db.free.Walk(func(ptr uint64, node bool) {
+		if !node {
+			freed = append(freed, ptr)
+		}
+	})
+	slices.Sort(freed)
+
+	errs := []error{}
+	for _, ptr := range freed {
+		more := true
+		err := btree.ReadLeaf(pageGetMapped(db, ptr), func(key, stored []byte) {
+			if !more {
+				return
+			}
+			// a tombstone is a delete, it's the live value before it that is wanted
+			if db.isTombstone(stored) {
+				return
+			}
+			if _, ok := db.lookup(key); ok {
+				return
+			}
+			val, _ := db.decodeVal(stored)
+			more = fn(key, val)
+		})
+		if err != nil && !errors.Is(err, btree.ErrNotLeaf) {
+			errs = append(errs, fmt.Errorf("page %d: %w", ptr, err))
+		}
+		if !more {
+			break
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("RecoverFreed: %w", errors.Join(errs...))
+	}
+	return nil
+}
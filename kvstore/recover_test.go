@@ -0,0 +1,118 @@
+package kvstore
+
+import (
+	"fmt"
+	"kurocifer/LeichtKV/btree"
+	"os"
+	"strings"
+	"testing"
+)
+
+// the pairs RecoverFreed reports, the last value seen for each key
+func recovered(t *testing.T, db *KV) map[string]string {
+	t.Helper()
+	got := map[string]string{}
+	if err := db.RecoverFreed(func(key, val []byte) bool {
+		got[string(key)] = string(val)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestRecoverFreed(t *testing.T) {
+	for _, tombstones := range []bool{false, true} {
+		t.Run(fmt.Sprint("tombstones=", tombstones), func(t *testing.T) {
+			db := openTestDB(t, func(db *KV) { db.Tombstones = tombstones })
+			for i := 0; i < 200; i++ {
+				mustSet(t, db, fmt.Sprintf("key%03d", i), fmt.Sprint("v", i))
+			}
+			if got := recovered(t, db); len(got) != 0 {
+				t.Fatalf("recovered %d pairs without a delete", len(got))
+			}
+
+			// in one update, the next one may reuse the freed pages
+			if err := db.ApplyDiff(nil, [][]byte{[]byte("key050"), []byte("key150")}); err != nil {
+				t.Fatal(err)
+			}
+			got := recovered(t, db)
+			if len(got) != 2 || got["key050"] != "v50" || got["key150"] != "v150" {
+				t.Fatalf("recovered %v", got)
+			}
+
+			n := 0
+			db.RecoverFreed(func(key, val []byte) bool {
+				n++
+				return false
+			})
+			if n != 1 {
+				t.Errorf("fn called %d times after returning false", n)
+			}
+
+			// a key set again is in the DB, so not reported
+			mustSet(t, db, "key050", "again")
+			if _, ok := recovered(t, db)["key050"]; ok {
+				t.Fatal("recovered key050 after setting it again")
+			}
+		})
+	}
+}
+
+func TestRecoverFreedSkipsBuiltTree(t *testing.T) {
+	db := openTestDB(t, nil)
+	mustSet(t, db, "k", "v")
+	pairs := []KVPair{}
+	for i := 0; i < 500; i++ {
+		pairs = append(pairs, KVPair{Key: []byte(fmt.Sprintf("new%03d", i)), Val: []byte("v")})
+	}
+	root, err := db.BuildTree(pairs, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the built tree is in no committed root but wasn't freed either
+	if got := recovered(t, db); len(got) != 0 {
+		t.Fatalf("recovered %d pairs of a tree not swapped in", len(got))
+	}
+	if err := db.DropTree(root); err != nil {
+		t.Fatal(err)
+	}
+	if got := recovered(t, db); len(got) != len(pairs) {
+		t.Fatalf("recovered %d pairs of the dropped tree, want %d", len(got), len(pairs))
+	}
+}
+
+func TestRecoverFreedDecodeError(t *testing.T) {
+	db := openTestDB(t, nil)
+	for i := 0; i < 200; i++ {
+		mustSet(t, db, fmt.Sprintf("key%03d", i), fmt.Sprint("v", i))
+	}
+	mustDel(t, db, "key050")
+
+	// the freed leaf holding the deleted key
+	leaf := uint64(0)
+	db.free.Walk(func(ptr uint64, node bool) {
+		_ = btree.ReadLeaf(pageGetMapped(db, ptr), func(key, val []byte) {
+			if !node && string(key) == "key050" {
+				leaf = ptr
+			}
+		})
+	})
+	if leaf == 0 {
+		t.Fatal("no freed leaf holds the deleted key")
+	}
+	// a key count that doesn't fit in the page
+	fp, err := os.OpenFile(db.Path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	if _, err := fp.WriteAt([]byte{0xff, 0xff}, int64(leaf)*btree.BTREE_PAGE_SIZE+2); err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.RecoverFreed(func(key, val []byte) bool { return true })
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("page %d", leaf)) {
+		t.Fatalf("RecoverFreed of a damaged leaf: %v", err)
+	}
+}
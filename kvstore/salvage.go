@@ -0,0 +1,49 @@
+package kvstore
+
+import (
+	"fmt"
+	"sync"
+)
+
+// the problems met by reads in BestEffort mode
+type readErrors struct {
+	sync.Mutex
+	errs []error
+}
+
+func (db *KV) readError(err error) {
+	db.readErrs.Lock()
+	defer db.readErrs.Unlock()
+	db.readErrs.errs = append(db.readErrs.errs, err)
+}
+
+// ReadErrors returns and clears the damaged pages met by reads since the last call.
+// Only BestEffort reads record them, otherwise a damaged page panics the read.
+func (db *KV) ReadErrors() []error {
+	db.readErrs.Lock()
+	defer db.readErrs.Unlock()
+	errs := db.readErrs.errs
+	db.readErrs.errs = nil
+	return errs
+}
+
+// lookup for reads, tolerant of damaged pages in BestEffort mode. a tombstone is absent
+func (db *KV) readLookup(key []byte) ([]byte, bool, error) {
+	if !db.bloomMayContain(key) {
+		db.counters.bloomSkips.Add(1)
+		return nil, false, nil
+	}
+	if !db.BestEffort {
+		stored, ok := db.lookup(key)
+		return stored, ok, nil
+	}
+	stored, ok, err := db.tree.LookupBestEffort(key)
+	if err != nil {
+		db.readError(err)
+		return nil, false, fmt.Errorf("damaged page on the path: %w", err)
+	}
+	if !ok || db.isTombstone(stored) {
+		return nil, false, nil
+	}
+	return stored, true, nil
+}
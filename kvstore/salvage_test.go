@@ -0,0 +1,148 @@
+package kvstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"kurocifer/LeichtKV/btree"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBestEffort(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	key := func(i int) string { return fmt.Sprintf("key%06d", i) }
+	val := strings.Repeat("v", 200)
+	if err := db.LoadSorted(testPairs(20000, val), 1); err != nil {
+		t.Fatal(err)
+	}
+	if h := db.Height(); h < 3 {
+		t.Fatalf("height %d, want internal nodes below the root", h)
+	}
+	// an internal node with a sibling on each side, and the keys under it
+	root := db.Node(db.tree.Root)
+	if nkeys := binary.LittleEndian.Uint16(root.Data[2:]); nkeys < 3 {
+		t.Fatalf("%d kids of the root", nkeys)
+	}
+	node := root.GetPtr(1)
+	from, to := string(root.GetKey(1)), string(root.GetKey(2))
+	db.Close()
+
+	// overwrite the internal node with a bad node type
+	fp, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	junk := make([]byte, btree.BTREE_PAGE_SIZE)
+	junk[0] = 0xff
+	if _, err := fp.WriteAt(junk, int64(node)*btree.BTREE_PAGE_SIZE); err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+
+	db = &KV{Path: path, BestEffort: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, _, _, err := db.GetWithFlags([]byte(from)); err == nil {
+		t.Fatal("GetWithFlags through the damaged node succeeded")
+	}
+	// Get has no error to report it with
+	if val, ok := db.Get([]byte(from)); ok {
+		t.Fatalf("Get through the damaged node = %q", val)
+	}
+	mustGet(t, db, key(0), val)
+	mustGet(t, db, to, val)
+	mustGet(t, db, key(19999), val)
+
+	// every key outside the damaged subtree, on both sides of it
+	want := 0
+	for i := 0; i < 20000; i++ {
+		if k := key(i); k < from || k >= to {
+			want++
+		}
+	}
+	n := 0
+	db.scan(nil, func(k, v []byte) bool {
+		if string(k) >= from && string(k) < to {
+			t.Fatalf("scanned %q under the damaged node", k)
+		}
+		n++
+		return true
+	})
+	if n != want {
+		t.Fatalf("scanned %d keys, want the %d outside the damaged node", n, want)
+	}
+	if errs := db.ReadErrors(); len(errs) == 0 {
+		t.Fatal("no read errors recorded")
+	}
+	if errs := db.ReadErrors(); len(errs) != 0 {
+		t.Fatalf("ReadErrors not cleared: %v", errs)
+	}
+}
+
+func TestRepairOffsets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	leaf, _, _ := db.tree.Locate([]byte("key0500"))
+	db.Close()
+
+	// scramble the offset list of the leaf holding key0500, its kvs are intact
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := data[int(leaf)*btree.BTREE_PAGE_SIZE:][:btree.BTREE_PAGE_SIZE]
+	nkeys := int(binary.LittleEndian.Uint16(page[2:]))
+	for i := 0; i < nkeys; i++ {
+		binary.LittleEndian.PutUint16(page[btree.HEADER+8*nkeys+2*i:], uint16(3*i))
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	db = &KV{Path: path, RepairOffsets: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i += 7 {
+		mustGet(t, db, fmt.Sprintf("key%04d", i), "value")
+	}
+	mustLookup(t, db, "key0500", "value")
+	if db.MetricsSnapshot().OffsetRepairs == 0 {
+		t.Error("no repairs counted")
+	}
+	// served from memory, the file is untouched until the leaf is rewritten
+	if onDisk, _ := os.ReadFile(path); !bytes.Equal(onDisk[int(leaf)*btree.BTREE_PAGE_SIZE:][:btree.BTREE_PAGE_SIZE], page) {
+		t.Fatal("the damaged page was written")
+	}
+	mustSet(t, db, "key0500", "new")
+	db.Close()
+
+	db = &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Validate(); err != nil {
+		t.Fatalf("the rewritten leaf didn't persist the repair: %v", err)
+	}
+	mustGet(t, db, "key0500", "new")
+	mustGet(t, db, "key0501", "value")
+}
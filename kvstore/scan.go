@@ -0,0 +1,312 @@
+package kvstore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// Scan skips the first offset keys >= start, then calls fn for up to limit keys in sorted order.
+// Stops early if fn returns false.
+// NOTE: the skipped keys are still walked, so the cost is O(offset + limit).
+// Cursor-style paging (passing the last seen key as the next start) avoids this.
+func (db *KV) Scan(start []byte, limit, offset int, fn func(k, v []byte) bool) error {
+	if limit < 0 || offset < 0 {
+		return errors.New("Scan: negative limit or offset")
+	}
+	if limit == 0 {
+		return nil
+	}
+
+	db.scan(start, func(k, v []byte) bool {
+		if offset > 0 {
+			offset--
+			return true
+		}
+		limit--
+		return fn(k, v) && limit > 0
+	})
+	return nil
+}
+
+// GetRange returns copies of up to limit pairs with keys in [start, end), in key order.
+// A nil end means no upper bound.
+func (db *KV) GetRange(start, end []byte, limit int) ([]KVPair, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("GetRange: bad limit %d", limit)
+	}
+
+	pairs := []KVPair{}
+	db.scan(start, func(k, v []byte) bool {
+		if end != nil && db.compareKeys(k, end) >= 0 {
+			return false
+		}
+		pairs = append(pairs, KVPair{append([]byte{}, k...), append([]byte{}, v...)})
+		return len(pairs) < limit
+	})
+	return pairs, nil
+}
+
+// SnapshotGetMany reads all the keys against the same root, so the results are consistent
+// with each other. It holds the writer lock meanwhile, so updates wait for it.
+// The returned values are copies.
+func (db *KV) SnapshotGetMany(keys [][]byte) ([][]byte, []bool, error) {
+	// the tree and the pending pages it reads through are only stable under the writer lock
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	vals := make([][]byte, len(keys))
+	found := make([]bool, len(keys))
+
+	db.counters.gets.Add(uint64(len(keys)))
+	for i, key := range keys {
+		if val, _, ok := db.lookupLive(key); ok {
+			vals[i] = append([]byte{}, val...)
+			found[i] = true
+		}
+	}
+	return vals, found, nil
+}
+
+type KVPair struct {
+	Key []byte
+	Val []byte
+}
+
+// GroupByPrefix calls fn once per run of keys sharing the same first component,
+// i.e. everything before the first sep. A key without sep is a group of its own,
+// together with the keys that start with it and sep. Components are compared like keys,
+// after NormalizeKey, and group is spelled as in the first key of the run.
+// A group is reported once per run, not once overall: a key sorting between a component and
+// the component followed by sep splits it, e.g. with sep '/' the keys "a", "a!" and "a/x"
+// make the runs "a", "a!" and "a" again.
+// pairs hold copies. Stops early if fn returns false.
+func (db *KV) GroupByPrefix(sep byte, fn func(group []byte, pairs []KVPair) bool) error {
+	var group []byte
+	var pairs []KVPair
+	more := true
+	db.scan(nil, func(k, v []byte) bool {
+		prefix := k
+		if i := bytes.IndexByte(k, sep); i >= 0 {
+			prefix = k[:i]
+		}
+		if len(pairs) > 0 && db.compareKeys(prefix, group) != 0 {
+			if more = fn(group, pairs); !more {
+				return false
+			}
+			pairs = nil
+		}
+		if len(pairs) == 0 {
+			group = append([]byte{}, prefix...)
+		}
+		pairs = append(pairs, KVPair{append([]byte{}, k...), append([]byte{}, v...)})
+		return true
+	})
+	if more && len(pairs) > 0 {
+		fn(group, pairs)
+	}
+	return nil
+}
+
+// PrefixSuccessor returns the smallest key greater than every key starting with prefix,
+// i.e. the exclusive end of a prefix scan. Returns false when there is none
+// (an empty prefix or one of only 0xff bytes), meaning the scan runs to the end.
+func PrefixSuccessor(prefix []byte) ([]byte, bool) {
+	// drop the trailing 0xff bytes, they can't be incremented, then increment the last byte left
+	end := bytes.TrimRight(prefix, "\xff")
+	if len(end) == 0 {
+		return nil, false
+	}
+	succ := append([]byte{}, end...)
+	succ[len(succ)-1]++
+	return succ, true
+}
+
+// ScanPrefix calls fn for every key starting with prefix, in key order, until fn returns false.
+// With a NormalizeKey, it's the normalized key that must start with the normalized prefix.
+func (db *KV) ScanPrefix(prefix []byte, fn func(k, v []byte) bool) {
+	// the keys sort by their normalized form, so the scan ends at the successor of that
+	end, bounded := PrefixSuccessor(db.normalize(prefix))
+	db.scan(prefix, func(k, v []byte) bool {
+		if bounded && bytes.Compare(db.normalize(k), end) >= 0 {
+			return false
+		}
+		return fn(k, v)
+	})
+}
+
+// the key as the tree compares it
+func (db *KV) normalize(key []byte) []byte {
+	if db.NormalizeKey != nil {
+		return db.NormalizeKey(key)
+	}
+	return key
+}
+
+// compare keys in tree order, i.e. after normalization
+func (db *KV) compareKeys(a, b []byte) int {
+	return bytes.Compare(db.normalize(a), db.normalize(b))
+}
+
+// PrefetchRange asks the kernel to read in every page backing the keys in [start, end)
+// (MADV_WILLNEED), so a following scan of the range is served from memory.
+// A nil end means no upper bound. Only the internal nodes and the first leaf are read
+// to find the pages, the other leaves are left to the kernel.
+func (db *KV) PrefetchRange(start, end []byte) error {
+	var err error
+	db.tree.RangePages(start, end, func(ptr uint64) {
+		if err == nil {
+			err = madvise(pageGetMapped(db, ptr).Data, syscall.MADV_WILLNEED)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("PrefetchRange: madvise: %w", err)
+	}
+	return nil
+}
+
+// SplitRanges splits the keyspace into up to n contiguous ranges [start, end) holding roughly
+// the same number of keys, for scanning in parallel. The first start and the last end are nil,
+// meaning unbounded. Fewer ranges are returned when the DB is too small to split n ways.
+// The boundaries are taken from the internal nodes, so the balance is only as good as the tree's.
+func (db *KV) SplitRanges(n int) ([][2][]byte, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("SplitRanges: bad count %d", n)
+	}
+
+	seps := db.tree.Separators(n)
+	bounds := [][]byte{nil}
+	for i := 1; i < n && len(seps) > 0; i++ {
+		key := seps[i*len(seps)/n]
+		if !bytes.Equal(key, bounds[len(bounds)-1]) {
+			bounds = append(bounds, append([]byte{}, key...))
+		}
+	}
+	bounds = append(bounds, nil)
+
+	ranges := make([][2][]byte, 0, len(bounds)-1)
+	for i := 0; i+1 < len(bounds); i++ {
+		ranges = append(ranges, [2][]byte{bounds[i], bounds[i+1]})
+	}
+	return ranges, nil
+}
+
+// ScanLeaves calls fn for every key >= start in key order, along with the pointer of the leaf page
+// holding it, until fn returns false. The pointer changes exactly at page boundaries, for processing
+// a page worth of entries at a time. Tombstones are skipped.
+func (db *KV) ScanLeaves(start []byte, fn func(page uint64, k, v []byte) bool) {
+	db.tree.ScanLeaves(start, func(leaf uint64, k, v []byte) bool {
+		if db.isTombstone(v) {
+			return true
+		}
+		val, meta := db.decodeVal(v)
+		if db.expired(meta) {
+			return true
+		}
+		return fn(leaf, k, val)
+	})
+}
+
+// ForEachUnordered calls fn for every key until fn returns false, visiting the leaves in the order
+// they sit in the file rather than in key order, which reads the file front to back.
+// Keys are only sorted within a leaf. For dumps and order-independent folds like content hashes.
+// Tombstones are skipped.
+func (db *KV) ForEachUnordered(fn func(k, v []byte) bool) error {
+	db.tree.ScanUnordered(func(k, v []byte) bool {
+		if db.isTombstone(v) {
+			return true
+		}
+		val, meta := db.decodeVal(v)
+		if db.expired(meta) {
+			return true
+		}
+		return fn(k, val)
+	})
+	return nil
+}
+
+// MatchKeys calls fn for every key matching pattern, in key order, until fn returns false.
+// '*' matches any run of bytes and '?' any single byte, like Redis KEYS. A '\' makes the byte
+// after it literal, so "\*" matches a '*' and "\\" a '\'.
+// A pattern whose only wildcard is a trailing '*' is a prefix scan and only reads the matching keys;
+// any other wildcard means a full scan testing every key in the DB.
+func (db *KV) MatchKeys(pattern []byte, fn func(k []byte) bool) error {
+	if len(pattern) == 0 {
+		return errors.New("MatchKeys: empty pattern")
+	}
+
+	if prefix, ok := globPrefix(pattern); ok {
+		db.ScanPrefix(prefix, func(k, v []byte) bool {
+			return fn(k)
+		})
+		return nil
+	}
+
+	// matched in tree order, like the prefix scan
+	pattern = db.normalize(pattern)
+	db.scan(nil, func(k, v []byte) bool {
+		if globMatch(pattern, db.normalize(k)) {
+			return fn(k)
+		}
+		return true
+	})
+	return nil
+}
+
+// the pattern byte at p, whether it's a wildcard, and the number of pattern bytes it takes.
+// an escaped byte is never a wildcard, a '\' at the end of the pattern is a literal '\'
+func globToken(pattern []byte, p int) (c byte, wild bool, n int) {
+	if pattern[p] == '\\' && p+1 < len(pattern) {
+		return pattern[p+1], false, 2
+	}
+	return pattern[p], pattern[p] == '*' || pattern[p] == '?', 1
+}
+
+// the literal prefix of a pattern whose only wildcard is a trailing '*'
+func globPrefix(pattern []byte) ([]byte, bool) {
+	prefix := []byte{}
+	for p := 0; p < len(pattern); {
+		c, wild, n := globToken(pattern, p)
+		if wild {
+			return prefix, c == '*' && p+n == len(pattern)
+		}
+		prefix = append(prefix, c)
+		p += n
+	}
+	return nil, false
+}
+
+// glob matching with '*', '?' and '\' escapes, backtracking to the last '*' on a mismatch
+func globMatch(pattern, key []byte) bool {
+	p, k := 0, 0
+	star, mark := -1, 0
+	for k < len(key) {
+		if p < len(pattern) {
+			c, wild, n := globToken(pattern, p)
+			if wild && c == '*' {
+				star, mark = p, k
+				p++
+				continue
+			}
+			if wild || c == key[k] {
+				p += n
+				k++
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		// let the last '*' swallow one more byte
+		mark++
+		p, k = star+1, mark
+	}
+	for p < len(pattern) {
+		if c, wild, _ := globToken(pattern, p); !wild || c != '*' {
+			break
+		}
+		p++
+	}
+	return p == len(pattern)
+}
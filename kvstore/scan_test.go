@@ -0,0 +1,641 @@
+package kvstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"kurocifer/LeichtKV/btree"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func TestScanLimitOffset(t *testing.T) {
+	db := openTestDB(t, nil)
+	for i := 0; i < 20; i++ {
+		mustSet(t, db, fmt.Sprintf("k%02d", i), "v")
+	}
+
+	for _, c := range []struct {
+		start         string
+		limit, offset int
+		first, n      int // the expected slice of k00..k19
+	}{
+		{"", 5, 0, 0, 5},
+		{"", 5, 5, 5, 5},
+		{"", 5, 18, 18, 2},
+		{"", 100, 0, 0, 20},
+		{"", 5, 20, 0, 0},
+		{"", 0, 3, 0, 0},
+		{"k10", 3, 2, 12, 3},
+		{"k095", 2, 0, 10, 2},
+	} {
+		got := []string{}
+		if err := db.Scan([]byte(c.start), c.limit, c.offset, func(k, v []byte) bool {
+			got = append(got, string(k))
+			return true
+		}); err != nil {
+			t.Fatal(err)
+		}
+		want := []string{}
+		for i := c.first; i < c.first+c.n; i++ {
+			want = append(want, fmt.Sprintf("k%02d", i))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("Scan(%q, %d, %d) = %v, want %v", c.start, c.limit, c.offset, got, want)
+		}
+	}
+
+	if err := db.Scan(nil, -1, 0, nil); err == nil {
+		t.Error("Scan accepted a negative limit")
+	}
+	if err := db.Scan(nil, 1, -1, nil); err == nil {
+		t.Error("Scan accepted a negative offset")
+	}
+}
+
+// run with -race: the reads must not overlap an update
+func TestSnapshotGetManyConcurrentWriter(t *testing.T) {
+	db := openTestDB(t, nil)
+	keys := [][]byte{[]byte("a"), []byte("b")}
+
+	done := make(chan error)
+	go func() {
+		var err error
+		// a is always set before b, so a snapshot never sees b ahead of a
+		for i := 0; i < 200 && err == nil; i++ {
+			val := []byte(fmt.Sprintf("%03d", i))
+			if err = db.Set(keys[0], val); err == nil {
+				err = db.Set(keys[1], val)
+			}
+		}
+		done <- err
+	}()
+
+	for running := true; running; {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			running = false
+		default:
+		}
+		vals, found, err := db.SnapshotGetMany(keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found[1] && (!found[0] || string(vals[1]) > string(vals[0])) {
+			t.Fatalf("b = %q read with a = %q", vals[1], vals[0])
+		}
+	}
+}
+
+// the groups of GroupByPrefix as "group: key key ..."
+func groups(t *testing.T, db *KV, sep byte, max int) []string {
+	t.Helper()
+	out := []string{}
+	err := db.GroupByPrefix(sep, func(group []byte, pairs []KVPair) bool {
+		line := string(group) + ":"
+		for _, p := range pairs {
+			line += " " + string(p.Key) + "=" + string(p.Val)
+		}
+		out = append(out, line)
+		return len(out) < max
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestGroupByPrefix(t *testing.T) {
+	db := openTestDB(t, nil)
+	if got := groups(t, db, '/', 10); len(got) != 0 {
+		t.Fatalf("groups of an empty DB: %q", got)
+	}
+	for _, key := range []string{"2024/jan/a", "2024/jan/b", "2024/feb/a", "2025/mar/x", "misc", "\xff\xff", "\xff\xff/z"} {
+		mustSet(t, db, key, "v")
+	}
+
+	want := []string{
+		"2024: 2024/feb/a=v 2024/jan/a=v 2024/jan/b=v",
+		"2025: 2025/mar/x=v",
+		"misc: misc=v",
+		"\xff\xff: \xff\xff=v \xff\xff/z=v",
+	}
+	if got := groups(t, db, '/', 10); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("groups:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if got := groups(t, db, '/', 2); len(got) != 2 {
+		t.Fatalf("%d groups after fn returned false", len(got))
+	}
+}
+
+func TestGroupByPrefixKeyBeforeSeparator(t *testing.T) {
+	db := openTestDB(t, nil)
+	// "a!" sorts between "a" and "a/b", splitting the keys of a
+	for _, key := range []string{"a", "a!", "a/b"} {
+		mustSet(t, db, key, "v")
+	}
+	want := []string{"a: a=v", "a!: a!=v", "a: a/b=v"}
+	if got := groups(t, db, '/', 10); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("groups %q, want %q", got, want)
+	}
+}
+
+func TestGroupByPrefixNormalized(t *testing.T) {
+	db := openLowerDB(t)
+	for _, key := range []string{"A/x", "a/y", "B", "b/z"} {
+		mustSet(t, db, key, "v")
+	}
+	want := []string{"A: A/x=v a/y=v", "B: B=v b/z=v"}
+	if got := groups(t, db, '/', 10); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("groups %q, want %q", got, want)
+	}
+}
+
+func TestPrefixSuccessor(t *testing.T) {
+	for _, c := range []struct {
+		prefix, succ string
+		ok           bool
+	}{
+		{"abc", "abd", true},
+		{"ab\xff", "ac", true},
+		{"a\xff\xff", "b", true},
+		{"\xff\xff", "", false},
+		{"", "", false},
+	} {
+		succ, ok := PrefixSuccessor([]byte(c.prefix))
+		if ok != c.ok || string(succ) != c.succ {
+			t.Errorf("PrefixSuccessor(%q) = %q %v, want %q %v", c.prefix, succ, ok, c.succ, c.ok)
+		}
+	}
+}
+
+// the keys ScanPrefix(prefix) finds, stopping after limit
+func prefixKeys(db *KV, prefix string, limit int) []string {
+	keys := []string{}
+	db.ScanPrefix([]byte(prefix), func(k, v []byte) bool {
+		keys = append(keys, string(k))
+		return len(keys) < limit
+	})
+	return keys
+}
+
+func TestScanPrefix(t *testing.T) {
+	db := openTestDB(t, nil)
+	for _, key := range []string{"a", "ab", "ab\xff", "ab\xff\x00", "ac", "b", "\xff", "\xff\xff"} {
+		mustSet(t, db, key, "v")
+	}
+	for _, c := range []struct {
+		prefix string
+		want   []string
+	}{
+		{"ab", []string{"ab", "ab\xff", "ab\xff\x00"}},
+		{"ab\xff", []string{"ab\xff", "ab\xff\x00"}},
+		{"a", []string{"a", "ab", "ab\xff", "ab\xff\x00", "ac"}},
+		{"\xff", []string{"\xff", "\xff\xff"}},
+		{"", []string{"a", "ab", "ab\xff", "ab\xff\x00", "ac", "b", "\xff", "\xff\xff"}},
+		{"abc", []string{}},
+	} {
+		if got := prefixKeys(db, c.prefix, 100); strings.Join(got, ",") != strings.Join(c.want, ",") {
+			t.Errorf("ScanPrefix(%q) = %q, want %q", c.prefix, got, c.want)
+		}
+	}
+	if got := prefixKeys(db, "a", 2); len(got) != 2 {
+		t.Errorf("%d keys after fn returned false", len(got))
+	}
+}
+
+func TestPrefetchRange(t *testing.T) {
+	db := openTestDB(t, nil)
+	for i := 0; i < 2000; i++ {
+		mustSet(t, db, fmt.Sprintf("key%06d", i), strings.Repeat("v", 100))
+	}
+
+	advised := map[uintptr]bool{}
+	madvise := sysMadvise
+	fail := false
+	sysMadvise = func(chunk []byte, advice int) error {
+		if advice != syscall.MADV_WILLNEED || len(chunk) != 4096 {
+			t.Errorf("madvise of %d bytes with %d", len(chunk), advice)
+		}
+		if fail {
+			return syscall.EINVAL
+		}
+		advised[uintptr(unsafe.Pointer(&chunk[0]))] = true
+		return madvise(chunk, advice)
+	}
+	t.Cleanup(func() { sysMadvise = madvise })
+
+	start, end := []byte("key000500"), []byte("key000700")
+	if err := db.PrefetchRange(start, end); err != nil {
+		t.Fatal(err)
+	}
+	// every page the scan reads was advised
+	n := 0
+	db.tree.RangePages(start, end, func(ptr uint64) {
+		n++
+		if !advised[uintptr(unsafe.Pointer(&pageGetMapped(db, ptr).Data[0]))] {
+			t.Errorf("page %d not prefetched", ptr)
+		}
+	})
+	if len(advised) != n || n < 3 {
+		t.Errorf("%d pages advised for a range of %d pages", len(advised), n)
+	}
+	keys := 0
+	db.Scan(start, 1000, 0, func(k, v []byte) bool {
+		keys++
+		return string(k) < string(end)
+	})
+	if keys != 201 {
+		t.Errorf("the scan after the prefetch saw %d keys", keys)
+	}
+
+	fail = true
+	if err := db.PrefetchRange(start, end); !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("PrefetchRange with a failing madvise: %v", err)
+	}
+}
+
+// evict the pages of the file from the page cache, so the next read goes to the disk
+func evict(b *testing.B, db *KV) {
+	for _, chunk := range db.mmap.chunks {
+		if err := syscall.Madvise(chunk, syscall.MADV_DONTNEED); err != nil {
+			b.Fatal(err)
+		}
+	}
+	const POSIX_FADV_DONTNEED = 4
+	_, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64, db.fp.Fd(), 0, 0, POSIX_FADV_DONTNEED, 0, 0)
+	if errno != 0 {
+		b.Fatal(errno)
+	}
+}
+
+func BenchmarkPrefetchRange(b *testing.B) {
+	db := &KV{Path: filepath.Join(b.TempDir(), "test.db")}
+	if err := db.Open(); err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 20000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%06d", i)), []byte(strings.Repeat("v", 200))); err != nil {
+			b.Fatal(err)
+		}
+	}
+	start, end := []byte("key005000"), []byte("key015000")
+	scan := func() {
+		db.Scan(start, 10000, 0, func(k, v []byte) bool { return true })
+	}
+
+	b.Run("cold", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			evict(b, db)
+			b.StartTimer()
+			scan()
+		}
+	})
+	b.Run("prefetched", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			evict(b, db)
+			b.StartTimer()
+			// timed with the scan: the prefetch must not read the range itself
+			if err := db.PrefetchRange(start, end); err != nil {
+				b.Fatal(err)
+			}
+			scan()
+		}
+	})
+}
+
+func TestSplitRanges(t *testing.T) {
+	db := openTestDB(t, nil)
+	if ranges, err := db.SplitRanges(4); err != nil || len(ranges) != 1 {
+		t.Fatalf("SplitRanges of an empty DB = %v %v", ranges, err)
+	}
+	const n = 20000
+	for i := 0; i < n; i++ {
+		mustSet(t, db, fmt.Sprintf("key%06d", i), "v")
+	}
+
+	for _, parts := range []int{1, 4, 16} {
+		ranges, err := db.SplitRanges(parts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ranges) != parts || ranges[0][0] != nil || ranges[len(ranges)-1][1] != nil {
+			t.Fatalf("SplitRanges(%d) = %d ranges, %q to %q", parts, len(ranges), ranges[0][0], ranges[len(ranges)-1][1])
+		}
+		// contiguous, and each key in exactly one of them
+		total := 0
+		for i, r := range ranges {
+			if i > 0 && !bytes.Equal(r[0], ranges[i-1][1]) {
+				t.Fatalf("range %d starts at %q, the one before ends at %q", i, r[0], ranges[i-1][1])
+			}
+			count := 0
+			db.scan(r[0], func(k, v []byte) bool {
+				if r[1] != nil && bytes.Compare(k, r[1]) >= 0 {
+					return false
+				}
+				count++
+				return true
+			})
+			if count < n/parts/2 || count > 2*n/parts {
+				t.Errorf("SplitRanges(%d): range %d holds %d keys", parts, i, count)
+			}
+			total += count
+		}
+		if total != n {
+			t.Errorf("SplitRanges(%d) covers %d keys, want %d", parts, total, n)
+		}
+	}
+
+	if _, err := db.SplitRanges(0); err == nil {
+		t.Error("SplitRanges accepted a count of 0")
+	}
+}
+
+func TestScanLeaves(t *testing.T) {
+	for _, tombstones := range []bool{false, true} {
+		t.Run(fmt.Sprint("tombstones=", tombstones), func(t *testing.T) {
+			db := openTestDB(t, func(db *KV) { db.Tombstones = tombstones })
+			for i := 0; i < 1000; i++ {
+				mustSet(t, db, fmt.Sprintf("key%04d", i), "value")
+			}
+			for i := 0; i < 1000; i += 2 {
+				mustDel(t, db, fmt.Sprintf("key%04d", i))
+			}
+
+			n, pages := 0, map[uint64]bool{}
+			db.ScanLeaves(nil, func(page uint64, k, v []byte) bool {
+				if want := fmt.Sprintf("key%04d", 2*n+1); string(k) != want || string(v) != "value" {
+					t.Fatalf("got %q=%q, want %s=value", k, v, want)
+				}
+				pages[page] = true
+				n++
+				return true
+			})
+			if n != 500 || len(pages) < 2 {
+				t.Fatalf("%d keys over %d pages", n, len(pages))
+			}
+		})
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	for _, c := range []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"*", "", true},
+		{"*", "abc", true},
+		{"a*", "abc", true},
+		{"a*", "bac", false},
+		{"*c", "abc", true},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"a*b*c", "aXXbYYc", true},
+		{"a*b*c", "aXXcYYb", false},
+		{"*ab", "aaab", true},
+		{"user:?:*", "user:1:name", true},
+		{"user:?:*", "user:12:name", false},
+		{"abc", "abc", true},
+		{"abc", "abcd", false},
+		// escaped wildcards are literal
+		{`a\*`, "a*", true},
+		{`a\*`, "ab", false},
+		{`a\?`, "a?", true},
+		{`a\?`, "ab", false},
+		{`*\**`, "x*y", true},
+		{`*\**`, "xy", false},
+		{`a\\`, `a\`, true},
+		{`a\b`, "ab", true},
+		{`a\`, `a\`, true},
+	} {
+		if got := globMatch([]byte(c.pattern), []byte(c.key)); got != c.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", c.pattern, c.key, got, c.want)
+		}
+	}
+}
+
+func matchKeys(t *testing.T, db *KV, pattern string) []string {
+	t.Helper()
+	got := []string{}
+	if err := db.MatchKeys([]byte(pattern), func(k []byte) bool {
+		got = append(got, string(k))
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestMatchKeys(t *testing.T) {
+	db := openTestDB(t, func(db *KV) { db.Tombstones = true })
+	for _, k := range []string{"user:1:name", "user:1:age", "user:2:name", "user:10:name", "item:1"} {
+		mustSet(t, db, k, "v")
+	}
+	mustDel(t, db, "user:1:age")
+
+	for pattern, want := range map[string][]string{
+		"user:*":      {"user:10:name", "user:1:name", "user:2:name"},
+		"user:?:name": {"user:1:name", "user:2:name"},
+		"*:1*":        {"item:1", "user:10:name", "user:1:name"},
+		"nothing*":    {},
+		"user:1:age":  {},
+		"item:1":      {"item:1"},
+	} {
+		if got := matchKeys(t, db, pattern); strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("MatchKeys(%q) = %q, want %q", pattern, got, want)
+		}
+	}
+	if err := db.MatchKeys(nil, func(k []byte) bool { return true }); err == nil {
+		t.Error("empty pattern accepted")
+	}
+}
+
+func TestMatchKeysEscapes(t *testing.T) {
+	db := openTestDB(t, nil)
+	for _, k := range []string{"a*", "a*b", "ab", "a?", `a\`} {
+		mustSet(t, db, k, "v")
+	}
+	for pattern, want := range map[string][]string{
+		`a\**`: {"a*", "a*b"},
+		`a\*`:  {"a*"},
+		`a\?`:  {"a?"},
+		`a\\`:  {`a\`},
+		"a?":   {"a*", "a?", `a\`, "ab"},
+	} {
+		if got := matchKeys(t, db, pattern); strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("MatchKeys(%q) = %q, want %q", pattern, got, want)
+		}
+	}
+}
+
+// the leaves read from the tree while fn runs
+func leafReads(db *KV, fn func()) int {
+	get, reads := db.tree.Get, 0
+	db.tree.Get = func(ptr uint64) btree.BNode {
+		node := get(ptr)
+		if binary.LittleEndian.Uint16(node.Data)&0xff == btree.BNODE_LEAF {
+			reads++
+		}
+		return node
+	}
+	defer func() { db.tree.Get = get }()
+	fn()
+	return reads
+}
+
+func TestMatchKeysPrefixScan(t *testing.T) {
+	db := openTestDB(t, nil)
+	for i := 0; i < 5000; i++ {
+		mustSet(t, db, fmt.Sprintf("item:%05d", i), strings.Repeat("v", 50))
+	}
+	for i := 0; i < 10; i++ {
+		mustSet(t, db, fmt.Sprintf("user:%d", i), "v")
+	}
+	leaves := db.Stats().Leaves
+
+	// a trailing '*' only reads the leaves of the prefix, escapes before it included
+	for _, pattern := range []string{"user:*", `us\er:*`} {
+		if n := leafReads(db, func() { matchKeys(t, db, pattern) }); n > 2 {
+			t.Errorf("MatchKeys(%q) read %d of %d leaves", pattern, n, leaves)
+		}
+	}
+	// any other wildcard reads them all
+	if n := leafReads(db, func() { matchKeys(t, db, "user:?*") }); n < leaves {
+		t.Errorf("MatchKeys(\"user:?*\") read %d of %d leaves", n, leaves)
+	}
+}
+
+func TestMatchKeysNormalized(t *testing.T) {
+	db := openLowerDB(t)
+	for _, k := range []string{"User:1", "user:2", "item:1"} {
+		mustSet(t, db, k, "v")
+	}
+	for _, pattern := range []string{"USER:*", "USER:?", "*SER:*"} {
+		if got := matchKeys(t, db, pattern); len(got) != 2 || got[0] != "User:1" || got[1] != "user:2" {
+			t.Errorf("MatchKeys(%q) = %q, want [User:1 user:2]", pattern, got)
+		}
+	}
+}
+
+func TestForEachUnordered(t *testing.T) {
+	db := openTestDB(t, func(db *KV) { db.Tombstones = true })
+	for i := 0; i < 1000; i++ {
+		mustSet(t, db, fmt.Sprintf("key%04d", i), "value")
+	}
+	for i := 0; i < 1000; i += 2 {
+		mustDel(t, db, fmt.Sprintf("key%04d", i))
+	}
+	seen := map[string]bool{}
+	if err := db.ForEachUnordered(func(k, v []byte) bool {
+		if string(v) != "value" || seen[string(k)] {
+			t.Fatalf("key %q = %q, seen %v", k, v, seen[string(k)])
+		}
+		seen[string(k)] = true
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 500 {
+		t.Fatalf("%d keys visited, want the 500 live ones", len(seen))
+	}
+}
+
+// a full pass over a DB built by inserts in random order, so the leaves are scattered over
+// the file, cold from disk each time
+func BenchmarkForEachUnordered(b *testing.B) {
+	db := &KV{Path: filepath.Join(b.TempDir(), "test.db")}
+	if err := db.Open(); err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	for _, i := range rand.New(rand.NewSource(1)).Perm(20000) {
+		if err := db.Set([]byte(fmt.Sprintf("key%06d", i)), []byte(strings.Repeat("v", 200))); err != nil {
+			b.Fatal(err)
+		}
+	}
+	count := func(k, v []byte) bool { return true }
+
+	b.Run("Scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			evict(b, db)
+			b.StartTimer()
+			if err := db.Scan(nil, 20000, 0, count); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("ForEachUnordered", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			evict(b, db)
+			b.StartTimer()
+			if err := db.ForEachUnordered(count); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestGetRange(t *testing.T) {
+	db := openTestDB(t, func(db *KV) { db.Tombstones = true })
+	for i := 0; i < 10; i++ {
+		mustSet(t, db, fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i))
+	}
+
+	pairs, err := db.GetRange([]byte("k2"), []byte("k7"), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != 3 || string(pairs[0].Key) != "k2" || string(pairs[2].Key) != "k4" {
+		t.Fatalf("GetRange = %q, want k2..k4", pairs)
+	}
+	pairs, _ = db.GetRange([]byte("k2"), []byte("k7"), 100)
+	if len(pairs) != 5 || string(pairs[4].Key) != "k6" {
+		t.Fatalf("GetRange = %q, want k2..k6", pairs)
+	}
+
+	// the pairs are copies, independent of each other and of later writes
+	pairs[0].Val[0] = 'x'
+	mustSet(t, db, "k3", "changed")
+	if string(pairs[1].Val) != "v3" {
+		t.Errorf("pair changed to %q by a later write", pairs[1].Val)
+	}
+	mustGet(t, db, "k2", "v2")
+
+	// deleted keys are skipped
+	mustDel(t, db, "k4")
+	pairs, _ = db.GetRange([]byte("k3"), []byte("k6"), 100)
+	if len(pairs) != 2 || string(pairs[0].Key) != "k3" || string(pairs[1].Key) != "k5" {
+		t.Fatalf("GetRange = %q, want [k3 k5]", pairs)
+	}
+
+	if _, err := db.GetRange(nil, nil, 0); err == nil {
+		t.Error("GetRange accepted a limit of 0")
+	}
+}
+
+func TestGetRangeNormalized(t *testing.T) {
+	db := openLowerDB(t)
+	for _, k := range []string{"a", "B", "c", "D"} {
+		mustSet(t, db, k, "v")
+	}
+	pairs, err := db.GetRange([]byte("A"), []byte("C"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != 2 || string(pairs[0].Key) != "a" || string(pairs[1].Key) != "B" {
+		t.Fatalf("GetRange = %q, want [a B]", pairs)
+	}
+}
@@ -0,0 +1,92 @@
+package kvstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+const INDEX_SIG = "LKVIDX01"
+
+// the sidecar index file, see KV.IndexPath
+// | sig | root | used | free list | commit seq | keys | added | nwords | bloom filter words |
+// | 8B  |  8B  |  8B  |    8B     |     8B     |  8B  |  8B   |   8B   |     nwords*8B      |
+// root, used, the free list head and the commit seq stamp the master page the index was written
+// against. the seq tells apart two states that happen to reuse the same pages.
+const INDEX_HEADER = 8 + 7*8
+
+// load the bloom filter from the sidecar if it matches the file as opened
+func (db *KV) indexLoad() (*bloom, error) {
+	if !db.wasClean {
+		return nil, errors.New("the DB was not closed cleanly")
+	}
+	data, err := os.ReadFile(db.IndexPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < INDEX_HEADER || !bytes.Equal(data[:8], []byte(INDEX_SIG)) {
+		return nil, errors.New("not an index file")
+	}
+
+	field := func(i int) uint64 {
+		return binary.LittleEndian.Uint64(data[8+8*i:])
+	}
+	if field(0) != db.tree.Root || field(1) != db.page.flushed || field(2) != db.free.Head() || field(3) != db.seq {
+		return nil, errors.New("stale index")
+	}
+	nwords := field(6)
+	if nwords == 0 || uint64(len(data)-INDEX_HEADER) != nwords*8 {
+		return nil, errors.New("truncated index")
+	}
+
+	b := &bloom{bits: make([]atomic.Uint64, nwords), keys: int(field(4)), added: int(field(5))}
+	for i := range b.bits {
+		b.bits[i].Store(binary.LittleEndian.Uint64(data[INDEX_HEADER+8*i:]))
+	}
+	return b, nil
+}
+
+// write the sidecar for the current committed state, through a temporary file and a rename
+// so a reader never sees a partial one
+func (db *KV) indexStore() error {
+	b := db.bloom.Load()
+	if b == nil {
+		return nil
+	}
+
+	data := make([]byte, INDEX_HEADER, INDEX_HEADER+8*len(b.bits))
+	copy(data, INDEX_SIG)
+	for i, v := range []uint64{db.tree.Root, db.page.flushed, db.free.Head(), db.seq,
+		uint64(b.keys), uint64(b.added), uint64(len(b.bits))} {
+		binary.LittleEndian.PutUint64(data[8+8*i:], v)
+	}
+	for i := range b.bits {
+		data = binary.LittleEndian.AppendUint64(data, b.bits[i].Load())
+	}
+
+	tmp := db.IndexPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("write index: %w", err)
+	}
+	if err := os.Rename(tmp, db.IndexPath); err != nil {
+		return fmt.Errorf("write index: %w", err)
+	}
+	return nil
+}
+
+// set up the bloom filter on Open, from the sidecar when it's valid
+func (db *KV) bloomOpen() {
+	if !db.BloomFilter {
+		return
+	}
+	if db.IndexPath != "" {
+		if b, err := db.indexLoad(); err == nil {
+			db.bloom.Store(b)
+			return
+		}
+	}
+	db.bloomBuild()
+}
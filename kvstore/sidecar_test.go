@@ -0,0 +1,113 @@
+package kvstore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// open the DB at path with the bloom filter cached in path+".idx", and report whether the
+// filter came from the sidecar. a rebuilt filter has no Insert calls since it was built
+func openIndexed(t *testing.T, path string) (*KV, bool) {
+	t.Helper()
+	db := &KV{Path: path, BloomFilter: true, IndexPath: path + ".idx"}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	return db, db.bloom.Load().added != 0
+}
+
+func TestIndexSidecar(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, _ := openIndexed(t, path)
+	for i := 0; i < 300; i++ {
+		mustSet(t, db, fmt.Sprintf("key%04d", i), "v")
+	}
+	db.Close()
+	if _, err := os.Stat(path + ".idx"); err != nil {
+		t.Fatalf("no sidecar after Close: %v", err)
+	}
+
+	db, loaded := openIndexed(t, path)
+	if !loaded {
+		t.Fatal("the filter was rebuilt with a valid sidecar")
+	}
+	for i := 0; i < 300; i++ {
+		mustFind(t, db, fmt.Sprintf("key%04d", i))
+	}
+	mustLookupMiss(t, db, "absent")
+	db.Close()
+}
+
+func TestIndexSidecarRejected(t *testing.T) {
+	setup := func(t *testing.T) string {
+		path := filepath.Join(t.TempDir(), "test.db")
+		db, _ := openIndexed(t, path)
+		for i := 0; i < 300; i++ {
+			mustSet(t, db, fmt.Sprintf("key%04d", i), "v")
+		}
+		db.Close()
+		return path
+	}
+
+	t.Run("written without the filter", func(t *testing.T) {
+		path := setup(t)
+		db := &KV{Path: path}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		mustSet(t, db, "new", "v")
+		db.Close()
+
+		db, loaded := openIndexed(t, path)
+		defer db.Close()
+		if loaded {
+			t.Fatal("a stale sidecar was loaded")
+		}
+		mustFind(t, db, "new")
+	})
+
+	t.Run("not closed cleanly", func(t *testing.T) {
+		path := setup(t)
+		db, _ := openIndexed(t, path)
+		mustSet(t, db, "new", "v")
+		// what a crash leaves: the committed file and the sidecar of the last Close
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		crashed := filepath.Join(t.TempDir(), "crashed.db")
+		idx, err := os.ReadFile(path + ".idx")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(crashed, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(crashed+".idx", idx, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+
+		db, loaded := openIndexed(t, crashed)
+		defer db.Close()
+		if loaded {
+			t.Fatal("the sidecar was loaded after a crash")
+		}
+		mustFind(t, db, "new")
+	})
+
+	t.Run("damaged", func(t *testing.T) {
+		path := setup(t)
+		if err := os.WriteFile(path+".idx", []byte("junk"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		db, loaded := openIndexed(t, path)
+		defer db.Close()
+		if loaded {
+			t.Fatal("a damaged sidecar was loaded")
+		}
+		mustFind(t, db, "key0042")
+	})
+}
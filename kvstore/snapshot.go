@@ -0,0 +1,119 @@
+package kvstore
+
+import (
+	"bytes"
+	"errors"
+	"kurocifer/LeichtKV/btree"
+	"slices"
+	"sync/atomic"
+)
+
+// Snapshot is a read-only view of the DB as of when it was taken, see KV.Snapshot.
+// It can be read while updates run: it only reads committed pages, through the mappings that
+// existed when it was taken, and never the pending pages of an update.
+type Snapshot struct {
+	db       *KV
+	tree     btree.BTree
+	released atomic.Bool
+}
+
+// Snapshot pins the current committed tree. Pages are copy-on-write, so the pinned root stays
+// readable while later updates commit, as long as its pages aren't reused: until Release, the pages
+// freed by updates are held back from the free list, and the file grows instead.
+func (db *KV) Snapshot() *Snapshot {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	db.drain.snaps++
+	s := &Snapshot{db: db, tree: db.tree}
+	// the chunks are never moved while a snapshot is open, see TrimMapping
+	chunks := slices.Clone(db.mmap.chunks)
+	s.tree.Get = func(ptr uint64) btree.BNode {
+		return chunksPage(chunks, ptr)
+	}
+	return s
+}
+
+// Release ends the snapshot. Once the last one is released the held pages are freed.
+func (s *Snapshot) Release() {
+	db := s.db
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	if s.released.Swap(true) {
+		return
+	}
+	if db.drain.snaps > 0 { // Close drops them all
+		db.drain.snaps--
+		db.drainWake()
+	}
+}
+
+// Get returns the value key had when the snapshot was taken.
+func (s *Snapshot) Get(key []byte) ([]byte, bool, error) {
+	if s.released.Load() {
+		return nil, false, errors.New("Snapshot.Get: released")
+	}
+	stored, ok := s.tree.Lookup(key)
+	if !ok || s.db.isTombstone(stored) {
+		return nil, false, nil
+	}
+	val, meta := s.db.decodeVal(stored)
+	if s.db.expired(meta) {
+		return nil, false, nil
+	}
+	return val, true, nil
+}
+
+// the ops reported by Diff
+const (
+	DIFF_ADD = '+' // the key is only in to, v is its value there
+	DIFF_DEL = '-' // the key is only in from, v is its value there
+	DIFF_MOD = '~' // the key is in both with different values, v is the value in to
+)
+
+// Diff calls fn for every key that differs between two snapshots of the DB, in key order,
+// until fn returns false. Values are compared after decoding, with their flags.
+// The subtrees the snapshots share are skipped without being read, so diffing two snapshots
+// a few updates apart reads about the pages those updates wrote, see btree.Diff.
+func (db *KV) Diff(from, to *Snapshot, fn func(op byte, k, v []byte) bool) error {
+	if from.db != db || to.db != db {
+		return errors.New("Diff: snapshot of another DB")
+	}
+	if from.released.Load() || to.released.Load() {
+		return errors.New("Diff: released snapshot")
+	}
+
+	btree.Diff(&from.tree, &to.tree, func(key, va, vb []byte) bool {
+		// a tombstone or an expired value is an absent key, like for the reads
+		if db.absent(va) {
+			va = nil
+		}
+		if db.absent(vb) {
+			vb = nil
+		}
+		switch {
+		case va == nil && vb == nil:
+			return true
+		case va == nil:
+			val, _ := db.decodeVal(vb)
+			return fn(DIFF_ADD, key, val)
+		case vb == nil:
+			val, _ := db.decodeVal(va)
+			return fn(DIFF_DEL, key, val)
+		case db.sameVal(va, vb):
+			return true
+		default:
+			val, _ := db.decodeVal(vb)
+			return fn(DIFF_MOD, key, val)
+		}
+	})
+	return nil
+}
+
+// stored values holding the same value and flags, timestamps aside
+func (db *KV) sameVal(a, b []byte) bool {
+	vala, ma := db.decodeVal(a)
+	valb, mb := db.decodeVal(b)
+	return ma.flags == mb.flags && bytes.Equal(vala, valb)
+}
@@ -0,0 +1,149 @@
+package kvstore
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type diffOp struct {
+	op  byte
+	key string
+	val string
+}
+
+func mustDiff(t *testing.T, db *KV, from, to *Snapshot) []diffOp {
+	t.Helper()
+	var ops []diffOp
+	err := db.Diff(from, to, func(op byte, k, v []byte) bool {
+		ops = append(ops, diffOp{op, string(k), string(v)})
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ops
+}
+
+func TestSnapshotGet(t *testing.T) {
+	for _, tomb := range []bool{false, true} {
+		t.Run(fmt.Sprintf("tombstones=%v", tomb), func(t *testing.T) {
+			db := openTestDB(t, func(db *KV) { db.Tombstones = tomb; db.ValueFlags = tomb })
+			mustSet(t, db, "a", "1")
+			mustSet(t, db, "b", "2")
+			snap := db.Snapshot()
+			defer snap.Release()
+
+			mustSet(t, db, "a", "changed")
+			mustDel(t, db, "b")
+			mustSet(t, db, "c", "3")
+
+			for key, want := range map[string]string{"a": "1", "b": "2"} {
+				val, ok, err := snap.Get([]byte(key))
+				if err != nil || !ok || string(val) != want {
+					t.Fatalf("Get(%q) = %q, %v, %v", key, val, ok, err)
+				}
+			}
+			if _, ok, err := snap.Get([]byte("c")); err != nil || ok {
+				t.Fatalf("Get(c) = %v, %v", ok, err)
+			}
+			mustGet(t, db, "a", "changed")
+
+			// a key deleted before the snapshot is absent from it, tombstone or not
+			later := db.Snapshot()
+			defer later.Release()
+			if _, ok, err := later.Get([]byte("b")); err != nil || ok {
+				t.Fatalf("Get(b) = %v, %v", ok, err)
+			}
+		})
+	}
+}
+
+func TestSnapshotDiff(t *testing.T) {
+	for _, tomb := range []bool{false, true} {
+		t.Run(fmt.Sprintf("tombstones=%v", tomb), func(t *testing.T) {
+			db := openTestDB(t, func(db *KV) { db.Tombstones = tomb; db.ValueFlags = tomb })
+			mustSet(t, db, "a", "1")
+			mustSet(t, db, "b", "2")
+			mustSet(t, db, "c", "3")
+			mustSet(t, db, "gone", "x")
+			mustDel(t, db, "gone")
+			from := db.Snapshot()
+			defer from.Release()
+
+			mustDel(t, db, "a")
+			mustSet(t, db, "b", "changed")
+			mustSet(t, db, "c", "3") // the same value is no change
+			mustSet(t, db, "d", "4")
+			to := db.Snapshot()
+			defer to.Release()
+
+			want := []diffOp{{DIFF_DEL, "a", "1"}, {DIFF_MOD, "b", "changed"}, {DIFF_ADD, "d", "4"}}
+			if ops := mustDiff(t, db, from, to); fmt.Sprint(ops) != fmt.Sprint(want) {
+				t.Fatalf("diff %v, want %v", ops, want)
+			}
+			if ops := mustDiff(t, db, to, to); len(ops) != 0 {
+				t.Fatalf("diff of a snapshot with itself: %v", ops)
+			}
+		})
+	}
+}
+
+func TestSnapshotReleased(t *testing.T) {
+	db := openTestDB(t, nil)
+	mustSet(t, db, "a", "1")
+	snap, other := db.Snapshot(), db.Snapshot()
+	snap.Release()
+	snap.Release() // twice is fine
+	defer other.Release()
+
+	if _, _, err := snap.Get([]byte("a")); err == nil {
+		t.Fatal("Get on a released snapshot")
+	}
+	if err := db.Diff(snap, other, func(byte, []byte, []byte) bool { return true }); err == nil {
+		t.Fatal("Diff of a released snapshot")
+	}
+	// the mappings stay put for the open one
+	if err := db.TrimMapping(); err == nil {
+		t.Fatal("TrimMapping with a snapshot open")
+	}
+}
+
+// run with -race: readers of a snapshot don't touch the pending pages of a concurrent update
+func TestSnapshotConcurrentWriter(t *testing.T) {
+	db := openTestDB(t, nil)
+	for i := 0; i < 200; i++ {
+		mustSet(t, db, fmt.Sprintf("key%04d", i), "old")
+	}
+	snap := db.Snapshot()
+	defer snap.Release()
+	same := db.Snapshot()
+	defer same.Release()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// big values, so the file grows and gets new mappings meanwhile
+		for i := 0; i < 200; i++ {
+			if err := db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(strings.Repeat("n", 2000))); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 200; i += 7 {
+			val, ok, err := snap.Get([]byte(fmt.Sprintf("key%04d", i)))
+			if err != nil || !ok || string(val) != "old" {
+				t.Fatalf("Get(key%04d) = %q, %v, %v", i, val, ok, err)
+			}
+		}
+		if ops := mustDiff(t, db, snap, same); len(ops) != 0 {
+			t.Fatalf("diff %v", ops)
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,72 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"kurocifer/LeichtKV/btree"
+)
+
+// leaves holding fewer keys than this on average make the tree deep and scans slow
+const LOW_FANOUT = 8
+
+// Stats walks the tree and reports its shape. Keys counts the stored entries,
+// tombstones and expired values included, see Len for the keys a read finds.
+func (db *KV) Stats() btree.Stats {
+	return db.tree.Stats()
+}
+
+// Len returns the number of keys, without the tombstones and expired values. Walks every leaf.
+func (db *KV) Len() int {
+	n := 0
+	db.scan(nil, func(k, v []byte) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// FanoutWarning returns a warning when the average leaf holds fewer than LOW_FANOUT keys,
+// which happens when most values are close to BTREE_MAX_VALUE_SIZE. Returns "" otherwise.
+func (db *KV) FanoutWarning() string {
+	stats := db.Stats()
+	if stats.Leaves == 0 || stats.LeafFanout() >= LOW_FANOUT {
+		return ""
+	}
+	return fmt.Sprintf(
+		"low leaf fan-out: %.1f keys per leaf over %d leaves (height %d); "+
+			"large values should be stored outside the tree, keeping only a reference in it",
+		stats.LeafFanout(), stats.Leaves, stats.Height,
+	)
+}
+
+// RangeSize returns the on-disk bytes taken by the keys in [start, end), a nil end meaning
+// no upper bound. Node headers and the internal nodes are not counted, so it's an estimate of
+// what a scan of the range reads, to compare against a full scan (Stats().Bytes).
+func (db *KV) RangeSize(start, end []byte) (uint64, error) {
+	if end != nil && db.compareKeys(start, end) > 0 {
+		return 0, errors.New("RangeSize: start is after end")
+	}
+	return uint64(db.tree.RangeBytes(start, end)), nil
+}
+
+// Height is the number of levels of the tree, 0 for an empty DB. Reads one page per level.
+func (db *KV) Height() int {
+	return db.tree.Height()
+}
+
+// enforce MaxHeight on the pending tree of an update. repacking is left to the caller
+// (CompactRange), it rewrites the whole tree and doesn't belong on the path of a single write.
+// an update that only deletes keys always goes through, it's how the tree gets back under
+// the limit, even when a tombstone splits a leaf
+func (db *KV) checkHeight() error {
+	if db.MaxHeight <= 0 {
+		return nil
+	}
+	if p := db.counters.pending; p.dels > 0 && p.dels == p.writes {
+		return nil
+	}
+	if h := db.tree.Height(); h > db.MaxHeight {
+		return fmt.Errorf("%w: %d levels, at most %d", ErrTreeTooTall, h, db.MaxHeight)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"kurocifer/LeichtKV/btree"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFanoutWarning(t *testing.T) {
+	db := openTestDB(t, nil)
+	if msg := db.FanoutWarning(); msg != "" {
+		t.Errorf("empty DB: %q", msg)
+	}
+	for i := 0; i < 100; i++ {
+		mustSet(t, db, fmt.Sprintf("small%03d", i), "v")
+	}
+	if msg := db.FanoutWarning(); msg != "" {
+		t.Errorf("small values: %q", msg)
+	}
+
+	// a leaf each
+	for i := 0; i < 100; i++ {
+		mustSet(t, db, fmt.Sprintf("large%03d", i), strings.Repeat("v", btree.BTREE_MAX_VALUE_SIZE))
+	}
+	if msg := db.FanoutWarning(); !strings.Contains(msg, "low leaf fan-out") {
+		t.Errorf("large values: %q", msg)
+	}
+}
+
+func TestRangeSize(t *testing.T) {
+	db := openLowerDB(t)
+	for i := 0; i < 1000; i++ {
+		mustSet(t, db, fmt.Sprintf("key%04d", i), "value")
+	}
+	all, err := db.RangeSize(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	half, err := db.RangeSize([]byte("KEY0500"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all == 0 || 2*half != all {
+		t.Fatalf("RangeSize of half the keys %d, of all %d", half, all)
+	}
+	if size, err := db.RangeSize([]byte("key0100"), []byte("KEY0100")); err != nil || size != 0 {
+		t.Fatalf("empty range: %d %v", size, err)
+	}
+	if _, err := db.RangeSize([]byte("KEY0200"), []byte("key0100")); err == nil {
+		t.Fatal("start after end accepted")
+	}
+}
+
+func TestMaxHeight(t *testing.T) {
+	// in random order, so the leaves split half full and repacking makes room
+	perm := rand.New(rand.NewSource(1)).Perm(100000)
+	key := func(i int) string { return fmt.Sprintf("key%06d", perm[i]) }
+	val := strings.Repeat("v", 200)
+
+	// without a limit, how many keys make the tree taller than 2 levels
+	free := openTestDB(t, nil)
+	grows := 0
+	for free.Height() <= 2 {
+		mustSet(t, free, key(grows), val)
+		grows++
+	}
+
+	db := openTestDB(t, func(db *KV) { db.MaxHeight = 2 })
+	if h := db.Height(); h != 0 {
+		t.Fatalf("empty DB: height %d", h)
+	}
+	n := 0
+	for ; ; n++ {
+		err := db.Set([]byte(key(n)), []byte(val))
+		if errors.Is(err, ErrTreeTooTall) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the write that would add a level is refused as is, not after repacking the tree
+	if n+1 != grows {
+		t.Fatalf("%d keys before ErrTreeTooTall, a tree without the limit grew with key %d", n, grows)
+	}
+	if h := db.Height(); h != 2 {
+		t.Fatalf("height %d after the failed update", h)
+	}
+	mustMiss(t, db, key(n))
+
+	// the repacked tree holds more than the one that grew a level
+	if err := db.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	mustSet(t, db, key(n), val)
+	for i := 0; i <= n; i += 97 {
+		mustGet(t, db, key(i), val)
+	}
+	if err := db.tree.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxHeightAllowsDeletes(t *testing.T) {
+	for _, tombstones := range []bool{false, true} {
+		t.Run(fmt.Sprint("tombstones=", tombstones), func(t *testing.T) {
+			db := openTestDB(t, func(db *KV) { db.Tombstones = tombstones })
+			val := strings.Repeat("v", 200)
+			n := 0
+			for ; db.Height() <= 2; n++ {
+				mustSet(t, db, fmt.Sprintf("key%06d", n), val)
+			}
+			// a tree already over the limit takes no more sets, but deletes still go through
+			db.MaxHeight = 2
+			if err := db.Set([]byte("more"), []byte(val)); !errors.Is(err, ErrTreeTooTall) {
+				t.Fatalf("Set over the limit: %v", err)
+			}
+			for i := 0; i < n; i += 2 {
+				if deleted, err := db.Del([]byte(fmt.Sprintf("key%06d", i))); err != nil || !deleted {
+					t.Fatalf("Del over the limit: %v %v", deleted, err)
+				}
+			}
+			for i := 0; i < n; i++ {
+				if i%2 == 0 {
+					mustMiss(t, db, fmt.Sprintf("key%06d", i))
+				} else {
+					mustGet(t, db, fmt.Sprintf("key%06d", i), val)
+				}
+			}
+			if err := db.tree.Validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			// deleting more gets the tree back under the limit, tombstones stay until collected
+			if tombstones {
+				return
+			}
+			for i := 1; db.Height() > 2; i += 2 {
+				mustDel(t, db, fmt.Sprintf("key%06d", i))
+			}
+			mustSet(t, db, "more", val)
+		})
+	}
+}
+
+func TestLen(t *testing.T) {
+	now := time.Unix(1_000_000, 0)
+	db := openTestDB(t, func(db *KV) {
+		db.Tombstones = true
+		db.Expiry = true
+		db.Clock = func() time.Time { return now }
+	})
+	if n := db.Len(); n != 0 {
+		t.Fatalf("Len of an empty DB = %d", n)
+	}
+	for i := 0; i < 100; i++ {
+		mustSet(t, db, fmt.Sprintf("key%03d", i), "v")
+	}
+	for i := 0; i < 100; i += 4 {
+		mustDel(t, db, fmt.Sprintf("key%03d", i))
+	}
+	if err := db.SetWithTTL([]byte("key001"), []byte("v"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if n := db.Len(); n != 75 {
+		t.Fatalf("Len = %d, want 75", n)
+	}
+	// the tombstones are still stored, and counted by Stats
+	if n := db.Stats().Keys; n != 100 {
+		t.Fatalf("Stats().Keys = %d, want 100", n)
+	}
+	now = now.Add(time.Minute)
+	if n := db.Len(); n != 74 {
+		t.Fatalf("Len after the expiry = %d, want 74", n)
+	}
+}
@@ -0,0 +1,67 @@
+package kvstore
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// syscalls can fail with EINTR when a signal arrives, which is not a real failure.
+// these wrappers simply re-issue the call until it completes.
+
+// the raw calls behind the wrappers, tests swap them to inject failures
+var (
+	sysMmap      = syscall.Mmap
+	sysMunmap    = syscall.Munmap
+	sysFallocate = syscall.Fallocate
+	sysFsync     = (*os.File).Sync
+	sysMadvise   = syscall.Madvise
+)
+
+func retryEINTR(fn func() error) error {
+	for {
+		err := fn()
+		if !errors.Is(err, syscall.EINTR) {
+			return err
+		}
+	}
+}
+
+func mmap(fd int, offset int64, length int, prot int, flags int) ([]byte, error) {
+	var chunk []byte
+	err := retryEINTR(func() (err error) {
+		chunk, err = sysMmap(fd, offset, length, prot, flags)
+		return err
+	})
+	return chunk, err
+}
+
+func munmap(chunk []byte) error {
+	return retryEINTR(func() error {
+		return sysMunmap(chunk)
+	})
+}
+
+func fallocate(fd int, mode uint32, offset int64, length int64) error {
+	return retryEINTR(func() error {
+		return sysFallocate(fd, mode, offset, length)
+	})
+}
+
+func fsync(fp *os.File) error {
+	return retryEINTR(func() error {
+		return sysFsync(fp)
+	})
+}
+
+func madvise(chunk []byte, advice int) error {
+	return retryEINTR(func() error {
+		return sysMadvise(chunk, advice)
+	})
+}
+
+func flock(fd int, how int) error {
+	return retryEINTR(func() error {
+		return syscall.Flock(fd, how)
+	})
+}
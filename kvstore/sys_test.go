@@ -0,0 +1,80 @@
+package kvstore
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestRetryEINTR(t *testing.T) {
+	// the first 2 calls of each are interrupted
+	nfallocate, nfsync := 0, 0
+	fallocate, fsync := sysFallocate, sysFsync
+	sysFallocate = func(fd int, mode uint32, offset int64, length int64) error {
+		if nfallocate++; nfallocate <= 2 {
+			return syscall.EINTR
+		}
+		return fallocate(fd, mode, offset, length)
+	}
+	sysFsync = func(fp *os.File) error {
+		if nfsync++; nfsync <= 2 {
+			return syscall.EINTR
+		}
+		return fsync(fp)
+	}
+	t.Cleanup(func() { sysFallocate, sysFsync = fallocate, fsync })
+
+	db := openTestDB(t, nil)
+	mustSet(t, db, "k", "v")
+	// fsync again for the master page
+	if nfallocate != 3 || nfsync != 4 {
+		t.Fatalf("fallocate called %d times, fsync %d times; want 3 and 4", nfallocate, nfsync)
+	}
+	got := ""
+	db.Scan(nil, 1, 0, func(k, v []byte) bool {
+		got = string(k) + "=" + string(v)
+		return true
+	})
+	if got != "k=v" {
+		t.Fatalf("Scan found %q after the retried commit", got)
+	}
+}
+
+func TestRandomAccess(t *testing.T) {
+	advice := []int{}
+	madvise := sysMadvise
+	sysMadvise = func(chunk []byte, a int) error {
+		advice = append(advice, a)
+		return madvise(chunk, a)
+	}
+	t.Cleanup(func() { sysMadvise = madvise })
+
+	openTestDB(t, nil)
+	if len(advice) != 0 {
+		t.Fatalf("madvise %v without RandomAccess", advice)
+	}
+
+	db := openTestDB(t, func(db *KV) { db.RandomAccess = true })
+	mustSet(t, db, "k", "v")
+	// the new mapping is advised too
+	if err := db.TrimMapping(); err != nil {
+		t.Fatal(err)
+	}
+	if len(advice) != 2 || advice[0] != syscall.MADV_RANDOM || advice[1] != syscall.MADV_RANDOM {
+		t.Fatalf("madvise %v, want MADV_RANDOM for both mappings", advice)
+	}
+	mustGet(t, db, "k", "v")
+}
+
+func TestRandomAccessError(t *testing.T) {
+	madvise := sysMadvise
+	sysMadvise = func([]byte, int) error { return syscall.EINVAL }
+	t.Cleanup(func() { sysMadvise = madvise })
+
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db"), RandomAccess: true}
+	if err := db.Open(); err == nil {
+		db.Close()
+		t.Fatal("opened with madvise failing")
+	}
+}
@@ -0,0 +1,94 @@
+package kvstore
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// with FEATURE_TOMBSTONES every stored value starts with a tag
+const (
+	VALUE_LIVE      = 0 // followed by the value, as without the feature
+	VALUE_TOMBSTONE = 1 // followed by the commit seq of the delete, 8 bytes
+)
+
+func (db *KV) isTombstone(stored []byte) bool {
+	return db.features&FEATURE_TOMBSTONES != 0 && len(stored) != 0 && stored[0] == VALUE_TOMBSTONE
+}
+
+// the commit seq of the delete that left a tombstone
+func tombstoneSeq(stored []byte) uint64 {
+	return binary.LittleEndian.Uint64(stored[1:])
+}
+
+// delete key as part of an update. with FEATURE_TOMBSTONES the key is kept
+// with a tombstone stamped with the seq of the update. returns false if key doesn't exist
+func (db *KV) deleteKey(key []byte) bool {
+	if db.features&FEATURE_TOMBSTONES == 0 {
+		return db.tree.Delete(key)
+	}
+	if _, ok := db.lookup(key); !ok {
+		return false
+	}
+	db.tree.Insert(key, db.tombstone())
+	return true
+}
+
+// a tombstone for a delete by the running update
+func (db *KV) tombstone() []byte {
+	stone := make([]byte, 9)
+	stone[0] = VALUE_TOMBSTONE
+	binary.LittleEndian.PutUint64(stone[1:], db.seq)
+	return stone
+}
+
+// Seq returns the commit seq of the last update. It's bumped by every update and
+// kept in the master page, so it survives a reopen.
+func (db *KV) Seq() uint64 {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	return db.seq
+}
+
+// DeletesSince calls fn, in key order, for every key deleted by an update after seq and not set again,
+// with the seq of the delete. A changelog consumer that has seen up to seq learns of the deletes since.
+// Needs a file created with Tombstones, and only sees the tombstones GCTombstones hasn't removed yet.
+func (db *KV) DeletesSince(seq uint64, fn func(key []byte, seq uint64) bool) {
+	db.tree.Scan(nil, func(k, v []byte) bool {
+		if !db.isTombstone(v) || tombstoneSeq(v) <= seq {
+			return true
+		}
+		return fn(k, tombstoneSeq(v))
+	})
+}
+
+// GCTombstones removes the tombstones of deletes more than retention updates old, as one atomic update.
+// Returns how many were removed.
+func (db *KV) GCTombstones(retention uint64) (int, error) {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	if db.features&FEATURE_TOMBSTONES == 0 {
+		return 0, nil
+	}
+	keys := [][]byte{}
+	db.tree.Scan(nil, func(k, v []byte) bool {
+		// as a difference, so a huge retention can't overflow
+		if db.isTombstone(v) && db.seq-tombstoneSeq(v) >= retention {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		return true
+	})
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	err := db.update(func() {
+		for _, key := range keys {
+			db.tree.Delete(key)
+		}
+	})
+	if err != nil {
+		return 0, fmt.Errorf("GCTombstones: %w", err)
+	}
+	return len(keys), nil
+}
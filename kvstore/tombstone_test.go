@@ -0,0 +1,143 @@
+package kvstore
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+// the deletes DeletesSince(seq) reports
+func deletesSince(db *KV, seq uint64) map[string]uint64 {
+	dels := map[string]uint64{}
+	db.DeletesSince(seq, func(key []byte, seq uint64) bool {
+		dels[string(key)] = seq
+		return true
+	})
+	return dels
+}
+
+func TestTombstoneDelete(t *testing.T) {
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db"), Tombstones: true, ValueFlags: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	mustSet(t, db, "a", "1")
+	mustSet(t, db, "b", "2")
+	seen := db.Seq()
+
+	mustDel(t, db, "a")
+	del := db.Seq()
+	if del != seen+1 {
+		t.Fatalf("seq %d after the delete, was %d", del, seen)
+	}
+	// the delete is an event for a consumer that has seen up to before it
+	if dels := deletesSince(db, seen); len(dels) != 1 || dels["a"] != del {
+		t.Fatalf("deletes since %d: %v", seen, dels)
+	}
+	if dels := deletesSince(db, del); len(dels) != 0 {
+		t.Fatalf("deletes since %d: %v", del, dels)
+	}
+
+	// but to readers the key is gone
+	mustMiss(t, db, "a")
+	if _, _, ok, _ := db.GetWithFlags([]byte("a")); ok {
+		t.Error("GetWithFlags found a tombstone")
+	}
+	if _, found, _ := db.SnapshotGetMany([][]byte{[]byte("a")}); found[0] {
+		t.Error("SnapshotGetMany found a tombstone")
+	}
+	if ok, err := db.Rename([]byte("a"), []byte("c")); ok || err != nil {
+		t.Errorf("Rename of a tombstone = %v %v", ok, err)
+	}
+	if ok, err := db.Del([]byte("a")); ok || err != nil {
+		t.Errorf("Del of a tombstone = %v %v", ok, err)
+	}
+	if v, ok, err := db.IncrBounded([]byte("a"), 5, 100); v != 5 || !ok || err != nil {
+		t.Errorf("IncrBounded of a tombstone = %v %v %v", v, ok, err)
+	}
+	// which set it again
+	if dels := deletesSince(db, seen); len(dels) != 0 {
+		t.Fatalf("deletes since %d after setting the key again: %v", seen, dels)
+	}
+
+	// a renamed key leaves a tombstone too, and it all survives a reopen
+	if ok, err := db.Rename([]byte("b"), []byte("c")); !ok || err != nil {
+		t.Fatalf("Rename = %v %v", ok, err)
+	}
+	seq := db.Seq()
+	db.Close()
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.Seq() != seq {
+		t.Fatalf("seq %d after reopening, was %d", db.Seq(), seq)
+	}
+	if dels := deletesSince(db, seen); len(dels) != 1 || dels["b"] != seq {
+		t.Fatalf("deletes since %d after reopening: %v", seen, dels)
+	}
+	mustMiss(t, db, "b")
+	mustGet(t, db, "c", "2")
+}
+
+func TestGCTombstones(t *testing.T) {
+	db := openTestDB(t, func(db *KV) { db.Tombstones = true })
+	for i := 0; i < 100; i++ {
+		mustSet(t, db, fmt.Sprintf("key%03d", i), "v")
+	}
+	for i := 0; i < 100; i += 2 {
+		mustDel(t, db, fmt.Sprintf("key%03d", i))
+	}
+	if n := db.Stats().Keys; n != 100 {
+		t.Fatalf("%d keys with the tombstones, want 100", n)
+	}
+
+	// nothing is that old
+	if n, err := db.GCTombstones(math.MaxUint64); n != 0 || err != nil {
+		t.Fatalf("GC with the largest retention = %d %v, want nothing removed", n, err)
+	}
+
+	// the last deletes are still within a retention of 10 updates
+	n, err := db.GCTombstones(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 40 {
+		t.Fatalf("GC removed %d tombstones, want 40", n)
+	}
+	if dels := deletesSince(db, 0); len(dels) != 10 {
+		t.Fatalf("%d tombstones left, want 10", len(dels))
+	}
+
+	// and go once the window has passed
+	for i := 0; i < 10; i++ {
+		mustSet(t, db, "other", fmt.Sprint(i))
+	}
+	if n, err := db.GCTombstones(10); n != 10 || err != nil {
+		t.Fatalf("GC = %d %v, want the last 10 tombstones", n, err)
+	}
+	if dels := deletesSince(db, 0); len(dels) != 0 {
+		t.Fatalf("tombstones left: %v", dels)
+	}
+	if n := db.Stats().Keys; n != 51 {
+		t.Fatalf("%d keys after the GC, want 51", n)
+	}
+	mustMiss(t, db, "key000")
+	mustGet(t, db, "key001", "v")
+}
+
+func TestTombstonesNotEnabled(t *testing.T) {
+	db := openTestDB(t, nil)
+	mustSet(t, db, "a", "1")
+	mustDel(t, db, "a")
+	if n := db.Stats().Keys; n != 0 {
+		t.Fatalf("%d keys after deleting the only one", n)
+	}
+	if dels := deletesSince(db, 0); len(dels) != 0 {
+		t.Fatalf("deletes without tombstones: %v", dels)
+	}
+	if n, err := db.GCTombstones(0); n != 0 || err != nil {
+		t.Fatalf("GC = %d %v", n, err)
+	}
+}
@@ -0,0 +1,107 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrNoExpiry = errors.New("expiry is not enabled for this DB")
+
+// SetWithTTL stores val under key until ttl from now, overriding KV.DefaultTTL; 0 never expires.
+// Needs a file created with Expiry. An expired key reads as absent, but stays in the file
+// until it is overwritten, deleted, or removed by SweepExpired.
+func (db *KV) SetWithTTL(key []byte, val []byte, ttl time.Duration) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	if db.features&FEATURE_EXPIRY == 0 {
+		return ErrNoExpiry
+	}
+	if ttl < 0 {
+		return fmt.Errorf("SetWithTTL: negative ttl %v", ttl)
+	}
+
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	meta := db.metaFor(key, 0)
+	meta.expires = 0
+	if ttl > 0 {
+		meta.expires = db.now().Add(ttl).UnixNano()
+	}
+	return db.set(key, val, meta)
+}
+
+// SweepExpired deletes the expired keys in one update and returns how many there were.
+// Reads already skip them, this reclaims their space; call it periodically for a cache
+// that is mostly written and rarely read back.
+func (db *KV) SweepExpired() (int, error) {
+	if db.features&FEATURE_EXPIRY == 0 {
+		return 0, ErrNoExpiry
+	}
+
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	keys := [][]byte{}
+	db.tree.Scan(nil, func(k, v []byte) bool {
+		if db.isTombstone(v) {
+			return true
+		}
+		if _, meta := db.decodeVal(v); db.expired(meta) {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		return true
+	})
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	err := db.update(func() {
+		for _, key := range keys {
+			db.deleteKey(key)
+		}
+	})
+	if err != nil {
+		return 0, fmt.Errorf("SweepExpired: %w", err)
+	}
+	db.counters.dels.Add(uint64(len(keys)))
+	return len(keys), nil
+}
+
+// a value past its expiry, which reads treat as absent
+func (db *KV) expired(meta valMeta) bool {
+	return meta.expires != 0 && db.now().UnixNano() >= meta.expires
+}
+
+// a stored value that reads as absent: a tombstone or an expired value
+func (db *KV) absent(stored []byte) bool {
+	if stored == nil || db.isTombstone(stored) {
+		return true
+	}
+	_, meta := db.decodeVal(stored)
+	return db.expired(meta)
+}
+
+// the current value of key for a read-modify-write, not found if it was deleted or expired.
+// the caller holds db.writer
+func (db *KV) lookupLive(key []byte) ([]byte, valMeta, bool) {
+	stored, ok := db.lookup(key)
+	if !ok {
+		return nil, valMeta{}, false
+	}
+	val, meta := db.decodeVal(stored)
+	if db.expired(meta) {
+		return nil, valMeta{}, false
+	}
+	return val, meta, true
+}
+
+// the metadata for a value computed from the current one of key: the flags and the expiry
+// carry over, where a plain write gets DefaultTTL from metaFor
+func (db *KV) metaKeep(key []byte, old valMeta) valMeta {
+	meta := db.metaFor(key, old.flags)
+	meta.expires = old.expires
+	return meta
+}
@@ -0,0 +1,222 @@
+package kvstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// a DB with Expiry and DefaultTTL on a clock the test moves with the returned func
+func openTTLDB(t *testing.T, ttl time.Duration) (*KV, func(time.Duration)) {
+	now := time.Unix(1_000_000, 0)
+	db := openTestDB(t, func(db *KV) {
+		db.Expiry = true
+		db.DefaultTTL = ttl
+		db.Clock = func() time.Time { return now }
+	})
+	return db, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestDefaultTTL(t *testing.T) {
+	db, advance := openTTLDB(t, time.Minute)
+	mustSet(t, db, "k", "v")
+	advance(59 * time.Second)
+	mustGet(t, db, "k", "v")
+	advance(time.Second)
+	mustMiss(t, db, "k")
+}
+
+func TestSetWithTTLOverridesDefault(t *testing.T) {
+	db, advance := openTTLDB(t, time.Minute)
+	if err := db.SetWithTTL([]byte("long"), []byte("v"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetWithTTL([]byte("never"), []byte("v"), 0); err != nil {
+		t.Fatal(err)
+	}
+	advance(30 * time.Minute)
+	mustGet(t, db, "long", "v")
+	mustGet(t, db, "never", "v")
+	advance(30 * time.Minute)
+	mustMiss(t, db, "long")
+	mustGet(t, db, "never", "v")
+}
+
+func TestModifyKeepsTTL(t *testing.T) {
+	db, advance := openTTLDB(t, time.Minute)
+	if err := db.SetWithTTL([]byte("k"), []byte("a"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	advance(30 * time.Minute)
+	err := db.Modify([]byte("k"), func(old []byte, existed bool) ([]byte, bool) {
+		return append(old, 'b'), false
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// past DefaultTTL from the Modify, but not past the hour of the SetWithTTL
+	advance(29 * time.Minute)
+	mustGet(t, db, "k", "ab")
+	advance(time.Minute)
+	mustMiss(t, db, "k")
+}
+
+func TestIncrBoundedKeepsTTL(t *testing.T) {
+	db, advance := openTTLDB(t, time.Minute)
+	if err := db.SetWithTTL([]byte("n"), make([]byte, 8), 0); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, ok, err := db.IncrBounded([]byte("n"), 1, 10); err != nil || !ok {
+			t.Fatalf("IncrBounded: %v %v", ok, err)
+		}
+		advance(time.Hour)
+	}
+	val, ok := db.Get([]byte("n"))
+	if !ok || binary.LittleEndian.Uint64(val) != 3 {
+		t.Fatalf("Get = %v %v, want 3", val, ok)
+	}
+}
+
+func TestExpiredIsAbsentForReadModifyWrite(t *testing.T) {
+	db, advance := openTTLDB(t, time.Minute)
+	var eight [8]byte
+	binary.LittleEndian.PutUint64(eight[:], 5)
+	if err := db.Set([]byte("n"), eight[:]); err != nil {
+		t.Fatal(err)
+	}
+	mustSet(t, db, "k", "old")
+	advance(time.Minute)
+
+	// the expired count restarts from 0, with a fresh DefaultTTL
+	if next, ok, err := db.IncrBounded([]byte("n"), 1, 10); err != nil || !ok || next != 1 {
+		t.Fatalf("IncrBounded = %d %v %v, want 1", next, ok, err)
+	}
+	err := db.Modify([]byte("k"), func(old []byte, existed bool) ([]byte, bool) {
+		if existed {
+			t.Errorf("Modify: expired value %q seen as existing", old)
+		}
+		return []byte("new"), false
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	advance(59 * time.Second)
+	mustGet(t, db, "k", "new")
+	advance(time.Second)
+	mustMiss(t, db, "k")
+	mustMiss(t, db, "n")
+}
+
+func TestTransformAllSkipsExpired(t *testing.T) {
+	db, advance := openTTLDB(t, time.Minute)
+	mustSet(t, db, "gone", "v")
+	advance(30 * time.Second)
+	mustSet(t, db, "live", "v")
+	advance(30 * time.Second)
+
+	seen := []string{}
+	err := db.TransformAll(func(k, v []byte) ([]byte, bool) {
+		seen = append(seen, string(k))
+		return append(v, '2'), true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 1 || seen[0] != "live" {
+		t.Fatalf("TransformAll saw %q, want only live", seen)
+	}
+	mustMiss(t, db, "gone")
+	mustGet(t, db, "live", "v2")
+	// the rewrite kept the expiry of the Set
+	advance(30 * time.Second)
+	mustMiss(t, db, "live")
+}
+
+func TestReadsSkipExpired(t *testing.T) {
+	db, advance := openTTLDB(t, time.Minute)
+	mustSet(t, db, "a", "v")
+	hot := db.HotKey([]byte("a"))
+	before := db.Snapshot()
+	defer before.Release()
+	advance(time.Minute)
+	after := db.Snapshot()
+	defer after.Release()
+
+	if _, ok := hot.Get(); ok {
+		t.Error("HotKey.Get found an expired key")
+	}
+	if _, ok, _ := before.Get([]byte("a")); ok {
+		t.Error("Snapshot.Get found an expired key")
+	}
+	if _, found, _ := db.SnapshotGetMany([][]byte{[]byte("a")}); found[0] {
+		t.Error("SnapshotGetMany found an expired key")
+	}
+	db.ScanLeaves(nil, func(leaf uint64, k, v []byte) bool {
+		if len(k) > 0 {
+			t.Errorf("ScanLeaves visited expired %q", k)
+		}
+		return true
+	})
+	db.ForEachUnordered(func(k, v []byte) bool {
+		if len(k) > 0 {
+			t.Errorf("ForEachUnordered visited expired %q", k)
+		}
+		return true
+	})
+	if _, _, ok, _ := db.GetTimes([]byte("a")); ok {
+		t.Error("GetTimes found an expired key")
+	}
+	if ok, err := db.Rename([]byte("a"), []byte("b")); ok || err != nil {
+		t.Errorf("Rename of an expired key = %v %v", ok, err)
+	}
+	if err := db.Diff(before, after, func(op byte, k, v []byte) bool {
+		t.Errorf("Diff reported %q for an expired key", k)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSweepExpired(t *testing.T) {
+	for _, tomb := range []bool{false, true} {
+		t.Run(fmt.Sprintf("tombstones=%v", tomb), func(t *testing.T) {
+			now := time.Unix(1_000_000, 0)
+			db := openTestDB(t, func(db *KV) {
+				db.Expiry, db.Tombstones = true, tomb
+				db.Clock = func() time.Time { return now }
+			})
+			for i := 0; i < 100; i++ {
+				if err := db.SetWithTTL([]byte(fmt.Sprintf("k%03d", i)), []byte("v"), time.Duration(i%2)*time.Minute); err != nil {
+					t.Fatal(err)
+				}
+			}
+			mustDel(t, db, "k001") // expires, but is already deleted
+			now = now.Add(time.Minute)
+
+			n, err := db.SweepExpired()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 49 {
+				t.Fatalf("SweepExpired = %d, want 49", n)
+			}
+			if n, err := db.SweepExpired(); err != nil || n != 0 {
+				t.Fatalf("second SweepExpired = %d, %v", n, err)
+			}
+			mustGet(t, db, "k000", "v")
+			mustMiss(t, db, "k001")
+			mustMiss(t, db, "k003")
+			if r := db.HealthCheck(); !r.OK() {
+				t.Fatalf("health check:\n%s", r)
+			}
+		})
+	}
+
+	db := openTestDB(t, nil)
+	if _, err := db.SweepExpired(); !errors.Is(err, ErrNoExpiry) {
+		t.Fatalf("SweepExpired without Expiry = %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+package kvstore
+
+import (
+	"fmt"
+	"kurocifer/LeichtKV/utils"
+)
+
+// Tx collects writes that are applied together as one atomic update, see KV.Update.
+type Tx struct {
+	db   *KV
+	ops  []txOp    // in the order they were made
+	keys *keyRange // the keys it may touch, nil for all. see UpdateRange
+}
+
+type txOp struct {
+	key []byte
+	val []byte
+	del bool
+}
+
+// Set stores val under key when the transaction commits.
+func (tx *Tx) Set(key []byte, val []byte) error {
+	if err := tx.checkKey(key); err != nil {
+		return err
+	}
+	// the real metadata is only known when applying, but it doesn't change the checks
+	if _, err := tx.db.encodeVal(val, valMeta{}); err != nil {
+		return err
+	}
+	tx.ops = append(tx.ops, txOp{key: append([]byte{}, key...), val: append([]byte{}, val...)})
+	return nil
+}
+
+// Del removes key when the transaction commits.
+func (tx *Tx) Del(key []byte) error {
+	if err := tx.checkKey(key); err != nil {
+		return err
+	}
+	tx.ops = append(tx.ops, txOp{key: append([]byte{}, key...), del: true})
+	return nil
+}
+
+// Get returns the value of key as the transaction sees it: its own pending Set or Del of the key
+// if it made one, the committed value otherwise. The DB can't change under a running transaction.
+func (tx *Tx) Get(key []byte) ([]byte, bool, error) {
+	if err := tx.checkKey(key); err != nil {
+		return nil, false, err
+	}
+	// the last write to the key wins
+	for i := len(tx.ops) - 1; i >= 0; i-- {
+		if op := tx.ops[i]; tx.db.compareKeys(op.key, key) == 0 {
+			return op.val, !op.del, nil
+		}
+	}
+
+	if tx.keys != nil {
+		// other range txs may be committing, only the range is protected
+		tx.db.writer.Lock()
+		defer tx.db.writer.Unlock()
+	}
+	stored, ok, err := tx.db.readLookup(key)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	val, meta := tx.db.decodeVal(stored)
+	if tx.db.expired(meta) {
+		return nil, false, nil
+	}
+	if tx.keys != nil {
+		val = append([]byte{}, val...)
+	}
+	return val, true, nil
+}
+
+func (tx *Tx) checkKey(key []byte) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	if tx.keys != nil && !tx.db.inRange(tx.keys, key) {
+		return fmt.Errorf("%w: %q", ErrOutOfRange, key)
+	}
+	return nil
+}
+
+// Update runs fn and applies the writes it made through tx as one atomic update.
+// Nothing is written if fn returns an error.
+func (db *KV) Update(fn func(tx *Tx) error) error {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	return db.runTx(fn, nil)
+}
+
+// run a transaction under db.writer. before, if not nil, runs inside the update ahead of the writes
+func (db *KV) runTx(fn func(tx *Tx) error, before func()) error {
+	tx := &Tx{db: db}
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	return db.update(func() {
+		if before != nil {
+			before()
+		}
+		tx.apply()
+	})
+}
+
+// make the writes, inside db.update
+func (tx *Tx) apply() {
+	for _, op := range tx.ops {
+		if op.del {
+			tx.db.deleteKey(op.key)
+			continue
+		}
+		stored, err := tx.db.encodeVal(op.val, tx.db.metaFor(op.key, 0))
+		utils.Assert(err == nil) // checked by Set
+		tx.db.tree.Insert(op.key, stored)
+	}
+}
+
+// SchemaVersion is the application schema version recorded in the master page by Migrate,
+// 0 for a new file.
+func (db *KV) SchemaVersion() int {
+	return int(db.schema)
+}
+
+// Migrate brings the data up to schema version currentVersion. migrations[v] upgrades the data
+// from version v-1 to v; each pending one runs in its own transaction, committed together with
+// the new version number, so a failure leaves the DB at the last completed version and
+// running Migrate again only runs what's left.
+func (db *KV) Migrate(currentVersion int, migrations map[int]func(*Tx) error) error {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	stored := int(db.schema)
+	if currentVersion < stored {
+		return fmt.Errorf("Migrate: the data is at schema version %d, newer than %d", stored, currentVersion)
+	}
+
+	for v := stored + 1; v <= currentVersion; v++ {
+		migrate, ok := migrations[v]
+		if !ok {
+			return fmt.Errorf("Migrate: no migration to version %d", v)
+		}
+		old := db.schema
+		err := db.runTx(migrate, func() {
+			db.schema = uint32(v)
+		})
+		if err != nil {
+			db.schema = old
+			return fmt.Errorf("Migrate: version %d: %w", v, err)
+		}
+	}
+	return nil
+}
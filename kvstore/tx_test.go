@@ -0,0 +1,174 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpdate(t *testing.T) {
+	for _, tombstones := range []bool{false, true} {
+		t.Run(fmt.Sprint("tombstones=", tombstones), func(t *testing.T) {
+			db := openTestDB(t, func(db *KV) { db.Tombstones = tombstones })
+			mustSet(t, db, "old", "v")
+
+			err := db.Update(func(tx *Tx) error {
+				if err := tx.Set([]byte("a"), []byte("1")); err != nil {
+					return err
+				}
+				if err := tx.Set([]byte("a"), []byte("2")); err != nil {
+					return err
+				}
+				return tx.Del([]byte("old"))
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			mustGet(t, db, "a", "2")
+			mustMiss(t, db, "old")
+
+			// nothing is written when fn fails
+			boom := errors.New("boom")
+			err = db.Update(func(tx *Tx) error {
+				tx.Set([]byte("b"), []byte("1"))
+				tx.Del([]byte("a"))
+				return boom
+			})
+			if !errors.Is(err, boom) {
+				t.Fatalf("Update = %v, want the error of fn", err)
+			}
+			mustMiss(t, db, "b")
+			mustGet(t, db, "a", "2")
+		})
+	}
+}
+
+func TestTxChecks(t *testing.T) {
+	db := openTestDB(t, nil)
+	db.Update(func(tx *Tx) error {
+		if err := tx.Set(make([]byte, 2000), []byte("v")); !errors.Is(err, ErrKeyTooLarge) {
+			t.Errorf("Set of an oversized key: %v", err)
+		}
+		if err := tx.Set([]byte("k"), make([]byte, 4000)); !errors.Is(err, ErrValueTooLarge) {
+			t.Errorf("Set of an oversized value: %v", err)
+		}
+		if err := tx.Del(nil); err == nil {
+			t.Error("Del of an empty key accepted")
+		}
+		return nil
+	})
+}
+
+func mustTxGet(t *testing.T, tx *Tx, key, want string, wantOK bool) {
+	t.Helper()
+	val, ok, err := tx.Get([]byte(key))
+	if err != nil || ok != wantOK || string(val) != want {
+		t.Fatalf("Tx.Get(%q) = %q %v %v, want %q %v", key, val, ok, err, want, wantOK)
+	}
+}
+
+func TestTxGet(t *testing.T) {
+	db := openTestDB(t, func(db *KV) { db.Tombstones = true })
+	mustSet(t, db, "a", "1")
+	mustSet(t, db, "b", "1")
+	mustSet(t, db, "gone", "1")
+	mustDel(t, db, "gone")
+
+	err := db.Update(func(tx *Tx) error {
+		mustTxGet(t, tx, "a", "1", true)
+		mustTxGet(t, tx, "gone", "", false) // a committed tombstone
+		mustTxGet(t, tx, "none", "", false)
+
+		tx.Set([]byte("a"), []byte("2"))
+		tx.Del([]byte("b"))
+		tx.Set([]byte("c"), []byte("3"))
+		tx.Del([]byte("c"))
+		tx.Set([]byte("c"), []byte("4"))
+		mustTxGet(t, tx, "a", "2", true)
+		mustTxGet(t, tx, "b", "", false)
+		mustTxGet(t, tx, "c", "4", true)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, db, "a", "2")
+	mustMiss(t, db, "b")
+	mustGet(t, db, "c", "4")
+}
+
+func TestTxGetNormalized(t *testing.T) {
+	db := openLowerDB(t)
+	mustSet(t, db, "Key", "1")
+	db.Update(func(tx *Tx) error {
+		mustTxGet(t, tx, "KEY", "1", true)
+		tx.Set([]byte("other"), []byte("2"))
+		mustTxGet(t, tx, "OTHER", "2", true)
+		tx.Del([]byte("KEY"))
+		mustTxGet(t, tx, "key", "", false)
+		return nil
+	})
+}
+
+func TestMigrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if v := db.SchemaVersion(); v != 0 {
+		t.Fatalf("new file at schema version %d", v)
+	}
+
+	ran := []int{}
+	step := func(v int) func(*Tx) error {
+		return func(tx *Tx) error {
+			ran = append(ran, v)
+			return tx.Set([]byte(fmt.Sprint("v", v)), []byte("done"))
+		}
+	}
+	boom := errors.New("boom")
+	migrations := map[int]func(*Tx) error{
+		1: step(1),
+		2: step(2),
+		3: func(tx *Tx) error {
+			tx.Set([]byte("v3"), []byte("partial"))
+			return boom
+		},
+	}
+	if err := db.Migrate(3, migrations); !errors.Is(err, boom) {
+		t.Fatalf("Migrate = %v, want the failing migration's error", err)
+	}
+	if v := db.SchemaVersion(); v != 2 || len(ran) != 2 {
+		t.Fatalf("schema version %d after running %v, want 2", v, ran)
+	}
+	mustGet(t, db, "v2", "done")
+	mustMiss(t, db, "v3")
+	db.Close()
+
+	// the version survives a reopen, and only the pending migrations run
+	db = &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if v := db.SchemaVersion(); v != 2 {
+		t.Fatalf("schema version %d after reopening, want 2", v)
+	}
+	migrations[3] = step(3)
+	if err := db.Migrate(3, migrations); err != nil {
+		t.Fatal(err)
+	}
+	if v := db.SchemaVersion(); v != 3 || len(ran) != 3 || ran[2] != 3 {
+		t.Fatalf("schema version %d after running %v, want 3", v, ran)
+	}
+	mustGet(t, db, "v3", "done")
+
+	if err := db.Migrate(2, migrations); err == nil {
+		t.Error("Migrate to an older version accepted")
+	}
+	if err := db.Migrate(5, migrations); err == nil || db.SchemaVersion() != 3 {
+		t.Errorf("Migrate without a migration to 4: %v, at version %d", err, db.SchemaVersion())
+	}
+}
@@ -0,0 +1,550 @@
+package kvstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"kurocifer/LeichtKV/btree"
+	"math"
+)
+
+var ErrKeyExists = errors.New("key already exists")
+
+// Rename moves the value (and its flags) from oldKey to newKey in a single atomic update.
+// Returns false if oldKey doesn't exist, and ErrKeyExists if newKey does.
+func (db *KV) Rename(oldKey, newKey []byte) (bool, error) {
+	if err := checkKey(newKey); err != nil {
+		return false, fmt.Errorf("Rename: %w", err)
+	}
+
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	stored, ok := db.lookup(oldKey)
+	if !ok || db.absent(stored) {
+		return false, nil
+	}
+	if bytes.Equal(oldKey, newKey) {
+		return true, nil
+	}
+	// keys equal once normalized are the same entry, the insert only changes its stored bytes
+	same := db.compareKeys(oldKey, newKey) == 0
+	if _, _, ok := db.lookupLive(newKey); ok && !same {
+		return false, ErrKeyExists
+	}
+
+	stored = append([]byte{}, stored...)
+	err := db.update(func() {
+		db.tree.Insert(newKey, stored)
+		if !same {
+			db.deleteKey(oldKey)
+		}
+	})
+	return err == nil, err
+}
+
+// IncrBounded adds delta to the int64 stored at key (8 bytes, little endian, missing counts as 0),
+// but only if the result stays <= max and doesn't overflow. Returns the resulting value and whether
+// it was applied; when it wasn't, the value is the current one.
+func (db *KV) IncrBounded(key []byte, delta, max int64) (int64, bool, error) {
+	if err := checkKey(key); err != nil {
+		return 0, false, fmt.Errorf("IncrBounded: %w", err)
+	}
+
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	cur, meta := int64(0), db.metaFor(key, 0)
+	if val, old, ok := db.lookupLive(key); ok {
+		meta = db.metaKeep(key, old)
+		if len(val) != 8 {
+			return 0, false, fmt.Errorf("IncrBounded: value of %d bytes is not an int64", len(val))
+		}
+		cur = int64(binary.LittleEndian.Uint64(val))
+	}
+
+	if (delta > 0 && cur > math.MaxInt64-delta) || (delta < 0 && cur < math.MinInt64-delta) {
+		return cur, false, nil // would overflow
+	}
+	next := cur + delta
+	if next > max {
+		return cur, false, nil
+	}
+
+	var val [8]byte
+	binary.LittleEndian.PutUint64(val[:], uint64(next))
+	stored, err := db.encodeVal(val[:], meta)
+	if err != nil {
+		return cur, false, err
+	}
+	if err := db.update(func() { db.tree.Insert(key, stored) }); err != nil {
+		return cur, false, err
+	}
+	return next, true, nil
+}
+
+// Modify replaces the value of key with what fn makes of the current one, or deletes the key
+// when fn says so. The read and the write happen under the writer lock, so nothing can change
+// the key in between. Values keep their flags.
+func (db *KV) Modify(key []byte, fn func(old []byte, existed bool) (val []byte, del bool)) error {
+	if err := checkKey(key); err != nil {
+		return fmt.Errorf("Modify: %w", err)
+	}
+
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	old, meta, existed := db.lookupLive(key)
+	if existed {
+		old, meta = append([]byte{}, old...), db.metaKeep(key, meta)
+	} else {
+		meta = db.metaFor(key, 0)
+	}
+
+	val, del := fn(old, existed)
+	if del {
+		if !existed {
+			return nil
+		}
+		return db.update(func() { db.deleteKey(key) })
+	}
+
+	stored, err := db.encodeVal(val, meta)
+	if err != nil {
+		return fmt.Errorf("Modify: %w", err)
+	}
+	return db.update(func() { db.tree.Insert(key, stored) })
+}
+
+// TransformAll rewrites every value through fn, deleting the key when keep is false.
+// All the changes are committed as one atomic update, so a crash leaves either the old
+// or the new data. The pending pages of the whole rewrite are held in memory until the flush.
+func (db *KV) TransformAll(fn func(k, v []byte) (newV []byte, keep bool)) error {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	type change struct {
+		key    []byte
+		stored []byte // nil to delete
+	}
+	changes := []change{}
+
+	var err error
+	db.tree.Scan(nil, func(k, v []byte) bool {
+		if db.isTombstone(v) {
+			return true
+		}
+		val, meta := db.decodeVal(v)
+		if db.expired(meta) {
+			return true // left for SweepExpired
+		}
+		newV, keep := fn(k, val)
+
+		c := change{key: append([]byte{}, k...)}
+		if keep {
+			if c.stored, err = db.encodeVal(newV, db.metaKeep(k, meta)); err != nil {
+				return false
+			}
+			c.stored = append([]byte{}, c.stored...)
+		}
+		changes = append(changes, c)
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("TransformAll: %w", err)
+	}
+
+	return db.update(func() {
+		for _, c := range changes {
+			if c.stored != nil {
+				db.tree.Insert(c.key, c.stored)
+			} else {
+				db.deleteKey(c.key)
+			}
+		}
+	})
+}
+
+// Clear empties the DB without closing or deleting the file. The empty tree is committed first,
+// then every page but the master goes to the free list, so a crash in between only leaves
+// an unreferenced tail that the next Open reclaims.
+func (db *KV) Clear() error {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	if db.ReadOnly {
+		return ErrReadOnly
+	}
+	if db.drain.snaps > 0 {
+		return errors.New("Clear: snapshots are open")
+	}
+
+	// the master page needs a whole page even if nothing was ever written
+	if err := extendFile(db, 1); err != nil {
+		return fmt.Errorf("Clear: %w", err)
+	}
+
+	root, head, flushed := db.tree.Root, db.free.Head(), db.page.flushed
+	rollback(db, 0, 0) // drop anything pending, and the free list with the rest of the file
+	deferred := db.drain.deferred
+	db.drain.deferred = nil
+	db.page.flushed = 1
+	if err := masterStore(db); err != nil {
+		db.tree.Root, db.page.flushed = root, flushed
+		db.free.SetHead(head)
+		db.drain.deferred = deferred
+		return fmt.Errorf("Clear: %w", err)
+	}
+	db.gen++
+	db.pinRefresh()
+	db.bloomBuild()
+
+	if err := reclaimTail(db); err != nil {
+		return fmt.Errorf("Clear: %w", err)
+	}
+	return nil
+}
+
+// DeletePrefix deletes every key starting with prefix as one atomic update and returns how many
+// were deleted. The empty prefix matches every key, so it empties the DB; unlike Clear, the file
+// keeps its size and the pages go to the free list. With Tombstones, each key leaves a tombstone.
+func (db *KV) DeletePrefix(prefix []byte) (int, error) {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	// collect first, the leaves can't be read while the tree is being changed
+	keys := [][]byte{}
+	db.ScanPrefix(prefix, func(k, v []byte) bool {
+		keys = append(keys, append([]byte{}, k...))
+		return true
+	})
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	if err := db.update(func() {
+		for _, key := range keys {
+			db.deleteKey(key)
+		}
+	}); err != nil {
+		return 0, fmt.Errorf("DeletePrefix: %w", err)
+	}
+	db.counters.dels.Add(uint64(len(keys)))
+	return len(keys), nil
+}
+
+// SeedIfEmpty writes pairs as one atomic update if the DB has no keys, and reports whether it did.
+// The check and the writes happen under the writer lock, so two processes or goroutines seeding
+// the same DB can't both do it. pairs needn't be sorted; a later pair wins over an earlier one.
+func (db *KV) SeedIfEmpty(pairs []KVPair) (bool, error) {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	// a tree emptied by deletes keeps its root, with only the sentinel or tombstones
+	empty := true
+	db.scan(nil, func(k, v []byte) bool {
+		empty = false
+		return false
+	})
+	if !empty {
+		return false, nil
+	}
+
+	stored := make([][]byte, len(pairs))
+	for i, p := range pairs {
+		if err := checkKey(p.Key); err != nil {
+			return false, fmt.Errorf("SeedIfEmpty: %w", err)
+		}
+		var err error
+		if stored[i], err = db.encodeVal(p.Val, db.metaFor(p.Key, 0)); err != nil {
+			return false, fmt.Errorf("SeedIfEmpty: %w", err)
+		}
+	}
+	if len(pairs) == 0 {
+		return false, nil
+	}
+
+	if err := db.update(func() {
+		for i, p := range pairs {
+			db.tree.Insert(p.Key, stored[i])
+		}
+	}); err != nil {
+		return false, fmt.Errorf("SeedIfEmpty: %w", err)
+	}
+	db.counters.sets.Add(uint64(len(pairs)))
+	return true, nil
+}
+
+// CompactFreeList repacks the free list into as few pages as can hold it, in one update.
+// The pages it frees up stay free; the file doesn't shrink. See FreeList.Compact.
+func (db *KV) CompactFreeList() error {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	if err := db.update(func() {
+		db.free.Compact()
+	}); err != nil {
+		return fmt.Errorf("CompactFreeList: %w", err)
+	}
+	return nil
+}
+
+// LoadSorted bulk loads an empty DB from pairs sorted by key, in one atomic update.
+// The order is that of the normalized keys when there is a NormalizeKey.
+// fill, between 0.5 and 1, is how full each page is packed: 1 makes the smallest tree,
+// but then the first insert anywhere splits a page.
+func (db *KV) LoadSorted(pairs []KVPair, fill float64) error {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	if !(0.5 <= fill && fill <= 1) {
+		return fmt.Errorf("LoadSorted: fill factor %v is not in [0.5, 1]", fill)
+	}
+	// a tree emptied by deletes keeps its root, with only the sentinel
+	empty := true
+	db.tree.Scan(nil, func(k, v []byte) bool {
+		empty = false
+		return false
+	})
+	if !empty {
+		return errors.New("LoadSorted: the DB is not empty")
+	}
+
+	keys, vals, err := db.encodeSorted(pairs)
+	if err != nil {
+		return fmt.Errorf("LoadSorted: %w", err)
+	}
+	return db.update(func() {
+		db.tree.LoadSorted(keys, vals, fill)
+		db.bloomAddAll() // a bulk load doesn't go through Insert
+	})
+}
+
+// check pairs for a bulk load and encode their values
+func (db *KV) encodeSorted(pairs []KVPair) (keys, vals [][]byte, err error) {
+	keys = make([][]byte, len(pairs))
+	vals = make([][]byte, len(pairs))
+	for i, p := range pairs {
+		if err := checkKey(p.Key); err != nil {
+			return nil, nil, err
+		}
+		if i > 0 && db.compareKeys(pairs[i-1].Key, p.Key) >= 0 {
+			return nil, nil, errors.New("keys are not sorted and unique")
+		}
+		stored, err := db.encodeVal(p.Val, db.metaFor(p.Key, 0))
+		if err != nil {
+			return nil, nil, err
+		}
+		keys[i], vals[i] = p.Key, stored
+	}
+	return keys, vals, nil
+}
+
+// BuildTree writes a tree holding pairs, sorted by key, into the file without making it visible,
+// and returns its root for SwapRoot. The DB keeps serving the current tree meanwhile.
+// The built tree survives a reopen; one that won't be swapped in must be given back with DropTree,
+// or its pages stay lost until an unclean Open finds them. On error nothing is kept.
+func (db *KV) BuildTree(pairs []KVPair, fill float64) (uint64, error) {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	if !(0.5 <= fill && fill <= 1) {
+		return 0, fmt.Errorf("BuildTree: fill factor %v is not in [0.5, 1]", fill)
+	}
+	if len(pairs) == 0 {
+		return 0, errors.New("BuildTree: no pairs, use Clear to empty the DB")
+	}
+	keys, vals, err := db.encodeSorted(pairs)
+	if err != nil {
+		return 0, fmt.Errorf("BuildTree: %w", err)
+	}
+
+	// a second tree on the same pages, the master still points to the current root
+	side := db.tree
+	side.Root = 0
+	err = db.update(func() {
+		side.LoadSorted(keys, vals, fill)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("BuildTree: %w", err)
+	}
+	return side.Root, nil
+}
+
+// SwapRoot atomically replaces the whole dataset with the tree at newRoot (see BuildTree)
+// by rewriting the root in the master page. The new tree is validated first, which reads all of it,
+// and must not share a page with the current tree or the free list. The pages of the old tree are freed.
+func (db *KV) SwapRoot(newRoot uint64) error {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	if newRoot == db.tree.Root && newRoot != 0 {
+		return nil
+	}
+	if _, err := db.sideTree(newRoot); err != nil {
+		return fmt.Errorf("SwapRoot: %w", err)
+	}
+
+	// collect first, a freed page can't be read anymore
+	old := []uint64{}
+	db.tree.RangePages(nil, nil, func(ptr uint64) {
+		old = append(old, ptr)
+	})
+	if err := db.update(func() {
+		for _, ptr := range old {
+			db.tree.Del(ptr)
+		}
+		db.tree.Root = newRoot
+		db.bloomAddAll()
+	}); err != nil {
+		return fmt.Errorf("SwapRoot: %w", err)
+	}
+	db.bloomBuild() // drop the keys of the old tree
+	return nil
+}
+
+// DropTree frees the pages of a tree from BuildTree that won't be swapped in, in one update.
+// It is checked like in SwapRoot, so the current tree or a tree already freed can't be dropped.
+func (db *KV) DropTree(root uint64) error {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	side, err := db.sideTree(root)
+	if err != nil {
+		return fmt.Errorf("DropTree: %w", err)
+	}
+	pages := []uint64{}
+	side.RangePages(nil, nil, func(ptr uint64) {
+		pages = append(pages, ptr)
+	})
+	if err := db.update(func() {
+		for _, ptr := range pages {
+			db.tree.Del(ptr)
+		}
+	}); err != nil {
+		return fmt.Errorf("DropTree: %w", err)
+	}
+	return nil
+}
+
+// the tree at root, a tree built next to the current one: it must be valid, which reads all of it,
+// and must not share a page with the current tree or the free list, or freeing it or swapping it in
+// would free or reuse that page. the caller holds db.writer
+func (db *KV) sideTree(root uint64) (btree.BTree, error) {
+	if root == 0 || root >= db.page.flushed {
+		return btree.BTree{}, fmt.Errorf("bad root %d", root)
+	}
+	side := db.tree
+	side.Root = root
+	if err := side.Validate(); err != nil {
+		return btree.BTree{}, fmt.Errorf("not a valid tree: %w", err)
+	}
+
+	owner := map[uint64]string{}
+	db.tree.RangePages(nil, nil, func(ptr uint64) {
+		owner[ptr] = "the current tree"
+	})
+	db.free.Walk(func(ptr uint64, node bool) {
+		owner[ptr] = "the free list"
+	})
+	var err error
+	side.RangePages(nil, nil, func(ptr uint64) {
+		if who, ok := owner[ptr]; ok && err == nil {
+			err = fmt.Errorf("page %d is part of %s", ptr, who)
+		}
+	})
+	return side, err
+}
+
+// CompactRange repacks the pages holding the keys in [start, end) densely, for a range that has
+// churned, as one atomic update. The rest of the tree is kept, only the smallest subtree covering
+// the range and the path to it are rewritten. A nil end means no upper bound.
+func (db *KV) CompactRange(start, end []byte) error {
+	if end != nil && db.compareKeys(start, end) > 0 {
+		return errors.New("CompactRange: start is after end")
+	}
+
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	if err := db.update(func() {
+		db.tree.CompactRange(start, end)
+	}); err != nil {
+		return fmt.Errorf("CompactRange: %w", err)
+	}
+	return nil
+}
+
+// ApplyDiff applies a sorted list of upserts and a sorted list of deletes as one atomic update.
+// The two lists must each be strictly increasing and must not share keys.
+// They are merged into the tree in a single pass, each page they touch is rewritten once.
+func (db *KV) ApplyDiff(upserts []KVPair, deletes [][]byte) error {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	for i := 1; i < len(upserts); i++ {
+		if db.compareKeys(upserts[i-1].Key, upserts[i].Key) >= 0 {
+			return errors.New("ApplyDiff: upserts are not sorted and unique")
+		}
+	}
+	for i := 1; i < len(deletes); i++ {
+		if db.compareKeys(deletes[i-1], deletes[i]) >= 0 {
+			return errors.New("ApplyDiff: deletes are not sorted and unique")
+		}
+	}
+	for _, key := range deletes {
+		if err := checkKey(key); err != nil {
+			return fmt.Errorf("ApplyDiff: %w", err)
+		}
+	}
+
+	stored := make([][]byte, len(upserts))
+	for i, p := range upserts {
+		if err := checkKey(p.Key); err != nil {
+			return fmt.Errorf("ApplyDiff: %w", err)
+		}
+		var err error
+		if stored[i], err = db.encodeVal(p.Val, db.metaFor(p.Key, 0)); err != nil {
+			return fmt.Errorf("ApplyDiff: %w", err)
+		}
+	}
+	// merge the lists, checking they are disjoint before touching the tree
+	ops := make([]btree.Op, 0, len(upserts)+len(deletes))
+	for i, j := 0, 0; i < len(upserts) || j < len(deletes); {
+		cmp := -1
+		if i == len(upserts) {
+			cmp = 1
+		} else if j < len(deletes) {
+			cmp = db.compareKeys(upserts[i].Key, deletes[j])
+		}
+		switch {
+		case cmp < 0:
+			ops = append(ops, btree.Op{Key: upserts[i].Key, Val: stored[i]})
+			i++
+		case cmp > 0:
+			ops = append(ops, btree.Op{Key: deletes[j], Del: true})
+			j++
+		default:
+			return fmt.Errorf("ApplyDiff: key %q is both upserted and deleted", deletes[j])
+		}
+	}
+
+	return db.update(func() {
+		if db.features&FEATURE_TOMBSTONES != 0 {
+			// the deletes of keys that exist leave tombstones, the others do nothing
+			kept := ops[:0]
+			for _, op := range ops {
+				if op.Del {
+					if _, ok := db.lookup(op.Key); !ok {
+						continue
+					}
+					op = btree.Op{Key: op.Key, Val: db.tombstone()}
+				}
+				kept = append(kept, op)
+			}
+			ops = kept
+		}
+		db.tree.Apply(ops)
+	})
+}
@@ -0,0 +1,756 @@
+package kvstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"kurocifer/LeichtKV/btree"
+	"kurocifer/LeichtKV/freelist"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestRename(t *testing.T) {
+	db := openTestDB(t, func(db *KV) { db.ValueFlags = true })
+	if err := db.SetWithFlags([]byte("old"), []byte("v"), 7); err != nil {
+		t.Fatal(err)
+	}
+	mustSet(t, db, "taken", "t")
+
+	if ok, err := db.Rename([]byte("missing"), []byte("x")); ok || err != nil {
+		t.Errorf("Rename of a missing key = %v %v", ok, err)
+	}
+	if ok, err := db.Rename([]byte("old"), []byte("taken")); ok || !errors.Is(err, ErrKeyExists) {
+		t.Errorf("Rename onto an existing key = %v %v", ok, err)
+	}
+	mustGet(t, db, "taken", "t")
+	if ok, err := db.Rename([]byte("old"), []byte("old")); !ok || err != nil {
+		t.Errorf("Rename to itself = %v %v", ok, err)
+	}
+
+	if ok, err := db.Rename([]byte("old"), []byte("new")); !ok || err != nil {
+		t.Fatalf("Rename = %v %v", ok, err)
+	}
+	mustMiss(t, db, "old")
+	val, flags, ok, _ := db.GetWithFlags([]byte("new"))
+	if !ok || string(val) != "v" || flags != 7 {
+		t.Errorf("renamed to %q %#x %v", val, flags, ok)
+	}
+}
+
+func TestRenameFailedCommit(t *testing.T) {
+	db := openTestDB(t, nil)
+	mustSet(t, db, "old", "v")
+
+	// neither half of a failed rename lands
+	failMasterWrites(t, syscall.EIO)
+	if ok, err := db.Rename([]byte("old"), []byte("new")); ok || err == nil {
+		t.Fatalf("Rename with a failing commit = %v %v", ok, err)
+	}
+	mustGet(t, db, "old", "v")
+	mustMiss(t, db, "new")
+}
+
+func TestIncrBounded(t *testing.T) {
+	db := openTestDB(t, nil)
+	key := []byte("n")
+
+	if next, ok, err := db.IncrBounded(key, 5, 5); err != nil || !ok || next != 5 {
+		t.Fatalf("IncrBounded to the limit = %d %v %v, want 5", next, ok, err)
+	}
+	if next, ok, err := db.IncrBounded(key, 1, 5); err != nil || ok || next != 5 {
+		t.Fatalf("IncrBounded past the limit = %d %v %v, want 5 not applied", next, ok, err)
+	}
+	if next, ok, err := db.IncrBounded(key, -10, 5); err != nil || !ok || next != -5 {
+		t.Fatalf("IncrBounded down = %d %v %v, want -5", next, ok, err)
+	}
+}
+
+func TestIncrBoundedOverflow(t *testing.T) {
+	db := openTestDB(t, nil)
+	up, down := []byte("up"), []byte("down")
+
+	if _, ok, _ := db.IncrBounded(up, math.MaxInt64, math.MaxInt64); !ok {
+		t.Fatal("IncrBounded to MaxInt64 not applied")
+	}
+	if next, ok, err := db.IncrBounded(up, 1, math.MaxInt64); err != nil || ok || next != math.MaxInt64 {
+		t.Fatalf("IncrBounded past MaxInt64 = %d %v %v", next, ok, err)
+	}
+
+	if _, ok, _ := db.IncrBounded(down, math.MinInt64, math.MaxInt64); !ok {
+		t.Fatal("IncrBounded to MinInt64 not applied")
+	}
+	if next, ok, err := db.IncrBounded(down, -1, math.MaxInt64); err != nil || ok || next != math.MinInt64 {
+		t.Fatalf("IncrBounded past MinInt64 = %d %v %v", next, ok, err)
+	}
+	if next, ok, err := db.IncrBounded(down, math.MinInt64, math.MaxInt64); err != nil || ok || next != math.MinInt64 {
+		t.Fatalf("IncrBounded by MinInt64 from MinInt64 = %d %v %v", next, ok, err)
+	}
+}
+
+func TestModify(t *testing.T) {
+	for _, tomb := range []bool{false, true} {
+		t.Run(fmt.Sprintf("tombstones=%v", tomb), func(t *testing.T) {
+			db := openTestDB(t, func(db *KV) { db.Tombstones = tomb; db.ValueFlags = true })
+			appendX := func(old []byte, existed bool) ([]byte, bool) {
+				return append(old, 'x'), false
+			}
+
+			// a missing key is created from nothing
+			if err := db.Modify([]byte("k"), func(old []byte, existed bool) ([]byte, bool) {
+				if existed || old != nil {
+					t.Errorf("missing key seen as %q, %v", old, existed)
+				}
+				return []byte("v"), false
+			}); err != nil {
+				t.Fatal(err)
+			}
+			mustGet(t, db, "k", "v")
+
+			// an update sees the current value and keeps the flags
+			if err := db.SetWithFlags([]byte("f"), []byte("v"), 7); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Modify([]byte("f"), appendX); err != nil {
+				t.Fatal(err)
+			}
+			if val, flags, ok, err := db.GetWithFlags([]byte("f")); err != nil || !ok || string(val) != "vx" || flags != 7 {
+				t.Fatalf("GetWithFlags = %q, %d, %v, %v", val, flags, ok, err)
+			}
+
+			// a delete
+			if err := db.Modify([]byte("k"), func(old []byte, existed bool) ([]byte, bool) {
+				if !existed || string(old) != "v" {
+					t.Errorf("key seen as %q, %v", old, existed)
+				}
+				return nil, true
+			}); err != nil {
+				t.Fatal(err)
+			}
+			mustMiss(t, db, "k")
+
+			// the deleted key, tombstone or not, is missing again, and deleting it is a no-op
+			seq := db.Seq()
+			if err := db.Modify([]byte("k"), func(old []byte, existed bool) ([]byte, bool) {
+				if existed || old != nil {
+					t.Errorf("deleted key seen as %q, %v", old, existed)
+				}
+				return nil, true
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if db.Seq() != seq {
+				t.Fatal("deleting a missing key committed an update")
+			}
+			if err := db.Modify([]byte("k"), appendX); err != nil {
+				t.Fatal(err)
+			}
+			mustGet(t, db, "k", "x")
+		})
+	}
+}
+
+func TestModifyFailedCommit(t *testing.T) {
+	db := openTestDB(t, nil)
+	mustSet(t, db, "k", "v")
+	failMasterWrites(t, syscall.EIO)
+	if err := db.Modify([]byte("k"), func(old []byte, existed bool) ([]byte, bool) {
+		return nil, true
+	}); err == nil {
+		t.Fatal("Modify succeeded with a failing master write")
+	}
+	mustGet(t, db, "k", "v")
+}
+
+func TestSeedIfEmpty(t *testing.T) {
+	for _, tombstones := range []bool{false, true} {
+		t.Run(fmt.Sprint("tombstones=", tombstones), func(t *testing.T) {
+			db := openTestDB(t, func(db *KV) { db.Tombstones = tombstones })
+			seed := []KVPair{{[]byte("a"), []byte("1")}, {[]byte("a"), []byte("2")}}
+
+			if ok, err := db.SeedIfEmpty(nil); err != nil || ok {
+				t.Fatalf("SeedIfEmpty of nothing = %v %v", ok, err)
+			}
+			if ok, err := db.SeedIfEmpty(seed); err != nil || !ok {
+				t.Fatalf("SeedIfEmpty on a new DB = %v %v", ok, err)
+			}
+			mustGet(t, db, "a", "2")
+			if ok, err := db.SeedIfEmpty(seed); err != nil || ok {
+				t.Fatalf("SeedIfEmpty on a DB with keys = %v %v", ok, err)
+			}
+
+			// deleting every key leaves a root holding only the sentinel or a tombstone, still empty
+			mustDel(t, db, "a")
+			if ok, err := db.SeedIfEmpty([]KVPair{{[]byte("b"), []byte("3")}}); err != nil || !ok {
+				t.Fatalf("SeedIfEmpty after deleting every key = %v %v", ok, err)
+			}
+			mustGet(t, db, "b", "3")
+
+			// nothing is written when a pair is bad
+			mustDel(t, db, "b")
+			bad := []KVPair{{[]byte("c"), []byte("4")}, {nil, []byte("5")}}
+			if ok, err := db.SeedIfEmpty(bad); err == nil || ok {
+				t.Fatalf("SeedIfEmpty with an empty key = %v %v", ok, err)
+			}
+			mustMiss(t, db, "c")
+		})
+	}
+}
+
+func TestTransformAll(t *testing.T) {
+	db := openTestDB(t, func(db *KV) { db.ValueFlags = true })
+	for i := 0; i < 300; i++ {
+		if err := db.SetWithFlags([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprint(i)), byte(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// change the even values, drop the odd keys
+	err := db.TransformAll(func(k, v []byte) ([]byte, bool) {
+		n, _ := strconv.Atoi(string(v))
+		return []byte(fmt.Sprint(2 * n)), n%2 == 0
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		if i%2 == 1 {
+			mustMiss(t, db, key)
+			continue
+		}
+		val, flags, ok, _ := db.GetWithFlags([]byte(key))
+		if !ok || string(val) != fmt.Sprint(2*i) || flags != byte(i) {
+			t.Fatalf("%s = %q %#x %v after the transform", key, val, flags, ok)
+		}
+	}
+}
+
+func TestTransformAllDoublesValues(t *testing.T) {
+	db := openTestDB(t, nil)
+	const n = 300
+	for i := 0; i < n; i++ {
+		mustSet(t, db, fmt.Sprintf("key%04d", i), strings.Repeat(string(rune('a'+i%26)), 8))
+	}
+	leaves := db.tree.Stats().Leaves
+
+	// each pass doubles every value, from 8 bytes up to 1KB, so the leaves keep splitting
+	for pass, size := 1, 16; size <= 1024; pass, size = pass+1, 2*size {
+		err := db.TransformAll(func(k, v []byte) ([]byte, bool) {
+			return append(append([]byte{}, v...), v...), true
+		})
+		if err != nil {
+			t.Fatalf("pass %d: %v", pass, err)
+		}
+		for i := 0; i < n; i++ {
+			mustGet(t, db, fmt.Sprintf("key%04d", i), strings.Repeat(string(rune('a'+i%26)), size))
+		}
+		if err := db.Validate(); err != nil {
+			t.Fatalf("pass %d: %v", pass, err)
+		}
+	}
+	if got := db.tree.Stats().Leaves; got < 64*leaves {
+		t.Errorf("%d leaves after growing the values 128 times, %d before", got, leaves)
+	}
+}
+
+func TestTransformAllFailedCommit(t *testing.T) {
+	db := openTestDB(t, nil)
+	for i := 0; i < 100; i++ {
+		mustSet(t, db, fmt.Sprintf("key%04d", i), "old")
+	}
+
+	failMasterWrites(t, syscall.EIO)
+	err := db.TransformAll(func(k, v []byte) ([]byte, bool) { return []byte("new"), true })
+	if err == nil {
+		t.Fatal("TransformAll with a failing commit")
+	}
+	for i := 0; i < 100; i++ {
+		mustGet(t, db, fmt.Sprintf("key%04d", i), "old")
+	}
+}
+
+func TestClear(t *testing.T) {
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db")}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2000; i++ {
+		mustSet(t, db, fmt.Sprintf("key%06d", i), "v")
+	}
+	size := db.mmap.file
+
+	if err := db.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if n := db.Len(); n != 0 {
+		t.Fatalf("Len = %d after Clear", n)
+	}
+	if n := db.Stats().Keys; n != 0 {
+		t.Fatalf("%d keys after Clear", n)
+	}
+	mustMiss(t, db, "key000000")
+	if len(freeSet(db)) == 0 {
+		t.Fatal("no pages on the free list after Clear")
+	}
+
+	// the cleared pages take the new writes, and it all survives a reopen
+	for i := 0; i < 2000; i++ {
+		mustSet(t, db, fmt.Sprintf("new%06d", i), "v")
+	}
+	if db.mmap.file != size {
+		t.Errorf("file grown from %d to %d bytes", size, db.mmap.file)
+	}
+	db.Close()
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if n := db.Stats().Keys; n != 2000 {
+		t.Fatalf("%d keys after reopening, want 2000", n)
+	}
+	mustMiss(t, db, "key000000")
+	mustGet(t, db, "new001999", "v")
+}
+
+func TestClearFailedCommit(t *testing.T) {
+	db := openTestDB(t, nil)
+	mustSet(t, db, "k", "v")
+
+	failMasterWrites(t, syscall.EIO)
+	if err := db.Clear(); err == nil {
+		t.Fatal("Clear with a failing commit succeeded")
+	}
+	mustGet(t, db, "k", "v")
+	mustSet(t, db, "k2", "v2")
+	mustGet(t, db, "k2", "v2")
+}
+
+// rewrite the free list as nodes of size pointers each, in one update, as many small updates
+// could leave it. the old nodes' pages are listed like Compact lists them
+func fragmentFreeList(t *testing.T, db *KV, size int) {
+	t.Helper()
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	err := db.update(func() {
+		items := []uint64{}
+		db.free.Walk(func(ptr uint64, node bool) { items = append(items, ptr) })
+		total, head := len(items), uint64(0)
+		for len(items) > 0 {
+			n := min(size, len(items))
+			node := btree.BNode{Data: make([]byte, btree.BTREE_PAGE_SIZE)}
+			binary.LittleEndian.PutUint16(node.Data[0:], freelist.BNODE_FREE_LIST)
+			binary.LittleEndian.PutUint16(node.Data[2:], uint16(n))
+			binary.LittleEndian.PutUint64(node.Data[12:], head)
+			for i, ptr := range items[:n] {
+				binary.LittleEndian.PutUint64(node.Data[freelist.FREE_LIST_HEADER+8*i:], ptr)
+			}
+			items = items[n:]
+			head = db.free.New(node)
+		}
+		binary.LittleEndian.PutUint64(db.free.Get(head).Data[4:], uint64(total))
+		db.free.SetHead(head)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func freeNodes(db *KV) int {
+	nodes := 0
+	db.free.Walk(func(ptr uint64, node bool) {
+		if node {
+			nodes++
+		}
+	})
+	return nodes
+}
+
+func TestCompactFreeList(t *testing.T) {
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db")}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2000; i++ {
+		mustSet(t, db, fmt.Sprintf("key%06d", i), strings.Repeat("v", 200))
+	}
+	for i := 0; i < 2000; i += 4 {
+		mustDel(t, db, fmt.Sprintf("key%06d", i))
+	}
+	fragmentFreeList(t, db, 5)
+	before := freeSet(db)
+	if nodes := freeNodes(db); nodes < len(before)/6 {
+		t.Fatalf("%d free list nodes for %d pages before compacting", nodes, len(before))
+	}
+
+	if err := db.CompactFreeList(); err != nil {
+		t.Fatal(err)
+	}
+	// the same pages are accounted for, by the fewest nodes that hold them
+	after := freeSet(db)
+	if len(after) != len(before) {
+		t.Fatalf("%d pages on the free list, was %d", len(after), len(before))
+	}
+	if nodes, want := freeNodes(db), (len(after)+freelist.FREE_LIST_CAP)/(freelist.FREE_LIST_CAP+1); nodes != want {
+		t.Fatalf("%d free list nodes for %d pages, want %d", nodes, len(after), want)
+	}
+	if leaked := db.PageLeakReport(); len(leaked) != 0 {
+		t.Fatalf("leaked pages %v", leaked)
+	}
+	// a dense list is left alone
+	if err := db.CompactFreeList(); err != nil {
+		t.Fatal(err)
+	}
+	if got := freeSet(db); len(got) != len(after) {
+		t.Fatalf("%d pages on the free list, was %d", len(got), len(after))
+	}
+
+	db.Close()
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if n := db.Stats().Keys; n != 1500 {
+		t.Fatalf("%d keys after reopening, want 1500", n)
+	}
+	mustGet(t, db, "key000001", strings.Repeat("v", 200))
+	if r := db.HealthCheck(); !r.OK() {
+		t.Fatalf("health check:\n%s", r)
+	}
+}
+
+func TestLoadSorted(t *testing.T) {
+	pairs := []KVPair{}
+	for i := 0; i < 2000; i++ {
+		pairs = append(pairs, KVPair{Key: []byte(fmt.Sprintf("key%06d", i)), Val: []byte(strconv.Itoa(i))})
+	}
+	db := openTestDB(t, nil)
+
+	for _, fill := range []float64{0, 0.4, 1.1} {
+		if err := db.LoadSorted(pairs, fill); err == nil {
+			t.Errorf("LoadSorted with a fill factor of %v", fill)
+		}
+	}
+	unsorted := []KVPair{pairs[1], pairs[0]}
+	if err := db.LoadSorted(unsorted, 1); err == nil {
+		t.Error("LoadSorted of unsorted keys")
+	}
+
+	if err := db.LoadSorted(pairs, 0.7); err != nil {
+		t.Fatal(err)
+	}
+	if n := db.Stats().Keys; n != 2000 {
+		t.Fatalf("%d keys after the load, want 2000", n)
+	}
+	mustGet(t, db, "key001234", "1234")
+	if err := db.LoadSorted(pairs, 1); err == nil {
+		t.Fatal("LoadSorted into a DB with keys")
+	}
+
+	// a DB emptied by Clear or by deletes takes a load again
+	if err := db.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.LoadSorted(pairs[:1000], 1); err != nil {
+		t.Fatalf("LoadSorted after Clear: %v", err)
+	}
+	mustGet(t, db, "key000999", "999")
+	for _, p := range pairs[:1000] {
+		mustDel(t, db, string(p.Key))
+	}
+	if err := db.LoadSorted(pairs[1000:], 1); err != nil {
+		t.Fatalf("LoadSorted after deleting every key: %v", err)
+	}
+	mustMiss(t, db, "key000999")
+	mustGet(t, db, "key001999", "1999")
+	if n := db.Stats().Keys; n != 1000 {
+		t.Fatalf("%d keys, want 1000", n)
+	}
+}
+
+func testPairs(n int, val string) []KVPair {
+	pairs := make([]KVPair, n)
+	for i := range pairs {
+		pairs[i] = KVPair{[]byte(fmt.Sprintf("key%06d", i)), []byte(val)}
+	}
+	return pairs
+}
+
+func TestSwapRoot(t *testing.T) {
+	db := openTestDB(t, nil)
+	if err := db.LoadSorted(testPairs(2000, strings.Repeat("a", 100)), 1); err != nil {
+		t.Fatal(err)
+	}
+	oldRoot := db.tree.Root
+
+	root, err := db.BuildTree(testPairs(1000, "b"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// not visible until swapped in, not even after a reopen
+	mustGet(t, db, "key000999", strings.Repeat("a", 100))
+	db.Close()
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, db, "key001999", strings.Repeat("a", 100))
+
+	if err := db.SwapRoot(root); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, db, "key000999", "b")
+	mustMiss(t, db, "key001000")
+	if err := db.tree.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the old tree is on the free list now
+	err = db.SwapRoot(oldRoot)
+	if err == nil || !strings.Contains(err.Error(), "free list") {
+		t.Fatalf("SwapRoot to a freed tree: %v", err)
+	}
+	if _, err := db.BuildTree(nil, 1); err == nil {
+		t.Error("BuildTree of no pairs")
+	}
+}
+
+func TestSwapRootRejectsSharedPages(t *testing.T) {
+	db := openTestDB(t, nil)
+	if err := db.LoadSorted(testPairs(2000, strings.Repeat("a", 100)), 1); err != nil {
+		t.Fatal(err)
+	}
+	if h := db.Stats().Height; h < 2 {
+		t.Fatalf("height %d, want an internal root", h)
+	}
+
+	// the first kid holds the sentinel, so it is a valid tree by itself
+	sub := db.tree.Get(db.tree.Root).GetPtr(0)
+	err := db.SwapRoot(sub)
+	if err == nil || !strings.Contains(err.Error(), "current tree") {
+		t.Fatalf("SwapRoot to a subtree of the current tree: %v", err)
+	}
+	mustGet(t, db, "key001999", strings.Repeat("a", 100))
+	if err := db.tree.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDropTree(t *testing.T) {
+	db := openTestDB(t, nil)
+	if err := db.LoadSorted(testPairs(2000, strings.Repeat("a", 100)), 1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2000; i += 2 {
+		mustDel(t, db, fmt.Sprintf("key%06d", i)) // free pages for the build to reuse
+	}
+	free, used := len(freeSet(db)), db.page.flushed
+
+	// a build that fails keeps nothing
+	failMasterWrites(t, syscall.EIO)
+	if _, err := db.BuildTree(testPairs(1000, "b"), 1); err == nil {
+		t.Fatal("BuildTree with a failing master page write")
+	}
+	if n := len(freeSet(db)); n != free || db.page.flushed != used {
+		t.Fatalf("failed build: %d free pages of %d, was %d of %d", n, db.page.flushed, free, used)
+	}
+
+	root, err := db.BuildTree(testPairs(1000, "b"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(db.PageLeakReport()) == 0 {
+		t.Fatal("the built tree is reachable")
+	}
+	if err := db.DropTree(root); err != nil {
+		t.Fatal(err)
+	}
+	// every page the build took, from the free list or the end of the file, is free again
+	if n := len(freeSet(db)); n != free+int(db.page.flushed-used) {
+		t.Fatalf("%d free pages after the drop, want %d + %d appended", n, free, db.page.flushed-used)
+	}
+	if leaked := db.PageLeakReport(); len(leaked) != 0 {
+		t.Fatalf("leaked pages %v", leaked)
+	}
+	mustGet(t, db, "key000001", strings.Repeat("a", 100))
+
+	for _, bad := range []uint64{root, db.tree.Root} {
+		if err := db.DropTree(bad); err == nil {
+			t.Errorf("dropped the tree at %d twice or the current one", bad)
+		}
+	}
+	mustGet(t, db, "key000001", strings.Repeat("a", 100))
+}
+
+func TestApplyDiff(t *testing.T) {
+	for _, tombstones := range []bool{false, true} {
+		t.Run(fmt.Sprint("tombstones=", tombstones), func(t *testing.T) {
+			init := func(db *KV) { db.Tombstones = tombstones }
+			diffed, oneByOne := openTestDB(t, init), openTestDB(t, init)
+			r := rand.New(rand.NewSource(1))
+			for round := 0; round < 50; round++ {
+				// random keys, each either upserted or deleted, in order
+				var upserts []KVPair
+				var deletes [][]byte
+				for _, i := range r.Perm(1000)[:1+r.Intn(200)] {
+					key := []byte(fmt.Sprintf("key%06d", i))
+					if r.Intn(3) == 0 {
+						deletes = append(deletes, key)
+					} else {
+						upserts = append(upserts, KVPair{key, []byte(fmt.Sprint(round))})
+					}
+				}
+				sort.Slice(upserts, func(i, j int) bool { return bytes.Compare(upserts[i].Key, upserts[j].Key) < 0 })
+				sort.Slice(deletes, func(i, j int) bool { return bytes.Compare(deletes[i], deletes[j]) < 0 })
+
+				if err := diffed.ApplyDiff(upserts, deletes); err != nil {
+					t.Fatal(err)
+				}
+				for _, p := range upserts {
+					mustSet(t, oneByOne, string(p.Key), string(p.Val))
+				}
+				for _, key := range deletes {
+					if _, err := oneByOne.Del(key); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				if eq, err := TreesEqual(diffed, oneByOne); err != nil || !eq {
+					t.Fatalf("round %d: the diff and the single ops give different data: %v", round, err)
+				}
+				if err := diffed.Validate(); err != nil {
+					t.Fatalf("round %d: %v", round, err)
+				}
+			}
+			// the same tombstones, but the single deletes took more updates, so their seqs differ
+			if a, b := deletesSince(diffed, 0), deletesSince(oneByOne, 0); tombstones && !sameKeys(a, b) {
+				t.Fatalf("the diff left %d tombstones, the single deletes %d", len(a), len(b))
+			}
+		})
+	}
+}
+
+func sameKeys(a, b map[string]uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key := range a {
+		if _, ok := b[key]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func TestApplyDiffBadInput(t *testing.T) {
+	db := openTestDB(t, nil)
+	mustSet(t, db, "a", "1")
+	kv := func(key string) KVPair { return KVPair{[]byte(key), []byte("v")} }
+	for _, c := range []struct {
+		name    string
+		upserts []KVPair
+		deletes [][]byte
+	}{
+		{"unsorted upserts", []KVPair{kv("c"), kv("b")}, nil},
+		{"duplicate upserts", []KVPair{kv("b"), kv("b")}, nil},
+		{"unsorted deletes", nil, [][]byte{[]byte("c"), []byte("b")}},
+		{"upserted and deleted", []KVPair{kv("a"), kv("b")}, [][]byte{[]byte("b")}},
+		{"empty key", []KVPair{kv("")}, nil},
+	} {
+		if err := db.ApplyDiff(c.upserts, c.deletes); err == nil {
+			t.Errorf("%s: applied", c.name)
+		}
+	}
+	// nothing of the rejected diffs landed
+	mustGet(t, db, "a", "1")
+	mustMiss(t, db, "b")
+
+	failMasterWrites(t, syscall.EIO)
+	if err := db.ApplyDiff([]KVPair{kv("b")}, [][]byte{[]byte("a")}); err == nil {
+		t.Fatal("ApplyDiff with a failing commit succeeded")
+	}
+	mustGet(t, db, "a", "1")
+	mustMiss(t, db, "b")
+}
+
+func TestCompactRange(t *testing.T) {
+	db := openTestDB(t, nil)
+	if err := db.LoadSorted(testPairs(5000, "value"), 0.5); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1000; i < 3000; i += 2 {
+		mustDel(t, db, fmt.Sprintf("key%06d", i))
+	}
+	before := db.tree.Stats()
+	if err := db.CompactRange([]byte("key001000"), []byte("key003000")); err != nil {
+		t.Fatal(err)
+	}
+	if after := db.tree.Stats(); after.Leaves >= before.Leaves || after.Keys != before.Keys {
+		t.Fatalf("leaves %d -> %d, keys %d -> %d", before.Leaves, after.Leaves, before.Keys, after.Keys)
+	}
+	mustGet(t, db, "key000999", "value")
+	mustMiss(t, db, "key001000")
+	mustGet(t, db, "key001001", "value")
+	mustGet(t, db, "key004999", "value")
+
+	if err := db.CompactRange([]byte("b"), []byte("a")); err == nil {
+		t.Fatal("start after end accepted")
+	}
+}
+
+func TestDeletePrefix(t *testing.T) {
+	for _, tombstones := range []bool{false, true} {
+		t.Run(fmt.Sprint("tombstones=", tombstones), func(t *testing.T) {
+			db := openTestDB(t, func(db *KV) { db.Tombstones = tombstones })
+			for i := 0; i < 300; i++ {
+				for _, p := range []string{"user:", "users", "usr:", "user:1:"} {
+					mustSet(t, db, fmt.Sprintf("%s%04d", p, i), "v")
+				}
+			}
+
+			// "user:" covers "user:1:" too, but not "users" or "usr:"
+			n, err := db.DeletePrefix([]byte("user:"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 600 {
+				t.Fatalf("DeletePrefix deleted %d keys, want 600", n)
+			}
+			count := func(prefix string) int {
+				c := 0
+				db.ScanPrefix([]byte(prefix), func(k, v []byte) bool { c++; return true })
+				return c
+			}
+			if c := count("user:"); c != 0 {
+				t.Errorf("%d keys left under user:", c)
+			}
+			if c := count("users"); c != 300 {
+				t.Errorf("%d keys under users, want 300", c)
+			}
+			if c := count("usr:"); c != 300 {
+				t.Errorf("%d keys under usr:, want 300", c)
+			}
+			mustGet(t, db, "users0000", "v")
+			mustGet(t, db, "usr:0299", "v")
+			if err := db.tree.Validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			if n, err := db.DeletePrefix([]byte("nothing")); err != nil || n != 0 {
+				t.Fatalf("DeletePrefix of an absent prefix = %d %v", n, err)
+			}
+			if n, err := db.DeletePrefix(nil); err != nil || n != 600 {
+				t.Fatalf("DeletePrefix of the empty prefix = %d %v, want 600", n, err)
+			}
+			if c := count(""); c != 0 {
+				t.Errorf("%d keys left after deleting everything", c)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package kvstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"kurocifer/LeichtKV/btree"
+	"time"
+)
+
+var ErrNoValueFlags = errors.New("value flags are not enabled for this DB")
+var ErrNoTimestamps = errors.New("timestamps are not enabled for this DB")
+var ErrKeyTooLarge = fmt.Errorf("key is larger than %d bytes", btree.BTREE_MAX_KEY_SIZE)
+var ErrValueTooLarge = errors.New("value is too large")
+
+// keys are stored inline and must fit in a page next to the largest value, see btree.BTREE_INLINE_BUDGET
+func checkKey(key []byte) error {
+	if len(key) == 0 {
+		return errors.New("empty key")
+	}
+	if len(key) > btree.BTREE_MAX_KEY_SIZE {
+		return ErrKeyTooLarge
+	}
+	return nil
+}
+
+// metadata stored in front of a value, depending on the file features
+// | tag (FEATURE_TOMBSTONES) | flags (FEATURE_VALUE_FLAGS) | created | modified (FEATURE_TIMESTAMPS) | expires (FEATURE_EXPIRY) | value |
+// |           1B             |             1B              |   8B    |              8B               |           8B             |  ...  |
+type valMeta struct {
+	flags    byte
+	created  int64 // unix nanoseconds
+	modified int64
+	expires  int64 // unix nanoseconds, 0 for never
+}
+
+// the value as stored in the tree, with the VALUE_LIVE tag and the metadata the file has features for
+func (db *KV) encodeVal(val []byte, meta valMeta) ([]byte, error) {
+	if db.features&FEATURE_VALUE_FLAGS == 0 && meta.flags != 0 {
+		return nil, ErrNoValueFlags
+	}
+	// checked before anything is encoded, the length fields of a kv are only 16 bits
+	if len(val)+db.valOverhead() > btree.BTREE_MAX_VALUE_SIZE {
+		return nil, fmt.Errorf("%w: %d bytes, at most %d", ErrValueTooLarge, len(val), btree.BTREE_MAX_VALUE_SIZE-db.valOverhead())
+	}
+	if db.features&(FEATURE_TOMBSTONES|FEATURE_VALUE_FLAGS|FEATURE_TIMESTAMPS|FEATURE_EXPIRY) == 0 {
+		return val, nil
+	}
+
+	stored := make([]byte, 0, db.valOverhead()+len(val))
+	if db.features&FEATURE_TOMBSTONES != 0 {
+		stored = append(stored, VALUE_LIVE)
+	}
+	if db.features&FEATURE_VALUE_FLAGS != 0 {
+		stored = append(stored, meta.flags)
+	}
+	if db.features&FEATURE_TIMESTAMPS != 0 {
+		stored = binary.LittleEndian.AppendUint64(stored, uint64(meta.created))
+		stored = binary.LittleEndian.AppendUint64(stored, uint64(meta.modified))
+	}
+	if db.features&FEATURE_EXPIRY != 0 {
+		stored = binary.LittleEndian.AppendUint64(stored, uint64(meta.expires))
+	}
+	return append(stored, val...), nil
+}
+
+// the bytes the value envelope adds in front of every value
+func (db *KV) valOverhead() int {
+	n := 0
+	if db.features&FEATURE_TOMBSTONES != 0 {
+		n += 1
+	}
+	if db.features&FEATURE_VALUE_FLAGS != 0 {
+		n += 1
+	}
+	if db.features&FEATURE_TIMESTAMPS != 0 {
+		n += 16
+	}
+	if db.features&FEATURE_EXPIRY != 0 {
+		n += 8
+	}
+	return n
+}
+
+// MaxValueSize is the longest value Set accepts next to a key of keyLen bytes in this DB,
+// i.e. btree.MaxValueSize less the per-value metadata of the file. -1 if the key is not storable.
+func (db *KV) MaxValueSize(keyLen int) int {
+	max := btree.MaxValueSize(keyLen)
+	if max < 0 {
+		return -1
+	}
+	return max - db.valOverhead()
+}
+
+// the reverse of encodeVal, for a value that isn't a tombstone
+func (db *KV) decodeVal(stored []byte) ([]byte, valMeta) {
+	meta := valMeta{}
+	if db.features&FEATURE_TOMBSTONES != 0 && len(stored) >= 1 {
+		stored = stored[1:]
+	}
+	if db.features&FEATURE_VALUE_FLAGS != 0 && len(stored) >= 1 {
+		meta.flags, stored = stored[0], stored[1:]
+	}
+	if db.features&FEATURE_TIMESTAMPS != 0 && len(stored) >= 16 {
+		meta.created = int64(binary.LittleEndian.Uint64(stored[0:]))
+		meta.modified = int64(binary.LittleEndian.Uint64(stored[8:]))
+		stored = stored[16:]
+	}
+	if db.features&FEATURE_EXPIRY != 0 && len(stored) >= 8 {
+		meta.expires = int64(binary.LittleEndian.Uint64(stored))
+		stored = stored[8:]
+	}
+	return stored, meta
+}
+
+// the metadata for a new value of key. an update keeps the creation time of the value it replaces,
+// a key set again after a tombstone delete starts over. the expiry is DefaultTTL from now
+func (db *KV) metaFor(key []byte, flags byte) valMeta {
+	meta := valMeta{flags: flags}
+	if db.features&FEATURE_EXPIRY != 0 && db.DefaultTTL > 0 {
+		meta.expires = db.now().Add(db.DefaultTTL).UnixNano()
+	}
+	if db.features&FEATURE_TIMESTAMPS != 0 {
+		now := db.now().UnixNano()
+		meta.created, meta.modified = now, now
+		if _, prev, ok := db.lookupLive(key); ok {
+			meta.created = prev.created
+		}
+	}
+	return meta
+}
+
+func (db *KV) now() time.Time {
+	if db.Clock != nil {
+		return db.Clock()
+	}
+	return time.Now()
+}
+
+// the stored value of key. a tombstone is absent
+func (db *KV) lookup(key []byte) ([]byte, bool) {
+	stored, ok := db.tree.Lookup(key)
+	if !ok || db.isTombstone(stored) {
+		return nil, false
+	}
+	return stored, true
+}
+
+// scan in key order, with the values decoded. tombstones are skipped
+func (db *KV) scan(start []byte, fn func(k, v []byte) bool) {
+	decoded := func(k, v []byte) bool {
+		if db.isTombstone(v) {
+			return true
+		}
+		val, meta := db.decodeVal(v)
+		if db.expired(meta) {
+			return true
+		}
+		return fn(k, val)
+	}
+	if db.BestEffort {
+		db.tree.ScanBestEffort(start, decoded, func(ptr uint64, err error) {
+			db.readError(err)
+		})
+		return
+	}
+	db.tree.Scan(start, decoded)
+}
+
+// GetWithFlags returns the value of key along with the flags it was stored with.
+// val points into the mapping without copying, it survives the mapping growing (see KV.mmap).
+// The value of a pinned key is a copy instead.
+func (db *KV) GetWithFlags(key []byte) (val []byte, flags byte, ok bool, err error) {
+	db.counters.gets.Add(1)
+	if p, hit := db.pinGet(key); hit {
+		db.counters.cacheHits.Add(1)
+		if !p.ok {
+			return nil, 0, false, nil
+		}
+		val, meta := db.decodeVal(p.stored)
+		if db.expired(meta) {
+			return nil, 0, false, nil
+		}
+		// a copy, the pinned value is shared by every reader
+		return append([]byte(nil), val...), meta.flags, true, nil
+	}
+
+	stored, ok, err := db.readLookup(key)
+	if err != nil || !ok {
+		return nil, 0, false, err
+	}
+	val, meta := db.decodeVal(stored)
+	if db.expired(meta) {
+		return nil, 0, false, nil
+	}
+	return val, meta.flags, true, nil
+}
+
+// GetTimes returns when key was first inserted and last written.
+// Needs a file created with Timestamps.
+func (db *KV) GetTimes(key []byte) (created, modified time.Time, ok bool, err error) {
+	if db.features&FEATURE_TIMESTAMPS == 0 {
+		return created, modified, false, ErrNoTimestamps
+	}
+	stored, ok := db.lookup(key)
+	if !ok {
+		return created, modified, false, nil
+	}
+	_, meta := db.decodeVal(stored)
+	if db.expired(meta) {
+		return created, modified, false, nil
+	}
+	return time.Unix(0, meta.created), time.Unix(0, meta.modified), true, nil
+}
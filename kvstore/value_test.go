@@ -0,0 +1,200 @@
+package kvstore
+
+import (
+	"bytes"
+	"errors"
+	"kurocifer/LeichtKV/btree"
+	"testing"
+	"time"
+)
+
+func TestValueFlags(t *testing.T) {
+	db := openTestDB(t, func(db *KV) { db.ValueFlags = true })
+	if err := db.SetWithFlags([]byte("a"), []byte("1"), 0x5a); err != nil {
+		t.Fatal(err)
+	}
+	mustSet(t, db, "b", "2")
+
+	// the flags survive a reopen, which keeps the feature even if not asked for
+	db.Close()
+	db.ValueFlags = false
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		key, val string
+		flags    byte
+	}{{"a", "1", 0x5a}, {"b", "2", 0}} {
+		val, flags, ok, err := db.GetWithFlags([]byte(c.key))
+		if err != nil || !ok || string(val) != c.val || flags != c.flags {
+			t.Errorf("GetWithFlags(%q) = %q %#x %v %v, want %q %#x", c.key, val, flags, ok, err, c.val, c.flags)
+		}
+	}
+
+	// plain reads don't see the flags byte
+	mustGet(t, db, "a", "1")
+	vals, _, _ := db.SnapshotGetMany([][]byte{[]byte("a")})
+	if string(vals[0]) != "1" {
+		t.Errorf("SnapshotGetMany = %q", vals[0])
+	}
+}
+
+func TestValueFlagsNotEnabled(t *testing.T) {
+	db := openTestDB(t, nil)
+	if err := db.SetWithFlags([]byte("a"), []byte("1"), 1); !errors.Is(err, ErrNoValueFlags) {
+		t.Fatalf("SetWithFlags = %v, want ErrNoValueFlags", err)
+	}
+	mustMiss(t, db, "a")
+
+	// flags 0 is a plain Set
+	if err := db.SetWithFlags([]byte("a"), []byte("1"), 0); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, db, "a", "1")
+}
+
+// a clock that only moves when told to
+type testClock struct{ now time.Time }
+
+func (c *testClock) Now() time.Time { return c.now }
+
+func mustTimes(t *testing.T, db *KV, key string, created, modified time.Time) {
+	t.Helper()
+	c, m, ok, err := db.GetTimes([]byte(key))
+	if err != nil || !ok || !c.Equal(created) || !m.Equal(modified) {
+		t.Fatalf("GetTimes(%q) = %v %v %v %v, want %v %v", key, c, m, ok, err, created, modified)
+	}
+}
+
+func TestTimestamps(t *testing.T) {
+	clock := &testClock{now: time.Unix(1000, 0)}
+	db := openTestDB(t, func(db *KV) {
+		db.Timestamps, db.ValueFlags, db.Tombstones = true, true, true
+		db.Clock = clock.Now
+	})
+	t0 := clock.now
+	if err := db.SetWithFlags([]byte("a"), []byte("1"), 7); err != nil {
+		t.Fatal(err)
+	}
+	mustTimes(t, db, "a", t0, t0)
+
+	// an update keeps the created time
+	clock.now = t0.Add(time.Second)
+	mustSet(t, db, "a", "2")
+	mustTimes(t, db, "a", t0, clock.now)
+	mustGet(t, db, "a", "2")
+	if _, _, ok, _ := db.GetTimes([]byte("b")); ok {
+		t.Error("GetTimes found a missing key")
+	}
+
+	// a key set again after a delete is new
+	mustDel(t, db, "a")
+	if _, _, ok, _ := db.GetTimes([]byte("a")); ok {
+		t.Error("GetTimes found a tombstone")
+	}
+	clock.now = t0.Add(2 * time.Second)
+	mustSet(t, db, "a", "3")
+	mustTimes(t, db, "a", clock.now, clock.now)
+
+	// and the times survive a reopen
+	t2 := clock.now
+	db.Close()
+	db.Timestamps = false
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	mustTimes(t, db, "a", t2, t2)
+	mustGet(t, db, "a", "3")
+}
+
+func TestTimestampsNotEnabled(t *testing.T) {
+	db := openTestDB(t, nil)
+	mustSet(t, db, "a", "1")
+	if _, _, _, err := db.GetTimes([]byte("a")); !errors.Is(err, ErrNoTimestamps) {
+		t.Fatalf("GetTimes = %v, want ErrNoTimestamps", err)
+	}
+}
+
+func TestKeyTooLarge(t *testing.T) {
+	db := openTestDB(t, nil)
+	max := bytes.Repeat([]byte{'k'}, btree.BTREE_MAX_KEY_SIZE)
+	big := append([]byte{'k'}, max...)
+	// the largest key fits next to the largest value
+	if err := db.Set(max, make([]byte, btree.BTREE_MAX_VALUE_SIZE)); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, err := range map[string]error{
+		"Set":              db.Set(big, []byte("v")),
+		"Del":              func() error { _, err := db.Del(big); return err }(),
+		"Rename":           func() error { _, err := db.Rename(max, big); return err }(),
+		"IncrBounded":      func() error { _, _, err := db.IncrBounded(big, 1, 10); return err }(),
+		"LoadSorted":       openTestDB(t, nil).LoadSorted([]KVPair{{big, []byte("v")}}, 1),
+		"BuildTree":        func() error { _, err := db.BuildTree([]KVPair{{big, []byte("v")}}, 1); return err }(),
+		"ApplyDiff upsert": db.ApplyDiff([]KVPair{{big, []byte("v")}}, nil),
+		"ApplyDiff delete": db.ApplyDiff(nil, [][]byte{big}),
+	} {
+		if !errors.Is(err, ErrKeyTooLarge) {
+			t.Errorf("%s of an oversized key: %v", name, err)
+		}
+	}
+	if err := db.Set(nil, []byte("v")); err == nil || errors.Is(err, ErrKeyTooLarge) {
+		t.Errorf("Set of an empty key: %v", err)
+	}
+	if n := db.Stats().Keys; n != 1 {
+		t.Fatalf("%d keys, want 1", n)
+	}
+}
+
+func TestMaxValueSize(t *testing.T) {
+	key := bytes.Repeat([]byte{'k'}, btree.BTREE_MAX_KEY_SIZE)
+	for _, features := range []func(db *KV){
+		nil,
+		func(db *KV) { db.ValueFlags = true },
+		func(db *KV) { db.Tombstones, db.Timestamps = true, true },
+		func(db *KV) { db.ValueFlags, db.Tombstones, db.Timestamps = true, true, true },
+	} {
+		db := openTestDB(t, features)
+		max := db.MaxValueSize(len(key))
+		if err := db.Set(key, make([]byte, max)); err != nil {
+			t.Fatalf("features %x: value of MaxValueSize %d: %v", db.features, max, err)
+		}
+		if err := db.Set(key, make([]byte, max+1)); err == nil {
+			t.Fatalf("features %x: value of %d bytes accepted, MaxValueSize is %d", db.features, max+1, max)
+		}
+	}
+
+	db := openTestDB(t, nil)
+	if max := db.MaxValueSize(btree.BTREE_MAX_KEY_SIZE + 1); max != -1 {
+		t.Fatalf("MaxValueSize of an oversized key = %d, want -1", max)
+	}
+}
+
+func TestValueTooLarge(t *testing.T) {
+	for _, features := range []func(db *KV){nil, func(db *KV) { db.Tombstones, db.Timestamps = true, true }} {
+		db := openTestDB(t, features)
+		big := make([]byte, db.MaxValueSize(1)+1)
+		for name, err := range map[string]error{
+			"Set":        db.Set([]byte("k"), big),
+			"LoadSorted": openTestDB(t, features).LoadSorted([]KVPair{{[]byte("k"), big}}, 1),
+			"BuildTree":  func() error { _, err := db.BuildTree([]KVPair{{[]byte("k"), big}}, 1); return err }(),
+			"ApplyDiff":  db.ApplyDiff([]KVPair{{[]byte("k"), big}}, nil),
+		} {
+			if !errors.Is(err, ErrValueTooLarge) {
+				t.Errorf("features %x: %s of an oversized value: %v", db.features, name, err)
+			}
+		}
+		mustMiss(t, db, "k")
+
+		// the largest length a uint16 holds, and the first one it would truncate to 0
+		for _, n := range []int{0xffff, 0x10000} {
+			if err := db.Set([]byte("k"), make([]byte, n)); !errors.Is(err, ErrValueTooLarge) {
+				t.Errorf("features %x: Set of a %d byte value: %v", db.features, n, err)
+			}
+			if err := db.Set(make([]byte, n), []byte("v")); err == nil {
+				t.Errorf("features %x: Set of a %d byte key succeeded", db.features, n)
+			}
+			mustMiss(t, db, "k")
+		}
+	}
+}